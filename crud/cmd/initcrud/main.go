@@ -3,7 +3,9 @@ package main
 import (
 	"ChatService/crud/internal/app"
 	client "ChatService/crud/internal/clients"
+	ssoClient "ChatService/crud/internal/clients/sso"
 	"ChatService/crud/internal/config"
+	jwtVal "ChatService/crud/internal/lib/jwt"
 
 	Logger "ChatService/crud/internal/lib/logger"
 	"context"
@@ -23,32 +25,69 @@ func main() {
 	logger := Logger.SetupLogger(cnf.Env)
 	logger.Info("Starting logger")
 
-	clientFabric := client.ClientMustLoad(cnf, logger)
+	sso, err := ssoClient.New(
+		context.Background(),
+		logger,
+		cnf.Clients.SSO.Addr,
+		cnf.Clients.SSO.Timeout,
+		cnf.Clients.SSO.RetriesCount,
+		cnf.Clients.SSO.ServiceToken,
+	)
+	if err != nil {
+		logger.Error("failed to initialize SSO client", "error", err.Error())
+		os.Exit(1)
+	}
+	logger.Info("ClientSSO initialized")
+
+	// Tokens signed by SSO are verified with its public keys, app secrets only cover legacy HS256 tokens
+	keys := jwtVal.KeySet{ssoClient.NewJWKSCache(sso, logger, cnf.Clients.SSO.JWKSCacheTTL)}
+	if cnf.LegacyHS256 {
+		logger.Warn("legacy HS256 tokens are accepted, turn legacy_hs256 off once they have expired",
+			"apps", len(cnf.AppSecrets))
+		keys = append(keys, jwtVal.NewKeys(cnf.AppSecrets))
+	}
+
+	clientFabric := client.ClientMustLoad(cnf, logger, keys)
 
 	go func() {
 		logger.Info("Starting HTTP server on :8080")
 		if err := clientFabric.HttpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("HTTP server error", err)
+			logger.Error("HTTP server error", "error", err.Error())
 		}
 	}()
 
-	application := app.New(logger, cnf.Storage.Path, cnf.AppSecret, cnf.GRPC.Server.Port, clientFabric.CRUD)
+	application := app.New(logger, cnf.Storage, cnf.Purge, cnf.Attachments, keys, cnf.GRPC.Server.Port, clientFabric.CRUD,
+		sso, ssoClient.NewRevocationCache(sso, cnf.Clients.SSO.RevocationCacheTTL),
+		ssoClient.NewRestrictionCache(sso, cnf.Clients.SSO.RestrictionCacheTTL))
 	logger.Info("Starting application")
 
 	go func() {
 		application.GRPCServer.MustRun()
 	}()
 
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	go application.RunPurge(workersCtx)
+	go application.RunThumbnails(workersCtx)
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
 	<-stop
 
+	stopWorkers()
+	// Close live subscriptions first, otherwise graceful stop waits for them forever
+	application.Events.Close()
 	application.GRPCServer.Stop()
+	if err := application.Storage.Close(); err != nil {
+		logger.Error("Storage close error", "error", err.Error())
+	}
+	if err := sso.Close(); err != nil {
+		logger.Error("SSO client close error", "error", err.Error())
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := clientFabric.HttpServer.Shutdown(ctx); err != nil {
-		logger.Error("HTTP shutdown error", err)
+		logger.Error("HTTP shutdown error", "error", err.Error())
 	}
 
 	logger.Info("Gracefully stopped")
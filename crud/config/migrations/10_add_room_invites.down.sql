@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS room_invites;
+ALTER TABLE rooms DROP COLUMN public;
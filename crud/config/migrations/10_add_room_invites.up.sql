@@ -0,0 +1,13 @@
+-- Rooms are invite-only unless created as public, general stays open to everyone
+ALTER TABLE rooms ADD COLUMN public INTEGER NOT NULL DEFAULT 0;
+UPDATE rooms SET public = 1 WHERE id = 1;
+
+-- An invite lets uid join a private room once, it is used up by the join
+CREATE TABLE IF NOT EXISTS room_invites
+(
+    room_id    INTEGER NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+    uid        INTEGER NOT NULL,
+    invited_by INTEGER NOT NULL,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (room_id, uid)
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_messages_room;
+ALTER TABLE messages DROP COLUMN room_id;
+DROP TABLE IF EXISTS room_members;
+DROP TABLE IF EXISTS rooms;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS rooms
+(
+    id         INTEGER PRIMARY KEY,
+    name       TEXT NOT NULL UNIQUE,
+    owner_uid  INTEGER NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS room_members
+(
+    room_id   INTEGER NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+    uid       INTEGER NOT NULL,
+    joined_at TEXT NOT NULL,
+    PRIMARY KEY (room_id, uid)
+);
+
+-- Existing messages are moved to the default room
+INSERT INTO rooms (id, name, owner_uid, created_at)
+VALUES (1, 'general', 0, datetime('now'));
+
+ALTER TABLE messages ADD COLUMN room_id INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS idx_messages_room ON messages (room_id, id);
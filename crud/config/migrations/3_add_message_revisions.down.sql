@@ -0,0 +1,4 @@
+ALTER TABLE messages DROP COLUMN revision_count;
+ALTER TABLE messages DROP COLUMN edited_at;
+DROP INDEX IF EXISTS idx_message_revisions_message;
+DROP TABLE IF EXISTS message_revisions;
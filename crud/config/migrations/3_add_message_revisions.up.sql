@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS message_revisions
+(
+    id         INTEGER PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    content    TEXT NOT NULL,
+    editor_uid INTEGER NOT NULL,
+    edited_at  TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message ON message_revisions (message_id, id);
+
+ALTER TABLE messages ADD COLUMN edited_at TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN revision_count INTEGER NOT NULL DEFAULT 0;
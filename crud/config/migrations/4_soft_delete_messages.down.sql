@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_messages_deleted;
+DELETE FROM message_revisions WHERE message_id IN (SELECT id FROM messages WHERE deleted_at <> '');
+DELETE FROM messages WHERE deleted_at <> '';
+ALTER TABLE messages DROP COLUMN deleted_by;
+ALTER TABLE messages DROP COLUMN deleted_at;
@@ -0,0 +1,5 @@
+ALTER TABLE messages ADD COLUMN deleted_at TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN deleted_by INTEGER NOT NULL DEFAULT 0;
+
+-- Lets the purge job find old tombstones without a full scan
+CREATE INDEX IF NOT EXISTS idx_messages_deleted ON messages (deleted_at) WHERE deleted_at <> '';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_messages_thread;
+ALTER TABLE messages DROP COLUMN thread_root_id;
+ALTER TABLE messages DROP COLUMN parent_id;
@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN parent_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN thread_root_id INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages (thread_root_id, id);
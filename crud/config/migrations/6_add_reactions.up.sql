@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS reactions
+(
+    id         INTEGER PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id    INTEGER NOT NULL,
+    emoji      TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    UNIQUE (message_id, user_id, emoji)
+);
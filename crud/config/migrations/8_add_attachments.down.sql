@@ -0,0 +1,2 @@
+ALTER TABLE messages DROP COLUMN attachment_id;
+DROP TABLE IF EXISTS attachments;
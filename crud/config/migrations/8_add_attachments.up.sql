@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS attachments
+(
+    id         INTEGER PRIMARY KEY,
+    uid        INTEGER NOT NULL,
+    room_id    INTEGER NOT NULL,
+    file_name  TEXT NOT NULL,
+    mime_type  TEXT NOT NULL,
+    size       INTEGER NOT NULL,
+    sha256     TEXT NOT NULL,
+    blob_key   TEXT NOT NULL UNIQUE,
+    created_at TEXT NOT NULL
+);
+
+ALTER TABLE messages ADD COLUMN attachment_id INTEGER NOT NULL DEFAULT 0;
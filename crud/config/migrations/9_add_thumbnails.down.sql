@@ -0,0 +1,4 @@
+DELETE FROM attachments WHERE id IN (SELECT thumbnail_id FROM attachments WHERE thumbnail_id <> 0);
+ALTER TABLE attachments DROP COLUMN thumbnail_id;
+ALTER TABLE attachments DROP COLUMN height;
+ALTER TABLE attachments DROP COLUMN width;
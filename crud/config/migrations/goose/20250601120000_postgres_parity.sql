@@ -0,0 +1,61 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE SEQUENCE IF NOT EXISTS messages_id_seq OWNED BY messages.id;
+SELECT setval('messages_id_seq', COALESCE((SELECT MAX(id) FROM messages), 0) + 1, false);
+ALTER TABLE messages ALTER COLUMN id TYPE BIGINT;
+ALTER TABLE messages ALTER COLUMN id SET DEFAULT nextval('messages_id_seq');
+ALTER TABLE messages ALTER COLUMN uid TYPE BIGINT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS type INTEGER;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS datetime TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS types
+(
+    id   SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+INSERT INTO types (name)
+VALUES ('text'),
+       ('image'),
+       ('file')
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS rooms
+(
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT NOT NULL UNIQUE,
+    owner_uid  BIGINT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS room_members
+(
+    room_id   BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+    uid       BIGINT NOT NULL,
+    joined_at TEXT NOT NULL,
+    PRIMARY KEY (room_id, uid)
+);
+
+-- Existing messages are moved to the default room
+INSERT INTO rooms (id, name, owner_uid, created_at)
+VALUES (1, 'general', 0, to_char(now(), 'YYYY-MM-DD HH24:MI:SS'))
+ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('rooms', 'id'), (SELECT MAX(id) FROM rooms));
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS room_id BIGINT NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS idx_messages_room ON messages (room_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_messages_room;
+ALTER TABLE messages DROP COLUMN IF EXISTS room_id;
+DROP TABLE IF EXISTS room_members;
+DROP TABLE IF EXISTS rooms;
+DROP TABLE IF EXISTS types;
+ALTER TABLE messages DROP COLUMN IF EXISTS datetime;
+ALTER TABLE messages DROP COLUMN IF EXISTS type;
+ALTER TABLE messages ALTER COLUMN id DROP DEFAULT;
+DROP SEQUENCE IF EXISTS messages_id_seq;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS message_revisions
+(
+    id         BIGSERIAL PRIMARY KEY,
+    message_id BIGINT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    content    TEXT NOT NULL,
+    editor_uid BIGINT NOT NULL,
+    edited_at  TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message ON message_revisions (message_id, id);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS revision_count INTEGER NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE messages DROP COLUMN IF EXISTS revision_count;
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
+DROP TABLE IF EXISTS message_revisions;
+-- +goose StatementEnd
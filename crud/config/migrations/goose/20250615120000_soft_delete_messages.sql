@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by BIGINT NOT NULL DEFAULT 0;
+
+-- Lets the purge job find old tombstones without a full scan
+CREATE INDEX IF NOT EXISTS idx_messages_deleted ON messages (deleted_at) WHERE deleted_at <> '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_messages_deleted;
+DELETE FROM messages WHERE deleted_at <> '';
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE messages DROP COLUMN IF EXISTS deleted_at;
+-- +goose StatementEnd
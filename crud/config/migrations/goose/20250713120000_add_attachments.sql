@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS attachments
+(
+    id         BIGSERIAL PRIMARY KEY,
+    uid        BIGINT NOT NULL,
+    room_id    BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+    file_name  TEXT NOT NULL,
+    mime_type  TEXT NOT NULL,
+    size       BIGINT NOT NULL,
+    sha256     TEXT NOT NULL,
+    blob_key   TEXT NOT NULL UNIQUE,
+    created_at TEXT NOT NULL
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment_id BIGINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE messages DROP COLUMN IF EXISTS attachment_id;
+DROP TABLE IF EXISTS attachments;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE rooms SET public = TRUE WHERE id = 1;
+
+CREATE TABLE IF NOT EXISTS room_invites
+(
+    room_id    BIGINT NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+    uid        BIGINT NOT NULL,
+    invited_by BIGINT NOT NULL,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (room_id, uid)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS room_invites;
+ALTER TABLE rooms DROP COLUMN IF EXISTS public;
+-- +goose StatementEnd
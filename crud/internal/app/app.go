@@ -4,26 +4,98 @@ import (
 	crudApp "ChatService/crud/internal/app/crud"
 	grpcApp "ChatService/crud/internal/app/grpc"
 	"ChatService/crud/internal/clients/service"
+	"ChatService/crud/internal/config"
+	"ChatService/crud/internal/lib/auth"
+	jwtVal "ChatService/crud/internal/lib/jwt"
+	"ChatService/crud/internal/services/crud"
+	"ChatService/crud/internal/services/hub"
+	"ChatService/crud/internal/storage/blob"
 	"ChatService/crud/internal/storage/postgres"
+	"ChatService/crud/internal/storage/sqlite"
+	"context"
+	"fmt"
 	"log/slog"
+	"time"
 )
 
+// eventBuffer is how many events a subscriber may lag behind before it is dropped
+const eventBuffer = 64
+
+// connectTimeout bounds the initial connection to the postgres backend
+const connectTimeout = 10 * time.Second
+
+// Storage is implemented by every message storage backend.
+type Storage interface {
+	crud.MessageCRUDer
+	crud.RoomCRUDer
+	crud.ReactionCRUDer
+	crud.AttachmentCRUDer
+	Close() error
+}
+
 type App struct {
 	GRPCServer *grpcApp.App
 	SSOClient  *service.ClientCRUD
+	Events     *hub.Hub
+	Storage    Storage
+
+	crud  *crud.CRUD
+	purge config.Purge
 }
 
-func New(log *slog.Logger, storagePath string, secret string, port int, ssoClient *service.ClientCRUD) *App {
+func New(log *slog.Logger, storageCfg config.Storage, purge config.Purge, attachments config.Attachments, keys jwtVal.KeyResolver, port int,
+	ssoClient *service.ClientCRUD, permissions crud.PermissionChecker, revocations auth.RevocationChecker,
+	restrictions crud.RestrictionProvider) *App {
 
-	storagePostgres, err := postgres.New(storagePath)
+	storage, err := newStorage(storageCfg)
 	if err != nil {
 		panic(err)
 	}
-	log.Info("Starting storage")
-	crudService := crudApp.New(log, storagePostgres)
-	grpcSever := grpcApp.New(log, crudService, secret, port)
+	log.Info("Starting storage", slog.String("type", storageCfg.Type))
+	blobs, err := newBlobStore(attachments)
+	if err != nil {
+		panic(err)
+	}
+	events := hub.New(eventBuffer)
+	crudService := crudApp.New(log, storage, storage, storage, storage, blobs, attachments.MaxSize, events, permissions, restrictions)
+	authenticator := &auth.Authenticator{Keys: keys, Revocations: revocations}
+	grpcSever := grpcApp.New(log, crudService, authenticator, port)
 	return &App{
 		GRPCServer: grpcSever,
 		SSOClient:  ssoClient,
+		Events:     events,
+		Storage:    storage,
+		crud:       crudService,
+		purge:      purge,
+	}
+}
+
+// RunPurge removes expired tombstones in the background until ctx is cancelled.
+func (a *App) RunPurge(ctx context.Context) {
+	a.crud.RunPurge(ctx, a.purge.Retention, a.purge.Interval)
+}
+
+// RunThumbnails generates thumbnails for posted images until ctx is cancelled.
+func (a *App) RunThumbnails(ctx context.Context) {
+	a.crud.RunThumbnails(ctx)
+}
+
+func newStorage(cfg config.Storage) (Storage, error) {
+	switch cfg.Type {
+	case "sqlite":
+		return sqlite.New(cfg.Path)
+	case "postgres":
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
+		return postgres.New(ctx, cfg.DSN, cfg.MaxConns)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+}
+
+func newBlobStore(cfg config.Attachments) (crud.BlobStore, error) {
+	switch cfg.Store {
+	case "local":
+		return blob.NewLocal(cfg.Path)
 	}
+	return nil, fmt.Errorf("unknown attachment store %q", cfg.Store)
 }
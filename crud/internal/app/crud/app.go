@@ -5,9 +5,24 @@ import (
 	"log/slog"
 )
 
-func New(log *slog.Logger, cruder crud.MessageCRUDer) *crud.CRUD {
+// thumbnailQueue is how many image messages may wait for a thumbnail before new ones are skipped
+const thumbnailQueue = 128
+
+func New(log *slog.Logger, cruder crud.MessageCRUDer, roomCRUDer crud.RoomCRUDer, reactions crud.ReactionCRUDer,
+	attachments crud.AttachmentCRUDer, blobs crud.BlobStore, maxAttachmentSize int64, events crud.EventBus, permissions crud.PermissionChecker,
+	restrictions crud.RestrictionProvider) *crud.CRUD {
 	return &crud.CRUD{
 		Log:           log,
 		MessageCRUDer: cruder,
+		RoomCRUDer:    roomCRUDer,
+		Reactions:     reactions,
+		Attachments:   attachments,
+		Blobs:         blobs,
+		Events:        events,
+		Permissions:   permissions,
+		Restrictions:  restrictions,
+
+		MaxAttachmentSize: maxAttachmentSize,
+		Thumbnails:        make(chan crud.ThumbnailJob, thumbnailQueue),
 	}
 }
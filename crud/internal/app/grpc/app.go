@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"ChatService/crud/internal/grpc/crud"
+	"ChatService/crud/internal/lib/auth"
 	"fmt"
 	"google.golang.org/grpc"
 	"log/slog"
@@ -14,9 +15,12 @@ type App struct {
 	GrpcServer *grpc.Server
 }
 
-func New(log *slog.Logger, crudService crud.CRUD, secret string, port int) *App {
-	gRPCServer := grpc.NewServer()
-	crud.RegisterServer(gRPCServer, crudService, secret)
+func New(log *slog.Logger, crudService crud.CRUD, authenticator *auth.Authenticator, port int) *App {
+	gRPCServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(authUnaryInterceptor(authenticator)),
+		grpc.ChainStreamInterceptor(authStreamInterceptor(authenticator)),
+	)
+	crud.RegisterServer(gRPCServer, crudService, authenticator)
 	return &App{
 		logger:     log,
 		port:       port,
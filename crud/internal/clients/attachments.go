@@ -0,0 +1,159 @@
+package clients
+
+import (
+	client "ChatService/crud/internal/clients/service"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uploadMemory is how much of a multipart upload is kept in memory, the rest is spooled to disk
+const uploadMemory = 1 << 20
+
+// inlineTypes may be shown by the browser, anything else is always downloaded
+// so an uploaded HTML or SVG file can not run scripts on this origin
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// uploadHandler accepts a multipart form with room_id and file and answers with the attachment metadata.
+func uploadHandler(cli *client.ClientCRUD, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseMultipartForm(uploadMemory); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		defer func() {
+			_ = r.MultipartForm.RemoveAll()
+		}()
+
+		roomID, err := strconv.ParseInt(r.FormValue("room_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "File required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		attachment, err := cli.UploadAttachment(r.Context(), token, roomID, header.Filename, file)
+		if err != nil {
+			logger.Error("failed to upload attachment", "error", err.Error())
+			if status.Code(err) == codes.ResourceExhausted {
+				http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to upload attachment", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]interface{}{
+			"status":     "success",
+			"attachment": attachment,
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error("failed to encode response", "error", err.Error())
+		}
+	}
+}
+
+// downloadHandler serves GET /api/attachments/{id} by relaying the chunks of DownloadAttachment.
+func downloadHandler(cli *client.ClientCRUD, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/attachments/"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid attachment id", http.StatusBadRequest)
+			return
+		}
+
+		stream, err := cli.DownloadAttachment(r.Context(), token, id)
+		if err != nil {
+			logger.Error("failed to download attachment", "error", err.Error())
+			http.Error(w, "Failed to download attachment", http.StatusInternalServerError)
+			return
+		}
+
+		// Errors of a server stream arrive with the first Recv
+		first, err := stream.Recv()
+		if err != nil {
+			switch status.Code(err) {
+			case codes.NotFound:
+				http.NotFound(w, r)
+			case codes.PermissionDenied:
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			default:
+				logger.Error("failed to download attachment", "error", err.Error())
+				http.Error(w, "Failed to download attachment", http.StatusInternalServerError)
+			}
+			return
+		}
+		info := first.GetInfo()
+
+		// The content of an attachment never changes, its hash is a strong ETag
+		etag := `"` + info.GetSha256() + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		disposition := "attachment"
+		if inlineTypes[info.GetMimeType()] {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", info.GetMimeType())
+		w.Header().Set("Content-Length", strconv.FormatInt(info.GetSize(), 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": info.GetFileName()}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				// Headers are already sent, the truncated body tells the browser the download failed
+				logger.Error("attachment download interrupted", "error", err.Error())
+				return
+			}
+			if _, err := w.Write(resp.GetChunk()); err != nil {
+				return
+			}
+		}
+	}
+}
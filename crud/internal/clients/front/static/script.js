@@ -3,99 +3,597 @@ document.addEventListener('DOMContentLoaded', function() {
     const messagesContainer = document.getElementById('messages');
     const messageInput = document.getElementById('message-content');
     const messageTypeSelect = document.getElementById('message-type');
-    const currentUserId = 9; // Пример ID пользователя
+    const messageFileInput = document.getElementById('message-file');
+    const roomSelect = document.getElementById('room-select');
+    const roomForm = document.getElementById('room-form');
+    const roomNameInput = document.getElementById('room-name');
+    const roomPublicInput = document.getElementById('room-public');
+    const inviteForm = document.getElementById('invite-form');
+    const inviteUserIdInput = document.getElementById('invite-user-id');
+    const replyTarget = document.getElementById('reply-target');
+    const replyTargetText = document.getElementById('reply-target-text');
+    const replyCancel = document.getElementById('reply-cancel');
+    const searchForm = document.getElementById('search-form');
+    const searchQuery = document.getElementById('search-query');
+    const searchRoomOnly = document.getElementById('search-room-only');
+    const searchResults = document.getElementById('search-results');
+    const searchResultsTitle = document.getElementById('search-results-title');
+    const searchHits = document.getElementById('search-hits');
+    const searchClose = document.getElementById('search-close');
+    let currentUserId = 0; // Приходит от сервера в событии hello
+    let currentRoomId = 1; // Комната по умолчанию (general)
+    let socket = null;
+    let reconnectDelay = 1000;
+    let olderCursor = 0; // id, до которого ещё есть непрочитанная история
+    let replyToId = 0; // Сообщение, на которое отвечаем (0 — в общую ленту)
+    let lastSearch = null; // Параметры последнего поиска, чтобы дозагружать результаты
+    // Сторона квадрата превью, как ThumbnailSize на сервере
+    const THUMBNAIL_SIZE = 256;
+    const quickReactions = ['👍', '❤️', '😂', '🎉', '👀'];
 
-    loadMessages();
+    const loadOlderButton = document.createElement('button');
+    loadOlderButton.className = 'load-older';
+    loadOlderButton.textContent = 'Load older messages';
+    loadOlderButton.addEventListener('click', function() {
+        send({ action: 'older', room_id: currentRoomId, before_id: olderCursor });
+    });
+
+    loadRooms().then(connect);
+
+    // WebSocket: история комнаты и события в реальном времени
+    function connect() {
+        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+        socket = new WebSocket(`${protocol}//${window.location.host}/ws`);
+
+        socket.addEventListener('open', function() {
+            reconnectDelay = 1000;
+            joinRoom(currentRoomId);
+        });
+
+        socket.addEventListener('message', function(e) {
+            handleEvent(JSON.parse(e.data));
+        });
 
-    async function loadMessages() {
+        socket.addEventListener('close', function() {
+            showError('Connection lost, reconnecting...');
+            setTimeout(connect, reconnectDelay);
+            reconnectDelay = Math.min(reconnectDelay * 2, 30000);
+        });
+    }
+
+    function send(payload) {
+        if (!socket || socket.readyState !== WebSocket.OPEN) {
+            showError('Not connected to the chat');
+            return false;
+        }
+        socket.send(JSON.stringify(payload));
+        return true;
+    }
+
+    function joinRoom(roomId) {
+        currentRoomId = roomId;
+        send({ action: 'join', room_id: roomId });
+    }
+
+    function handleEvent(event) {
+        switch (event.event) {
+            case 'hello':
+                currentUserId = event.uid;
+                break;
+            case 'history':
+                if (event.room_id !== currentRoomId) return;
+                messagesContainer.innerHTML = '';
+                (event.messages || []).forEach(addMessageToUI);
+                setOlderCursor(event.next_cursor);
+                break;
+            case 'older':
+                if (event.room_id !== currentRoomId) return;
+                prependMessages(event.messages || []);
+                setOlderCursor(event.next_cursor);
+                break;
+            case 'created':
+                if (event.room_id !== currentRoomId) return;
+                // Ответы не попадают в общую ленту, только в свою ветку
+                if (event.message.thread_root_id) {
+                    addReplyToUI(event.message);
+                } else {
+                    addMessageToUI(event.message);
+                }
+                break;
+            case 'thread':
+                showThread(event.message, event.messages || []);
+                break;
+            case 'updated':
+                updateMessageInUI(event.message);
+                break;
+            case 'deleted':
+                markMessageDeleted(event.message);
+                break;
+            case 'restored':
+                replaceMessageInUI(event.message);
+                break;
+            case 'reaction_added':
+            case 'reaction_removed':
+                updateReactionsInUI(event);
+                break;
+            case 'search':
+                showSearchResults(event.hits || [], event.next_cursor);
+                break;
+            case 'error':
+                showError(event.error);
+                break;
+        }
+    }
+
+    async function loadRooms() {
         try {
-            showLoading(true);
-            const response = await fetch('/api/messages');
+            const response = await fetch('/api/rooms');
             if (!response.ok) throw new Error(`HTTP error! status: ${response.status}`);
 
             const data = await response.json();
-            messagesContainer.innerHTML = '';
-
-            data.messages.forEach(msg => {
-                addMessageToUI({
-                    id: msg.id,
-                    content: msg.content,
-                    type: msg.type,
-                    userId: msg.uid,
-                    timestamp: msg.datetime,
-                });
+            roomSelect.innerHTML = '';
+
+            data.rooms.forEach(room => {
+                const option = document.createElement('option');
+                option.value = room.id;
+                // Закрытые комнаты, куда пригласили, отмечены до первого входа
+                option.textContent = room.is_invited ? `${room.name} (invited)` : room.name;
+                roomSelect.appendChild(option);
             });
+            roomSelect.value = currentRoomId;
         } catch (error) {
             showError(error.message);
-        } finally {
-            showLoading(false);
         }
     }
 
-    messageForm.addEventListener('submit', async function(e) {
-        e.preventDefault();
-        const messageType = messageTypeSelect.value;
-        const content = messageInput.value.trim();
+    roomSelect.addEventListener('change', function() {
+        joinRoom(Number(roomSelect.value));
+    });
 
-        if (!validateInput(messageType, content)) return;
+    roomForm.addEventListener('submit', async function(e) {
+        e.preventDefault();
+        const name = roomNameInput.value.trim();
+        if (!name) return;
 
         try {
-            showLoading(true);
-            const response = await fetch('/api/messages', {
+            const response = await fetch('/api/rooms', {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
-                body: new URLSearchParams({
-                    'type': messageType,
-                    'message-content': content,
-                })
+                body: new URLSearchParams({ 'name': name, 'public': roomPublicInput.checked })
             });
-
             if (!response.ok) throw new Error(await response.text());
 
             const result = await response.json();
+            currentRoomId = result.room_id;
+            roomNameInput.value = '';
+            roomPublicInput.checked = false;
+            await loadRooms();
+            joinRoom(currentRoomId);
+        } catch (error) {
+            showError(error.message);
+        }
+    });
 
-            addMessageToUI({
-                id: result.message_id,
-                content: content,
-                type: messageType,
-                userId: currentUserId,
-                timestamp: result.datetime
-            });
+    // В закрытую комнату можно войти только по приглашению участника
+    inviteForm.addEventListener('submit', async function(e) {
+        e.preventDefault();
+        const userId = inviteUserIdInput.value.trim();
+        if (!userId) return;
 
-            messageInput.value = '';
+        try {
+            const response = await fetch('/api/rooms/invite', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+                body: new URLSearchParams({ 'room_id': currentRoomId, 'user_id': userId })
+            });
+            if (!response.ok) throw new Error(await response.text());
+            inviteUserIdInput.value = '';
         } catch (error) {
             showError(error.message);
-        } finally {
-            showLoading(false);
         }
     });
 
+    messageTypeSelect.addEventListener('change', function() {
+        // Картинки и файлы загружаются отдельно, текст становится подписью
+        const withFile = messageTypeSelect.value === 'image' || messageTypeSelect.value === 'file';
+        messageFileInput.hidden = !withFile;
+        messageFileInput.accept = messageTypeSelect.value === 'image' ? 'image/*' : '';
+        messageInput.required = !withFile;
+        messageInput.placeholder = withFile ? 'Add a caption (optional)...' : 'Type your message...';
+    });
+
+    messageForm.addEventListener('submit', async function(e) {
+        e.preventDefault();
+        const messageType = messageTypeSelect.value;
+        const content = messageInput.value.trim();
+        const file = messageFileInput.hidden ? null : messageFileInput.files[0];
+
+        if (!validateInput(messageType, content, file)) return;
+
+        let attachmentId = 0;
+        if (file) {
+            try {
+                attachmentId = await uploadAttachment(file);
+            } catch (error) {
+                showError(error.message);
+                return;
+            }
+        }
+
+        // Само сообщение придёт обратно событием created
+        if (send({ action: 'send', room_id: currentRoomId, parent_id: replyToId, type: messageType, content: content, attachment_id: attachmentId })) {
+            messageInput.value = '';
+            messageFileInput.value = '';
+            setReplyTarget(0);
+        }
+    });
+
+    async function uploadAttachment(file) {
+        const body = new FormData();
+        body.append('room_id', currentRoomId);
+        body.append('file', file);
+
+        const response = await fetch('/api/attachments', { method: 'POST', body: body });
+        if (!response.ok) throw new Error(await response.text());
+        const result = await response.json();
+        return result.attachment.id;
+    }
+
+    replyCancel.addEventListener('click', function() {
+        setReplyTarget(0);
+    });
+
+    function setReplyTarget(messageId) {
+        replyToId = messageId;
+        replyTarget.hidden = !messageId;
+        replyTargetText.textContent = messageId ? `Replying in thread #${messageId}` : '';
+    }
+
+    const loadMoreHitsButton = document.createElement('button');
+    loadMoreHitsButton.className = 'load-older';
+    loadMoreHitsButton.textContent = 'More results';
+
+    searchForm.addEventListener('submit', function(e) {
+        e.preventDefault();
+        const query = searchQuery.value.trim();
+        if (!query) return;
+
+        lastSearch = { action: 'search', query: query, room_id: searchRoomOnly.checked ? currentRoomId : 0 };
+        searchHits.innerHTML = '';
+        send(lastSearch);
+    });
+
+    loadMoreHitsButton.addEventListener('click', function() {
+        send({ ...lastSearch, before_id: Number(loadMoreHitsButton.dataset.cursor) });
+    });
+
+    searchClose.addEventListener('click', function() {
+        searchResults.hidden = true;
+        searchHits.innerHTML = '';
+        lastSearch = null;
+    });
+
+    function showSearchResults(hits, cursor) {
+        loadMoreHitsButton.remove();
+        searchResults.hidden = false;
+        hits.forEach(hit => searchHits.appendChild(createSearchHitElement(hit)));
+        searchResultsTitle.textContent = searchHits.children.length ? `Results for "${lastSearch.query}"` : `Nothing found for "${lastSearch.query}"`;
+
+        if (cursor) {
+            loadMoreHitsButton.dataset.cursor = cursor;
+            searchHits.appendChild(loadMoreHitsButton);
+        }
+    }
+
+    function createSearchHitElement(hit) {
+        const element = document.createElement('div');
+        element.className = 'search-hit';
+
+        const meta = document.createElement('div');
+        meta.className = 'search-hit-meta';
+        meta.textContent = `#${hit.message.room_id} · ${hit.message.datetime}`;
+        element.appendChild(meta);
+
+        const snippet = document.createElement('div');
+        appendHighlighted(snippet, hit.snippet);
+        element.appendChild(snippet);
+
+        element.addEventListener('click', () => {
+            const message = findMessageElement(hit.message.id);
+            if (message) {
+                message.classList.add('highlighted');
+                message.scrollIntoView({ block: 'center' });
+                setTimeout(() => message.classList.remove('highlighted'), 2000);
+            } else if (hit.message.room_id !== currentRoomId) {
+                roomSelect.value = hit.message.room_id;
+                joinRoom(hit.message.room_id);
+            }
+        });
+        return element;
+    }
+
+    // Сниппет не экранирован: собираем его из текстовых узлов, а не через innerHTML
+    function appendHighlighted(parent, snippet) {
+        snippet.split('<mark>').forEach((part, i) => {
+            if (i === 0) {
+                parent.appendChild(document.createTextNode(part));
+                return;
+            }
+            const end = part.indexOf('</mark>');
+            const mark = document.createElement('mark');
+            mark.textContent = end === -1 ? part : part.slice(0, end);
+            parent.appendChild(mark);
+            if (end !== -1) {
+                parent.appendChild(document.createTextNode(part.slice(end + '</mark>'.length)));
+            }
+        });
+    }
+
+    function setOlderCursor(cursor) {
+        olderCursor = cursor || 0;
+        if (olderCursor) {
+            messagesContainer.prepend(loadOlderButton);
+        } else {
+            loadOlderButton.remove();
+        }
+    }
+
+    function prependMessages(messages) {
+        // Сохраняем позицию прокрутки, пока история растёт сверху
+        const previousHeight = messagesContainer.scrollHeight;
+        const anchor = loadOlderButton.nextSibling;
+        messages.forEach(message => {
+            messagesContainer.insertBefore(createMessageElement(message), anchor);
+        });
+        messagesContainer.scrollTop += messagesContainer.scrollHeight - previousHeight;
+    }
+
     function addMessageToUI(message) {
-        const isMyMessage = message.userId === currentUserId;
+        messagesContainer.appendChild(createMessageElement(message));
+        messagesContainer.scrollTop = messagesContainer.scrollHeight;
+    }
+
+    function createMessageElement(message) {
+        const isMyMessage = message.uid === currentUserId;
         const messageElement = document.createElement('div');
 
         messageElement.className = `message ${isMyMessage ? 'sent' : 'received'}`;
+        messageElement.dataset.id = message.id;
         messageElement.innerHTML = `
             <div class="message-header">
-                <span class="message-type">${message.type}</span>
-                <span class="message-time">${message.timestamp}</span>
+                <span class="message-type"></span>
+                <span class="message-time"></span>
+                <span class="message-edited"></span>
             </div>
-            <div class="message-content">${message.content}</div>
+            <div class="message-content"></div>
         `;
+        messageElement.querySelector('.message-type').textContent = message.type;
+        messageElement.querySelector('.message-time').textContent = message.datetime;
+        messageElement.querySelector('.message-content').textContent = message.content;
+        setEditedMarker(messageElement, message);
 
-        messagesContainer.appendChild(messageElement);
-        messagesContainer.scrollTop = messagesContainer.scrollHeight;
+        // Удалённое сообщение остаётся в ленте заглушкой
+        if (message.deleted_at) {
+            setTombstone(messageElement);
+            return messageElement;
+        }
+
+        if (message.attachment) {
+            messageElement.querySelector('.message-content').after(createAttachmentElement(message));
+        }
+
+        messageElement.appendChild(createReactionBar(message));
+
+        if (!message.thread_root_id) {
+            const threadButton = document.createElement('button');
+            threadButton.className = 'message-thread';
+            threadButton.addEventListener('click', () => {
+                setReplyTarget(message.id);
+                send({ action: 'thread', mid: message.id });
+            });
+            messageElement.appendChild(threadButton);
+            setReplyCount(messageElement, message.reply_count || 0);
+        }
+
+        if (isMyMessage) {
+            const deleteButton = document.createElement('button');
+            deleteButton.className = 'message-delete';
+            deleteButton.textContent = '×';
+            deleteButton.title = 'Delete message';
+            deleteButton.addEventListener('click', () => send({ action: 'delete', mid: message.id }));
+            messageElement.querySelector('.message-header').appendChild(deleteButton);
+        }
+
+        return messageElement;
     }
 
-    function validateInput(type, content) {
-        if (!content.trim()) {
-            showError('Message content cannot be empty!');
-            return false;
+    function createAttachmentElement(message) {
+        const attachment = message.attachment;
+        const url = `/api/attachments/${attachment.id}`;
+        const container = document.createElement('div');
+        container.className = 'message-attachment';
+
+        if (message.type === 'image') {
+            const image = document.createElement('img');
+            // Пока превью не готово, показываем оригинал
+            image.src = message.thumbnail_id ? `/api/attachments/${message.thumbnail_id}` : url;
+            image.alt = attachment.file_name;
+            image.loading = 'lazy';
+            // Размеры известны заранее, лента не прыгает при загрузке картинки
+            if (message.width && message.height) {
+                const scale = Math.min(1, THUMBNAIL_SIZE / Math.max(message.width, message.height));
+                image.width = Math.max(1, Math.round(message.width * scale));
+                image.height = Math.max(1, Math.round(message.height * scale));
+            }
+            const link = document.createElement('a');
+            link.href = url;
+            link.target = '_blank';
+            link.rel = 'noopener';
+            link.appendChild(image);
+            container.appendChild(link);
+        } else {
+            const link = document.createElement('a');
+            link.href = url;
+            link.download = attachment.file_name;
+            link.textContent = `${attachment.file_name} (${formatSize(attachment.size)})`;
+            container.appendChild(link);
+        }
+        return container;
+    }
+
+    function formatSize(bytes) {
+        if (bytes < 1024) return `${bytes} B`;
+        if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)} KB`;
+        return `${(bytes / 1024 / 1024).toFixed(1)} MB`;
+    }
+
+    function createReactionBar(message) {
+        const bar = document.createElement('div');
+        bar.className = 'message-reactions';
+        renderReactions(bar, message.id, message.reaction || []);
+        return bar;
+    }
+
+    // Счётчики приходят с сервера, а отмечать свои реакции нужно самим
+    function renderReactions(bar, messageId, reactions) {
+        bar.innerHTML = '';
+        const mine = new Set(reactions.filter(r => r.reacted_by_me).map(r => r.emoji));
+        bar.dataset.mine = JSON.stringify([...mine]);
+
+        reactions.forEach(reaction => {
+            bar.appendChild(createReactionButton(messageId, reaction.emoji, reaction.count, mine.has(reaction.emoji)));
+        });
+        quickReactions
+            .filter(emoji => !reactions.some(r => r.emoji === emoji))
+            .forEach(emoji => {
+                const button = createReactionButton(messageId, emoji, 0, false);
+                button.classList.add('reaction-picker');
+                bar.appendChild(button);
+            });
+    }
+
+    function createReactionButton(messageId, emoji, count, isMine) {
+        const button = document.createElement('button');
+        button.className = `reaction ${isMine ? 'mine' : ''}`;
+        button.textContent = count ? `${emoji} ${count}` : emoji;
+        button.addEventListener('click', () => {
+            send({ action: isMine ? 'unreact' : 'react', mid: messageId, emoji: emoji });
+        });
+        return button;
+    }
+
+    function updateReactionsInUI(event) {
+        const element = findMessageElement(event.message.id);
+        if (!element) return;
+        const bar = element.querySelector(':scope > .message-reactions');
+        if (!bar) return;
+
+        // В событии reacted_by_me всегда false: восстанавливаем по actor_uid
+        const mine = new Set(JSON.parse(bar.dataset.mine || '[]'));
+        if (event.actor_uid === currentUserId) {
+            if (event.event === 'reaction_added') {
+                mine.add(event.emoji);
+            } else {
+                mine.delete(event.emoji);
+            }
+        }
+        const reactions = (event.message.reaction || []).map(r => ({ ...r, reacted_by_me: mine.has(r.emoji) }));
+        renderReactions(bar, event.message.id, reactions);
+    }
+
+    function setReplyCount(element, count) {
+        const threadButton = element.querySelector('.message-thread');
+        element.dataset.replies = count;
+        if (!threadButton) return;
+        threadButton.textContent = count ? `${count} ${count === 1 ? 'reply' : 'replies'}` : 'Reply';
+    }
+
+    function addReplyToUI(reply) {
+        const root = findMessageElement(reply.thread_root_id);
+        if (!root) return;
+
+        setReplyCount(root, Number(root.dataset.replies || 0) + 1);
+        const replies = root.querySelector('.thread-replies');
+        if (replies) {
+            replies.appendChild(createMessageElement(reply));
         }
+    }
+
+    function showThread(rootMessage, replies) {
+        const root = findMessageElement(rootMessage.id);
+        if (!root) return;
+
+        let container = root.querySelector('.thread-replies');
+        if (!container) {
+            container = document.createElement('div');
+            container.className = 'thread-replies';
+            root.appendChild(container);
+        }
+        container.innerHTML = '';
+        replies.forEach(reply => container.appendChild(createMessageElement(reply)));
+    }
+
+    function findMessageElement(id) {
+        return messagesContainer.querySelector(`.message[data-id="${id}"]`);
+    }
+
+    function updateMessageInUI(message) {
+        const element = findMessageElement(message.id);
+        if (element) {
+            element.querySelector('.message-content').textContent = message.content;
+            setEditedMarker(element, message);
+            // Превью картинки готовится в фоне и приходит тем же событием updated
+            const attachment = element.querySelector('.message-attachment');
+            if (attachment && message.attachment) {
+                attachment.replaceWith(createAttachmentElement(message));
+            }
+        }
+    }
+
+    function setEditedMarker(element, message) {
+        // edited_at пустой, пока сообщение ни разу не редактировали
+        const marker = element.querySelector('.message-edited');
+        marker.textContent = message.edited_at ? '(edited)' : '';
+        marker.title = message.edited_at ? `Edited ${message.edited_at}` : '';
+    }
+
+    function setTombstone(element) {
+        element.classList.add('deleted');
+        element.querySelector('.message-content').textContent = 'Message deleted';
+        const deleteButton = element.querySelector('.message-delete');
+        if (deleteButton) {
+            deleteButton.remove();
+        }
+        element.querySelectorAll(':scope > .message-reactions, :scope > .message-attachment').forEach(part => part.remove());
+    }
+
+    function markMessageDeleted(message) {
+        const element = findMessageElement(message.id);
+        if (element) {
+            setTombstone(element);
+        }
+    }
+
+    function replaceMessageInUI(message) {
+        const element = findMessageElement(message.id);
+        if (element) {
+            element.replaceWith(createMessageElement(message));
+        }
+    }
+
+    function validateInput(type, content, file) {
         if (!type) {
             showError('Please select a message type!');
             return false;
         }
+        if ((type === 'image' || type === 'file') && !file) {
+            showError('Please choose a file to send!');
+            return false;
+        }
+        if (type === 'text' && !content.trim()) {
+            showError('Message content cannot be empty!');
+            return false;
+        }
         return true;
     }
 
@@ -106,12 +604,4 @@ document.addEventListener('DOMContentLoaded', function() {
         messagesContainer.prepend(errorDiv);
         setTimeout(() => errorDiv.remove(), 3000);
     }
-
-    function showLoading(isLoading) {
-        const button = messageForm.querySelector('button');
-        button.disabled = isLoading;
-        button.innerHTML = isLoading
-            ? '<div class="spinner"></div> Sending...'
-            : 'Send Message';
-    }
-});
\ No newline at end of file
+});
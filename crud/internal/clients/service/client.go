@@ -4,16 +4,22 @@ import (
 	"ChatService/crud/internal/domain/models"
 	crudv1 "ChatService/protos/gen/go/crud"
 	"context"
+	"errors"
 	"fmt"
 	grpclog "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	grpcretry "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/retry"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"io"
 	"log/slog"
 	"time"
 )
 
+// uploadChunkSize is the size of the chunks UploadAttachment sends
+const uploadChunkSize = 64 << 10
+
 type ClientCRUD struct {
 	apiCRUD crudv1.MessageClient
 	conn    *grpc.ClientConn
@@ -61,20 +67,24 @@ func InterceptorLogger(l *slog.Logger) grpclog.Logger {
 	})
 }
 
+// withToken authenticates a call with the authorization metadata the CRUD server reads
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
 func (c *ClientCRUD) GetMessage(ctx context.Context, token string, mid int64) (models.Message, error) {
 	const op = "crud.GetMessage"
 
-	resp, err := c.apiCRUD.GetMessage(ctx, &crudv1.GetMessageRequest{
-		Token: token,
-		Mid:   mid,
+	resp, err := c.apiCRUD.GetMessage(withToken(ctx, token), &crudv1.GetMessageRequest{
+		Mid: mid,
 	})
 	if err != nil {
 		return models.Message{}, fmt.Errorf("%s: %w", op, err)
 	}
-	return models.Message{Content: resp.Content}, nil
+	return models.Message{Content: resp.Content, RoomID: resp.RoomId}, nil
 }
 
-func (c *ClientCRUD) SentMessage(ctx context.Context, datetime, typeMessage, content, token string) (int64, error) {
+func (c *ClientCRUD) SentMessage(ctx context.Context, datetime, typeMessage, content, token string, roomID, parentID, attachmentID int64) (int64, error) {
 	const op = "crud.SentMessage"
 
 	typeOf := int32(0)
@@ -87,11 +97,13 @@ func (c *ClientCRUD) SentMessage(ctx context.Context, datetime, typeMessage, con
 		typeOf = 3
 	}
 
-	resp, err := c.apiCRUD.SentMessage(ctx, &crudv1.SentMessageRequest{
-		Type:     typeOf,
-		Token:    token,
-		Content:  content,
-		Datetime: datetime,
+	resp, err := c.apiCRUD.SentMessage(withToken(ctx, token), &crudv1.SentMessageRequest{
+		Type:         typeOf,
+		Content:      content,
+		Datetime:     datetime,
+		RoomId:       roomID,
+		ParentId:     parentID,
+		AttachmentId: attachmentID,
 	})
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
@@ -102,8 +114,7 @@ func (c *ClientCRUD) SentMessage(ctx context.Context, datetime, typeMessage, con
 func (c *ClientCRUD) UpdateMessage(ctx context.Context, newContent, token string, mid int64) (bool, error) {
 	const op = "crud.UpdateMessage"
 
-	resp, err := c.apiCRUD.UpdateMessage(ctx, &crudv1.UpdateMessageRequest{
-		Token:      token,
+	resp, err := c.apiCRUD.UpdateMessage(withToken(ctx, token), &crudv1.UpdateMessageRequest{
 		NewContent: newContent,
 		Mid:        mid,
 	})
@@ -116,9 +127,8 @@ func (c *ClientCRUD) UpdateMessage(ctx context.Context, newContent, token string
 func (c *ClientCRUD) DeleteMessage(ctx context.Context, token string, mid int64) (bool, error) {
 	const op = "crud.DeleteMessage"
 
-	resp, err := c.apiCRUD.DeleteMessage(ctx, &crudv1.DeleteMessageRequest{
-		Token: token,
-		Mid:   mid,
+	resp, err := c.apiCRUD.DeleteMessage(withToken(ctx, token), &crudv1.DeleteMessageRequest{
+		Mid: mid,
 	})
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
@@ -126,20 +136,218 @@ func (c *ClientCRUD) DeleteMessage(ctx context.Context, token string, mid int64)
 	return resp.Status, nil
 }
 
-func (c *ClientCRUD) ShowAllMessages(ctx context.Context, token string) ([]*crudv1.GetMessageResponse, error) {
+func (c *ClientCRUD) ShowAllMessages(ctx context.Context, token string, roomID int64, page models.Page) ([]*crudv1.GetMessageResponse, int64, error) {
 	const op = "client.ShowAllMessages"
 
 	req := &crudv1.ShowMessagesRequest{
-		Token: token,
+		RoomId:   roomID,
+		Limit:    int32(page.Limit),
+		BeforeId: page.BeforeID,
+		AfterId:  page.AfterID,
 	}
 
-	resp, err := c.apiCRUD.ShowMessages(ctx, req)
+	resp, err := c.apiCRUD.ShowMessages(withToken(ctx, token), req)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return nil, 0, fmt.Errorf("%s: %w", op, err)
 	}
 	if len(resp.Message) == 0 {
-		return []*crudv1.GetMessageResponse{}, nil
+		return []*crudv1.GetMessageResponse{}, 0, nil
 	}
 
-	return resp.Message, nil
+	return resp.Message, resp.NextCursor, nil
+}
+
+func (c *ClientCRUD) GetThread(ctx context.Context, token string, mid int64, page models.Page) (*crudv1.GetThreadResponse, error) {
+	const op = "client.GetThread"
+
+	resp, err := c.apiCRUD.GetThread(withToken(ctx, token), &crudv1.GetThreadRequest{
+		Mid:     mid,
+		Limit:   int32(page.Limit),
+		AfterId: page.AfterID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp, nil
+}
+
+func (c *ClientCRUD) SearchMessages(ctx context.Context, token string, filter models.SearchFilter, page models.Page) (*crudv1.SearchMessagesResponse, error) {
+	const op = "client.SearchMessages"
+
+	resp, err := c.apiCRUD.SearchMessages(withToken(ctx, token), &crudv1.SearchMessagesRequest{
+		Query:     filter.Query,
+		RoomId:    filter.RoomID,
+		AuthorUid: filter.AuthorID,
+		Type:      filter.Type,
+		DateFrom:  filter.DateFrom,
+		DateTo:    filter.DateTo,
+		Limit:     int32(page.Limit),
+		BeforeId:  page.BeforeID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp, nil
+}
+
+func (c *ClientCRUD) AddReaction(ctx context.Context, token, emoji string, mid int64) (bool, error) {
+	const op = "crud.AddReaction"
+
+	resp, err := c.apiCRUD.AddReaction(withToken(ctx, token), &crudv1.AddReactionRequest{
+		Mid:   mid,
+		Emoji: emoji,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Status, nil
+}
+
+func (c *ClientCRUD) RemoveReaction(ctx context.Context, token, emoji string, mid int64) (bool, error) {
+	const op = "crud.RemoveReaction"
+
+	resp, err := c.apiCRUD.RemoveReaction(withToken(ctx, token), &crudv1.RemoveReactionRequest{
+		Mid:   mid,
+		Emoji: emoji,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Status, nil
+}
+
+// UploadAttachment streams r to the CRUD service in chunks.
+func (c *ClientCRUD) UploadAttachment(ctx context.Context, token string, roomID int64, fileName string, r io.Reader) (*crudv1.Attachment, error) {
+	const op = "crud.UploadAttachment"
+
+	stream, err := c.apiCRUD.UploadAttachment(withToken(ctx, token))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := stream.Send(&crudv1.UploadAttachmentRequest{
+		Data: &crudv1.UploadAttachmentRequest_Info{Info: &crudv1.UploadAttachmentInfo{
+			RoomId:   roomID,
+			FileName: fileName,
+		}},
+	}); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			sendErr := stream.Send(&crudv1.UploadAttachmentRequest{
+				Data: &crudv1.UploadAttachmentRequest_Chunk{Chunk: buf[:n]},
+			})
+			// io.EOF on Send means the server has already answered, CloseAndRecv returns its status
+			if sendErr != nil && !errors.Is(sendErr, io.EOF) {
+				return nil, fmt.Errorf("%s: %w", op, sendErr)
+			}
+			if sendErr != nil {
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Attachment, nil
+}
+
+// DownloadAttachment opens a download stream, its first message carries the metadata and the rest the content.
+func (c *ClientCRUD) DownloadAttachment(ctx context.Context, token string, id int64) (crudv1.Message_DownloadAttachmentClient, error) {
+	const op = "crud.DownloadAttachment"
+
+	stream, err := c.apiCRUD.DownloadAttachment(withToken(ctx, token), &crudv1.DownloadAttachmentRequest{
+		Id: id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return stream, nil
+}
+
+func (c *ClientCRUD) CreateRoom(ctx context.Context, token, name string, public bool) (int64, error) {
+	const op = "crud.CreateRoom"
+
+	resp, err := c.apiCRUD.CreateRoom(withToken(ctx, token), &crudv1.CreateRoomRequest{
+		Name:   name,
+		Public: public,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.RoomId, nil
+}
+
+func (c *ClientCRUD) JoinRoom(ctx context.Context, token string, roomID int64) (bool, error) {
+	const op = "crud.JoinRoom"
+
+	resp, err := c.apiCRUD.JoinRoom(withToken(ctx, token), &crudv1.JoinRoomRequest{
+		RoomId: roomID,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Status, nil
+}
+
+func (c *ClientCRUD) InviteToRoom(ctx context.Context, token string, roomID, userID int64) (bool, error) {
+	const op = "crud.InviteToRoom"
+
+	resp, err := c.apiCRUD.InviteToRoom(withToken(ctx, token), &crudv1.InviteToRoomRequest{
+		RoomId: roomID,
+		UserId: userID,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Status, nil
+}
+
+func (c *ClientCRUD) LeaveRoom(ctx context.Context, token string, roomID int64) (bool, error) {
+	const op = "crud.LeaveRoom"
+
+	resp, err := c.apiCRUD.LeaveRoom(withToken(ctx, token), &crudv1.LeaveRoomRequest{
+		RoomId: roomID,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Status, nil
+}
+
+func (c *ClientCRUD) ListRooms(ctx context.Context, token string) ([]*crudv1.Room, error) {
+	const op = "crud.ListRooms"
+
+	resp, err := c.apiCRUD.ListRooms(withToken(ctx, token), &crudv1.ListRoomsRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(resp.Room) == 0 {
+		return []*crudv1.Room{}, nil
+	}
+	return resp.Room, nil
+}
+
+func (c *ClientCRUD) Subscribe(ctx context.Context, token string, roomID int64) (crudv1.Message_SubscribeClient, error) {
+	const op = "crud.Subscribe"
+
+	stream, err := c.apiCRUD.Subscribe(withToken(ctx, token), &crudv1.SubscribeRequest{
+		RoomId: roomID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return stream, nil
 }
@@ -0,0 +1,136 @@
+package sso
+
+import (
+	"ChatService/crud/internal/domain/models"
+	ssov1 "ChatService/protos/gen/go/sso"
+	"context"
+	"fmt"
+	grpclog "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
+	grpcretry "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"log/slog"
+	"time"
+)
+
+// serviceTokenKey is the metadata key SSO expects the service token in
+const serviceTokenKey = "x-service-token"
+
+// ClientSSO asks the SSO service about users the CRUD service acts on behalf of.
+type ClientSSO struct {
+	apiAuth ssov1.AuthServiceClient
+	conn    *grpc.ClientConn
+	log     *slog.Logger
+}
+
+func New(ctx context.Context, log *slog.Logger, addr string, timeout time.Duration, retriesCount int,
+	serviceToken string) (*ClientSSO, error) {
+	const op = "sso.NewClient"
+
+	retryOpts := []grpcretry.CallOption{
+		grpcretry.WithCodes(codes.Aborted, codes.DeadlineExceeded, codes.Unavailable),
+		grpcretry.WithPerRetryTimeout(timeout),
+		grpcretry.WithMax(uint(retriesCount)),
+	}
+
+	logOpts := []grpclog.Option{
+		grpclog.WithLogOnEvents(grpclog.PayloadSent, grpclog.PayloadReceived),
+	}
+
+	clientConn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(
+			serviceTokenInterceptor(serviceToken),
+			grpcretry.UnaryClientInterceptor(retryOpts...),
+			grpclog.UnaryClientInterceptor(InterceptorLogger(log), logOpts...),
+		))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &ClientSSO{
+		apiAuth: ssov1.NewAuthServiceClient(clientConn),
+		log:     log,
+		conn:    clientConn,
+	}, nil
+}
+
+func (c *ClientSSO) Close() error {
+	return c.conn.Close()
+}
+
+// serviceTokenInterceptor identifies CRUD to SSO on every call, the calls about other users require it.
+func serviceTokenInterceptor(token string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, serviceTokenKey, token)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func InterceptorLogger(l *slog.Logger) grpclog.Logger {
+	return grpclog.LoggerFunc(func(ctx context.Context, lvl grpclog.Level, msg string, fields ...any) {
+		l.Log(ctx, slog.Level(lvl), msg, fields...)
+	})
+}
+
+// CheckPermission asks SSO whether the role of the user grants permission.
+func (c *ClientSSO) CheckPermission(ctx context.Context, uid int64, permission string) (bool, error) {
+	const op = "sso.CheckPermission"
+
+	resp, err := c.apiAuth.CheckPermission(ctx, &ssov1.CheckPermissionRequest{UserId: uid, Permission: permission})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.GetAllowed(), nil
+}
+
+// GetRestrictions asks SSO for the bans and mutes of the user in force now.
+func (c *ClientSSO) GetRestrictions(ctx context.Context, uid int64) (models.Restrictions, error) {
+	const op = "sso.GetRestrictions"
+
+	resp, err := c.apiAuth.GetRestrictions(ctx, &ssov1.GetRestrictionsRequest{UserId: uid})
+	if err != nil {
+		return models.Restrictions{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var restrictions models.Restrictions
+	if ban := resp.GetBan(); ban != nil {
+		restriction := restrictionFromPB(ban)
+		restrictions.Ban = &restriction
+	}
+	for _, mute := range resp.GetMutes() {
+		restrictions.Mutes = append(restrictions.Mutes, restrictionFromPB(mute))
+	}
+	return restrictions, nil
+}
+
+func restrictionFromPB(restriction *ssov1.Restriction) models.Restriction {
+	result := models.Restriction{RoomID: restriction.GetRoomId(), Reason: restriction.GetReason()}
+	if restriction.GetExpiresAt() != 0 {
+		result.Until = time.Unix(restriction.GetExpiresAt(), 0)
+	}
+	return result
+}
+
+func (c *ClientSSO) IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	const op = "sso.IsTokenRevoked"
+
+	resp, err := c.apiAuth.IsTokenRevoked(ctx, &ssov1.IsTokenRevokedRequest{Jti: jti, UserId: userID, IssuedAt: issuedAt.Unix()})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.GetRevoked(), nil
+}
+
+func (c *ClientSSO) GetJWKS(ctx context.Context) ([]*ssov1.JWK, error) {
+	const op = "sso.GetJWKS"
+
+	resp, err := c.apiAuth.GetJWKS(ctx, &ssov1.GetJWKSRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.GetKeys(), nil
+}
@@ -0,0 +1,140 @@
+package sso
+
+import (
+	jwtVal "ChatService/crud/internal/lib/jwt"
+	ssov1 "ChatService/protos/gen/go/sso"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// minJWKSRefreshInterval limits how often an unknown kid makes the key set be fetched again,
+// so tokens with made-up kids can not flood SSO
+const minJWKSRefreshInterval = 10 * time.Second
+
+// JWKSSource returns the public keys SSO signs access tokens with.
+type JWKSSource interface {
+	GetJWKS(ctx context.Context) ([]*ssov1.JWK, error)
+}
+
+// JWKSCache verifies tokens with the keys SSO publishes. The key set is fetched again after ttl,
+// or at once when a token names a kid that is not cached, e.g. right after SSO rotated its key.
+type JWKSCache struct {
+	source JWKSSource
+	log    *slog.Logger
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	keys map[string]jwksKey
+	// fetched is the time of the last successful fetch, checked of the last attempt
+	fetched time.Time
+	checked time.Time
+}
+
+type jwksKey struct {
+	algorithm string
+	key       crypto.PublicKey
+}
+
+func NewJWKSCache(source JWKSSource, log *slog.Logger, ttl time.Duration) *JWKSCache {
+	return &JWKSCache{
+		source: source,
+		log:    log,
+		ttl:    ttl,
+		keys:   make(map[string]jwksKey),
+	}
+}
+
+func (c *JWKSCache) Key(ctx context.Context, id jwtVal.KeyID) (any, error) {
+	const op = "sso.JWKSCache.Key"
+
+	if id.KID == "" {
+		return nil, jwtVal.ErrUnknownKey
+	}
+
+	// Held during the fetch as well, concurrent calls wait for one fetch instead of starting their own
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key, ok := c.keys[id.KID]
+	if (!ok || now.Sub(c.fetched) >= c.ttl) && now.Sub(c.checked) >= minJWKSRefreshInterval {
+		c.checked = now
+		if err := c.refresh(ctx); err != nil {
+			// Cached keys stay usable while SSO is unreachable
+			c.log.Warn("failed to fetch JWKS", slog.String("op", op), slog.String("err", err.Error()))
+			if !ok {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+		} else {
+			c.fetched = now
+			key, ok = c.keys[id.KID]
+		}
+	}
+
+	// The algorithm is part of the key, a token can not pick another one for it
+	if !ok || key.algorithm != id.Algorithm {
+		return nil, jwtVal.ErrUnknownKey
+	}
+	return key.key, nil
+}
+
+func (c *JWKSCache) refresh(ctx context.Context) error {
+	jwks, err := c.source.GetJWKS(ctx)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]jwksKey, len(jwks))
+	for _, jwk := range jwks {
+		if jwk.GetUse() != "" && jwk.GetUse() != "sig" {
+			continue
+		}
+		key, err := publicKey(jwk)
+		if err != nil {
+			c.log.Warn("skipping JWK", slog.String("kid", jwk.GetKid()), slog.String("err", err.Error()))
+			continue
+		}
+		keys[jwk.GetKid()] = jwksKey{algorithm: jwk.GetAlg(), key: key}
+	}
+	c.keys = keys
+	return nil
+}
+
+func publicKey(jwk *ssov1.JWK) (crypto.PublicKey, error) {
+	switch jwk.GetKty() {
+	case "OKP":
+		if jwk.GetCrv() != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.GetCrv())
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.GetX())
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.GetN())
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.GetE())
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 2 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.GetKty())
+}
@@ -0,0 +1,41 @@
+package sso
+
+import (
+	"ChatService/crud/internal/domain/models"
+	"context"
+	"time"
+)
+
+// RestrictionSource returns the bans and mutes of a user, it is backed by the SSO service.
+type RestrictionSource interface {
+	GetRestrictions(ctx context.Context, uid int64) (models.Restrictions, error)
+}
+
+// RestrictionCache keeps the bans and mutes of a user for ttl, so SSO is asked once per user
+// and ttl instead of on every call. A new ban or mute therefore applies within ttl, one that
+// runs out is lifted right away since the entries keep their expiry.
+type RestrictionCache struct {
+	source RestrictionSource
+	cache  *ttlCache[int64, models.Restrictions]
+}
+
+func NewRestrictionCache(source RestrictionSource, ttl time.Duration) *RestrictionCache {
+	return &RestrictionCache{
+		source: source,
+		cache:  newTTLCache[int64, models.Restrictions](ttl),
+	}
+}
+
+func (c *RestrictionCache) Restrictions(ctx context.Context, uid int64) (models.Restrictions, error) {
+	now := time.Now()
+	if restrictions, ok := c.cache.get(uid, now); ok {
+		return restrictions, nil
+	}
+
+	restrictions, err := c.source.GetRestrictions(ctx, uid)
+	if err != nil {
+		return models.Restrictions{}, err
+	}
+	c.cache.set(uid, restrictions, now)
+	return restrictions, nil
+}
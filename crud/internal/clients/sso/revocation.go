@@ -0,0 +1,36 @@
+package sso
+
+import (
+	"ChatService/crud/internal/lib/auth"
+	"context"
+	"time"
+)
+
+// RevocationCache keeps the answers of IsTokenRevoked for ttl, so SSO is asked once per token
+// and ttl instead of on every call. A logout therefore reaches the CRUD service within ttl.
+type RevocationCache struct {
+	checker auth.RevocationChecker
+	cache   *ttlCache[string, bool]
+}
+
+func NewRevocationCache(checker auth.RevocationChecker, ttl time.Duration) *RevocationCache {
+	return &RevocationCache{
+		checker: checker,
+		cache:   newTTLCache[string, bool](ttl),
+	}
+}
+
+// IsTokenRevoked caches by jti, the user and iat of a token never change.
+func (c *RevocationCache) IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	now := time.Now()
+	if revoked, ok := c.cache.get(jti, now); ok {
+		return revoked, nil
+	}
+
+	revoked, err := c.checker.IsTokenRevoked(ctx, jti, userID, issuedAt)
+	if err != nil {
+		return false, err
+	}
+	c.cache.set(jti, revoked, now)
+	return revoked, nil
+}
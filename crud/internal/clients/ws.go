@@ -0,0 +1,301 @@
+package clients
+
+import (
+	client "ChatService/crud/internal/clients/service"
+	"ChatService/crud/internal/domain/models"
+	jwtVal "ChatService/crud/internal/lib/jwt"
+	crudv1 "ChatService/protos/gen/go/crud"
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxMessage = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsRequest is a command sent by the browser over the socket
+type wsRequest struct {
+	Action   string `json:"action"`
+	RoomID   int64  `json:"room_id"`
+	Mid      int64  `json:"mid"`
+	BeforeID int64  `json:"before_id"`
+	AfterID  int64  `json:"after_id"`
+	ParentID int64  `json:"parent_id"`
+	// AttachmentID comes from POST /api/attachments, the file itself is not sent over the socket
+	AttachmentID int64  `json:"attachment_id"`
+	Type         string `json:"type"`
+	Content      string `json:"content"`
+	Emoji        string `json:"emoji"`
+	Query        string `json:"query"`
+}
+
+// wsResponse is pushed to the browser: either a live event, a room history or an error
+type wsResponse struct {
+	Event    string                       `json:"event"`
+	UserID   int64                        `json:"uid,omitempty"`
+	RoomID   int64                        `json:"room_id,omitempty"`
+	Message  *crudv1.GetMessageResponse   `json:"message,omitempty"`
+	Messages []*crudv1.GetMessageResponse `json:"messages,omitempty"`
+	Hits     []*crudv1.SearchHit          `json:"hits,omitempty"`
+	Cursor   int64                        `json:"next_cursor,omitempty"`
+	ActorID  int64                        `json:"actor_uid,omitempty"`
+	Emoji    string                       `json:"emoji,omitempty"`
+	Error    string                       `json:"error,omitempty"`
+}
+
+// wsSession relays one browser socket to the CRUD service.
+// The browser joins a room, then receives its history followed by live events
+// and may send, edit and delete messages through the same socket.
+type wsSession struct {
+	conn   *websocket.Conn
+	cli    *client.ClientCRUD
+	log    *slog.Logger
+	token  string
+	userID int64
+
+	writeMu sync.Mutex
+
+	subMu     sync.Mutex
+	cancelSub context.CancelFunc
+}
+
+func wsHandler(cli *client.ClientCRUD, logger *slog.Logger, keys jwtVal.KeyResolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		// Browsers can not set headers on a websocket handshake
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		tokenInfo := jwtVal.ValidateToken(r.Context(), token, keys)
+		if tokenInfo.Error != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Error("failed to upgrade connection", "error", err.Error())
+			return
+		}
+
+		session := &wsSession{
+			conn:   conn,
+			cli:    cli,
+			log:    logger.With(slog.Int64("uid", tokenInfo.UserID)),
+			token:  token,
+			userID: tokenInfo.UserID,
+		}
+		session.run()
+	}
+}
+
+func (s *wsSession) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		s.unsubscribe()
+		_ = s.conn.Close()
+	}()
+
+	go s.ping(ctx)
+
+	s.conn.SetReadLimit(wsMaxMessage)
+	_ = s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	s.write(wsResponse{Event: "hello", UserID: s.userID})
+
+	for {
+		var req wsRequest
+		if err := s.conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				s.log.Warn("websocket closed", "error", err.Error())
+			}
+			return
+		}
+		s.handle(ctx, req)
+	}
+}
+
+func (s *wsSession) handle(ctx context.Context, req wsRequest) {
+	switch req.Action {
+	case "join":
+		s.join(ctx, req.RoomID)
+	case "older":
+		messages, cursor, err := s.cli.ShowAllMessages(ctx, s.token, req.RoomID, models.Page{BeforeID: req.BeforeID})
+		if err != nil {
+			s.fail("failed to get messages", err)
+			return
+		}
+		s.write(wsResponse{Event: "older", RoomID: req.RoomID, Messages: messages, Cursor: cursor})
+	case "send":
+		datetime := time.Now().String()[0:16]
+		if _, err := s.cli.SentMessage(ctx, datetime, req.Type, req.Content, s.token, req.RoomID, req.ParentID, req.AttachmentID); err != nil {
+			s.fail("failed to send message", err)
+		}
+	case "thread":
+		thread, err := s.cli.GetThread(ctx, s.token, req.Mid, models.Page{AfterID: req.AfterID})
+		if err != nil {
+			s.fail("failed to get thread", err)
+			return
+		}
+		s.write(wsResponse{
+			Event:    "thread",
+			RoomID:   thread.GetRoot().GetRoomId(),
+			Message:  thread.GetRoot(),
+			Messages: thread.GetReply(),
+			Cursor:   thread.GetNextCursor(),
+		})
+	case "search":
+		// room_id 0 searches every room the user has joined
+		result, err := s.cli.SearchMessages(ctx, s.token, models.SearchFilter{Query: req.Query, RoomID: req.RoomID}, models.Page{BeforeID: req.BeforeID})
+		if err != nil {
+			s.fail("failed to search messages", err)
+			return
+		}
+		s.write(wsResponse{Event: "search", RoomID: req.RoomID, Hits: result.GetHit(), Cursor: result.GetNextCursor()})
+	case "update":
+		if _, err := s.cli.UpdateMessage(ctx, req.Content, s.token, req.Mid); err != nil {
+			s.fail("failed to update message", err)
+		}
+	case "delete":
+		if _, err := s.cli.DeleteMessage(ctx, s.token, req.Mid); err != nil {
+			s.fail("failed to delete message", err)
+		}
+	case "react":
+		if _, err := s.cli.AddReaction(ctx, s.token, req.Emoji, req.Mid); err != nil {
+			s.fail("failed to add reaction", err)
+		}
+	case "unreact":
+		if _, err := s.cli.RemoveReaction(ctx, s.token, req.Emoji, req.Mid); err != nil {
+			s.fail("failed to remove reaction", err)
+		}
+	default:
+		s.write(wsResponse{Event: "error", Error: "unknown action " + req.Action})
+	}
+}
+
+// join switches the socket to a room: it subscribes first so no event is missed
+// between the history snapshot and the live stream.
+func (s *wsSession) join(ctx context.Context, roomID int64) {
+	if _, err := s.cli.JoinRoom(ctx, s.token, roomID); err != nil {
+		s.fail("failed to join room", err)
+		return
+	}
+
+	s.unsubscribe()
+	subCtx, cancel := context.WithCancel(ctx)
+	stream, err := s.cli.Subscribe(subCtx, s.token, roomID)
+	if err != nil {
+		cancel()
+		s.fail("failed to subscribe", err)
+		return
+	}
+	s.subMu.Lock()
+	s.cancelSub = cancel
+	s.subMu.Unlock()
+
+	messages, cursor, err := s.cli.ShowAllMessages(ctx, s.token, roomID, models.Page{})
+	if err != nil {
+		s.fail("failed to get messages", err)
+		return
+	}
+	s.write(wsResponse{Event: "history", RoomID: roomID, Messages: messages, Cursor: cursor})
+
+	go s.relay(stream, roomID)
+}
+
+func (s *wsSession) relay(stream crudv1.Message_SubscribeClient, roomID int64) {
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			if stream.Context().Err() == nil {
+				s.fail("live updates stopped", err)
+			}
+			return
+		}
+		s.write(wsResponse{
+			Event:   eventName(event.GetType()),
+			RoomID:  roomID,
+			Message: event.GetMessage(),
+			ActorID: event.GetActorUid(),
+			Emoji:   event.GetEmoji(),
+		})
+	}
+}
+
+func (s *wsSession) unsubscribe() {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	if s.cancelSub != nil {
+		s.cancelSub()
+		s.cancelSub = nil
+	}
+}
+
+func (s *wsSession) ping(ctx context.Context) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.writeMu.Lock()
+			_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := s.conn.WriteMessage(websocket.PingMessage, nil)
+			s.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) fail(msg string, err error) {
+	s.log.Error(msg, "error", err.Error())
+	s.write(wsResponse{Event: "error", Error: msg})
+}
+
+// write is safe for concurrent use: gorilla/websocket allows only one writer at a time
+func (s *wsSession) write(resp wsResponse) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := s.conn.WriteJSON(resp); err != nil {
+		s.log.Warn("failed to write to websocket", "error", err.Error())
+	}
+}
+
+func eventName(eventType crudv1.EventType) string {
+	switch eventType {
+	case crudv1.EventType_EVENT_TYPE_CREATED:
+		return "created"
+	case crudv1.EventType_EVENT_TYPE_UPDATED:
+		return "updated"
+	case crudv1.EventType_EVENT_TYPE_DELETED:
+		return "deleted"
+	case crudv1.EventType_EVENT_TYPE_RESTORED:
+		return "restored"
+	case crudv1.EventType_EVENT_TYPE_REACTION_ADDED:
+		return "reaction_added"
+	case crudv1.EventType_EVENT_TYPE_REACTION_REMOVED:
+		return "reaction_removed"
+	}
+	return "unknown"
+}
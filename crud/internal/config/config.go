@@ -7,12 +7,16 @@ import (
 )
 
 type Config struct {
-	Env       string `yaml:"env" env:"ENV" env-default:"local"`
-	AppSecret string `yaml:"app_secret" env:"APP_SECRET" env-required:"true"`
+	Env string `yaml:"env" env:"ENV" env-default:"local"`
+	// LegacyHS256 accepts HMAC tokens issued before SSO signed with asymmetric keys, verified with
+	// AppSecrets by app id. Off by default, tokens signed by SSO are verified with its JWKS.
+	LegacyHS256 bool             `yaml:"legacy_hs256" env:"LEGACY_HS256"`
+	AppSecrets  map[int64]string `yaml:"app_secrets"`
 
-	Storage struct {
-		Path string `yaml:"path" env:"STORAGE_PATH" env-required:"true"`
-	} `yaml:"storage"`
+	Storage Storage `yaml:"storage"`
+	Purge   Purge   `yaml:"purge"`
+
+	Attachments Attachments `yaml:"attachments"`
 
 	GRPC struct {
 		Server struct {
@@ -27,9 +31,43 @@ type Config struct {
 			Timeout      time.Duration `yaml:"timeout" env:"CRUD_TIMEOUT"`
 			RetriesCount int           `yaml:"retries_count" env:"CRUD_RETRIES_COUNT"`
 		} `yaml:"crud"`
+		SSO struct {
+			Addr         string        `yaml:"addr" env:"SSO_ADDR"`
+			Timeout      time.Duration `yaml:"timeout" env:"SSO_TIMEOUT"`
+			RetriesCount int           `yaml:"retries_count" env:"SSO_RETRIES_COUNT"`
+			// ServiceToken is sent to SSO in the x-service-token metadata, it is one of the tokens SSO accepts
+			ServiceToken string `yaml:"service_token" env:"SSO_SERVICE_TOKEN"`
+			// RevocationCacheTTL is how long an answer about a logged out token is reused
+			RevocationCacheTTL time.Duration `yaml:"revocation_cache_ttl" env:"SSO_REVOCATION_CACHE_TTL" env-default:"30s"`
+			// RestrictionCacheTTL is how long the bans and mutes of a user are reused, a new one applies within it
+			RestrictionCacheTTL time.Duration `yaml:"restriction_cache_ttl" env:"SSO_RESTRICTION_CACHE_TTL" env-default:"30s"`
+			// JWKSCacheTTL is how long the public keys of SSO are used before they are fetched again
+			JWKSCacheTTL time.Duration `yaml:"jwks_cache_ttl" env:"SSO_JWKS_CACHE_TTL" env-default:"1h"`
+		} `yaml:"sso"`
 	} `yaml:"clients"`
 }
 
+// Storage selects the message storage backend: "sqlite" uses Path, "postgres" uses DSN.
+type Storage struct {
+	Type     string `yaml:"type" env:"STORAGE_TYPE" env-default:"sqlite"`
+	Path     string `yaml:"path" env:"STORAGE_PATH"`
+	DSN      string `yaml:"dsn" env:"STORAGE_DSN"`
+	MaxConns int32  `yaml:"max_conns" env:"STORAGE_MAX_CONNS" env-default:"10"`
+}
+
+// Purge controls how long deleted messages are kept before they are removed for good.
+type Purge struct {
+	Retention time.Duration `yaml:"retention" env:"PURGE_RETENTION" env-default:"720h"`
+	Interval  time.Duration `yaml:"interval" env:"PURGE_INTERVAL" env-default:"1h"`
+}
+
+// Attachments selects where uploaded files are kept, "local" stores them as files under Path.
+type Attachments struct {
+	Store   string `yaml:"store" env:"ATTACHMENTS_STORE" env-default:"local"`
+	Path    string `yaml:"path" env:"ATTACHMENTS_PATH" env-default:"./crud/storage/attachments"`
+	MaxSize int64  `yaml:"max_size" env:"ATTACHMENTS_MAX_SIZE" env-default:"20971520"`
+}
+
 func MustLoad() *Config {
 	configPath := os.Getenv("CONFIG_PATH_FOR_CRUD")
 	if configPath == "" {
@@ -0,0 +1,19 @@
+package models
+
+// Attachment is an uploaded file, its bytes live in the blob store under BlobKey.
+type Attachment struct {
+	ID       int64
+	UserID   int64
+	RoomID   int64
+	FileName string
+	// MimeType is sniffed from the content, the name and the client are not trusted
+	MimeType  string
+	Size      int64
+	SHA256    string
+	BlobKey   string
+	CreatedAt string
+	// Width, Height and ThumbnailID are filled by the thumbnail worker for images posted in image messages
+	Width       int32
+	Height      int32
+	ThumbnailID int64
+}
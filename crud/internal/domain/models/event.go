@@ -0,0 +1,20 @@
+package models
+
+type EventType int32
+
+const (
+	EventCreated EventType = iota + 1
+	EventUpdated
+	EventDeleted
+	EventRestored
+	EventReactionAdded
+	EventReactionRemoved
+)
+
+type Event struct {
+	Type    EventType
+	Message Message
+	// ActorID and Emoji tell who changed which reaction, reaction events only
+	ActorID int64
+	Emoji   string
+}
@@ -1,9 +1,39 @@
 package models
 
+// Message types, stored as the id of the types table
+const (
+	TypeText  int32 = 1
+	TypeImage int32 = 2
+	TypeFile  int32 = 3
+)
+
 type Message struct {
 	ID       int64
 	Content  string
 	UserID   int64
+	RoomID   int64
 	Type     string
 	DateTime string
+	// EditedAt is empty until the first edit
+	EditedAt      string
+	RevisionCount int32
+	// DeletedAt is set on tombstones, the content stays in storage until the purge
+	DeletedAt string
+	DeletedBy int64
+	ParentID  int64
+	// ThreadRootID is 0 for messages of the main timeline
+	ThreadRootID int64
+	// ReplyCount and LastReplyAt are only filled for thread roots in a timeline page
+	ReplyCount  int32
+	LastReplyAt string
+	Reactions   []Reaction
+	// AttachmentID is set on image and file messages, Attachment holds its metadata
+	AttachmentID int64
+	Attachment   *Attachment
+}
+
+// Reply places a new message in a thread, the zero value posts to the main timeline.
+type Reply struct {
+	ParentID     int64
+	ThreadRootID int64
 }
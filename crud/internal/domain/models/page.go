@@ -0,0 +1,20 @@
+package models
+
+// Page selects a window of messages by id. BeforeID and AfterID are exclusive
+// cursors, at most one of them is set; with neither the newest messages are returned.
+type Page struct {
+	Limit    int
+	BeforeID int64
+	AfterID  int64
+}
+
+type MessagePage struct {
+	Messages   []Message
+	NextCursor int64
+}
+
+// Thread is the root message of a thread with a page of its replies.
+type Thread struct {
+	Root    Message
+	Replies MessagePage
+}
@@ -0,0 +1,8 @@
+package models
+
+// Permissions checked with SSO, the names are the ones SSO grants to roles.
+const (
+	PermissionMessageEditAny   = "message.edit.any"
+	PermissionMessageDeleteAny = "message.delete.any"
+	PermissionMessageRestore   = "message.restore"
+)
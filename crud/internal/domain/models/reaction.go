@@ -0,0 +1,9 @@
+package models
+
+// Reaction is how many users reacted to a message with Emoji.
+// ReactedByMe is relative to the user the message was read for.
+type Reaction struct {
+	Emoji       string
+	Count       int32
+	ReactedByMe bool
+}
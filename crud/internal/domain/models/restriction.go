@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// Restriction is a ban, or a mute in RoomID. Until is zero for a ban that does not expire.
+type Restriction struct {
+	RoomID int64
+	Reason string
+	Until  time.Time
+}
+
+// Active reports whether the restriction is still in force at now.
+func (r Restriction) Active(now time.Time) bool {
+	return r.Until.IsZero() || now.Before(r.Until)
+}
+
+// Restrictions are the bans and mutes of a user, they are kept by the SSO service.
+type Restrictions struct {
+	// Ban is nil unless the user is banned from every room
+	Ban   *Restriction
+	Mutes []Restriction
+}
+
+// Banned returns the ban of the user if it is in force at now.
+func (r Restrictions) Banned(now time.Time) (Restriction, bool) {
+	if r.Ban == nil || !r.Ban.Active(now) {
+		return Restriction{}, false
+	}
+	return *r.Ban, true
+}
+
+// Muted returns the mute of the user in the room if it is in force at now.
+func (r Restrictions) Muted(roomID int64, now time.Time) (Restriction, bool) {
+	for _, mute := range r.Mutes {
+		if mute.RoomID == roomID && mute.Active(now) {
+			return mute, true
+		}
+	}
+	return Restriction{}, false
+}
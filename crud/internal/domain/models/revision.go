@@ -0,0 +1,10 @@
+package models
+
+// Revision is a replaced version of a message: Content is what EditorID overwrote at EditedAt.
+type Revision struct {
+	ID        int64
+	MessageID int64
+	Content   string
+	EditorID  int64
+	EditedAt  string
+}
@@ -0,0 +1,12 @@
+package models
+
+type Room struct {
+	ID        int64
+	Name      string
+	OwnerID   int64
+	CreatedAt string
+	// Public rooms can be joined by anyone, private ones only with an invite
+	Public    bool
+	IsMember  bool
+	IsInvited bool
+}
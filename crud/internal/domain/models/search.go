@@ -0,0 +1,28 @@
+package models
+
+// Markers around the matched words of a SearchHit snippet
+const (
+	HighlightStart = "<mark>"
+	HighlightEnd   = "</mark>"
+)
+
+// SearchFilter narrows a full-text search, zero fields match anything.
+type SearchFilter struct {
+	Query    string
+	RoomID   int64
+	AuthorID int64
+	Type     int32
+	// DateFrom is inclusive and DateTo is exclusive, both are compared with the message datetime as strings
+	DateFrom string
+	DateTo   string
+}
+
+type SearchHit struct {
+	Message Message
+	Snippet string
+}
+
+type SearchPage struct {
+	Hits       []SearchHit
+	NextCursor int64
+}
@@ -2,7 +2,9 @@ package crud
 
 import (
 	"ChatService/crud/internal/domain/models"
-	jwtVal "ChatService/crud/internal/lib/jwt"
+	"ChatService/crud/internal/lib/auth"
+	"ChatService/crud/internal/lib/validator"
+	crudService "ChatService/crud/internal/services/crud"
 	"ChatService/crud/internal/storage"
 	crudv1 "ChatService/protos/gen/go/crud"
 	"context"
@@ -10,113 +12,816 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"io"
+	"time"
 )
 
 type CRUD interface {
-	GetMessage(ctx context.Context, mid int64) (models.Message, error)
-	UpdateMessage(ctx context.Context, mid int64, newContent string) (bool, error)
-	SentMessage(ctx context.Context, uid int64, content string, typeOf int32, datetime string) (int64, error)
-	DeleteMessage(ctx context.Context, uid int64) (bool, error)
-	ShowAllMessages(ctx context.Context, uid int64) ([]models.Message, error)
+	GetMessage(ctx context.Context, uid int64, mid int64) (models.Message, error)
+	UpdateMessage(ctx context.Context, uid int64, mid int64, newContent string) (bool, error)
+	SentMessage(ctx context.Context, uid int64, roomID int64, parentID int64, content string, typeOf int32, attachmentID int64, datetime string) (int64, error)
+	DeleteMessage(ctx context.Context, uid int64, mid int64) (bool, error)
+	GetMessageHistory(ctx context.Context, uid int64, mid int64) ([]models.Revision, error)
+	RestoreMessage(ctx context.Context, uid int64, mid int64) (bool, error)
+	GetThread(ctx context.Context, uid int64, mid int64, page models.Page) (models.Thread, error)
+	AddReaction(ctx context.Context, uid int64, mid int64, emoji string) (bool, error)
+	RemoveReaction(ctx context.Context, uid int64, mid int64, emoji string) (bool, error)
+	ShowAllMessages(ctx context.Context, uid int64, roomID int64, page models.Page) (models.MessagePage, error)
+	SearchMessages(ctx context.Context, uid int64, filter models.SearchFilter, page models.Page) (models.SearchPage, error)
+	CreateRoom(ctx context.Context, uid int64, name string, public bool) (int64, error)
+	JoinRoom(ctx context.Context, uid int64, roomID int64) (bool, error)
+	InviteToRoom(ctx context.Context, uid int64, roomID int64, inviteeID int64) (bool, error)
+	LeaveRoom(ctx context.Context, uid int64, roomID int64) (bool, error)
+	ListRooms(ctx context.Context, uid int64) ([]models.Room, error)
+	Subscribe(ctx context.Context, uid int64, roomID int64) (<-chan models.Event, func(), error)
+	CheckSubscriber(ctx context.Context, uid int64, roomID int64) error
+	UploadAttachment(ctx context.Context, uid int64, roomID int64, fileName string, r io.Reader) (models.Attachment, error)
+	OpenAttachment(ctx context.Context, uid int64, id int64) (models.Attachment, io.ReadCloser, error)
 }
 
+// subscriberCheckInterval is how often an open Subscribe stream checks the caller again,
+// a ban ends it within this and the restriction cache TTL of the SSO client.
+const subscriberCheckInterval = 15 * time.Second
+
+// downloadChunkSize is the size of the chunks DownloadAttachment streams, well below the default 4MB message limit
+const downloadChunkSize = 64 << 10
+
 type serverCRUD struct {
 	crudv1.UnimplementedMessageServer
-	crud   CRUD
-	Secret string
+	crud CRUD
+	auth *auth.Authenticator
 }
 
-func RegisterServer(gRPCServer *grpc.Server, crud CRUD, secret string) {
-	crudv1.RegisterMessageServer(gRPCServer, &serverCRUD{crud: crud, Secret: secret})
+func RegisterServer(gRPCServer *grpc.Server, crud CRUD, authenticator *auth.Authenticator) {
+	crudv1.RegisterMessageServer(gRPCServer, &serverCRUD{crud: crud, auth: authenticator})
+}
+
+// userID returns the caller authenticated by the interceptor from the authorization metadata.
+// The token field of the request is only checked for clients that do not send the header yet.
+func (s *serverCRUD) userID(ctx context.Context, token string) (int64, error) {
+	if identity, ok := auth.FromContext(ctx); ok {
+		return identity.UserID, nil
+	}
+	if token == "" {
+		return 0, status.Error(codes.Unauthenticated, "authorization metadata required")
+	}
+
+	identity, err := s.auth.Authenticate(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+	return identity.UserID, nil
 }
 
 func (s *serverCRUD) SentMessage(ctx context.Context, req *crudv1.SentMessageRequest) (*crudv1.SentMessageResponse, error) {
-	TokenResponse := jwtVal.ValidateToken(req.GetToken(), s.Secret)
-	if TokenResponse.Error != nil {
-		return nil, status.Error(codes.Unauthenticated, "failed in decoding token "+TokenResponse.Error.Error())
+	if err := validator.SentMessageValid(req); err != nil {
+		return nil, err
 	}
 
-	id, err := s.crud.SentMessage(ctx, TokenResponse.UserID, req.GetContent(), req.GetType(), req.GetDatetime())
+	uid, err := s.userID(ctx, req.GetToken())
 	if err != nil {
-		return nil, status.Error(codes.Unauthenticated, "failed to create message")
+		return nil, err
+	}
+
+	id, err := s.crud.SentMessage(ctx, uid, req.GetRoomId(), req.GetParentId(), req.GetContent(), req.GetType(), req.GetAttachmentId(), req.GetDatetime())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrMessageNotExist) {
+			return nil, status.Error(codes.NotFound, "reply target not found")
+		}
+		if errors.Is(err, storage.ErrMessageDeleted) {
+			return nil, status.Error(codes.FailedPrecondition, "can not reply to a deleted message")
+		}
+		if errors.Is(err, crudService.ErrReplyOtherRoom) {
+			return nil, status.Error(codes.InvalidArgument, "reply target is in another room")
+		}
+		if errors.Is(err, storage.ErrAttachmentNotExist) {
+			return nil, status.Error(codes.NotFound, "attachment not found")
+		}
+		if errors.Is(err, crudService.ErrAttachmentNotAllowed) {
+			return nil, status.Error(codes.PermissionDenied, "attachment was uploaded by another user or to another room")
+		}
+		if errors.Is(err, crudService.ErrAttachmentNotImage) {
+			return nil, status.Error(codes.InvalidArgument, "image messages need an image attachment")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to create message")
 	}
 	return &crudv1.SentMessageResponse{Mid: id}, nil
 }
 
 func (s *serverCRUD) DeleteMessage(ctx context.Context, req *crudv1.DeleteMessageRequest) (*crudv1.DeleteMessageResponse, error) {
-	TokenResponse := jwtVal.ValidateToken(req.GetToken(), s.Secret)
-	if TokenResponse.Error != nil {
-		return nil, status.Error(codes.Unauthenticated, "failed in decoding token")
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
 	}
 
-	answer, err := s.crud.DeleteMessage(ctx, req.GetMid())
+	answer, err := s.crud.DeleteMessage(ctx, uid, req.GetMid())
 	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
 		if errors.Is(err, storage.ErrMessageNotExist) {
-			return nil, status.Error(codes.PermissionDenied, "message not found")
+			return nil, status.Error(codes.NotFound, "message not found")
+		}
+		if errors.Is(err, crudService.ErrNotMessageOwner) {
+			return nil, status.Error(codes.PermissionDenied, "only the author or a moderator can delete the message")
+		}
+		if errors.Is(err, storage.ErrMessageDeleted) {
+			return nil, status.Error(codes.FailedPrecondition, "message is already deleted")
 		}
-		return nil, status.Error(codes.Unauthenticated, "failed to delete message")
+		return nil, status.Error(codes.Internal, "failed to delete message")
 	}
 	return &crudv1.DeleteMessageResponse{Status: answer}, nil
 }
 
 func (s *serverCRUD) GetMessage(ctx context.Context, req *crudv1.GetMessageRequest) (*crudv1.GetMessageResponse, error) {
-	TokenResponse := jwtVal.ValidateToken(req.GetToken(), s.Secret)
-	if TokenResponse.Error != nil {
-		return nil, status.Error(codes.Unauthenticated, "failed in decoding token")
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
 	}
 
-	message, err := s.crud.GetMessage(ctx, req.GetMid())
+	message, err := s.crud.GetMessage(ctx, uid, req.GetMid())
 	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
 		if errors.Is(err, storage.ErrMessageNotExist) {
-			return nil, status.Error(codes.PermissionDenied, "message not found")
+			return nil, status.Error(codes.NotFound, "message not found")
 		}
-		return nil, status.Error(codes.Unauthenticated, "failed to get message")
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to get message")
 	}
-	return &crudv1.GetMessageResponse{Id: message.ID, Content: message.Content, Type: message.Type, Uid: message.UserID}, nil
+	return messageToPB(message), nil
 }
 
 func (s *serverCRUD) UpdateMessage(ctx context.Context, req *crudv1.UpdateMessageRequest) (*crudv1.UpdateMessageResponse, error) {
-	TokenResponse := jwtVal.ValidateToken(req.GetToken(), s.Secret)
-	if TokenResponse.Error != nil {
-		return nil, status.Error(codes.Unauthenticated, "failed in decoding token")
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
 	}
 
-	answer, err := s.crud.UpdateMessage(ctx, req.GetMid(), req.GetNewContent())
+	answer, err := s.crud.UpdateMessage(ctx, uid, req.GetMid(), req.GetNewContent())
 	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
 		if errors.Is(err, storage.ErrMessageNotExist) {
-			return nil, status.Error(codes.PermissionDenied, "message not found")
+			return nil, status.Error(codes.NotFound, "message not found")
+		}
+		if errors.Is(err, crudService.ErrNotMessageOwner) {
+			return nil, status.Error(codes.PermissionDenied, "only the author or a moderator can edit the message")
 		}
-		return nil, status.Error(codes.Unauthenticated, "failed to update message")
+		if errors.Is(err, storage.ErrMessageDeleted) {
+			return nil, status.Error(codes.FailedPrecondition, "deleted messages can not be edited")
+		}
+		return nil, status.Error(codes.Internal, "failed to update message")
 	}
 	return &crudv1.UpdateMessageResponse{Status: answer}, nil
 }
 
+func (s *serverCRUD) RestoreMessage(ctx context.Context, req *crudv1.RestoreMessageRequest) (*crudv1.RestoreMessageResponse, error) {
+	if err := validator.RestoreMessageValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.crud.RestoreMessage(ctx, uid, req.GetMid())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, crudService.ErrPermissionDenied) {
+			return nil, status.Error(codes.PermissionDenied, "not allowed to restore messages")
+		}
+		if errors.Is(err, storage.ErrMessageNotExist) {
+			return nil, status.Error(codes.NotFound, "message not found")
+		}
+		if errors.Is(err, storage.ErrMessageNotDeleted) {
+			return nil, status.Error(codes.FailedPrecondition, "message is not deleted")
+		}
+		return nil, status.Error(codes.Internal, "failed to restore message")
+	}
+	return &crudv1.RestoreMessageResponse{Status: answer}, nil
+}
+
+func (s *serverCRUD) AddReaction(ctx context.Context, req *crudv1.AddReactionRequest) (*crudv1.AddReactionResponse, error) {
+	if err := validator.AddReactionValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.crud.AddReaction(ctx, uid, req.GetMid(), req.GetEmoji())
+	if err != nil {
+		return nil, reactionError(err, "failed to add reaction")
+	}
+	return &crudv1.AddReactionResponse{Status: answer}, nil
+}
+
+func (s *serverCRUD) RemoveReaction(ctx context.Context, req *crudv1.RemoveReactionRequest) (*crudv1.RemoveReactionResponse, error) {
+	if err := validator.RemoveReactionValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.crud.RemoveReaction(ctx, uid, req.GetMid(), req.GetEmoji())
+	if err != nil {
+		return nil, reactionError(err, "failed to remove reaction")
+	}
+	return &crudv1.RemoveReactionResponse{Status: answer}, nil
+}
+
+func reactionError(err error, msg string) error {
+	if st := restrictedError(err); st != nil {
+		return st
+	}
+	if errors.Is(err, storage.ErrMessageNotExist) {
+		return status.Error(codes.NotFound, "message not found")
+	}
+	if errors.Is(err, storage.ErrNotRoomMember) {
+		return status.Error(codes.PermissionDenied, "not a member of the room")
+	}
+	if errors.Is(err, storage.ErrMessageDeleted) {
+		return status.Error(codes.FailedPrecondition, "deleted messages can not be reacted to")
+	}
+	return status.Error(codes.Internal, msg)
+}
+
+func (s *serverCRUD) GetThread(ctx context.Context, req *crudv1.GetThreadRequest) (*crudv1.GetThreadResponse, error) {
+	if err := validator.GetThreadValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	thread, err := s.crud.GetThread(ctx, uid, req.GetMid(), models.Page{
+		Limit:   int(req.GetLimit()),
+		AfterID: req.GetAfterId(),
+	})
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrMessageNotExist) {
+			return nil, status.Error(codes.NotFound, "message not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to get thread")
+	}
+
+	response := &crudv1.GetThreadResponse{
+		Root:       messageToPB(thread.Root),
+		NextCursor: thread.Replies.NextCursor,
+	}
+	for _, reply := range thread.Replies.Messages {
+		response.Reply = append(response.Reply, messageToPB(reply))
+	}
+	return response, nil
+}
+
+func (s *serverCRUD) GetMessageHistory(ctx context.Context, req *crudv1.GetMessageHistoryRequest) (*crudv1.GetMessageHistoryResponse, error) {
+	if err := validator.GetMessageHistoryValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := s.crud.GetMessageHistory(ctx, uid, req.GetMid())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrMessageNotExist) {
+			return nil, status.Error(codes.NotFound, "message not found")
+		}
+		if errors.Is(err, storage.ErrMessageDeleted) {
+			return nil, status.Error(codes.NotFound, "message was deleted")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to get message history")
+	}
+
+	response := &crudv1.GetMessageHistoryResponse{}
+	for _, revision := range revisions {
+		response.Revision = append(response.Revision, &crudv1.MessageRevision{
+			Id:        revision.ID,
+			Content:   revision.Content,
+			EditorUid: revision.EditorID,
+			EditedAt:  revision.EditedAt,
+		})
+	}
+	return response, nil
+}
+
 func (s *serverCRUD) ShowMessages(ctx context.Context, req *crudv1.ShowMessagesRequest) (*crudv1.ShowMessagesResponse, error) {
-	tokenResponse := jwtVal.ValidateToken(req.GetToken(), s.Secret)
-	if tokenResponse.Error != nil {
-		return nil, status.Error(codes.Unauthenticated, "invalid authentication token")
+	if err := validator.ShowMessagesValid(req); err != nil {
+		return nil, err
 	}
 
-	messages, err := s.crud.ShowAllMessages(ctx, tokenResponse.UserID)
+	uid, err := s.userID(ctx, req.GetToken())
 	if err != nil {
+		return nil, err
+	}
+
+	page, err := s.crud.ShowAllMessages(ctx, uid, req.GetRoomId(), models.Page{
+		Limit:    int(req.GetLimit()),
+		BeforeID: req.GetBeforeId(),
+		AfterID:  req.GetAfterId(),
+	})
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
 		if errors.Is(err, storage.ErrNoMessagesFound) {
 			return &crudv1.ShowMessagesResponse{}, nil
 		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
 		return nil, status.Error(codes.Internal, "failed to retrieve messages")
 	}
 
 	var pbMessages []*crudv1.GetMessageResponse
-	for _, msg := range messages {
-		pbMessages = append(pbMessages, &crudv1.GetMessageResponse{
-			Id:       msg.ID,
-			Content:  msg.Content,
-			Uid:      msg.UserID,
-			Type:     msg.Type,
-			Datetime: msg.DateTime,
-		})
+	for _, msg := range page.Messages {
+		pbMessages = append(pbMessages, messageToPB(msg))
 	}
 
 	return &crudv1.ShowMessagesResponse{
-		Message: pbMessages,
+		Message:    pbMessages,
+		NextCursor: page.NextCursor,
+	}, nil
+}
+
+func (s *serverCRUD) SearchMessages(ctx context.Context, req *crudv1.SearchMessagesRequest) (*crudv1.SearchMessagesResponse, error) {
+	if err := validator.SearchMessagesValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	filter := models.SearchFilter{
+		Query:    req.GetQuery(),
+		RoomID:   req.GetRoomId(),
+		AuthorID: req.GetAuthorUid(),
+		Type:     req.GetType(),
+		DateFrom: req.GetDateFrom(),
+		DateTo:   req.GetDateTo(),
+	}
+	page, err := s.crud.SearchMessages(ctx, uid, filter, models.Page{
+		Limit:    int(req.GetLimit()),
+		BeforeID: req.GetBeforeId(),
+	})
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to search messages")
+	}
+
+	var hits []*crudv1.SearchHit
+	for _, hit := range page.Hits {
+		hits = append(hits, &crudv1.SearchHit{
+			Message: messageToPB(hit.Message),
+			Snippet: hit.Snippet,
+		})
+	}
+
+	return &crudv1.SearchMessagesResponse{
+		Hit:        hits,
+		NextCursor: page.NextCursor,
+	}, nil
+}
+
+func (s *serverCRUD) UploadAttachment(stream crudv1.Message_UploadAttachmentServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "upload info required")
+	}
+	if err := validator.UploadAttachmentValid(first); err != nil {
+		return err
+	}
+	info := first.GetInfo()
+
+	uid, err := s.userID(stream.Context(), info.GetToken())
+	if err != nil {
+		return err
+	}
+
+	attachment, err := s.crud.UploadAttachment(stream.Context(), uid, info.GetRoomId(), info.GetFileName(), &chunkReader{stream: stream})
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return st
+		}
+		if errors.Is(err, errInfoResent) {
+			return status.Error(codes.InvalidArgument, "upload info must only be sent once")
+		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		if errors.Is(err, crudService.ErrAttachmentTooLarge) {
+			return status.Error(codes.ResourceExhausted, "attachment is too large")
+		}
+		return status.Error(codes.Internal, "failed to upload attachment")
+	}
+	return stream.SendAndClose(&crudv1.UploadAttachmentResponse{Attachment: attachmentToPB(&attachment)})
+}
+
+func (s *serverCRUD) DownloadAttachment(req *crudv1.DownloadAttachmentRequest, stream crudv1.Message_DownloadAttachmentServer) error {
+	if err := validator.DownloadAttachmentValid(req); err != nil {
+		return err
+	}
+
+	uid, err := s.userID(stream.Context(), req.GetToken())
+	if err != nil {
+		return err
+	}
+
+	attachment, content, err := s.crud.OpenAttachment(stream.Context(), uid, req.GetId())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return st
+		}
+		if errors.Is(err, storage.ErrAttachmentNotExist) {
+			return status.Error(codes.NotFound, "attachment not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return status.Error(codes.Internal, "failed to download attachment")
+	}
+	defer content.Close()
+
+	if err := stream.Send(&crudv1.DownloadAttachmentResponse{
+		Data: &crudv1.DownloadAttachmentResponse_Info{Info: attachmentToPB(&attachment)},
+	}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&crudv1.DownloadAttachmentResponse{
+				Data: &crudv1.DownloadAttachmentResponse_Chunk{Chunk: buf[:n]},
+			}); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "failed to read attachment")
+		}
+	}
+}
+
+var errInfoResent = errors.New("upload info sent twice")
+
+// chunkReader reads the chunks of an upload stream as one continuous body
+type chunkReader struct {
+	stream crudv1.Message_UploadAttachmentServer
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		req, err := c.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if req.GetInfo() != nil {
+			return 0, errInfoResent
+		}
+		c.buf = req.GetChunk()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (s *serverCRUD) CreateRoom(ctx context.Context, req *crudv1.CreateRoomRequest) (*crudv1.CreateRoomResponse, error) {
+	if err := validator.CreateRoomValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := s.crud.CreateRoom(ctx, uid, req.GetName(), req.GetPublic())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrRoomExist) {
+			return nil, status.Error(codes.AlreadyExists, "room already exists")
+		}
+		return nil, status.Error(codes.Internal, "failed to create room")
+	}
+	return &crudv1.CreateRoomResponse{RoomId: id}, nil
+}
+
+func (s *serverCRUD) JoinRoom(ctx context.Context, req *crudv1.JoinRoomRequest) (*crudv1.JoinRoomResponse, error) {
+	if err := validator.JoinRoomValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.crud.JoinRoom(ctx, uid, req.GetRoomId())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrNotInvited) {
+			return nil, status.Error(codes.PermissionDenied, "the room is private, an invite is required")
+		}
+		return nil, status.Error(codes.Internal, "failed to join room")
+	}
+	return &crudv1.JoinRoomResponse{Status: answer}, nil
+}
+
+func (s *serverCRUD) InviteToRoom(ctx context.Context, req *crudv1.InviteToRoomRequest) (*crudv1.InviteToRoomResponse, error) {
+	if err := validator.InviteToRoomValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.crud.InviteToRoom(ctx, uid, req.GetRoomId(), req.GetUserId())
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.PermissionDenied, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to invite to room")
+	}
+	return &crudv1.InviteToRoomResponse{Status: answer}, nil
+}
+
+func (s *serverCRUD) LeaveRoom(ctx context.Context, req *crudv1.LeaveRoomRequest) (*crudv1.LeaveRoomResponse, error) {
+	if err := validator.LeaveRoomValid(req); err != nil {
+		return nil, err
+	}
+
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.crud.LeaveRoom(ctx, uid, req.GetRoomId())
+	if err != nil {
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return nil, status.Error(codes.NotFound, "room not found")
+		}
+		if errors.Is(err, storage.ErrNotRoomMember) {
+			return nil, status.Error(codes.FailedPrecondition, "not a member of the room")
+		}
+		return nil, status.Error(codes.Internal, "failed to leave room")
+	}
+	return &crudv1.LeaveRoomResponse{Status: answer}, nil
+}
+
+func (s *serverCRUD) ListRooms(ctx context.Context, req *crudv1.ListRoomsRequest) (*crudv1.ListRoomsResponse, error) {
+	uid, err := s.userID(ctx, req.GetToken())
+	if err != nil {
+		return nil, err
+	}
+
+	rooms, err := s.crud.ListRooms(ctx, uid)
+	if err != nil {
+		if st := restrictedError(err); st != nil {
+			return nil, st
+		}
+		return nil, status.Error(codes.Internal, "failed to retrieve rooms")
+	}
+
+	var pbRooms []*crudv1.Room
+	for _, room := range rooms {
+		pbRooms = append(pbRooms, &crudv1.Room{
+			Id:        room.ID,
+			Name:      room.Name,
+			OwnerUid:  room.OwnerID,
+			CreatedAt: room.CreatedAt,
+			IsMember:  room.IsMember,
+			Public:    room.Public,
+			IsInvited: room.IsInvited,
+		})
+	}
+
+	return &crudv1.ListRoomsResponse{
+		Room: pbRooms,
 	}, nil
 }
+
+func (s *serverCRUD) Subscribe(req *crudv1.SubscribeRequest, stream crudv1.Message_SubscribeServer) error {
+	if err := validator.SubscribeValid(req); err != nil {
+		return err
+	}
+
+	uid, err := s.userID(stream.Context(), req.GetToken())
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	events, cancel, err := s.crud.Subscribe(ctx, uid, req.GetRoomId())
+	if err != nil {
+		if st := subscriberError(err); st != nil {
+			return st
+		}
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			return status.Error(codes.NotFound, "room not found")
+		}
+		return status.Error(codes.Internal, "failed to subscribe")
+	}
+	defer cancel()
+
+	ticker := time.NewTicker(subscriberCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// Only a refusal ends the stream, a failed check is tried again on the next tick
+			if st := subscriberError(s.crud.CheckSubscriber(ctx, uid, req.GetRoomId())); st != nil {
+				return st
+			}
+		case event, ok := <-events:
+			if !ok {
+				// The hub drops slow subscribers and those who left the room, only the first may resubscribe
+				if st := subscriberError(s.crud.CheckSubscriber(ctx, uid, req.GetRoomId())); st != nil {
+					return st
+				}
+				return status.Error(codes.Unavailable, "subscription closed, resubscribe to continue")
+			}
+			if err := stream.Send(&crudv1.MessageEvent{
+				Type:     eventTypeToPB(event.Type),
+				Message:  messageToPB(event.Message),
+				ActorUid: event.ActorID,
+				Emoji:    event.Emoji,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// subscriberError is the status of a subscription refused by a ban or because the caller
+// is not a member of the room, nil for other errors.
+func subscriberError(err error) error {
+	if st := restrictedError(err); st != nil {
+		return st
+	}
+	if errors.Is(err, storage.ErrNotRoomMember) {
+		return status.Error(codes.PermissionDenied, "not a member of the room")
+	}
+	return nil
+}
+
+// restrictedError is the status of a call refused by a ban or a mute, nil for other errors.
+// The message tells the user until when and why.
+func restrictedError(err error) error {
+	var restricted *crudService.RestrictedError
+	if errors.As(err, &restricted) {
+		return status.Error(codes.PermissionDenied, restricted.Error())
+	}
+	return nil
+}
+
+func messageToPB(msg models.Message) *crudv1.GetMessageResponse {
+	resp := &crudv1.GetMessageResponse{
+		Id:            msg.ID,
+		Content:       msg.Content,
+		Uid:           msg.UserID,
+		Type:          msg.Type,
+		Datetime:      msg.DateTime,
+		RoomId:        msg.RoomID,
+		EditedAt:      msg.EditedAt,
+		RevisionCount: msg.RevisionCount,
+		DeletedAt:     msg.DeletedAt,
+		DeletedBy:     msg.DeletedBy,
+		ParentId:      msg.ParentID,
+		ThreadRootId:  msg.ThreadRootID,
+		ReplyCount:    msg.ReplyCount,
+		LastReplyAt:   msg.LastReplyAt,
+		Reaction:      reactionsToPB(msg.Reactions),
+		Attachment:    attachmentToPB(msg.Attachment),
+	}
+	if msg.Attachment != nil {
+		resp.Width = msg.Attachment.Width
+		resp.Height = msg.Attachment.Height
+		resp.ThumbnailId = msg.Attachment.ThumbnailID
+	}
+	return resp
+}
+
+func attachmentToPB(attachment *models.Attachment) *crudv1.Attachment {
+	if attachment == nil {
+		return nil
+	}
+	return &crudv1.Attachment{
+		Id:        attachment.ID,
+		Uid:       attachment.UserID,
+		RoomId:    attachment.RoomID,
+		FileName:  attachment.FileName,
+		MimeType:  attachment.MimeType,
+		Size:      attachment.Size,
+		Sha256:    attachment.SHA256,
+		CreatedAt: attachment.CreatedAt,
+	}
+}
+
+func reactionsToPB(reactions []models.Reaction) []*crudv1.Reaction {
+	answer := make([]*crudv1.Reaction, 0, len(reactions))
+	for _, reaction := range reactions {
+		answer = append(answer, &crudv1.Reaction{
+			Emoji:       reaction.Emoji,
+			Count:       reaction.Count,
+			ReactedByMe: reaction.ReactedByMe,
+		})
+	}
+	return answer
+}
+
+func eventTypeToPB(eventType models.EventType) crudv1.EventType {
+	switch eventType {
+	case models.EventCreated:
+		return crudv1.EventType_EVENT_TYPE_CREATED
+	case models.EventUpdated:
+		return crudv1.EventType_EVENT_TYPE_UPDATED
+	case models.EventDeleted:
+		return crudv1.EventType_EVENT_TYPE_DELETED
+	case models.EventRestored:
+		return crudv1.EventType_EVENT_TYPE_RESTORED
+	case models.EventReactionAdded:
+		return crudv1.EventType_EVENT_TYPE_REACTION_ADDED
+	case models.EventReactionRemoved:
+		return crudv1.EventType_EVENT_TYPE_REACTION_REMOVED
+	}
+	return crudv1.EventType_EVENT_TYPE_UNSPECIFIED
+}
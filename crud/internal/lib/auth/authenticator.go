@@ -0,0 +1,42 @@
+package auth
+
+import (
+	jwtVal "ChatService/crud/internal/lib/jwt"
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RevocationChecker answers whether a token was ended by Logout or a password reset, it is backed by the SSO service.
+type RevocationChecker interface {
+	IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error)
+}
+
+// Authenticator turns an access token into the identity of the caller.
+type Authenticator struct {
+	Keys        jwtVal.KeyResolver
+	Revocations RevocationChecker
+}
+
+// Authenticate validates the token and makes sure it was not revoked. Errors are gRPC statuses.
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	tokenResponse := jwtVal.ValidateToken(ctx, token, a.Keys)
+	if tokenResponse.Error != nil {
+		return Identity{}, status.Error(codes.Unauthenticated, "invalid authentication token")
+	}
+
+	// Tokens without jti predate revocation and simply live until exp
+	if tokenResponse.ID != "" && a.Revocations != nil {
+		revoked, err := a.Revocations.IsTokenRevoked(ctx, tokenResponse.ID, tokenResponse.UserID, tokenResponse.IssuedAt)
+		if err != nil {
+			// Failing closed: a logged out token must not work just because SSO is unreachable
+			return Identity{}, status.Error(codes.Unavailable, "failed to check authentication token")
+		}
+		if revoked {
+			return Identity{}, status.Error(codes.Unauthenticated, "authentication token was revoked")
+		}
+	}
+	return Identity{UserID: tokenResponse.UserID}, nil
+}
@@ -1,15 +1,21 @@
 package jwt
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"slices"
 	"time"
 )
 
 type TokenInfo struct {
 	Error  error
 	UserID int64
+	AppID  int64
+	// ID is the jti claim, empty for tokens issued before SSO started to set it
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
 }
 
 var (
@@ -17,14 +23,37 @@ var (
 	ErrInvalidToken = errors.New("invalid token")
 )
 
-func ValidateToken(tokenString string, secret string) TokenInfo {
+// Algorithms are the signing algorithms SSO signs tokens with.
+var Algorithms = []string{"EdDSA", "RS256"}
+
+// Audience is the aud claim SSO puts into the tokens it issues for the CRUD service, tokens
+// of OpenID Connect clients name the client and are refused.
+const Audience = "crud"
+
+// LegacyAlgorithm is accepted on top of Algorithms only when the resolver verifies legacy tokens, see Keys.
+const LegacyAlgorithm = "HS256"
+
+// ValidateToken checks the token with the key it names, see KeyResolver.
+func ValidateToken(ctx context.Context, tokenString string, keys KeyResolver) TokenInfo {
+	algorithms := Algorithms
+	if legacy, ok := keys.(legacyResolver); ok && legacy.legacy() {
+		algorithms = append(slices.Clip(Algorithms), LegacyAlgorithm)
+	}
+
 	// Decoding jwt
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return false, fmt.Errorf("unexpected signing method")
+		// The header and claims are decoded before the key is needed, they are only trusted once the signature matches
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		appID, ok := claims["appID"].(float64)
+		if !ok {
+			return nil, ErrInvalidToken
 		}
-		return []byte(secret), nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		return keys.Key(ctx, KeyID{Algorithm: token.Method.Alg(), KID: kid, AppID: int64(appID)})
+	}, jwt.WithValidMethods(algorithms))
 	if err != nil || !token.Valid {
 		return TokenInfo{Error: err}
 	}
@@ -44,11 +73,25 @@ func ValidateToken(tokenString string, secret string) TokenInfo {
 			return TokenInfo{Error: ErrTokenExpired}
 		}
 
-		userId, ok := claims["userID"]
+		userId, ok := claims["userID"].(float64)
 		if !ok {
 			return TokenInfo{Error: ErrInvalidToken}
 		}
-		return TokenInfo{Error: nil, UserID: int64(userId.(float64))}
+		// Legacy HS256 tokens predate audiences
+		if token.Method.Alg() != LegacyAlgorithm {
+			aud, err := claims.GetAudience()
+			if err != nil || !slices.Contains(aud, Audience) {
+				return TokenInfo{Error: ErrInvalidToken}
+			}
+		}
+		appID, _ := claims["appID"].(float64)
+		jti, _ := claims["jti"].(string)
+		// Tokens issued before iat was added count as issued now
+		issuedAt := time.Now()
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		return TokenInfo{Error: nil, UserID: int64(userId), AppID: int64(appID), ID: jti, IssuedAt: issuedAt, ExpiresAt: expTime}
 	}
 	return TokenInfo{Error: ErrInvalidToken}
 }
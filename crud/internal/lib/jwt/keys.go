@@ -0,0 +1,82 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// KeyResolver returns the key a token is verified with. Tokens signed by SSO are matched by
+// their kid header, legacy HMAC tokens by the app named in their appID claim.
+type KeyResolver interface {
+	Key(ctx context.Context, id KeyID) (any, error)
+}
+
+// KeyID names the key of a token, it is read before the signature is checked and is not trusted.
+type KeyID struct {
+	Algorithm string
+	KID       string
+	AppID     int64
+}
+
+var (
+	ErrUnknownKey = errors.New("unknown signing key")
+	ErrUnknownApp = fmt.Errorf("%w: unknown app", ErrUnknownKey)
+)
+
+// legacyResolver is implemented by resolvers that may verify LegacyAlgorithm tokens
+type legacyResolver interface {
+	legacy() bool
+}
+
+// KeySet asks its resolvers in order, the first one that knows the key answers.
+type KeySet []KeyResolver
+
+func (s KeySet) legacy() bool {
+	for _, resolver := range s {
+		if legacy, ok := resolver.(legacyResolver); ok && legacy.legacy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s KeySet) Key(ctx context.Context, id KeyID) (any, error) {
+	for _, resolver := range s {
+		key, err := resolver.Key(ctx, id)
+		if errors.Is(err, ErrUnknownKey) {
+			continue
+		}
+		return key, err
+	}
+	return nil, ErrUnknownKey
+}
+
+// Keys is a configured set of app secrets for HMAC tokens issued before SSO switched to
+// asymmetric keys. Only the listed apps are verified, a resolver with Keys in it makes
+// ValidateToken accept LegacyAlgorithm.
+type Keys struct {
+	Apps map[int64][]byte
+}
+
+func NewKeys(apps map[int64]string) *Keys {
+	keys := &Keys{Apps: make(map[int64][]byte, len(apps))}
+	for appID, secret := range apps {
+		keys.Apps[appID] = []byte(secret)
+	}
+	return keys
+}
+
+func (k *Keys) Key(ctx context.Context, id KeyID) (any, error) {
+	if id.Algorithm != LegacyAlgorithm {
+		return nil, ErrUnknownKey
+	}
+	if key, ok := k.Apps[id.AppID]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownApp
+}
+
+func (k *Keys) legacy() bool {
+	return true
+}
@@ -0,0 +1,140 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// MaxPixels guards against decompression bombs: a tiny file may declare a huge canvas
+const MaxPixels = 40_000_000
+
+const jpegQuality = 80
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrTooLarge          = errors.New("image is too large")
+)
+
+// Thumbnail is an encoded preview together with the size of the original image.
+type Thumbnail struct {
+	Data     []byte
+	MimeType string
+	// Width and Height of the original image
+	Width  int
+	Height int
+}
+
+// Generate decodes a PNG, JPEG or GIF image (the first frame of an animation) and scales it down
+// to fit into a size x size box keeping the aspect ratio. Smaller images are not enlarged.
+// JPEG images stay JPEG, the others become PNG so transparency is kept.
+func Generate(r io.Reader, size int) (Thumbnail, error) {
+	var buf bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return Thumbnail{}, fmt.Errorf("%w: %w", ErrUnsupportedFormat, err)
+	}
+	if config.Width*config.Height > MaxPixels {
+		return Thumbnail{}, ErrTooLarge
+	}
+
+	var src image.Image
+	rest := io.MultiReader(&buf, r)
+	switch format {
+	case "png":
+		src, err = png.Decode(rest)
+	case "jpeg":
+		src, err = jpeg.Decode(rest)
+	case "gif":
+		src, err = gif.Decode(rest)
+	default:
+		return Thumbnail{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+	}
+	if err != nil {
+		return Thumbnail{}, err
+	}
+
+	bounds := src.Bounds()
+	width, height := fit(bounds.Dx(), bounds.Dy(), size)
+	scaled := scale(src, width, height)
+
+	thumb := Thumbnail{Width: bounds.Dx(), Height: bounds.Dy()}
+	var out bytes.Buffer
+	if format == "jpeg" {
+		thumb.MimeType = "image/jpeg"
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		thumb.MimeType = "image/png"
+		err = png.Encode(&out, scaled)
+	}
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	thumb.Data = out.Bytes()
+	return thumb, nil
+}
+
+// fit returns the largest size within a box x box square with the aspect ratio of width x height
+func fit(width, height, box int) (int, int) {
+	if width <= box && height <= box {
+		return width, height
+	}
+	if width >= height {
+		return box, max(1, height*box/width)
+	}
+	return max(1, width*box/height), box
+}
+
+// scale resizes src by averaging every source pixel that falls into a destination pixel.
+// It is only used for downscaling, where it gives smooth results without extra dependencies.
+func scale(src image.Image, width, height int) *image.NRGBA {
+	bounds := src.Bounds()
+	// Converting once is much faster than calling At on a paletted or YCbCr image for every pixel
+	rgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return rgba
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * bounds.Dy() / height
+		y1 := max(y0+1, (y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := x * bounds.Dx() / width
+			x1 := max(x0+1, (x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					// Weight colours by alpha so transparent pixels do not darken the edges
+					r += int(p[0]) * int(p[3])
+					g += int(p[1]) * int(p[3])
+					b += int(p[2]) * int(p[3])
+					a += int(p[3])
+					n++
+				}
+			}
+			if a == 0 {
+				dst.SetNRGBA(x, y, color.NRGBA{})
+				continue
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / a),
+				G: uint8(g / a),
+				B: uint8(b / a),
+				A: uint8(a / n),
+			})
+		}
+	}
+	return dst
+}
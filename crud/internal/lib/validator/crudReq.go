@@ -1 +1,198 @@
 package validator
+
+import (
+	"ChatService/crud/internal/domain/models"
+	crudv1 "ChatService/protos/gen/go/crud"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	emptyValue = 0
+	// maxEmojiLen fits multi-codepoint emoji such as flags and skin tone sequences
+	maxEmojiLen    = 32
+	maxQueryLen    = 256
+	maxFileNameLen = 255
+	maxMessageType = models.TypeFile
+)
+
+func SentMessageValid(req *crudv1.SentMessageRequest) error {
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	if req.GetParentId() < emptyValue || req.GetAttachmentId() < emptyValue {
+		return status.Error(codes.InvalidArgument, "ids can not be negative")
+	}
+
+	switch req.GetType() {
+	case models.TypeImage, models.TypeFile:
+		if req.GetAttachmentId() == emptyValue {
+			return status.Error(codes.InvalidArgument, "attachment id required for image and file messages")
+		}
+	default:
+		if req.GetAttachmentId() != emptyValue {
+			return status.Error(codes.InvalidArgument, "only image and file messages can have an attachment")
+		}
+		if req.GetContent() == "" {
+			return status.Error(codes.InvalidArgument, "content required")
+		}
+	}
+	return nil
+}
+
+func UploadAttachmentValid(req *crudv1.UploadAttachmentRequest) error {
+	info := req.GetInfo()
+	if info == nil {
+		return status.Error(codes.InvalidArgument, "upload info required before the first chunk")
+	}
+	if info.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	if info.GetFileName() == "" {
+		return status.Error(codes.InvalidArgument, "file name required")
+	}
+	if len(info.GetFileName()) > maxFileNameLen || !utf8.ValidString(info.GetFileName()) {
+		return status.Error(codes.InvalidArgument, "file name is not valid")
+	}
+	return nil
+}
+
+func DownloadAttachmentValid(req *crudv1.DownloadAttachmentRequest) error {
+	if req.GetId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "attachment id required")
+	}
+	return nil
+}
+
+func ShowMessagesValid(req *crudv1.ShowMessagesRequest) error {
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	if req.GetLimit() < emptyValue {
+		return status.Error(codes.InvalidArgument, "limit can not be negative")
+	}
+	if req.GetBeforeId() < emptyValue || req.GetAfterId() < emptyValue {
+		return status.Error(codes.InvalidArgument, "cursor can not be negative")
+	}
+	if req.GetBeforeId() != emptyValue && req.GetAfterId() != emptyValue {
+		return status.Error(codes.InvalidArgument, "before_id and after_id are mutually exclusive")
+	}
+	return nil
+}
+
+func SearchMessagesValid(req *crudv1.SearchMessagesRequest) error {
+	query := strings.TrimSpace(req.GetQuery())
+	if query == "" {
+		return status.Error(codes.InvalidArgument, "query required")
+	}
+	if len(query) > maxQueryLen {
+		return status.Error(codes.InvalidArgument, "query is too long")
+	}
+	if req.GetRoomId() < emptyValue || req.GetAuthorUid() < emptyValue {
+		return status.Error(codes.InvalidArgument, "ids can not be negative")
+	}
+	if req.GetType() < emptyValue || req.GetType() > maxMessageType {
+		return status.Error(codes.InvalidArgument, "unknown message type")
+	}
+	if req.GetDateFrom() != "" && req.GetDateTo() != "" && req.GetDateFrom() >= req.GetDateTo() {
+		return status.Error(codes.InvalidArgument, "date_from must be before date_to")
+	}
+	if req.GetLimit() < emptyValue {
+		return status.Error(codes.InvalidArgument, "limit can not be negative")
+	}
+	if req.GetBeforeId() < emptyValue {
+		return status.Error(codes.InvalidArgument, "cursor can not be negative")
+	}
+	return nil
+}
+
+func CreateRoomValid(req *crudv1.CreateRoomRequest) error {
+	if req.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "room name required")
+	}
+	return nil
+}
+
+func JoinRoomValid(req *crudv1.JoinRoomRequest) error {
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	return nil
+}
+
+func InviteToRoomValid(req *crudv1.InviteToRoomRequest) error {
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	if req.GetUserId() <= emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
+	}
+	return nil
+}
+
+func LeaveRoomValid(req *crudv1.LeaveRoomRequest) error {
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	return nil
+}
+
+func SubscribeValid(req *crudv1.SubscribeRequest) error {
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	return nil
+}
+
+func GetMessageHistoryValid(req *crudv1.GetMessageHistoryRequest) error {
+	if req.GetMid() == emptyValue {
+		return status.Error(codes.InvalidArgument, "message id required")
+	}
+	return nil
+}
+
+func RestoreMessageValid(req *crudv1.RestoreMessageRequest) error {
+	if req.GetMid() == emptyValue {
+		return status.Error(codes.InvalidArgument, "message id required")
+	}
+	return nil
+}
+
+func AddReactionValid(req *crudv1.AddReactionRequest) error {
+	if req.GetMid() == emptyValue {
+		return status.Error(codes.InvalidArgument, "message id required")
+	}
+	return emojiValid(req.GetEmoji())
+}
+
+func RemoveReactionValid(req *crudv1.RemoveReactionRequest) error {
+	if req.GetMid() == emptyValue {
+		return status.Error(codes.InvalidArgument, "message id required")
+	}
+	return emojiValid(req.GetEmoji())
+}
+
+func emojiValid(emoji string) error {
+	if emoji == "" {
+		return status.Error(codes.InvalidArgument, "emoji required")
+	}
+	if len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) {
+		return status.Error(codes.InvalidArgument, "emoji is not valid")
+	}
+	return nil
+}
+
+func GetThreadValid(req *crudv1.GetThreadRequest) error {
+	if req.GetMid() == emptyValue {
+		return status.Error(codes.InvalidArgument, "message id required")
+	}
+	if req.GetLimit() < emptyValue {
+		return status.Error(codes.InvalidArgument, "limit can not be negative")
+	}
+	if req.GetAfterId() < emptyValue {
+		return status.Error(codes.InvalidArgument, "cursor can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package crud
+
+import (
+	"ChatService/crud/internal/domain/models"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+type AttachmentCRUDer interface {
+	SaveAttachment(ctx context.Context, attachment models.Attachment) (int64, error)
+	GetAttachment(ctx context.Context, id int64) (models.Attachment, error)
+	Attachments(ctx context.Context, ids []int64) (map[int64]models.Attachment, error)
+	SetAttachmentImage(ctx context.Context, id int64, width int32, height int32, thumbnailID int64) error
+}
+
+// BlobStore keeps the bytes of attachments, the metadata lives in AttachmentCRUDer.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// DefaultMaxAttachmentSize is used when CRUD.MaxAttachmentSize is not set
+const DefaultMaxAttachmentSize = 20 << 20
+
+// sniffLen is how much of the upload mimetype looks at, it is the library's own default
+const sniffLen = 3072
+
+var (
+	ErrAttachmentTooLarge   = errors.New("attachment is too large")
+	ErrAttachmentNotAllowed = errors.New("attachment belongs to another user or room")
+	ErrAttachmentNotImage   = errors.New("attachment is not an image")
+)
+
+// UploadAttachment stores the content read from r for a later image or file message in roomID.
+// The size is capped, the MIME type is sniffed from the content and a sha256 is computed on the fly.
+func (m *CRUD) UploadAttachment(ctx context.Context, uid int64, roomID int64, fileName string, r io.Reader) (models.Attachment, error) {
+	const op = "services.crud.UploadAttachment"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkWriter(ctx, roomID, uid); err != nil {
+		log.Warn("user can not upload to room", slog.Int64("room_id", roomID), slog.String("err", err.Error()))
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, err := newBlobKey()
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	maxSize := m.MaxAttachmentSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxAttachmentSize
+	}
+
+	hash := sha256.New()
+	head := &headBuffer{limit: sniffLen}
+	// One byte over the limit is enough to tell that the upload is too large
+	limited := &io.LimitedReader{R: r, N: maxSize + 1}
+	size, err := m.Blobs.Put(ctx, key, io.TeeReader(limited, io.MultiWriter(hash, head)))
+	if err != nil {
+		log.Error("Failed to store attachment", slog.String("err", err.Error()))
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if size > maxSize {
+		m.deleteBlob(ctx, log, key)
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, ErrAttachmentTooLarge)
+	}
+
+	attachment := models.Attachment{
+		UserID:    uid,
+		RoomID:    roomID,
+		FileName:  fileName,
+		MimeType:  mimetype.Detect(head.Bytes()).String(),
+		Size:      size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		BlobKey:   key,
+		CreatedAt: time.Now().Format(time.DateTime),
+	}
+	attachment.ID, err = m.Attachments.SaveAttachment(ctx, attachment)
+	if err != nil {
+		log.Error("Failed to save attachment", slog.String("err", err.Error()))
+		m.deleteBlob(ctx, log, key)
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("attachment uploaded", slog.Int64("id", attachment.ID), slog.String("mime_type", attachment.MimeType), slog.Int64("size", size))
+	return attachment, nil
+}
+
+// OpenAttachment returns the metadata and the content of an attachment to a member of its room.
+// The caller has to close the reader.
+func (m *CRUD) OpenAttachment(ctx context.Context, uid int64, id int64) (models.Attachment, io.ReadCloser, error) {
+	const op = "services.crud.OpenAttachment"
+	log := m.Log.With(slog.String("op", op))
+
+	attachment, err := m.Attachments.GetAttachment(ctx, id)
+	if err != nil {
+		return models.Attachment{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := m.checkMember(ctx, attachment.RoomID, uid); err != nil {
+		log.Warn("user can not read room", slog.Int64("room_id", attachment.RoomID), slog.String("err", err.Error()))
+		return models.Attachment{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	content, err := m.Blobs.Open(ctx, attachment.BlobKey)
+	if err != nil {
+		log.Error("Failed to open attachment", slog.Int64("id", id), slog.String("err", err.Error()))
+		return models.Attachment{}, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return attachment, content, nil
+}
+
+// checkAttachment makes sure a new message may reference the attachment: it has to be uploaded
+// by the sender to the same room, and image messages need image content.
+func (m *CRUD) checkAttachment(ctx context.Context, uid int64, roomID int64, typeOf int32, attachmentID int64) (models.Attachment, error) {
+	attachment, err := m.Attachments.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	if attachment.UserID != uid || attachment.RoomID != roomID {
+		return models.Attachment{}, ErrAttachmentNotAllowed
+	}
+	if typeOf == models.TypeImage && !strings.HasPrefix(attachment.MimeType, "image/") {
+		return models.Attachment{}, ErrAttachmentNotImage
+	}
+	return attachment, nil
+}
+
+// attachFiles fills the attachment metadata of image and file messages in one storage call.
+func (m *CRUD) attachFiles(ctx context.Context, messages []models.Message) error {
+	var ids []int64
+	for _, message := range messages {
+		if message.AttachmentID != 0 && message.DeletedAt == "" {
+			ids = append(ids, message.AttachmentID)
+		}
+	}
+
+	attachments, err := m.Attachments.Attachments(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if attachment, ok := attachments[messages[i].AttachmentID]; ok && messages[i].DeletedAt == "" {
+			messages[i].Attachment = &attachment
+		}
+	}
+	return nil
+}
+
+func (m *CRUD) deleteBlob(ctx context.Context, log *slog.Logger, key string) {
+	if err := m.Blobs.Delete(ctx, key); err != nil {
+		log.Error("Failed to delete blob", slog.String("key", key), slog.String("err", err.Error()))
+	}
+}
+
+func newBlobKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// headBuffer keeps the first limit bytes written to it and drops the rest
+type headBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := h.limit - h.Len(); room > 0 {
+		h.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
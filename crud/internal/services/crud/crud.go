@@ -7,37 +7,189 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 )
 
 type CRUD struct {
 	Log           *slog.Logger
 	MessageCRUDer MessageCRUDer
+	RoomCRUDer    RoomCRUDer
+	Reactions     ReactionCRUDer
+	Attachments   AttachmentCRUDer
+	Blobs         BlobStore
+	Events        EventBus
+	Permissions   PermissionChecker
+	Restrictions  RestrictionProvider
+	// MaxAttachmentSize caps uploads in bytes, DefaultMaxAttachmentSize is used when it is 0
+	MaxAttachmentSize int64
+	// Thumbnails queues image messages for RunThumbnails, nil disables thumbnails
+	Thumbnails chan ThumbnailJob
+
+	// rooms keeps the events of a room in the order its changes were stored
+	rooms roomLocks
 }
 
 type MessageCRUDer interface {
-	CreateMessage(ctx context.Context, uid int64, content string, typeOf int32, datetime string) (int64, error)
+	CreateMessage(ctx context.Context, uid int64, roomID int64, reply models.Reply, content string, typeOf int32, attachmentID int64, datetime string) (int64, error)
 	GetMessage(ctx context.Context, mid int64) (models.Message, error)
-	DeleteMessage(ctx context.Context, mid int64) (bool, error)
-	UpdateMessage(ctx context.Context, mid int64, newContent string) (bool, error)
-	ShowAllMessages(ctx context.Context, uid int64) ([]models.Message, error)
+	DeleteMessage(ctx context.Context, mid int64, deletedBy int64, deletedAt string) (bool, error)
+	RestoreMessage(ctx context.Context, mid int64) (bool, error)
+	PurgeDeletedMessages(ctx context.Context, deletedBefore string) (int64, []string, error)
+	UpdateMessage(ctx context.Context, mid int64, editorID int64, newContent string, editedAt string) (bool, error)
+	MessageHistory(ctx context.Context, mid int64) ([]models.Revision, error)
+	ShowAllMessages(ctx context.Context, roomID int64, page models.Page) ([]models.Message, error)
+	ThreadReplies(ctx context.Context, rootID int64, page models.Page) ([]models.Message, error)
+	SearchMessages(ctx context.Context, uid int64, filter models.SearchFilter, page models.Page) ([]models.SearchHit, error)
+}
+
+type RoomCRUDer interface {
+	CreateRoom(ctx context.Context, ownerID int64, name string, public bool, createdAt string) (int64, error)
+	AddRoomMember(ctx context.Context, roomID int64, uid int64, joinedAt string) (bool, error)
+	InviteRoomMember(ctx context.Context, roomID int64, invitedBy int64, uid int64, createdAt string) (bool, error)
+	RemoveRoomMember(ctx context.Context, roomID int64, uid int64) (bool, error)
+	IsRoomMember(ctx context.Context, roomID int64, uid int64) (bool, error)
+	ListRooms(ctx context.Context, uid int64) ([]models.Room, error)
+}
+
+type ReactionCRUDer interface {
+	AddReaction(ctx context.Context, mid int64, uid int64, emoji string, createdAt string) (bool, error)
+	RemoveReaction(ctx context.Context, mid int64, uid int64, emoji string) (bool, error)
+	MessageReactions(ctx context.Context, mids []int64, uid int64) (map[int64][]models.Reaction, error)
+}
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// PermissionChecker answers whether the role of a user grants a permission; it is backed by the SSO service.
+type PermissionChecker interface {
+	CheckPermission(ctx context.Context, uid int64, permission string) (bool, error)
+}
+
+// RestrictionProvider returns the bans and mutes of a user; it is backed by the SSO service.
+type RestrictionProvider interface {
+	Restrictions(ctx context.Context, uid int64) (models.Restrictions, error)
+}
+
+// RestrictedError refuses every call of a banned user, and writes of a user muted in the room.
+type RestrictedError struct {
+	Muted       bool
+	Restriction models.Restriction
+}
+
+func (e *RestrictedError) Error() string {
+	message := "user is banned"
+	if e.Muted {
+		message = "user is muted in the room"
+	}
+	if !e.Restriction.Until.IsZero() {
+		message += " until " + e.Restriction.Until.UTC().Format(time.DateTime) + " UTC"
+	}
+	if e.Restriction.Reason != "" {
+		message += ": " + e.Restriction.Reason
+	}
+	return message
+}
+
+var (
+	ErrNotMessageOwner  = errors.New("message belongs to another user")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrReplyOtherRoom   = errors.New("reply target is in another room")
+)
+
+type EventBus interface {
+	Publish(roomID int64, event models.Event)
+	Subscribe(roomID int64, uid int64) (<-chan models.Event, func())
+	Unsubscribe(roomID int64, uid int64)
 }
 
-func (m *CRUD) SentMessage(ctx context.Context, uid int64, content string, typeOf int32, datetime string) (int64, error) {
+// SentMessage posts a message to a room, a non-zero parentID makes it a reply in the thread of that message.
+func (m *CRUD) SentMessage(ctx context.Context, uid int64, roomID int64, parentID int64, content string, typeOf int32, attachmentID int64, datetime string) (int64, error) {
 	const op = "services.crud.SentMessage"
 	log := m.Log.With(slog.String("op", op))
 
-	id, err := m.MessageCRUDer.CreateMessage(ctx, uid, content, typeOf, datetime)
+	if err := m.checkWriter(ctx, roomID, uid); err != nil {
+		log.Warn("user can not write to room", slog.Int64("room_id", roomID), slog.String("err", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var reply models.Reply
+	if parentID != 0 {
+		parent, err := m.MessageCRUDer.GetMessage(ctx, parentID)
+		if err != nil {
+			log.Warn("Failed to get reply target", slog.Int64("parent_id", parentID), slog.String("err", err.Error()))
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		if parent.DeletedAt != "" {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrMessageDeleted)
+		}
+		if parent.RoomID != roomID {
+			return 0, fmt.Errorf("%s: %w", op, ErrReplyOtherRoom)
+		}
+
+		// Replies to replies stay in one flat thread under the first message
+		reply = models.Reply{ParentID: parent.ID, ThreadRootID: parent.ThreadRootID}
+		if reply.ThreadRootID == 0 {
+			reply.ThreadRootID = parent.ID
+		}
+	}
+
+	if attachmentID != 0 {
+		attachment, err := m.checkAttachment(ctx, uid, roomID, typeOf, attachmentID)
+		if err != nil {
+			log.Warn("attachment can not be posted", slog.Int64("attachment_id", attachmentID), slog.String("err", err.Error()))
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		// The caption is optional, the file name keeps the message readable and searchable without one
+		if content == "" {
+			content = attachment.FileName
+		}
+	}
+
+	unlock := m.rooms.lock(roomID)
+	defer unlock()
+	id, err := m.MessageCRUDer.CreateMessage(ctx, uid, roomID, reply, content, typeOf, attachmentID, datetime)
 	if err != nil {
 		log.Error("Failed to create message", slog.String("err", err.Error()))
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
+
+	m.publishStored(ctx, log, models.EventCreated, id)
+	if typeOf == models.TypeImage {
+		m.queueThumbnail(log, ThumbnailJob{AttachmentID: attachmentID, MessageID: id})
+	}
 	return id, nil
 }
 
-func (m *CRUD) DeleteMessage(ctx context.Context, uid int64) (bool, error) {
+func (m *CRUD) DeleteMessage(ctx context.Context, uid int64, mid int64) (bool, error) {
 	const op = "services.crud.DeleteMessage"
 	log := m.Log.With(slog.String("op", op))
-	answer, err := m.MessageCRUDer.DeleteMessage(ctx, uid)
+
+	// Read the message first: the author is checked and subscribers of its room are told about the deletion
+	message, err := m.MessageCRUDer.GetMessage(ctx, mid)
+	if err != nil {
+		if errors.Is(err, storage.ErrMessageNotExist) {
+			log.Error("Message does not exist")
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("Failed to get message", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if message.DeletedAt != "" {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageDeleted)
+	}
+
+	if err := m.checkOwner(ctx, uid, message, models.PermissionMessageDeleteAny); err != nil {
+		log.Warn("user can not delete message", slog.Int64("mid", mid), slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	unlock := m.rooms.lock(message.RoomID)
+	defer unlock()
+	deletedAt := time.Now().Format(time.DateTime)
+	answer, err := m.MessageCRUDer.DeleteMessage(ctx, mid, uid, deletedAt)
 	if err != nil {
 		if errors.Is(err, storage.ErrMessageNotExist) {
 			log.Error("Message does not exist")
@@ -46,10 +198,21 @@ func (m *CRUD) DeleteMessage(ctx context.Context, uid int64) (bool, error) {
 		log.Error("Failed to delete message", slog.String("err", err.Error()))
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
+
+	m.Events.Publish(message.RoomID, models.Event{
+		Type: models.EventDeleted,
+		Message: models.Message{
+			ID:        message.ID,
+			UserID:    message.UserID,
+			RoomID:    message.RoomID,
+			DeletedAt: deletedAt,
+			DeletedBy: uid,
+		},
+	})
 	return answer, err
 }
 
-func (m *CRUD) GetMessage(ctx context.Context, mid int64) (models.Message, error) {
+func (m *CRUD) GetMessage(ctx context.Context, uid int64, mid int64) (models.Message, error) {
 	const op = "services.crud.GetMessage"
 	log := m.Log.With(slog.String("op", op))
 	content, err := m.MessageCRUDer.GetMessage(ctx, mid)
@@ -61,13 +224,51 @@ func (m *CRUD) GetMessage(ctx context.Context, mid int64) (models.Message, error
 		log.Error("Failed to get message", slog.String("err", err.Error()))
 		return models.Message{}, fmt.Errorf("%s: %w", op, err)
 	}
-	return content, err
+
+	if err := m.checkMember(ctx, content.RoomID, uid); err != nil {
+		log.Warn("user can not read room", slog.Int64("room_id", content.RoomID), slog.String("err", err.Error()))
+		return models.Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	messages := []models.Message{hideDeleted(content)}
+	if err := m.fillMessages(ctx, uid, messages); err != nil {
+		log.Error("Failed to load reactions and attachments", slog.String("err", err.Error()))
+		return models.Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return messages[0], nil
 }
 
-func (m *CRUD) UpdateMessage(ctx context.Context, mid int64, newContent string) (bool, error) {
+func (m *CRUD) UpdateMessage(ctx context.Context, uid int64, mid int64, newContent string) (bool, error) {
 	const op = "services.crud.UpdateMessage"
 	log := m.Log.With(slog.String("op", op))
-	answer, err := m.MessageCRUDer.UpdateMessage(ctx, mid, newContent)
+
+	message, err := m.MessageCRUDer.GetMessage(ctx, mid)
+	if err != nil {
+		if errors.Is(err, storage.ErrMessageNotExist) {
+			log.Error("Message does not exist")
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("Failed to get message", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if message.DeletedAt != "" {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageDeleted)
+	}
+
+	if err := m.checkOwner(ctx, uid, message, models.PermissionMessageEditAny); err != nil {
+		log.Warn("user can not update message", slog.Int64("mid", mid), slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	// A muted author must not get around the mute by editing old messages
+	if err := m.checkMuted(ctx, message.RoomID, uid); err != nil {
+		log.Warn("user can not update message", slog.Int64("mid", mid), slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	unlock := m.rooms.lock(message.RoomID)
+	defer unlock()
+	answer, err := m.MessageCRUDer.UpdateMessage(ctx, mid, uid, newContent, time.Now().Format(time.DateTime))
 	if err != nil {
 		if errors.Is(err, storage.ErrMessageNotExist) {
 			log.Error("Message does not exist")
@@ -76,18 +277,574 @@ func (m *CRUD) UpdateMessage(ctx context.Context, mid int64, newContent string)
 		log.Error("Failed to update message", slog.String("err", err.Error()))
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
+
+	if answer {
+		m.publishStored(ctx, log, models.EventUpdated, mid)
+	}
 	return answer, nil
 }
 
-func (m *CRUD) ShowAllMessages(ctx context.Context, uid int64) ([]models.Message, error) {
+// GetMessageHistory returns the previous versions of a message to members of its room.
+func (m *CRUD) GetMessageHistory(ctx context.Context, uid int64, mid int64) ([]models.Revision, error) {
+	const op = "services.crud.GetMessageHistory"
+	log := m.Log.With(slog.String("op", op))
+
+	// GetMessage checks that the message exists and that uid can read its room
+	message, err := m.GetMessage(ctx, uid, mid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if message.DeletedAt != "" {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrMessageDeleted)
+	}
+
+	revisions, err := m.MessageCRUDer.MessageHistory(ctx, mid)
+	if err != nil {
+		log.Error("Failed to get message history", slog.String("err", err.Error()))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return revisions, nil
+}
+
+// RestoreMessage brings a deleted message back, it needs the message.restore permission.
+func (m *CRUD) RestoreMessage(ctx context.Context, uid int64, mid int64) (bool, error) {
+	const op = "services.crud.RestoreMessage"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkBanned(ctx, uid); err != nil {
+		log.Warn("user can not restore messages", slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	allowed, err := m.Permissions.CheckPermission(ctx, uid, models.PermissionMessageRestore)
+	if err != nil {
+		log.Error("Failed to check permission", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if !allowed {
+		log.Warn("user can not restore messages", slog.Int64("uid", uid))
+		return false, fmt.Errorf("%s: %w", op, ErrPermissionDenied)
+	}
+
+	// The room is locked before the restore, its events are published in order
+	message, err := m.MessageCRUDer.GetMessage(ctx, mid)
+	if err != nil {
+		if !errors.Is(err, storage.ErrMessageNotExist) {
+			log.Error("Failed to get message", slog.String("err", err.Error()))
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	unlock := m.rooms.lock(message.RoomID)
+	defer unlock()
+
+	answer, err := m.MessageCRUDer.RestoreMessage(ctx, mid)
+	if err != nil {
+		if errors.Is(err, storage.ErrMessageNotDeleted) {
+			log.Warn("Message is not deleted", slog.Int64("mid", mid))
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("Failed to restore message", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	m.publishStored(ctx, log, models.EventRestored, mid)
+	return answer, nil
+}
+
+// PurgeDeleted hard-deletes the messages that were deleted more than retention ago, along with the
+// attachments no other message uses.
+func (m *CRUD) PurgeDeleted(ctx context.Context, retention time.Duration) (int64, error) {
+	const op = "services.crud.PurgeDeleted"
+	log := m.Log.With(slog.String("op", op))
+
+	deletedBefore := time.Now().Add(-retention).Format(time.DateTime)
+	purged, blobKeys, err := m.MessageCRUDer.PurgeDeletedMessages(ctx, deletedBefore)
+	if err != nil {
+		log.Error("Failed to purge deleted messages", slog.String("err", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	// The rows are gone already, a blob that fails to delete is only logged
+	for _, key := range blobKeys {
+		m.deleteBlob(ctx, log, key)
+	}
+	if purged > 0 {
+		log.Info("Purged deleted messages", slog.Int64("count", purged), slog.String("deleted_before", deletedBefore))
+	}
+	return purged, nil
+}
+
+// RunPurge calls PurgeDeleted every interval until ctx is cancelled.
+func (m *CRUD) RunPurge(ctx context.Context, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Errors are logged by PurgeDeleted, the next tick retries
+		_, _ = m.PurgeDeleted(ctx, retention)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetThread returns the thread a message belongs to: its root and a page of replies after page.AfterID.
+func (m *CRUD) GetThread(ctx context.Context, uid int64, mid int64, page models.Page) (models.Thread, error) {
+	const op = "services.crud.GetThread"
+	log := m.Log.With(slog.String("op", op))
+
+	root, err := m.GetMessage(ctx, uid, mid)
+	if err != nil {
+		return models.Thread{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if root.ThreadRootID != 0 {
+		root, err = m.GetMessage(ctx, uid, root.ThreadRootID)
+		if err != nil {
+			return models.Thread{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+
+	// One extra row tells whether another page follows
+	replies, err := m.MessageCRUDer.ThreadReplies(ctx, root.ID, models.Page{Limit: limit + 1, AfterID: page.AfterID})
+	if err != nil {
+		log.Error("Failed to get thread replies", slog.String("err", err.Error()))
+		return models.Thread{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for i := range replies {
+		replies[i] = hideDeleted(replies[i])
+	}
+	if err := m.fillMessages(ctx, uid, replies); err != nil {
+		log.Error("Failed to load reactions and attachments", slog.String("err", err.Error()))
+		return models.Thread{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	thread := models.Thread{Root: root, Replies: models.MessagePage{Messages: replies}}
+	if len(replies) > limit {
+		thread.Replies.Messages = replies[:limit]
+		thread.Replies.NextCursor = replies[limit-1].ID
+	}
+	return thread, nil
+}
+
+func (m *CRUD) ShowAllMessages(ctx context.Context, uid int64, roomID int64, page models.Page) (models.MessagePage, error) {
 	const op = "services.crud.ShowAllMessages"
 	log := m.Log.With(slog.String("op", op))
-	answer, err := m.MessageCRUDer.ShowAllMessages(ctx, uid)
+
+	if err := m.checkMember(ctx, roomID, uid); err != nil {
+		log.Warn("user can not read room", slog.Int64("room_id", roomID), slog.String("err", err.Error()))
+		return models.MessagePage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+
+	// One extra row tells whether another page follows
+	page.Limit = limit + 1
+	answer, err := m.MessageCRUDer.ShowAllMessages(ctx, roomID, page)
 	if err != nil {
 		if errors.Is(err, storage.ErrNoMessagesFound) {
-			return answer, storage.ErrNoMessagesFound
+			return models.MessagePage{Messages: answer}, storage.ErrNoMessagesFound
 		}
 		log.Error("Failed to show all messages", slog.String("err", err.Error()))
+		return models.MessagePage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for i := range answer {
+		answer[i] = hideDeleted(answer[i])
+	}
+	if err := m.fillMessages(ctx, uid, answer); err != nil {
+		log.Error("Failed to load reactions and attachments", slog.String("err", err.Error()))
+		return models.MessagePage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	result := models.MessagePage{Messages: answer}
+	if len(answer) > limit {
+		if page.AfterID != 0 {
+			result.Messages = answer[:limit]
+			result.NextCursor = result.Messages[limit-1].ID
+		} else {
+			result.Messages = answer[1:]
+			result.NextCursor = result.Messages[0].ID
+		}
+	}
+	return result, nil
+}
+
+// SearchMessages looks for messages containing every word of the query, newest first.
+// Without a room filter only the rooms uid is a member of are searched.
+func (m *CRUD) SearchMessages(ctx context.Context, uid int64, filter models.SearchFilter, page models.Page) (models.SearchPage, error) {
+	const op = "services.crud.SearchMessages"
+	log := m.Log.With(slog.String("op", op))
+
+	if filter.RoomID != 0 {
+		if err := m.checkMember(ctx, filter.RoomID, uid); err != nil {
+			log.Warn("user can not read room", slog.Int64("room_id", filter.RoomID), slog.String("err", err.Error()))
+			return models.SearchPage{}, fmt.Errorf("%s: %w", op, err)
+		}
+	} else if err := m.checkBanned(ctx, uid); err != nil {
+		log.Warn("user can not search", slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return models.SearchPage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+
+	// One extra row tells whether another page follows
+	page.Limit = limit + 1
+	hits, err := m.MessageCRUDer.SearchMessages(ctx, uid, filter, page)
+	if err != nil {
+		log.Error("Failed to search messages", slog.String("err", err.Error()))
+		return models.SearchPage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	result := models.SearchPage{Hits: hits}
+	if len(hits) > limit {
+		result.Hits = hits[:limit]
+		result.NextCursor = result.Hits[limit-1].Message.ID
+	}
+
+	messages := make([]models.Message, len(result.Hits))
+	for i, hit := range result.Hits {
+		messages[i] = hit.Message
+	}
+	if err := m.fillMessages(ctx, uid, messages); err != nil {
+		log.Error("Failed to load reactions and attachments", slog.String("err", err.Error()))
+		return models.SearchPage{}, fmt.Errorf("%s: %w", op, err)
+	}
+	for i := range result.Hits {
+		result.Hits[i].Message = messages[i]
+	}
+	return result, nil
+}
+
+// AddReaction reacts to a message on behalf of uid, reacting twice with one emoji is a no-op that returns false.
+func (m *CRUD) AddReaction(ctx context.Context, uid int64, mid int64, emoji string) (bool, error) {
+	const op = "services.crud.AddReaction"
+	log := m.Log.With(slog.String("op", op))
+
+	// GetMessage checks that the message exists and that uid can read its room
+	message, err := m.GetMessage(ctx, uid, mid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if message.DeletedAt != "" {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageDeleted)
+	}
+
+	unlock := m.rooms.lock(message.RoomID)
+	defer unlock()
+	added, err := m.Reactions.AddReaction(ctx, mid, uid, emoji, time.Now().Format(time.DateTime))
+	if err != nil {
+		log.Error("Failed to add reaction", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if added {
+		m.publishReaction(ctx, log, models.EventReactionAdded, mid, uid, emoji)
+	}
+	return added, nil
+}
+
+// RemoveReaction takes back a reaction of uid, it returns false if there was nothing to remove.
+func (m *CRUD) RemoveReaction(ctx context.Context, uid int64, mid int64, emoji string) (bool, error) {
+	const op = "services.crud.RemoveReaction"
+	log := m.Log.With(slog.String("op", op))
+
+	message, err := m.GetMessage(ctx, uid, mid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	unlock := m.rooms.lock(message.RoomID)
+	defer unlock()
+	removed, err := m.Reactions.RemoveReaction(ctx, mid, uid, emoji)
+	if err != nil {
+		log.Error("Failed to remove reaction", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if removed {
+		m.publishReaction(ctx, log, models.EventReactionRemoved, mid, uid, emoji)
+	}
+	return removed, nil
+}
+
+// CreateRoom creates a room with uid as its owner and first member. Private rooms can only be
+// joined with an invite, see InviteToRoom.
+func (m *CRUD) CreateRoom(ctx context.Context, uid int64, name string, public bool) (int64, error) {
+	const op = "services.crud.CreateRoom"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkBanned(ctx, uid); err != nil {
+		log.Warn("user can not create rooms", slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	id, err := m.RoomCRUDer.CreateRoom(ctx, uid, name, public, time.Now().Format(time.DateTime))
+	if err != nil {
+		if errors.Is(err, storage.ErrRoomExist) {
+			log.Warn("Room already exists", slog.String("name", name))
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("Failed to create room", slog.String("err", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+// JoinRoom adds uid to a public room, or to a private one it is invited to.
+func (m *CRUD) JoinRoom(ctx context.Context, uid int64, roomID int64) (bool, error) {
+	const op = "services.crud.JoinRoom"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkBanned(ctx, uid); err != nil {
+		log.Warn("user can not join rooms", slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	answer, err := m.RoomCRUDer.AddRoomMember(ctx, roomID, uid, time.Now().Format(time.DateTime))
+	if err != nil {
+		if errors.Is(err, storage.ErrRoomNotExist) {
+			log.Warn("Room does not exist", slog.Int64("room_id", roomID))
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		if errors.Is(err, storage.ErrNotInvited) {
+			log.Warn("User is not invited to the room", slog.Int64("room_id", roomID), slog.Int64("uid", uid))
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("Failed to join room", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return answer, nil
+}
+
+// InviteToRoom lets inviteeID join the room once, uid has to be a member of it.
+// It returns false when inviteeID is already a member or invited.
+func (m *CRUD) InviteToRoom(ctx context.Context, uid int64, roomID int64, inviteeID int64) (bool, error) {
+	const op = "services.crud.InviteToRoom"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkMember(ctx, roomID, uid); err != nil {
+		log.Warn("user can not invite to room", slog.Int64("room_id", roomID), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	answer, err := m.RoomCRUDer.InviteRoomMember(ctx, roomID, uid, inviteeID, time.Now().Format(time.DateTime))
+	if err != nil {
+		log.Error("Failed to invite to room", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
 	}
 	return answer, nil
 }
+
+func (m *CRUD) LeaveRoom(ctx context.Context, uid int64, roomID int64) (bool, error) {
+	const op = "services.crud.LeaveRoom"
+	log := m.Log.With(slog.String("op", op))
+
+	answer, err := m.RoomCRUDer.RemoveRoomMember(ctx, roomID, uid)
+	if err != nil {
+		if errors.Is(err, storage.ErrRoomNotExist) || errors.Is(err, storage.ErrNotRoomMember) {
+			log.Warn("User can not leave room", slog.Int64("room_id", roomID), slog.String("err", err.Error()))
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("Failed to leave room", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	// Open streams of uid must not keep receiving the events of a room they left
+	m.Events.Unsubscribe(roomID, uid)
+	return answer, nil
+}
+
+func (m *CRUD) ListRooms(ctx context.Context, uid int64) ([]models.Room, error) {
+	const op = "services.crud.ListRooms"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkBanned(ctx, uid); err != nil {
+		log.Warn("user can not list rooms", slog.Int64("uid", uid), slog.String("err", err.Error()))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rooms, err := m.RoomCRUDer.ListRooms(ctx, uid)
+	if err != nil {
+		log.Error("Failed to list rooms", slog.String("err", err.Error()))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return rooms, nil
+}
+
+// Subscribe streams the events of a room the user is a member of.
+// The returned function must be called to release the subscription.
+func (m *CRUD) Subscribe(ctx context.Context, uid int64, roomID int64) (<-chan models.Event, func(), error) {
+	const op = "services.crud.Subscribe"
+	log := m.Log.With(slog.String("op", op))
+
+	if err := m.checkMember(ctx, roomID, uid); err != nil {
+		log.Warn("user can not read room", slog.Int64("room_id", roomID), slog.String("err", err.Error()))
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	events, cancel := m.Events.Subscribe(roomID, uid)
+	return events, cancel, nil
+}
+
+// CheckSubscriber repeats the checks of Subscribe for a stream that is open already,
+// a ban or leaving the room has to end it.
+func (m *CRUD) CheckSubscriber(ctx context.Context, uid int64, roomID int64) error {
+	const op = "services.crud.CheckSubscriber"
+
+	if err := m.checkMember(ctx, roomID, uid); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// publishStored reads the message back from storage and publishes it to the subscribers of its room.
+func (m *CRUD) publishStored(ctx context.Context, log *slog.Logger, eventType models.EventType, mid int64) {
+	message, err := m.MessageCRUDer.GetMessage(ctx, mid)
+	if err != nil {
+		log.Error("Failed to publish event", slog.Int64("mid", mid), slog.String("err", err.Error()))
+		return
+	}
+
+	messages := []models.Message{message}
+	if err := m.fillMessages(ctx, 0, messages); err != nil {
+		log.Error("Failed to publish event", slog.Int64("mid", mid), slog.String("err", err.Error()))
+		return
+	}
+	m.Events.Publish(message.RoomID, models.Event{Type: eventType, Message: messages[0]})
+}
+
+// publishReaction publishes the new reaction counts of a message together with the change that led to them.
+// Subscribers see ReactedByMe as false and compare ActorID with their own id instead.
+func (m *CRUD) publishReaction(ctx context.Context, log *slog.Logger, eventType models.EventType, mid int64, actorID int64, emoji string) {
+	message, err := m.MessageCRUDer.GetMessage(ctx, mid)
+	if err != nil {
+		log.Error("Failed to publish event", slog.Int64("mid", mid), slog.String("err", err.Error()))
+		return
+	}
+
+	messages := []models.Message{message}
+	if err := m.fillMessages(ctx, 0, messages); err != nil {
+		log.Error("Failed to publish event", slog.Int64("mid", mid), slog.String("err", err.Error()))
+		return
+	}
+	m.Events.Publish(message.RoomID, models.Event{Type: eventType, Message: messages[0], ActorID: actorID, Emoji: emoji})
+}
+
+// fillMessages loads what is stored next to the messages: reactions as seen by uid and attachment metadata.
+func (m *CRUD) fillMessages(ctx context.Context, uid int64, messages []models.Message) error {
+	if err := m.attachReactions(ctx, uid, messages); err != nil {
+		return err
+	}
+	return m.attachFiles(ctx, messages)
+}
+
+// attachReactions fills the reactions of the messages as seen by uid in one storage call, tombstones are skipped.
+func (m *CRUD) attachReactions(ctx context.Context, uid int64, messages []models.Message) error {
+	mids := make([]int64, 0, len(messages))
+	for _, message := range messages {
+		if message.DeletedAt == "" {
+			mids = append(mids, message.ID)
+		}
+	}
+
+	reactions, err := m.Reactions.MessageReactions(ctx, mids, uid)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+	}
+	return nil
+}
+
+// checkMember returns a *RestrictedError when uid is banned and storage.ErrNotRoomMember
+// when uid has not joined the room.
+func (m *CRUD) checkMember(ctx context.Context, roomID int64, uid int64) error {
+	if err := m.checkBanned(ctx, uid); err != nil {
+		return err
+	}
+	member, err := m.RoomCRUDer.IsRoomMember(ctx, roomID, uid)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return storage.ErrNotRoomMember
+	}
+	return nil
+}
+
+// checkWriter is checkMember for posting to the room, it also returns a *RestrictedError
+// when uid is muted there.
+func (m *CRUD) checkWriter(ctx context.Context, roomID int64, uid int64) error {
+	if err := m.checkMember(ctx, roomID, uid); err != nil {
+		return err
+	}
+	return m.checkMuted(ctx, roomID, uid)
+}
+
+// checkBanned returns a *RestrictedError when uid is banned.
+func (m *CRUD) checkBanned(ctx context.Context, uid int64) error {
+	restrictions, err := m.Restrictions.Restrictions(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if ban, banned := restrictions.Banned(time.Now()); banned {
+		return &RestrictedError{Restriction: ban}
+	}
+	return nil
+}
+
+// checkMuted returns a *RestrictedError when uid is muted in the room.
+func (m *CRUD) checkMuted(ctx context.Context, roomID int64, uid int64) error {
+	restrictions, err := m.Restrictions.Restrictions(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if mute, muted := restrictions.Muted(roomID, time.Now()); muted {
+		return &RestrictedError{Muted: true, Restriction: mute}
+	}
+	return nil
+}
+
+// checkOwner returns a *RestrictedError when uid is banned and ErrNotMessageOwner unless
+// uid wrote the message or holds permission, the one that covers messages of other users.
+func (m *CRUD) checkOwner(ctx context.Context, uid int64, message models.Message, permission string) error {
+	if err := m.checkBanned(ctx, uid); err != nil {
+		return err
+	}
+	if message.UserID == uid {
+		return nil
+	}
+
+	allowed, err := m.Permissions.CheckPermission(ctx, uid, permission)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrNotMessageOwner
+	}
+	return nil
+}
+
+// hideDeleted drops the content of a tombstone before it leaves the service.
+func hideDeleted(message models.Message) models.Message {
+	if message.DeletedAt != "" {
+		message.Content = ""
+	}
+	return message
+}
@@ -0,0 +1,43 @@
+package crud
+
+import "sync"
+
+// roomLocks serializes the changes of a room with publishing their events, so the subscribers
+// of the room get the events in the order the changes were stored. The zero value is ready to use.
+type roomLocks struct {
+	mu    sync.Mutex
+	rooms map[int64]*roomLock
+}
+
+type roomLock struct {
+	sync.Mutex
+	// waiters counts the holder and the callers waiting for it, the lock is dropped at zero
+	waiters int
+}
+
+// lock blocks until the room is free and returns the function that frees it again.
+func (l *roomLocks) lock(roomID int64) func() {
+	l.mu.Lock()
+	if l.rooms == nil {
+		l.rooms = make(map[int64]*roomLock)
+	}
+	room, ok := l.rooms[roomID]
+	if !ok {
+		room = &roomLock{}
+		l.rooms[roomID] = room
+	}
+	room.waiters++
+	l.mu.Unlock()
+
+	room.Lock()
+	return func() {
+		room.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		room.waiters--
+		if room.waiters == 0 {
+			delete(l.rooms, roomID)
+		}
+	}
+}
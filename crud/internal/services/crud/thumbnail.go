@@ -0,0 +1,129 @@
+package crud
+
+import (
+	"ChatService/crud/internal/domain/models"
+	"ChatService/crud/internal/lib/thumbnail"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ThumbnailSize is the side of the square box thumbnails are scaled into
+const ThumbnailSize = 256
+
+// thumbnailTypes are the formats the thumbnail worker can decode
+var thumbnailTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// ThumbnailJob asks the worker to make a thumbnail of an attachment posted in an image message.
+type ThumbnailJob struct {
+	AttachmentID int64
+	MessageID    int64
+}
+
+// RunThumbnails generates thumbnails for posted images until ctx is cancelled.
+func (m *CRUD) RunThumbnails(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-m.Thumbnails:
+			// Errors are logged by MakeThumbnail, the message keeps showing the full image
+			_ = m.MakeThumbnail(ctx, job)
+		}
+	}
+}
+
+// MakeThumbnail stores a scaled down copy of an image next to the original as a new attachment,
+// records the size of the original and tells subscribers that the message changed.
+func (m *CRUD) MakeThumbnail(ctx context.Context, job ThumbnailJob) error {
+	const op = "services.crud.MakeThumbnail"
+	log := m.Log.With(slog.String("op", op), slog.Int64("attachment_id", job.AttachmentID))
+
+	original, err := m.Attachments.GetAttachment(ctx, job.AttachmentID)
+	if err != nil {
+		log.Error("Failed to get attachment", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	// The same upload may be posted again, one thumbnail is enough
+	if original.ThumbnailID != 0 || !thumbnailTypes[original.MimeType] {
+		return nil
+	}
+
+	content, err := m.Blobs.Open(ctx, original.BlobKey)
+	if err != nil {
+		log.Error("Failed to open attachment", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	thumb, err := thumbnail.Generate(content, ThumbnailSize)
+	_ = content.Close()
+	if err != nil {
+		log.Warn("Failed to generate thumbnail", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := original.BlobKey + "-thumb"
+	size, err := m.Blobs.Put(ctx, key, bytes.NewReader(thumb.Data))
+	if err != nil {
+		log.Error("Failed to store thumbnail", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	hash := sha256.Sum256(thumb.Data)
+	thumbID, err := m.Attachments.SaveAttachment(ctx, models.Attachment{
+		UserID:    original.UserID,
+		RoomID:    original.RoomID,
+		FileName:  thumbnailName(original.FileName, thumb.MimeType),
+		MimeType:  thumb.MimeType,
+		Size:      size,
+		SHA256:    hex.EncodeToString(hash[:]),
+		BlobKey:   key,
+		CreatedAt: time.Now().Format(time.DateTime),
+	})
+	if err != nil {
+		log.Error("Failed to save thumbnail", slog.String("err", err.Error()))
+		m.deleteBlob(ctx, log, key)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := m.Attachments.SetAttachmentImage(ctx, original.ID, int32(thumb.Width), int32(thumb.Height), thumbID); err != nil {
+		log.Error("Failed to save image size", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if job.MessageID != 0 {
+		m.publishStored(ctx, log, models.EventUpdated, job.MessageID)
+	}
+	return nil
+}
+
+// queueThumbnail never blocks the sender: with a full queue the image is shown without a thumbnail
+func (m *CRUD) queueThumbnail(log *slog.Logger, job ThumbnailJob) {
+	if m.Thumbnails == nil {
+		return
+	}
+	select {
+	case m.Thumbnails <- job:
+	default:
+		log.Warn("thumbnail queue is full", slog.Int64("attachment_id", job.AttachmentID))
+	}
+}
+
+func thumbnailName(fileName string, mimeType string) string {
+	ext := ".png"
+	if mimeType == "image/jpeg" {
+		ext = ".jpg"
+	}
+	if dot := strings.LastIndexByte(fileName, '.'); dot > 0 {
+		fileName = fileName[:dot]
+	}
+	return "thumb-" + fileName + ext
+}
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"ChatService/crud/internal/domain/models"
+	"sync"
+)
+
+// Hub fans out message events to the subscribers of a room.
+// Each subscriber has its own buffered channel; a subscriber that falls
+// behind is dropped (its channel is closed) instead of blocking publishers,
+// so the events it does receive always arrive in order.
+type Hub struct {
+	mu sync.Mutex
+	// rooms maps the channels of the subscribers of a room to the user they belong to
+	rooms  map[int64]map[chan models.Event]int64
+	buffer int
+	closed bool
+}
+
+func New(buffer int) *Hub {
+	return &Hub{
+		rooms:  make(map[int64]map[chan models.Event]int64),
+		buffer: buffer,
+	}
+}
+
+// Subscribe registers a subscriber for the room on behalf of uid. The returned
+// function unsubscribes it and must be called once the subscriber is done.
+func (h *Hub) Subscribe(roomID int64, uid int64) (<-chan models.Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan models.Event, h.buffer)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	subs, ok := h.rooms[roomID]
+	if !ok {
+		subs = make(map[chan models.Event]int64)
+		h.rooms[roomID] = subs
+	}
+	subs[ch] = uid
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(roomID, ch)
+	}
+}
+
+func (h *Hub) Publish(roomID int64, event models.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.rooms[roomID] {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber: drop it rather than lose events silently
+			h.remove(roomID, ch)
+		}
+	}
+}
+
+// Unsubscribe drops the subscribers of the room that belong to uid, e.g. when uid leaves it.
+func (h *Hub) Unsubscribe(roomID int64, uid int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, owner := range h.rooms[roomID] {
+		if owner == uid {
+			h.remove(roomID, ch)
+		}
+	}
+}
+
+// Close drops every subscriber. Subscriptions made after Close end immediately.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for roomID, subs := range h.rooms {
+		for ch := range subs {
+			h.remove(roomID, ch)
+		}
+	}
+	h.closed = true
+}
+
+func (h *Hub) remove(roomID int64, ch chan models.Event) {
+	subs, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.rooms, roomID)
+	}
+}
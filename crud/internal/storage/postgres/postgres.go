@@ -4,167 +4,306 @@ import (
 	"ChatService/crud/internal/domain/models"
 	"ChatService/crud/internal/storage"
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
-	"os"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 
-	_ "github.com/golang-migrate/migrate/v4/database/sqlite3"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+const uniqueViolation = "23505"
+
 type Storage struct {
-	db *sql.DB
+	pool *pgxpool.Pool
 }
 
-func New(storagePath string) (*Storage, error) {
-	// TODO: with postgres
+func New(ctx context.Context, dsn string, maxConns int32) (*Storage, error) {
 	const op = "storage.postgres.New"
 
-	if _, err := os.Stat("sqlite3://" + storagePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("%s: database file does not exist: %w", op, err)
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if maxConns > 0 {
+		cfg.MaxConns = maxConns
 	}
 
-	db, err := sql.Open("sqlite3", storagePath)
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = db.Ping()
-	if err != nil {
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &Storage{db: db}, nil
+	return &Storage{pool: pool}, nil
 }
 
-func (s *Storage) CreateMessage(ctx context.Context, uid int64, content string, typeOf int32, datetime string) (int64, error) {
+func (s *Storage) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+func (s *Storage) CreateMessage(ctx context.Context, uid int64, roomID int64, reply models.Reply, content string, typeOf int32, attachmentID int64, datetime string) (int64, error) {
 	const op = "storage.postgres.CreateMessage"
 
-	stmt, err := s.db.Prepare("INSERT INTO messages (content, uid, type, datetime) VALUES (?, ?, ?, ?)")
+	var mid int64
+	err := s.pool.QueryRow(ctx,
+		"INSERT INTO messages (content, uid, type, datetime, room_id, parent_id, thread_root_id, attachment_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		content, uid, typeOf, datetime, roomID, reply.ParentID, reply.ThreadRootID, attachmentID,
+	).Scan(&mid)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
-	defer func() {
-		err := stmt.Close()
-		if err != nil {
+	return mid, nil
+}
+
+func (s *Storage) GetMessage(ctx context.Context, mid int64) (models.Message, error) {
+	const op = "storage.postgres.GetMessage"
+
+	var message models.Message
+	var typeOf int32
+	err := s.pool.QueryRow(ctx,
+		"SELECT id, content, uid, type, datetime, room_id, edited_at, revision_count, deleted_at, deleted_by, parent_id, thread_root_id, attachment_id FROM messages WHERE id=$1", mid,
+	).Scan(&message.ID, &message.Content, &message.UserID, &typeOf, &message.DateTime, &message.RoomID, &message.EditedAt, &message.RevisionCount, &message.DeletedAt, &message.DeletedBy, &message.ParentID, &message.ThreadRootID, &message.AttachmentID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Message{}, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
 		}
-	}()
+		return models.Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+	message.Type = typeName(typeOf)
+	return message, nil
+}
 
-	res, err := stmt.ExecContext(ctx, content, uid, typeOf, datetime)
+// DeleteMessage turns a message into a tombstone, the row stays until PurgeDeletedMessages removes it.
+func (s *Storage) DeleteMessage(ctx context.Context, mid int64, deletedBy int64, deletedAt string) (bool, error) {
+	const op = "storage.postgres.DeleteMessage"
+
+	tag, err := s.pool.Exec(ctx,
+		"UPDATE messages SET deleted_at=$1, deleted_by=$2 WHERE id=$3 AND deleted_at=''",
+		deletedAt, deletedBy, mid,
+	)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
 	}
+	return true, nil
+}
+
+func (s *Storage) RestoreMessage(ctx context.Context, mid int64) (bool, error) {
+	const op = "storage.postgres.RestoreMessage"
 
-	mid, err := res.LastInsertId()
+	tag, err := s.pool.Exec(ctx, "UPDATE messages SET deleted_at='', deleted_by=0 WHERE id=$1 AND deleted_at<>''", mid)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return false, fmt.Errorf("%s: %w", op, err)
 	}
-	return mid, nil
+	if tag.RowsAffected() == 0 {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotDeleted)
+	}
+	return true, nil
 }
 
-func (s *Storage) GetMessage(ctx context.Context, mid int64) (models.Message, error) {
-	const op = "storage.postgres.GetMessage"
+// purgeable matches the tombstones deleted before $1. A thread root is kept while a reply survives the purge.
+const purgeable = `deleted_at<>'' AND deleted_at<$1 AND NOT EXISTS (
+            SELECT 1 FROM messages r WHERE r.thread_root_id = messages.id AND (r.deleted_at='' OR r.deleted_at>=$1)
+        )`
+
+// PurgeDeletedMessages hard-deletes tombstones deleted before deletedBefore and returns how many were removed,
+// along with the blob keys of the attachments no message uses anymore. Their rows are deleted, the blobs are
+// left to the caller. Replies to a purged message are moved up to the thread root.
+func (s *Storage) PurgeDeletedMessages(ctx context.Context, deletedBefore string) (int64, []string, error) {
+	const op = "storage.postgres.PurgeDeletedMessages"
 
-	stmt, err := s.db.Prepare("SELECT * FROM messages WHERE id=?")
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return models.Message{}, fmt.Errorf("%s: %w", op, err)
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
 	}
 	defer func() {
-		err := stmt.Close()
-		if err != nil {
-		}
+		_ = tx.Rollback(ctx)
 	}()
 
-	var message models.Message
-	if err := stmt.QueryRowContext(ctx, mid).Scan(&message.ID, &message.Content, &message.UserID, &message.Type, &message.DateTime); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return models.Message{}, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
+	_, err = tx.Exec(ctx, `
+        UPDATE messages SET parent_id = thread_root_id
+        WHERE parent_id IN (SELECT id FROM messages WHERE `+purgeable+`)
+    `, deletedBefore)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Revisions and reactions go with the messages, their foreign keys cascade
+	rows, err := tx.Query(ctx, "DELETE FROM messages WHERE "+purgeable+" RETURNING attachment_id", deletedBefore)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	var n int64
+	var attachmentIDs []int64
+	for rows.Next() {
+		var attachmentID int64
+		if err := rows.Scan(&attachmentID); err != nil {
+			rows.Close()
+			return 0, nil, fmt.Errorf("%s: %w", op, err)
+		}
+		n++
+		if attachmentID != 0 {
+			attachmentIDs = append(attachmentIDs, attachmentID)
 		}
-		return models.Message{}, fmt.Errorf("%s: %w", op, err)
 	}
-	switch message.Type {
-	case "1":
-		message.Type = "text"
-	case "2":
-		message.Type = "image"
-	case "3":
-		message.Type = "file"
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
 	}
-	return message, nil
+
+	var blobKeys []string
+	if len(attachmentIDs) > 0 {
+		// Thumbnails are attachments of their own, they go with the original
+		rows, err = tx.Query(ctx, `
+            WITH unused AS (
+                SELECT id, thumbnail_id FROM attachments a
+                WHERE id = ANY($1) AND NOT EXISTS (SELECT 1 FROM messages m WHERE m.attachment_id = a.id)
+            )
+            DELETE FROM attachments
+            WHERE id IN (SELECT id FROM unused) OR id IN (SELECT thumbnail_id FROM unused)
+            RETURNING blob_key
+        `, attachmentIDs)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", op, err)
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return 0, nil, fmt.Errorf("%s: %w", op, err)
+			}
+			blobKeys = append(blobKeys, key)
+		}
+		if err := rows.Err(); err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, blobKeys, nil
 }
 
-func (s *Storage) DeleteMessage(ctx context.Context, mid int64) (bool, error) {
-	const op = "storage.postgres.DeleteMessage"
-	stmt, err := s.db.Prepare("DELETE from messages WHERE id=?")
+// UpdateMessage replaces the content of a message and keeps the previous content as a revision made by editorID.
+func (s *Storage) UpdateMessage(ctx context.Context, mid int64, editorID int64, newContent string, editedAt string) (bool, error) {
+	const op = "storage.postgres.UpdateMessage"
+
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
 	defer func() {
-		err := stmt.Close()
-		if err != nil {
-
-		}
+		_ = tx.Rollback(ctx)
 	}()
-	res, err := stmt.ExecContext(ctx, mid)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+
+	// The row lock keeps concurrent edits from recording the same previous content twice
+	var oldContent string
+	if err := tx.QueryRow(ctx, "SELECT content FROM messages WHERE id=$1 AND deleted_at='' FOR UPDATE", mid).Scan(&oldContent); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
 		}
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
-	_, err = res.RowsAffected()
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO message_revisions (message_id, content, editor_uid, edited_at) VALUES ($1, $2, $3, $4)",
+		mid, oldContent, editorID, editedAt,
+	)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
-	return true, nil
-}
 
-func (s *Storage) UpdateMessage(ctx context.Context, mid int64, newContent string) (bool, error) {
-	const op = "storage.postgres.UpdateMessage"
-	stmt, err := s.db.Prepare("UPDATE messages SET content=? where id=?")
+	tag, err := tx.Exec(ctx,
+		"UPDATE messages SET content=$1, edited_at=$2, revision_count=revision_count+1 WHERE id=$3",
+		newContent, editedAt, mid,
+	)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
-	defer func() {
-		err := stmt.Close()
-		if err != nil {
-		}
-	}()
 
-	res, err := stmt.ExecContext(ctx, newContent, mid)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
-		}
+	if err := tx.Commit(ctx); err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
-	n, err := res.RowsAffected()
+	return tag.RowsAffected() > 0, nil
+}
+
+// MessageHistory returns the replaced versions of a message, oldest first.
+func (s *Storage) MessageHistory(ctx context.Context, mid int64) ([]models.Revision, error) {
+	const op = "storage.postgres.MessageHistory"
+
+	rows, err := s.pool.Query(ctx,
+		"SELECT id, message_id, content, editor_uid, edited_at FROM message_revisions WHERE message_id=$1 ORDER BY id ASC",
+		mid,
+	)
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
-	return n > 0, nil
+	defer rows.Close()
+
+	var revisions []models.Revision
+	for rows.Next() {
+		var revision models.Revision
+		if err := rows.Scan(&revision.ID, &revision.MessageID, &revision.Content, &revision.EditorID, &revision.EditedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return revisions, nil
 }
 
-func (s *Storage) ShowAllMessages(ctx context.Context, uid int64) ([]models.Message, error) {
+// ShowAllMessages returns a page of the main timeline of a room, replies are left to ThreadReplies.
+func (s *Storage) ShowAllMessages(ctx context.Context, roomID int64, page models.Page) ([]models.Message, error) {
 	const op = "storage.postgres.ShowAllMessages"
+
+	// Walking backwards from before_id (or the newest message) reads in descending
+	// order, the page is flipped back to ascending order below.
 	query := `
-        SELECT id, uid, content, type, datetime 
-        FROM messages 
-        ORDER BY id ASC
+        SELECT m.id, m.uid, m.content, m.type, m.datetime, m.room_id, m.edited_at, m.revision_count,
+               m.deleted_at, m.deleted_by, m.parent_id, m.thread_root_id, m.attachment_id,
+               COUNT(r.id)::integer, COALESCE(MAX(r.datetime), '')
+        FROM messages m
+        LEFT JOIN messages r ON r.thread_root_id = m.id AND r.deleted_at = ''
+        WHERE m.room_id = $1 AND m.thread_root_id = 0 AND m.id < $2
+        GROUP BY m.id
+        ORDER BY m.id DESC
+        LIMIT $3
     `
-	//TODO: integrate users
-	/*answer, err := s.IsBanned(ctx, uid)
-	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+	cursor := page.BeforeID
+	if cursor == 0 {
+		cursor = math.MaxInt64
+	}
+	if page.AfterID != 0 {
+		query = `
+        SELECT m.id, m.uid, m.content, m.type, m.datetime, m.room_id, m.edited_at, m.revision_count,
+               m.deleted_at, m.deleted_by, m.parent_id, m.thread_root_id, m.attachment_id,
+               COUNT(r.id)::integer, COALESCE(MAX(r.datetime), '')
+        FROM messages m
+        LEFT JOIN messages r ON r.thread_root_id = m.id AND r.deleted_at = ''
+        WHERE m.room_id = $1 AND m.thread_root_id = 0 AND m.id > $2
+        GROUP BY m.id
+        ORDER BY m.id ASC
+        LIMIT $3
+    `
+		cursor = page.AfterID
 	}
-	if !answer {
-		return nil, fmt.Errorf("%s: %w", op, storage.Banned)
-	}*/
 
-	rows, err := s.db.QueryContext(ctx, query)
+	rows, err := s.pool.Query(ctx, query, roomID, cursor, page.Limit)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
@@ -173,23 +312,27 @@ func (s *Storage) ShowAllMessages(ctx context.Context, uid int64) ([]models.Mess
 	var messages []models.Message
 	for rows.Next() {
 		var msg models.Message
+		var typeOf int32
 		if err := rows.Scan(
 			&msg.ID,
 			&msg.UserID,
 			&msg.Content,
-			&msg.Type,
+			&typeOf,
 			&msg.DateTime,
+			&msg.RoomID,
+			&msg.EditedAt,
+			&msg.RevisionCount,
+			&msg.DeletedAt,
+			&msg.DeletedBy,
+			&msg.ParentID,
+			&msg.ThreadRootID,
+			&msg.AttachmentID,
+			&msg.ReplyCount,
+			&msg.LastReplyAt,
 		); err != nil {
 			return nil, fmt.Errorf("%s: %w", op, err)
 		}
-		switch msg.Type {
-		case "1":
-			msg.Type = "text"
-		case "2":
-			msg.Type = "image"
-		case "3":
-			msg.Type = "file"
-		}
+		msg.Type = typeName(typeOf)
 		messages = append(messages, msg)
 	}
 
@@ -201,28 +344,488 @@ func (s *Storage) ShowAllMessages(ctx context.Context, uid int64) ([]models.Mess
 		return make([]models.Message, 0), storage.ErrNoMessagesFound
 	}
 
+	if page.AfterID == 0 {
+		slices.Reverse(messages)
+	}
 	return messages, nil
 }
 
-func (s *Storage) IsBanned(ctx context.Context, uid int64) (bool, error) {
-	const op = "storage.postgres.IsBanned"
-	stmt, err := s.db.Prepare("SELECT role FROM users WHERE id=?")
+// ThreadReplies returns the replies of a thread after page.AfterID, oldest first.
+func (s *Storage) ThreadReplies(ctx context.Context, rootID int64, page models.Page) ([]models.Message, error) {
+	const op = "storage.postgres.ThreadReplies"
+	query := `
+        SELECT id, uid, content, type, datetime, room_id, edited_at, revision_count,
+               deleted_at, deleted_by, parent_id, thread_root_id, attachment_id
+        FROM messages
+        WHERE thread_root_id = $1 AND id > $2
+        ORDER BY id ASC
+        LIMIT $3
+    `
+
+	rows, err := s.pool.Query(ctx, query, rootID, page.AfterID, page.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var msg models.Message
+		var typeOf int32
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.Content,
+			&typeOf,
+			&msg.DateTime,
+			&msg.RoomID,
+			&msg.EditedAt,
+			&msg.RevisionCount,
+			&msg.DeletedAt,
+			&msg.DeletedBy,
+			&msg.ParentID,
+			&msg.ThreadRootID,
+			&msg.AttachmentID,
+		); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		msg.Type = typeName(typeOf)
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return messages, nil
+}
+
+// AddReaction records that uid reacted to a message with emoji, it returns false if that reaction already exists.
+func (s *Storage) AddReaction(ctx context.Context, mid int64, uid int64, emoji string, createdAt string) (bool, error) {
+	const op = "storage.postgres.AddReaction"
+
+	tag, err := s.pool.Exec(ctx,
+		"INSERT INTO reactions (message_id, user_id, emoji, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+		mid, uid, emoji, createdAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// RemoveReaction deletes a reaction of uid, it returns false if there was none.
+func (s *Storage) RemoveReaction(ctx context.Context, mid int64, uid int64, emoji string) (bool, error) {
+	const op = "storage.postgres.RemoveReaction"
+
+	tag, err := s.pool.Exec(ctx, "DELETE FROM reactions WHERE message_id=$1 AND user_id=$2 AND emoji=$3", mid, uid, emoji)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// MessageReactions aggregates the reactions of several messages, ReactedByMe is set for the reactions of uid.
+// Emojis of one message come in the order they were first used.
+func (s *Storage) MessageReactions(ctx context.Context, mids []int64, uid int64) (map[int64][]models.Reaction, error) {
+	const op = "storage.postgres.MessageReactions"
+
+	reactions := make(map[int64][]models.Reaction, len(mids))
+	if len(mids) == 0 {
+		return reactions, nil
+	}
+
+	query := `
+        SELECT message_id, emoji, COUNT(*)::integer, bool_or(user_id = $2)
+        FROM reactions
+        WHERE message_id = ANY($1)
+        GROUP BY message_id, emoji
+        ORDER BY message_id, MIN(id)
+    `
+
+	rows, err := s.pool.Query(ctx, query, mids, uid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mid int64
+		var reaction models.Reaction
+		if err := rows.Scan(&mid, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		reactions[mid] = append(reactions[mid], reaction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return reactions, nil
+}
+
+func (s *Storage) SaveAttachment(ctx context.Context, attachment models.Attachment) (int64, error) {
+	const op = "storage.postgres.SaveAttachment"
+
+	var id int64
+	err := s.pool.QueryRow(ctx,
+		"INSERT INTO attachments (uid, room_id, file_name, mime_type, size, sha256, blob_key, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		attachment.UserID, attachment.RoomID, attachment.FileName, attachment.MimeType,
+		attachment.Size, attachment.SHA256, attachment.BlobKey, attachment.CreatedAt,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+func (s *Storage) GetAttachment(ctx context.Context, id int64) (models.Attachment, error) {
+	const op = "storage.postgres.GetAttachment"
+
+	attachments, err := s.Attachments(ctx, []int64{id})
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, err)
+	}
+	attachment, ok := attachments[id]
+	if !ok {
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, storage.ErrAttachmentNotExist)
+	}
+	return attachment, nil
+}
+
+// SetAttachmentImage records the size of an image and the attachment holding its thumbnail.
+func (s *Storage) SetAttachmentImage(ctx context.Context, id int64, width int32, height int32, thumbnailID int64) error {
+	const op = "storage.postgres.SetAttachmentImage"
+
+	tag, err := s.pool.Exec(ctx,
+		"UPDATE attachments SET width=$1, height=$2, thumbnail_id=$3 WHERE id=$4",
+		width, height, thumbnailID, id,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrAttachmentNotExist)
+	}
+	return nil
+}
+
+// Attachments loads the metadata of several attachments at once, unknown ids are left out of the map.
+func (s *Storage) Attachments(ctx context.Context, ids []int64) (map[int64]models.Attachment, error) {
+	const op = "storage.postgres.Attachments"
+
+	attachments := make(map[int64]models.Attachment, len(ids))
+	if len(ids) == 0 {
+		return attachments, nil
+	}
+
+	rows, err := s.pool.Query(ctx, `
+        SELECT id, uid, room_id, file_name, mime_type, size, sha256, blob_key, created_at, width, height, thumbnail_id
+        FROM attachments
+        WHERE id = ANY($1)
+    `, ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Attachment
+		if err := rows.Scan(&a.ID, &a.UserID, &a.RoomID, &a.FileName, &a.MimeType, &a.Size, &a.SHA256, &a.BlobKey, &a.CreatedAt, &a.Width, &a.Height, &a.ThumbnailID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		attachments[a.ID] = a
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return attachments, nil
+}
+
+// SearchMessages returns the newest matches older than page.BeforeID among the rooms uid is a member of.
+// Deleted messages are never matched.
+func (s *Storage) SearchMessages(ctx context.Context, uid int64, filter models.SearchFilter, page models.Page) ([]models.SearchHit, error) {
+	const op = "storage.postgres.SearchMessages"
+
+	cursor := page.BeforeID
+	if cursor == 0 {
+		cursor = math.MaxInt64
+	}
+
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	tsQuery := "plainto_tsquery('simple', " + arg(filter.Query) + ")"
+	headline := fmt.Sprintf("StartSel=%s, StopSel=%s, MinWords=8, MaxWords=16", models.HighlightStart, models.HighlightEnd)
+	where := []string{
+		"m.search_vector @@ " + tsQuery,
+		"m.deleted_at = ''",
+		"m.id < " + arg(cursor),
+		"m.room_id IN (SELECT room_id FROM room_members WHERE uid = " + arg(uid) + ")",
+	}
+	if filter.RoomID != 0 {
+		where = append(where, "m.room_id = "+arg(filter.RoomID))
+	}
+	if filter.AuthorID != 0 {
+		where = append(where, "m.uid = "+arg(filter.AuthorID))
+	}
+	if filter.Type != 0 {
+		where = append(where, "m.type = "+arg(filter.Type))
+	}
+	if filter.DateFrom != "" {
+		where = append(where, "m.datetime >= "+arg(filter.DateFrom))
+	}
+	if filter.DateTo != "" {
+		where = append(where, "m.datetime < "+arg(filter.DateTo))
+	}
+
+	query := `
+        SELECT m.id, m.uid, m.content, m.type, m.datetime, m.room_id, m.edited_at, m.revision_count,
+               m.deleted_at, m.deleted_by, m.parent_id, m.thread_root_id, m.attachment_id,
+               ts_headline('simple', m.content, ` + tsQuery + `, ` + arg(headline) + `)
+        FROM messages m
+        WHERE ` + strings.Join(where, " AND ") + `
+        ORDER BY m.id DESC
+        LIMIT ` + arg(page.Limit)
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var hits []models.SearchHit
+	for rows.Next() {
+		var hit models.SearchHit
+		var typeOf int32
+		msg := &hit.Message
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.Content,
+			&typeOf,
+			&msg.DateTime,
+			&msg.RoomID,
+			&msg.EditedAt,
+			&msg.RevisionCount,
+			&msg.DeletedAt,
+			&msg.DeletedBy,
+			&msg.ParentID,
+			&msg.ThreadRootID,
+			&msg.AttachmentID,
+			&hit.Snippet,
+		); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		msg.Type = typeName(typeOf)
+		hits = append(hits, hit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return hits, nil
+}
+
+func (s *Storage) CreateRoom(ctx context.Context, ownerID int64, name string, public bool, createdAt string) (int64, error) {
+	const op = "storage.postgres.CreateRoom"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
 	defer func() {
-		err := stmt.Close()
-		if err != nil {
+		_ = tx.Rollback(ctx)
+	}()
+
+	var roomID int64
+	err = tx.QueryRow(ctx,
+		"INSERT INTO rooms (name, owner_uid, public, created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		name, ownerID, public, createdAt,
+	).Scan(&roomID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrRoomExist)
 		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// The owner is the first member of the room
+	if _, err := tx.Exec(ctx, "INSERT INTO room_members (room_id, uid, joined_at) VALUES ($1, $2, $3)", roomID, ownerID, createdAt); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return roomID, nil
+}
+
+// AddRoomMember lets uid join a public room, or a private one it is invited to. The invite is used up
+// by the join, storage.ErrNotInvited is returned without one. Members joining again are left as they are.
+func (s *Storage) AddRoomMember(ctx context.Context, roomID int64, uid int64, joinedAt string) (bool, error) {
+	const op = "storage.postgres.AddRoomMember"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
 	}()
 
-	var role int
-	if err := stmt.QueryRowContext(ctx, uid).Scan(&role); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
+	var public bool
+	if err := tx.QueryRow(ctx, "SELECT public FROM rooms WHERE id=$1", roomID).Scan(&public); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, fmt.Errorf("%s: %w", op, storage.ErrRoomNotExist)
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if !public {
+		tag, err := tx.Exec(ctx, "DELETE FROM room_invites WHERE room_id=$1 AND uid=$2", roomID, uid)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", op, err)
 		}
+		if tag.RowsAffected() == 0 {
+			var member bool
+			err := tx.QueryRow(ctx,
+				"SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id=$1 AND uid=$2)", roomID, uid,
+			).Scan(&member)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", op, err)
+			}
+			if !member {
+				return false, fmt.Errorf("%s: %w", op, storage.ErrNotInvited)
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO room_members (room_id, uid, joined_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		roomID, uid, joinedAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return true, nil
+}
+
+// InviteRoomMember lets uid join the room once, it returns false when uid is already a member or invited.
+func (s *Storage) InviteRoomMember(ctx context.Context, roomID int64, invitedBy int64, uid int64, createdAt string) (bool, error) {
+	const op = "storage.postgres.InviteRoomMember"
+
+	if err := s.roomExists(ctx, roomID); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tag, err := s.pool.Exec(ctx, `
+        INSERT INTO room_invites (room_id, uid, invited_by, created_at)
+        SELECT $1, $2, $3, $4
+        WHERE NOT EXISTS (SELECT 1 FROM room_members WHERE room_id=$1 AND uid=$2)
+        ON CONFLICT DO NOTHING
+    `, roomID, uid, invitedBy, createdAt)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *Storage) RemoveRoomMember(ctx context.Context, roomID int64, uid int64) (bool, error) {
+	const op = "storage.postgres.RemoveRoomMember"
+
+	if err := s.roomExists(ctx, roomID); err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return role == 0, nil
+	tag, err := s.pool.Exec(ctx, "DELETE FROM room_members WHERE room_id=$1 AND uid=$2", roomID, uid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrNotRoomMember)
+	}
+	return true, nil
+}
+
+func (s *Storage) IsRoomMember(ctx context.Context, roomID int64, uid int64) (bool, error) {
+	const op = "storage.postgres.IsRoomMember"
+
+	if err := s.roomExists(ctx, roomID); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var member bool
+	err := s.pool.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id=$1 AND uid=$2)", roomID, uid,
+	).Scan(&member)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return member, nil
+}
+
+// ListRooms returns the public rooms and the private ones uid is a member of or invited to.
+func (s *Storage) ListRooms(ctx context.Context, uid int64) ([]models.Room, error) {
+	const op = "storage.postgres.ListRooms"
+	query := `
+        SELECT r.id, r.name, r.owner_uid, r.created_at, r.public, m.uid IS NOT NULL, i.uid IS NOT NULL
+        FROM rooms r
+        LEFT JOIN room_members m ON m.room_id = r.id AND m.uid = $1
+        LEFT JOIN room_invites i ON i.room_id = r.id AND i.uid = $1
+        WHERE r.public OR m.uid IS NOT NULL OR i.uid IS NOT NULL
+        ORDER BY r.id ASC
+    `
+
+	rows, err := s.pool.Query(ctx, query, uid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var rooms []models.Room
+	for rows.Next() {
+		var room models.Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.OwnerID, &room.CreatedAt, &room.Public, &room.IsMember, &room.IsInvited); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return rooms, nil
+}
+
+func (s *Storage) roomExists(ctx context.Context, roomID int64) error {
+	var id int64
+	err := s.pool.QueryRow(ctx, "SELECT id FROM rooms WHERE id=$1", roomID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storage.ErrRoomNotExist
+		}
+		return err
+	}
+	return nil
+}
+
+func typeName(typeOf int32) string {
+	switch typeOf {
+	case 1:
+		return "text"
+	case 2:
+		return "image"
+	case 3:
+		return "file"
+	}
+	return strconv.Itoa(int(typeOf))
 }
@@ -0,0 +1,104 @@
+package postgres_test
+
+import (
+	"ChatService/crud/internal/storage/postgres"
+	"ChatService/crud/internal/storage/storagetest"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const migrationsPath = "../../../config/migrations/goose"
+
+// dsnEnv names the database the suite runs against, every case gets its own schema there
+const dsnEnv = "TEST_STORAGE_DSN"
+
+func TestStorage(t *testing.T) {
+	dsn := os.Getenv(dsnEnv)
+	if dsn == "" {
+		t.Skip(dsnEnv + " is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		ctx := context.Background()
+		schema := fmt.Sprintf("storagetest_%d", time.Now().UnixNano())
+
+		conn, err := pgx.Connect(ctx, dsn)
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		defer func() { _ = conn.Close(ctx) }()
+		if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+			t.Fatalf("create schema: %v", err)
+		}
+		t.Cleanup(func() {
+			conn, err := pgx.Connect(ctx, dsn)
+			if err != nil {
+				t.Errorf("connect: %v", err)
+				return
+			}
+			defer func() { _ = conn.Close(ctx) }()
+			if _, err := conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+				t.Errorf("drop schema: %v", err)
+			}
+		})
+
+		if _, err := conn.Exec(ctx, "SET search_path TO "+schema); err != nil {
+			t.Fatalf("set search_path: %v", err)
+		}
+		migrateUp(t, ctx, conn)
+
+		s, err := postgres.New(ctx, withSearchPath(t, dsn, schema), 4)
+		if err != nil {
+			t.Fatalf("postgres.New: %v", err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		return s
+	})
+}
+
+// migrateUp applies the Up sections of the goose migrations in order, the suite does not depend on goose itself.
+func migrateUp(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(migrationsPath, "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(raw), "-- +goose Down")
+		if _, err := conn.Exec(ctx, up); err != nil {
+			t.Fatalf("migrate %s: %v", filepath.Base(file), err)
+		}
+	}
+}
+
+// withSearchPath points every connection of the pool at schema, for URL and keyword/value DSNs alike
+func withSearchPath(t *testing.T, dsn, schema string) string {
+	t.Helper()
+
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("parse %s: %v", dsnEnv, err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
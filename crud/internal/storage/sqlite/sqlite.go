@@ -0,0 +1,1022 @@
+package sqlite
+
+import (
+	"ChatService/crud/internal/domain/models"
+	"ChatService/crud/internal/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/mattn/go-sqlite3"
+)
+
+type Storage struct {
+	db *sql.DB
+}
+
+// ErrFTS5Unavailable is returned by New when go-sqlite3 was built without the sqlite_fts5 tag.
+// The triggers of messages_fts fail every insert and update of messages without it.
+var ErrFTS5Unavailable = errors.New("sqlite is built without FTS5, build with -tags sqlite_fts5")
+
+func New(storagePath string) (*Storage, error) {
+	const op = "storage.sqlite.New"
+
+	if _, err := os.Stat(storagePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: database file does not exist: %w", op, err)
+	}
+
+	db, err := sql.Open("sqlite3", storagePath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !fts5 {
+		_ = db.Close()
+		return nil, fmt.Errorf("%s: %w", op, ErrFTS5Unavailable)
+	}
+
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) CreateMessage(ctx context.Context, uid int64, roomID int64, reply models.Reply, content string, typeOf int32, attachmentID int64, datetime string) (int64, error) {
+	const op = "storage.sqlite.CreateMessage"
+
+	stmt, err := s.db.Prepare("INSERT INTO messages (content, uid, type, datetime, room_id, parent_id, thread_root_id, attachment_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, content, uid, typeOf, datetime, roomID, reply.ParentID, reply.ThreadRootID, attachmentID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	mid, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return mid, nil
+}
+
+func (s *Storage) GetMessage(ctx context.Context, mid int64) (models.Message, error) {
+	const op = "storage.sqlite.GetMessage"
+
+	stmt, err := s.db.Prepare("SELECT id, content, uid, type, datetime, room_id, edited_at, revision_count, deleted_at, deleted_by, parent_id, thread_root_id, attachment_id FROM messages WHERE id=?")
+	if err != nil {
+		return models.Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	var message models.Message
+	if err := stmt.QueryRowContext(ctx, mid).Scan(&message.ID, &message.Content, &message.UserID, &message.Type, &message.DateTime, &message.RoomID, &message.EditedAt, &message.RevisionCount, &message.DeletedAt, &message.DeletedBy, &message.ParentID, &message.ThreadRootID, &message.AttachmentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Message{}, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
+		}
+		return models.Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+	message.Type = typeName(message.Type)
+	return message, nil
+}
+
+// DeleteMessage turns a message into a tombstone, the row stays until PurgeDeletedMessages removes it.
+func (s *Storage) DeleteMessage(ctx context.Context, mid int64, deletedBy int64, deletedAt string) (bool, error) {
+	const op = "storage.sqlite.DeleteMessage"
+	stmt, err := s.db.Prepare("UPDATE messages SET deleted_at=?, deleted_by=? WHERE id=? AND deleted_at=''")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, deletedAt, deletedBy, mid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
+	}
+	return true, nil
+}
+
+func (s *Storage) RestoreMessage(ctx context.Context, mid int64) (bool, error) {
+	const op = "storage.sqlite.RestoreMessage"
+	stmt, err := s.db.Prepare("UPDATE messages SET deleted_at='', deleted_by=0 WHERE id=? AND deleted_at<>''")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, mid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotDeleted)
+	}
+	return true, nil
+}
+
+// purgeable matches the tombstones deleted before the first argument. A thread root is kept while a reply
+// survives the purge, the second argument is the same time again.
+const purgeable = `deleted_at<>'' AND deleted_at<? AND NOT EXISTS (
+            SELECT 1 FROM messages r WHERE r.thread_root_id = messages.id AND (r.deleted_at='' OR r.deleted_at>=?)
+        )`
+
+// PurgeDeletedMessages hard-deletes tombstones deleted before deletedBefore and returns how many were removed,
+// along with the blob keys of the attachments no message uses anymore. Their rows are deleted, the blobs are
+// left to the caller. Replies to a purged message are moved up to the thread root.
+func (s *Storage) PurgeDeletedMessages(ctx context.Context, deletedBefore string) (int64, []string, error) {
+	const op = "storage.sqlite.PurgeDeletedMessages"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Foreign keys are not enforced by sqlite3 by default, so the revisions and reactions go explicitly
+	for _, table := range []string{"message_revisions", "reactions"} {
+		_, err = tx.ExecContext(ctx, `
+        DELETE FROM `+table+`
+        WHERE message_id IN (SELECT id FROM messages WHERE `+purgeable+`)
+    `, deletedBefore, deletedBefore)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+        UPDATE messages SET parent_id = thread_root_id
+        WHERE parent_id IN (SELECT id FROM messages WHERE `+purgeable+`)
+    `, deletedBefore, deletedBefore)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "DELETE FROM messages WHERE "+purgeable+" RETURNING attachment_id", deletedBefore, deletedBefore)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	var n int64
+	var attachmentIDs []int64
+	for rows.Next() {
+		var attachmentID int64
+		if err := rows.Scan(&attachmentID); err != nil {
+			_ = rows.Close()
+			return 0, nil, fmt.Errorf("%s: %w", op, err)
+		}
+		n++
+		if attachmentID != 0 {
+			attachmentIDs = append(attachmentIDs, attachmentID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	blobKeys, err := deleteUnusedAttachments(ctx, tx, attachmentIDs)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, blobKeys, nil
+}
+
+// deleteUnusedAttachments deletes those of ids that no message uses, with their thumbnails, and returns their blob keys.
+func deleteUnusedAttachments(ctx context.Context, tx *sql.Tx, ids []int64) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, thumbnail_id FROM attachments a
+        WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+          AND NOT EXISTS (SELECT 1 FROM messages m WHERE m.attachment_id = a.id)
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	var unused []any
+	for rows.Next() {
+		var id, thumbnailID int64
+		if err := rows.Scan(&id, &thumbnailID); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		unused = append(unused, id)
+		if thumbnailID != 0 {
+			unused = append(unused, thumbnailID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(unused) == 0 {
+		return nil, nil
+	}
+
+	rows, err = tx.QueryContext(ctx, "DELETE FROM attachments WHERE id IN (?"+strings.Repeat(", ?", len(unused)-1)+") RETURNING blob_key", unused...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobKeys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		blobKeys = append(blobKeys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return blobKeys, nil
+}
+
+// UpdateMessage replaces the content of a message and keeps the previous content as a revision made by editorID.
+func (s *Storage) UpdateMessage(ctx context.Context, mid int64, editorID int64, newContent string, editedAt string) (bool, error) {
+	const op = "storage.sqlite.UpdateMessage"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var oldContent string
+	if err := tx.QueryRowContext(ctx, "SELECT content FROM messages WHERE id=? AND deleted_at=''", mid).Scan(&oldContent); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, fmt.Errorf("%s: %w", op, storage.ErrMessageNotExist)
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO message_revisions (message_id, content, editor_uid, edited_at) VALUES (?, ?, ?, ?)",
+		mid, oldContent, editorID, editedAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE messages SET content=?, edited_at=?, revision_count=revision_count+1 WHERE id=?",
+		newContent, editedAt, mid,
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return n > 0, nil
+}
+
+// MessageHistory returns the replaced versions of a message, oldest first.
+func (s *Storage) MessageHistory(ctx context.Context, mid int64) ([]models.Revision, error) {
+	const op = "storage.sqlite.MessageHistory"
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, message_id, content, editor_uid, edited_at FROM message_revisions WHERE message_id=? ORDER BY id ASC",
+		mid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var revisions []models.Revision
+	for rows.Next() {
+		var revision models.Revision
+		if err := rows.Scan(&revision.ID, &revision.MessageID, &revision.Content, &revision.EditorID, &revision.EditedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return revisions, nil
+}
+
+// ShowAllMessages returns a page of the main timeline of a room, replies are left to ThreadReplies.
+func (s *Storage) ShowAllMessages(ctx context.Context, roomID int64, page models.Page) ([]models.Message, error) {
+	const op = "storage.sqlite.ShowAllMessages"
+
+	// Walking backwards from before_id (or the newest message) reads in descending
+	// order, the page is flipped back to ascending order below.
+	query := `
+        SELECT m.id, m.uid, m.content, m.type, m.datetime, m.room_id, m.edited_at, m.revision_count,
+               m.deleted_at, m.deleted_by, m.parent_id, m.thread_root_id, m.attachment_id,
+               COUNT(r.id), COALESCE(MAX(r.datetime), '')
+        FROM messages m
+        LEFT JOIN messages r ON r.thread_root_id = m.id AND r.deleted_at = ''
+        WHERE m.room_id = ? AND m.thread_root_id = 0 AND m.id < ?
+        GROUP BY m.id
+        ORDER BY m.id DESC
+        LIMIT ?
+    `
+	cursor := page.BeforeID
+	if cursor == 0 {
+		cursor = math.MaxInt64
+	}
+	if page.AfterID != 0 {
+		query = `
+        SELECT m.id, m.uid, m.content, m.type, m.datetime, m.room_id, m.edited_at, m.revision_count,
+               m.deleted_at, m.deleted_by, m.parent_id, m.thread_root_id, m.attachment_id,
+               COUNT(r.id), COALESCE(MAX(r.datetime), '')
+        FROM messages m
+        LEFT JOIN messages r ON r.thread_root_id = m.id AND r.deleted_at = ''
+        WHERE m.room_id = ? AND m.thread_root_id = 0 AND m.id > ?
+        GROUP BY m.id
+        ORDER BY m.id ASC
+        LIMIT ?
+    `
+		cursor = page.AfterID
+	}
+	rows, err := s.db.QueryContext(ctx, query, roomID, cursor, page.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var msg models.Message
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.Content,
+			&msg.Type,
+			&msg.DateTime,
+			&msg.RoomID,
+			&msg.EditedAt,
+			&msg.RevisionCount,
+			&msg.DeletedAt,
+			&msg.DeletedBy,
+			&msg.ParentID,
+			&msg.ThreadRootID,
+			&msg.AttachmentID,
+			&msg.ReplyCount,
+			&msg.LastReplyAt,
+		); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		msg.Type = typeName(msg.Type)
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(messages) == 0 {
+		return make([]models.Message, 0), storage.ErrNoMessagesFound
+	}
+
+	if page.AfterID == 0 {
+		slices.Reverse(messages)
+	}
+	return messages, nil
+}
+
+// ThreadReplies returns the replies of a thread after page.AfterID, oldest first.
+func (s *Storage) ThreadReplies(ctx context.Context, rootID int64, page models.Page) ([]models.Message, error) {
+	const op = "storage.sqlite.ThreadReplies"
+	query := `
+        SELECT id, uid, content, type, datetime, room_id, edited_at, revision_count,
+               deleted_at, deleted_by, parent_id, thread_root_id, attachment_id
+        FROM messages
+        WHERE thread_root_id = ? AND id > ?
+        ORDER BY id ASC
+        LIMIT ?
+    `
+
+	rows, err := s.db.QueryContext(ctx, query, rootID, page.AfterID, page.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var msg models.Message
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.Content,
+			&msg.Type,
+			&msg.DateTime,
+			&msg.RoomID,
+			&msg.EditedAt,
+			&msg.RevisionCount,
+			&msg.DeletedAt,
+			&msg.DeletedBy,
+			&msg.ParentID,
+			&msg.ThreadRootID,
+			&msg.AttachmentID,
+		); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		msg.Type = typeName(msg.Type)
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return messages, nil
+}
+
+// AddReaction records that uid reacted to a message with emoji, it returns false if that reaction already exists.
+func (s *Storage) AddReaction(ctx context.Context, mid int64, uid int64, emoji string, createdAt string) (bool, error) {
+	const op = "storage.sqlite.AddReaction"
+	stmt, err := s.db.Prepare("INSERT OR IGNORE INTO reactions (message_id, user_id, emoji, created_at) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, mid, uid, emoji, createdAt)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return n > 0, nil
+}
+
+// RemoveReaction deletes a reaction of uid, it returns false if there was none.
+func (s *Storage) RemoveReaction(ctx context.Context, mid int64, uid int64, emoji string) (bool, error) {
+	const op = "storage.sqlite.RemoveReaction"
+	stmt, err := s.db.Prepare("DELETE FROM reactions WHERE message_id=? AND user_id=? AND emoji=?")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, mid, uid, emoji)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return n > 0, nil
+}
+
+// MessageReactions aggregates the reactions of several messages, ReactedByMe is set for the reactions of uid.
+// Emojis of one message come in the order they were first used.
+func (s *Storage) MessageReactions(ctx context.Context, mids []int64, uid int64) (map[int64][]models.Reaction, error) {
+	const op = "storage.sqlite.MessageReactions"
+
+	reactions := make(map[int64][]models.Reaction, len(mids))
+	if len(mids) == 0 {
+		return reactions, nil
+	}
+
+	args := make([]any, 0, len(mids)+1)
+	args = append(args, uid)
+	for _, mid := range mids {
+		args = append(args, mid)
+	}
+	query := `
+        SELECT message_id, emoji, COUNT(*), MAX(user_id = ?)
+        FROM reactions
+        WHERE message_id IN (?` + strings.Repeat(", ?", len(mids)-1) + `)
+        GROUP BY message_id, emoji
+        ORDER BY message_id, MIN(id)
+    `
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mid int64
+		var reaction models.Reaction
+		if err := rows.Scan(&mid, &reaction.Emoji, &reaction.Count, &reaction.ReactedByMe); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		reactions[mid] = append(reactions[mid], reaction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return reactions, nil
+}
+
+func (s *Storage) SaveAttachment(ctx context.Context, attachment models.Attachment) (int64, error) {
+	const op = "storage.sqlite.SaveAttachment"
+
+	stmt, err := s.db.Prepare("INSERT INTO attachments (uid, room_id, file_name, mime_type, size, sha256, blob_key, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, attachment.UserID, attachment.RoomID, attachment.FileName, attachment.MimeType,
+		attachment.Size, attachment.SHA256, attachment.BlobKey, attachment.CreatedAt)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+func (s *Storage) GetAttachment(ctx context.Context, id int64) (models.Attachment, error) {
+	const op = "storage.sqlite.GetAttachment"
+
+	attachments, err := s.Attachments(ctx, []int64{id})
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, err)
+	}
+	attachment, ok := attachments[id]
+	if !ok {
+		return models.Attachment{}, fmt.Errorf("%s: %w", op, storage.ErrAttachmentNotExist)
+	}
+	return attachment, nil
+}
+
+// SetAttachmentImage records the size of an image and the attachment holding its thumbnail.
+func (s *Storage) SetAttachmentImage(ctx context.Context, id int64, width int32, height int32, thumbnailID int64) error {
+	const op = "storage.sqlite.SetAttachmentImage"
+
+	stmt, err := s.db.Prepare("UPDATE attachments SET width=?, height=?, thumbnail_id=? WHERE id=?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, width, height, thumbnailID, id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrAttachmentNotExist)
+	}
+	return nil
+}
+
+// Attachments loads the metadata of several attachments at once, unknown ids are left out of the map.
+func (s *Storage) Attachments(ctx context.Context, ids []int64) (map[int64]models.Attachment, error) {
+	const op = "storage.sqlite.Attachments"
+
+	attachments := make(map[int64]models.Attachment, len(ids))
+	if len(ids) == 0 {
+		return attachments, nil
+	}
+
+	args := make([]any, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := `
+        SELECT id, uid, room_id, file_name, mime_type, size, sha256, blob_key, created_at, width, height, thumbnail_id
+        FROM attachments
+        WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+    `
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Attachment
+		if err := rows.Scan(&a.ID, &a.UserID, &a.RoomID, &a.FileName, &a.MimeType, &a.Size, &a.SHA256, &a.BlobKey, &a.CreatedAt, &a.Width, &a.Height, &a.ThumbnailID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		attachments[a.ID] = a
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return attachments, nil
+}
+
+// SearchMessages returns the newest matches older than page.BeforeID among the rooms uid is a member of.
+// Deleted messages are never matched.
+func (s *Storage) SearchMessages(ctx context.Context, uid int64, filter models.SearchFilter, page models.Page) ([]models.SearchHit, error) {
+	const op = "storage.sqlite.SearchMessages"
+
+	cursor := page.BeforeID
+	if cursor == 0 {
+		cursor = math.MaxInt64
+	}
+
+	where := []string{
+		"messages_fts MATCH ?",
+		"m.deleted_at = ''",
+		"m.id < ?",
+		"m.room_id IN (SELECT room_id FROM room_members WHERE uid = ?)",
+	}
+	args := []any{models.HighlightStart, models.HighlightEnd, ftsQuery(filter.Query), cursor, uid}
+	if filter.RoomID != 0 {
+		where = append(where, "m.room_id = ?")
+		args = append(args, filter.RoomID)
+	}
+	if filter.AuthorID != 0 {
+		where = append(where, "m.uid = ?")
+		args = append(args, filter.AuthorID)
+	}
+	if filter.Type != 0 {
+		where = append(where, "m.type = ?")
+		args = append(args, filter.Type)
+	}
+	if filter.DateFrom != "" {
+		where = append(where, "m.datetime >= ?")
+		args = append(args, filter.DateFrom)
+	}
+	if filter.DateTo != "" {
+		where = append(where, "m.datetime < ?")
+		args = append(args, filter.DateTo)
+	}
+	args = append(args, page.Limit)
+
+	query := `
+        SELECT m.id, m.uid, m.content, m.type, m.datetime, m.room_id, m.edited_at, m.revision_count,
+               m.deleted_at, m.deleted_by, m.parent_id, m.thread_root_id, m.attachment_id,
+               snippet(messages_fts, 0, ?, ?, '…', 16)
+        FROM messages_fts
+        JOIN messages m ON m.id = messages_fts.rowid
+        WHERE ` + strings.Join(where, " AND ") + `
+        ORDER BY m.id DESC
+        LIMIT ?
+    `
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var hits []models.SearchHit
+	for rows.Next() {
+		var hit models.SearchHit
+		msg := &hit.Message
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.UserID,
+			&msg.Content,
+			&msg.Type,
+			&msg.DateTime,
+			&msg.RoomID,
+			&msg.EditedAt,
+			&msg.RevisionCount,
+			&msg.DeletedAt,
+			&msg.DeletedBy,
+			&msg.ParentID,
+			&msg.ThreadRootID,
+			&msg.AttachmentID,
+			&hit.Snippet,
+		); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		msg.Type = typeName(msg.Type)
+		hits = append(hits, hit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return hits, nil
+}
+
+func (s *Storage) CreateRoom(ctx context.Context, ownerID int64, name string, public bool, createdAt string) (int64, error) {
+	const op = "storage.sqlite.CreateRoom"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO rooms (name, owner_uid, public, created_at) VALUES (?, ?, ?, ?)", name, ownerID, public, createdAt)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintUnique) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrRoomExist)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	roomID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// The owner is the first member of the room
+	if _, err := tx.ExecContext(ctx, "INSERT INTO room_members (room_id, uid, joined_at) VALUES (?, ?, ?)", roomID, ownerID, createdAt); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return roomID, nil
+}
+
+// AddRoomMember lets uid join a public room, or a private one it is invited to. The invite is used up
+// by the join, storage.ErrNotInvited is returned without one. Members joining again are left as they are.
+func (s *Storage) AddRoomMember(ctx context.Context, roomID int64, uid int64, joinedAt string) (bool, error) {
+	const op = "storage.sqlite.AddRoomMember"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var public bool
+	if err := tx.QueryRowContext(ctx, "SELECT public FROM rooms WHERE id=?", roomID).Scan(&public); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, fmt.Errorf("%s: %w", op, storage.ErrRoomNotExist)
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if !public {
+		res, err := tx.ExecContext(ctx, "DELETE FROM room_invites WHERE room_id=? AND uid=?", roomID, uid)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		invited, err := res.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		if invited == 0 {
+			var member bool
+			err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id=? AND uid=?)", roomID, uid).Scan(&member)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", op, err)
+			}
+			if !member {
+				return false, fmt.Errorf("%s: %w", op, storage.ErrNotInvited)
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO room_members (room_id, uid, joined_at) VALUES (?, ?, ?)", roomID, uid, joinedAt); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return true, nil
+}
+
+// InviteRoomMember lets uid join the room once, it returns false when uid is already a member or invited.
+func (s *Storage) InviteRoomMember(ctx context.Context, roomID int64, invitedBy int64, uid int64, createdAt string) (bool, error) {
+	const op = "storage.sqlite.InviteRoomMember"
+
+	if err := s.roomExists(ctx, roomID); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	stmt, err := s.db.Prepare(`
+        INSERT OR IGNORE INTO room_invites (room_id, uid, invited_by, created_at)
+        SELECT ?, ?, ?, ?
+        WHERE NOT EXISTS (SELECT 1 FROM room_members WHERE room_id=? AND uid=?)
+    `)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, roomID, uid, invitedBy, createdAt, roomID, uid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return n > 0, nil
+}
+
+func (s *Storage) RemoveRoomMember(ctx context.Context, roomID int64, uid int64) (bool, error) {
+	const op = "storage.sqlite.RemoveRoomMember"
+
+	if err := s.roomExists(ctx, roomID); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	stmt, err := s.db.Prepare("DELETE FROM room_members WHERE room_id=? AND uid=?")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	res, err := stmt.ExecContext(ctx, roomID, uid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrNotRoomMember)
+	}
+	return true, nil
+}
+
+func (s *Storage) IsRoomMember(ctx context.Context, roomID int64, uid int64) (bool, error) {
+	const op = "storage.sqlite.IsRoomMember"
+
+	if err := s.roomExists(ctx, roomID); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	stmt, err := s.db.Prepare("SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id=? AND uid=?)")
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	var member bool
+	if err := stmt.QueryRowContext(ctx, roomID, uid).Scan(&member); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return member, nil
+}
+
+// ListRooms returns the public rooms and the private ones uid is a member of or invited to.
+func (s *Storage) ListRooms(ctx context.Context, uid int64) ([]models.Room, error) {
+	const op = "storage.sqlite.ListRooms"
+	query := `
+        SELECT r.id, r.name, r.owner_uid, r.created_at, r.public, m.uid IS NOT NULL, i.uid IS NOT NULL
+        FROM rooms r
+        LEFT JOIN room_members m ON m.room_id = r.id AND m.uid = ?
+        LEFT JOIN room_invites i ON i.room_id = r.id AND i.uid = ?
+        WHERE r.public OR m.uid IS NOT NULL OR i.uid IS NOT NULL
+        ORDER BY r.id ASC
+    `
+
+	rows, err := s.db.QueryContext(ctx, query, uid, uid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var rooms []models.Room
+	for rows.Next() {
+		var room models.Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.OwnerID, &room.CreatedAt, &room.Public, &room.IsMember, &room.IsInvited); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return rooms, nil
+}
+
+func (s *Storage) roomExists(ctx context.Context, roomID int64) error {
+	var id int64
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM rooms WHERE id=?", roomID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.ErrRoomNotExist
+		}
+		return err
+	}
+	return nil
+}
+
+// typeName turns the stored type code into the name clients see.
+func typeName(typeOf string) string {
+	switch typeOf {
+	case "1":
+		return "text"
+	case "2":
+		return "image"
+	case "3":
+		return "file"
+	}
+	return typeOf
+}
+
+// ftsQuery turns user input into an FTS5 query that matches every word.
+// Each word is quoted so characters like '*', '-' or ':' are searched for instead of parsed as FTS5 syntax.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(words, " ")
+}
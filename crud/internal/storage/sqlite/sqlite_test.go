@@ -0,0 +1,45 @@
+package sqlite_test
+
+import (
+	"ChatService/crud/internal/storage/sqlite"
+	"ChatService/crud/internal/storage/storagetest"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+const migrationsPath = "../../../config/migrations"
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		path := filepath.Join(t.TempDir(), "crud.db")
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Opened first so a build without FTS5 is skipped before the search migration fails
+		s, err := sqlite.New(path)
+		if errors.Is(err, sqlite.ErrFTS5Unavailable) {
+			t.Skip("run with -tags sqlite_fts5")
+		}
+		if err != nil {
+			t.Fatalf("sqlite.New: %v", err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+
+		m, err := migrate.New("file://"+migrationsPath, "sqlite3://"+path)
+		if err != nil {
+			t.Fatalf("migrate.New: %v", err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatalf("migrate up: %v", err)
+		}
+		if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+			t.Fatalf("migrate close: %v, %v", srcErr, dbErr)
+		}
+		return s
+	})
+}
@@ -3,7 +3,13 @@ package storage
 import "errors"
 
 var (
-	ErrMessageNotExist = errors.New("message does not exist")
-	ErrNoMessagesFound = errors.New("no messages found")
-	Banned             = errors.New("banned")
+	ErrMessageNotExist    = errors.New("message does not exist")
+	ErrNoMessagesFound    = errors.New("no messages found")
+	ErrMessageDeleted     = errors.New("message was deleted")
+	ErrMessageNotDeleted  = errors.New("message is not deleted")
+	ErrRoomNotExist       = errors.New("room does not exist")
+	ErrRoomExist          = errors.New("room already exists")
+	ErrNotRoomMember      = errors.New("user is not a member of the room")
+	ErrNotInvited         = errors.New("user is not invited to the room")
+	ErrAttachmentNotExist = errors.New("attachment does not exist")
 )
@@ -0,0 +1,710 @@
+// Package storagetest is the behaviour every storage backend of the CRUD service has to share.
+// A backend runs it from its own tests with Run, each case gets a freshly migrated storage.
+package storagetest
+
+import (
+	"ChatService/crud/internal/domain/models"
+	"ChatService/crud/internal/services/crud"
+	"ChatService/crud/internal/storage"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Storage is everything the services expect from a backend.
+type Storage interface {
+	crud.MessageCRUDer
+	crud.RoomCRUDer
+	crud.ReactionCRUDer
+	crud.AttachmentCRUDer
+}
+
+// generalRoom is created by the first room migration of every backend, it is public
+const generalRoom int64 = 1
+
+// Run runs the suite, open returns an empty migrated storage and cleans it up with t.Cleanup.
+func Run(t *testing.T, open func(t *testing.T) Storage) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{"CreateAndGetMessage", testCreateAndGetMessage},
+		{"Pagination", testPagination},
+		{"Threads", testThreads},
+		{"Tombstones", testTombstones},
+		{"Purge", testPurge},
+		{"PurgeThreadsAndAttachments", testPurgeThreadsAndAttachments},
+		{"Revisions", testRevisions},
+		{"Reactions", testReactions},
+		{"Search", testSearch},
+		{"Attachments", testAttachments},
+		{"Rooms", testRooms},
+		{"Invites", testInvites},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, open(t))
+		})
+	}
+}
+
+func testCreateAndGetMessage(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mid := mustCreate(t, s, 7, generalRoom, "hello", models.TypeText, "2025-07-01 10:00:00")
+	got, err := s.GetMessage(ctx, mid)
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	want := models.Message{ID: mid, Content: "hello", UserID: 7, RoomID: generalRoom, Type: "text", DateTime: "2025-07-01 10:00:00"}
+	if got.ID != want.ID || got.Content != want.Content || got.UserID != want.UserID || got.RoomID != want.RoomID ||
+		got.Type != want.Type || got.DateTime != want.DateTime {
+		t.Errorf("GetMessage = %+v, want %+v", got, want)
+	}
+	if got.EditedAt != "" || got.RevisionCount != 0 || got.DeletedAt != "" || got.ThreadRootID != 0 || got.AttachmentID != 0 {
+		t.Errorf("new message has edit, delete, thread or attachment fields set: %+v", got)
+	}
+
+	if _, err := s.GetMessage(ctx, mid+1000); !errors.Is(err, storage.ErrMessageNotExist) {
+		t.Errorf("GetMessage of unknown id: err = %v, want %v", err, storage.ErrMessageNotExist)
+	}
+}
+
+func testPagination(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	other := mustCreateRoom(t, s, 7, "other", true)
+	var mids []int64
+	for i := range 5 {
+		mids = append(mids, mustCreate(t, s, 7, generalRoom, "message "+string(rune('a'+i)), models.TypeText, "2025-07-01 10:00:00"))
+	}
+	mustCreate(t, s, 7, other, "elsewhere", models.TypeText, "2025-07-01 10:00:00")
+
+	page, err := s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 2})
+	if err != nil {
+		t.Fatalf("ShowAllMessages: %v", err)
+	}
+	assertIDs(t, "newest page", page, mids[3:5])
+
+	page, err = s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 2, BeforeID: mids[3]})
+	if err != nil {
+		t.Fatalf("ShowAllMessages before: %v", err)
+	}
+	assertIDs(t, "page before", page, mids[1:3])
+
+	page, err = s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 10, BeforeID: mids[1]})
+	if err != nil {
+		t.Fatalf("ShowAllMessages last page: %v", err)
+	}
+	assertIDs(t, "last page", page, mids[:1])
+
+	page, err = s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 2, AfterID: mids[1]})
+	if err != nil {
+		t.Fatalf("ShowAllMessages after: %v", err)
+	}
+	assertIDs(t, "page after", page, mids[2:4])
+
+	if _, err := s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 2, BeforeID: mids[0]}); !errors.Is(err, storage.ErrNoMessagesFound) {
+		t.Errorf("ShowAllMessages past the oldest: err = %v, want %v", err, storage.ErrNoMessagesFound)
+	}
+	empty := mustCreateRoom(t, s, 7, "empty", true)
+	if _, err := s.ShowAllMessages(ctx, empty, models.Page{Limit: 2}); !errors.Is(err, storage.ErrNoMessagesFound) {
+		t.Errorf("ShowAllMessages of an empty room: err = %v, want %v", err, storage.ErrNoMessagesFound)
+	}
+}
+
+func testThreads(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	root := mustCreate(t, s, 7, generalRoom, "root", models.TypeText, "2025-07-01 10:00:00")
+	first, err := s.CreateMessage(ctx, 8, generalRoom, models.Reply{ParentID: root, ThreadRootID: root}, "first", models.TypeText, 0, "2025-07-01 10:01:00")
+	if err != nil {
+		t.Fatalf("CreateMessage reply: %v", err)
+	}
+	second, err := s.CreateMessage(ctx, 7, generalRoom, models.Reply{ParentID: first, ThreadRootID: root}, "second", models.TypeText, 0, "2025-07-01 10:02:00")
+	if err != nil {
+		t.Fatalf("CreateMessage nested reply: %v", err)
+	}
+
+	page, err := s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 10})
+	if err != nil {
+		t.Fatalf("ShowAllMessages: %v", err)
+	}
+	assertIDs(t, "timeline", page, []int64{root})
+	if page[0].ReplyCount != 2 || page[0].LastReplyAt != "2025-07-01 10:02:00" {
+		t.Errorf("thread root: ReplyCount = %d, LastReplyAt = %q, want 2, %q", page[0].ReplyCount, page[0].LastReplyAt, "2025-07-01 10:02:00")
+	}
+
+	replies, err := s.ThreadReplies(ctx, root, models.Page{Limit: 10})
+	if err != nil {
+		t.Fatalf("ThreadReplies: %v", err)
+	}
+	assertIDs(t, "replies", replies, []int64{first, second})
+	if replies[1].ParentID != first || replies[1].ThreadRootID != root {
+		t.Errorf("nested reply: ParentID = %d, ThreadRootID = %d, want %d, %d", replies[1].ParentID, replies[1].ThreadRootID, first, root)
+	}
+
+	replies, err = s.ThreadReplies(ctx, root, models.Page{Limit: 10, AfterID: first})
+	if err != nil {
+		t.Fatalf("ThreadReplies after: %v", err)
+	}
+	assertIDs(t, "replies after", replies, []int64{second})
+}
+
+func testTombstones(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mid := mustCreate(t, s, 7, generalRoom, "oops", models.TypeText, "2025-07-01 10:00:00")
+	if ok, err := s.DeleteMessage(ctx, mid, 9, "2025-07-02 10:00:00"); err != nil || !ok {
+		t.Fatalf("DeleteMessage = %t, %v", ok, err)
+	}
+
+	got, err := s.GetMessage(ctx, mid)
+	if err != nil {
+		t.Fatalf("GetMessage of a tombstone: %v", err)
+	}
+	if got.DeletedAt != "2025-07-02 10:00:00" || got.DeletedBy != 9 {
+		t.Errorf("tombstone: DeletedAt = %q, DeletedBy = %d", got.DeletedAt, got.DeletedBy)
+	}
+	page, err := s.ShowAllMessages(ctx, generalRoom, models.Page{Limit: 10})
+	if err != nil {
+		t.Fatalf("ShowAllMessages: %v", err)
+	}
+	if len(page) != 1 || page[0].DeletedAt == "" {
+		t.Errorf("timeline should keep the tombstone in place: %+v", page)
+	}
+
+	if _, err := s.DeleteMessage(ctx, mid, 9, "2025-07-02 11:00:00"); !errors.Is(err, storage.ErrMessageNotExist) {
+		t.Errorf("DeleteMessage twice: err = %v, want %v", err, storage.ErrMessageNotExist)
+	}
+	if _, err := s.UpdateMessage(ctx, mid, 7, "edited", "2025-07-02 11:00:00"); !errors.Is(err, storage.ErrMessageNotExist) {
+		t.Errorf("UpdateMessage of a tombstone: err = %v, want %v", err, storage.ErrMessageNotExist)
+	}
+
+	if ok, err := s.RestoreMessage(ctx, mid); err != nil || !ok {
+		t.Fatalf("RestoreMessage = %t, %v", ok, err)
+	}
+	got, err = s.GetMessage(ctx, mid)
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if got.DeletedAt != "" || got.DeletedBy != 0 || got.Content != "oops" {
+		t.Errorf("restored message: %+v", got)
+	}
+	if _, err := s.RestoreMessage(ctx, mid); !errors.Is(err, storage.ErrMessageNotDeleted) {
+		t.Errorf("RestoreMessage of a live message: err = %v, want %v", err, storage.ErrMessageNotDeleted)
+	}
+}
+
+func testPurge(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	old := mustCreate(t, s, 7, generalRoom, "old", models.TypeText, "2025-07-01 10:00:00")
+	recent := mustCreate(t, s, 7, generalRoom, "recent", models.TypeText, "2025-07-01 10:00:00")
+	live := mustCreate(t, s, 7, generalRoom, "live", models.TypeText, "2025-07-01 10:00:00")
+	if _, err := s.UpdateMessage(ctx, old, 7, "old, edited", "2025-07-01 11:00:00"); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+	if _, err := s.AddReaction(ctx, old, 8, "👍", "2025-07-01 11:00:00"); err != nil {
+		t.Fatalf("AddReaction: %v", err)
+	}
+	if _, err := s.DeleteMessage(ctx, old, 7, "2025-07-02 10:00:00"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if _, err := s.DeleteMessage(ctx, recent, 7, "2025-07-05 10:00:00"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+
+	purged, blobKeys, err := s.PurgeDeletedMessages(ctx, "2025-07-03 00:00:00")
+	if err != nil {
+		t.Fatalf("PurgeDeletedMessages: %v", err)
+	}
+	if purged != 1 || len(blobKeys) != 0 {
+		t.Errorf("PurgeDeletedMessages = %d, %q, want 1 and no blobs", purged, blobKeys)
+	}
+
+	if _, err := s.GetMessage(ctx, old); !errors.Is(err, storage.ErrMessageNotExist) {
+		t.Errorf("GetMessage of a purged message: err = %v, want %v", err, storage.ErrMessageNotExist)
+	}
+	for _, mid := range []int64{recent, live} {
+		if _, err := s.GetMessage(ctx, mid); err != nil {
+			t.Errorf("GetMessage(%d) after purge: %v", mid, err)
+		}
+	}
+	history, err := s.MessageHistory(ctx, old)
+	if err != nil {
+		t.Fatalf("MessageHistory: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("revisions of a purged message are kept: %+v", history)
+	}
+	reactions, err := s.MessageReactions(ctx, []int64{old}, 8)
+	if err != nil {
+		t.Fatalf("MessageReactions: %v", err)
+	}
+	if len(reactions[old]) != 0 {
+		t.Errorf("reactions of a purged message are kept: %+v", reactions[old])
+	}
+}
+
+func testPurgeThreadsAndAttachments(t *testing.T, s Storage) {
+	ctx := context.Background()
+	const deletedAt, deletedBefore = "2025-07-02 10:00:00", "2025-07-03 00:00:00"
+
+	mustReply := func(parent, root int64, content string) int64 {
+		t.Helper()
+		mid, err := s.CreateMessage(ctx, 8, generalRoom, models.Reply{ParentID: parent, ThreadRootID: root}, content, models.TypeText, 0, "2025-07-01 10:01:00")
+		if err != nil {
+			t.Fatalf("CreateMessage reply: %v", err)
+		}
+		return mid
+	}
+	mustDelete := func(mids ...int64) {
+		t.Helper()
+		for _, mid := range mids {
+			if _, err := s.DeleteMessage(ctx, mid, 7, deletedAt); err != nil {
+				t.Fatalf("DeleteMessage(%d): %v", mid, err)
+			}
+		}
+	}
+	mustAttach := func(key string) int64 {
+		t.Helper()
+		id, err := s.SaveAttachment(ctx, models.Attachment{UserID: 7, RoomID: generalRoom, FileName: key, MimeType: "image/png", Size: 1, SHA256: "00", BlobKey: key, CreatedAt: "2025-07-01 10:00:00"})
+		if err != nil {
+			t.Fatalf("SaveAttachment: %v", err)
+		}
+		return id
+	}
+
+	// A root with a live reply stays, a nested reply to a purged reply moves up to the root
+	root := mustCreate(t, s, 7, generalRoom, "root", models.TypeText, "2025-07-01 10:00:00")
+	live := mustReply(root, root, "live")
+	deleted := mustReply(root, root, "deleted")
+	nested := mustReply(deleted, root, "nested")
+	// A root whose replies are all purged goes with them
+	gone := mustCreate(t, s, 7, generalRoom, "gone", models.TypeText, "2025-07-01 10:00:00")
+	goneReply := mustReply(gone, gone, "gone reply")
+
+	// An attachment goes with its last message, the thumbnail with it
+	image := mustAttach("blobs/image")
+	thumb := mustAttach("blobs/thumb")
+	if err := s.SetAttachmentImage(ctx, image, 640, 480, thumb); err != nil {
+		t.Fatalf("SetAttachmentImage: %v", err)
+	}
+	withImage := mustCreateWith(t, s, 7, generalRoom, "", models.TypeImage, image)
+	shared := mustAttach("blobs/shared")
+	sharedDeleted := mustCreateWith(t, s, 7, generalRoom, "", models.TypeFile, shared)
+	sharedLive := mustCreateWith(t, s, 7, generalRoom, "", models.TypeFile, shared)
+
+	mustDelete(root, deleted, gone, goneReply, withImage, sharedDeleted)
+
+	purged, blobKeys, err := s.PurgeDeletedMessages(ctx, deletedBefore)
+	if err != nil {
+		t.Fatalf("PurgeDeletedMessages: %v", err)
+	}
+	if purged != 5 {
+		t.Errorf("PurgeDeletedMessages = %d, want 5", purged)
+	}
+	slices.Sort(blobKeys)
+	if !slices.Equal(blobKeys, []string{"blobs/image", "blobs/thumb"}) {
+		t.Errorf("PurgeDeletedMessages blob keys = %q, want the image and its thumbnail", blobKeys)
+	}
+
+	for _, mid := range []int64{deleted, gone, goneReply, withImage, sharedDeleted} {
+		if _, err := s.GetMessage(ctx, mid); !errors.Is(err, storage.ErrMessageNotExist) {
+			t.Errorf("GetMessage(%d) of a purged message: err = %v, want %v", mid, err, storage.ErrMessageNotExist)
+		}
+	}
+	for _, mid := range []int64{root, live, sharedLive} {
+		if _, err := s.GetMessage(ctx, mid); err != nil {
+			t.Errorf("GetMessage(%d) after purge: %v", mid, err)
+		}
+	}
+	got, err := s.GetMessage(ctx, nested)
+	if err != nil {
+		t.Fatalf("GetMessage of the nested reply: %v", err)
+	}
+	if got.ParentID != root || got.ThreadRootID != root {
+		t.Errorf("nested reply: ParentID = %d, ThreadRootID = %d, want %d, %d", got.ParentID, got.ThreadRootID, root, root)
+	}
+	replies, err := s.ThreadReplies(ctx, root, models.Page{Limit: 10})
+	if err != nil {
+		t.Fatalf("ThreadReplies: %v", err)
+	}
+	assertIDs(t, "replies", replies, []int64{live, nested})
+
+	attachments, err := s.Attachments(ctx, []int64{image, thumb, shared})
+	if err != nil {
+		t.Fatalf("Attachments: %v", err)
+	}
+	if _, ok := attachments[shared]; !ok || len(attachments) != 1 {
+		t.Errorf("Attachments after purge = %+v, want only the one a live message uses", attachments)
+	}
+
+	// Once the last reply is gone the root follows
+	mustDelete(live, nested)
+	purged, _, err = s.PurgeDeletedMessages(ctx, deletedBefore)
+	if err != nil {
+		t.Fatalf("PurgeDeletedMessages: %v", err)
+	}
+	if purged != 3 {
+		t.Errorf("PurgeDeletedMessages of the rest of the thread = %d, want 3", purged)
+	}
+}
+
+func testRevisions(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mid := mustCreate(t, s, 7, generalRoom, "v1", models.TypeText, "2025-07-01 10:00:00")
+	if ok, err := s.UpdateMessage(ctx, mid, 7, "v2", "2025-07-01 11:00:00"); err != nil || !ok {
+		t.Fatalf("UpdateMessage = %t, %v", ok, err)
+	}
+	if ok, err := s.UpdateMessage(ctx, mid, 9, "v3", "2025-07-01 12:00:00"); err != nil || !ok {
+		t.Fatalf("UpdateMessage = %t, %v", ok, err)
+	}
+
+	got, err := s.GetMessage(ctx, mid)
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if got.Content != "v3" || got.EditedAt != "2025-07-01 12:00:00" || got.RevisionCount != 2 {
+		t.Errorf("edited message: Content = %q, EditedAt = %q, RevisionCount = %d", got.Content, got.EditedAt, got.RevisionCount)
+	}
+
+	history, err := s.MessageHistory(ctx, mid)
+	if err != nil {
+		t.Fatalf("MessageHistory: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("MessageHistory has %d revisions, want 2", len(history))
+	}
+	want := []models.Revision{
+		{MessageID: mid, Content: "v1", EditorID: 7, EditedAt: "2025-07-01 11:00:00"},
+		{MessageID: mid, Content: "v2", EditorID: 9, EditedAt: "2025-07-01 12:00:00"},
+	}
+	for i := range want {
+		history[i].ID = 0
+		if history[i] != want[i] {
+			t.Errorf("revision %d = %+v, want %+v", i, history[i], want[i])
+		}
+	}
+
+	if _, err := s.UpdateMessage(ctx, mid+1000, 7, "x", "2025-07-01 12:00:00"); !errors.Is(err, storage.ErrMessageNotExist) {
+		t.Errorf("UpdateMessage of unknown id: err = %v, want %v", err, storage.ErrMessageNotExist)
+	}
+}
+
+func testReactions(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	first := mustCreate(t, s, 7, generalRoom, "first", models.TypeText, "2025-07-01 10:00:00")
+	second := mustCreate(t, s, 7, generalRoom, "second", models.TypeText, "2025-07-01 10:00:00")
+
+	add := func(mid, uid int64, emoji string, want bool) {
+		t.Helper()
+		added, err := s.AddReaction(ctx, mid, uid, emoji, "2025-07-01 11:00:00")
+		if err != nil {
+			t.Fatalf("AddReaction: %v", err)
+		}
+		if added != want {
+			t.Errorf("AddReaction(%d, %d, %s) = %t, want %t", mid, uid, emoji, added, want)
+		}
+	}
+	add(first, 7, "👍", true)
+	add(first, 7, "👍", false)
+	add(first, 8, "👍", true)
+	add(first, 8, "🎉", true)
+	add(second, 8, "👀", true)
+
+	reactions, err := s.MessageReactions(ctx, []int64{first, second}, 7)
+	if err != nil {
+		t.Fatalf("MessageReactions: %v", err)
+	}
+	wantFirst := []models.Reaction{{Emoji: "👍", Count: 2, ReactedByMe: true}, {Emoji: "🎉", Count: 1}}
+	if !slices.Equal(reactions[first], wantFirst) {
+		t.Errorf("reactions of first = %+v, want %+v", reactions[first], wantFirst)
+	}
+	wantSecond := []models.Reaction{{Emoji: "👀", Count: 1}}
+	if !slices.Equal(reactions[second], wantSecond) {
+		t.Errorf("reactions of second = %+v, want %+v", reactions[second], wantSecond)
+	}
+
+	if removed, err := s.RemoveReaction(ctx, first, 7, "👍"); err != nil || !removed {
+		t.Errorf("RemoveReaction = %t, %v, want true", removed, err)
+	}
+	if removed, err := s.RemoveReaction(ctx, first, 7, "👍"); err != nil || removed {
+		t.Errorf("RemoveReaction twice = %t, %v, want false", removed, err)
+	}
+	reactions, err = s.MessageReactions(ctx, []int64{first}, 7)
+	if err != nil {
+		t.Fatalf("MessageReactions: %v", err)
+	}
+	wantFirst = []models.Reaction{{Emoji: "👍", Count: 1}, {Emoji: "🎉", Count: 1}}
+	if !slices.Equal(reactions[first], wantFirst) {
+		t.Errorf("reactions of first after removal = %+v, want %+v", reactions[first], wantFirst)
+	}
+
+	if reactions, err := s.MessageReactions(ctx, nil, 7); err != nil || len(reactions) != 0 {
+		t.Errorf("MessageReactions of no messages = %v, %v", reactions, err)
+	}
+}
+
+func testSearch(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	secret := mustCreateRoom(t, s, 9, "secret", false)
+	if _, err := s.AddRoomMember(ctx, generalRoom, 7, "2025-07-01 09:00:00"); err != nil {
+		t.Fatalf("AddRoomMember: %v", err)
+	}
+	deploy := mustCreate(t, s, 8, generalRoom, "deploy the search index tonight", models.TypeText, "2025-07-01 10:00:00")
+	works := mustCreate(t, s, 7, generalRoom, "search works now", models.TypeText, "2025-07-02 10:00:00")
+	mustCreate(t, s, 7, generalRoom, "nothing to see", models.TypeText, "2025-07-03 10:00:00")
+	deleted := mustCreate(t, s, 7, generalRoom, "search this deleted one", models.TypeText, "2025-07-03 10:00:00")
+	mustCreate(t, s, 9, secret, "search the secret room", models.TypeText, "2025-07-03 10:00:00")
+	if _, err := s.DeleteMessage(ctx, deleted, 7, "2025-07-04 10:00:00"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+
+	search := func(name string, filter models.SearchFilter, page models.Page, want []int64) []models.SearchHit {
+		t.Helper()
+		if page.Limit == 0 {
+			page.Limit = 10
+		}
+		hits, err := s.SearchMessages(ctx, 7, filter, page)
+		if err != nil {
+			t.Fatalf("%s: SearchMessages: %v", name, err)
+		}
+		var got []int64
+		for _, hit := range hits {
+			got = append(got, hit.Message.ID)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: hits = %v, want %v", name, got, want)
+		}
+		return hits
+	}
+
+	hits := search("newest first, member rooms only, no tombstones", models.SearchFilter{Query: "search"}, models.Page{}, []int64{works, deploy})
+	for _, hit := range hits {
+		if !strings.Contains(hit.Snippet, models.HighlightStart+"search"+models.HighlightEnd) {
+			t.Errorf("snippet %q does not highlight the match", hit.Snippet)
+		}
+	}
+	search("first page", models.SearchFilter{Query: "search"}, models.Page{Limit: 1}, []int64{works})
+	search("next page", models.SearchFilter{Query: "search"}, models.Page{Limit: 1, BeforeID: works}, []int64{deploy})
+	search("every word", models.SearchFilter{Query: "search tonight"}, models.Page{}, []int64{deploy})
+	search("author", models.SearchFilter{Query: "search", AuthorID: 8}, models.Page{}, []int64{deploy})
+	search("dates", models.SearchFilter{Query: "search", DateFrom: "2025-07-02", DateTo: "2025-07-03"}, models.Page{}, []int64{works})
+	search("type", models.SearchFilter{Query: "search", Type: models.TypeImage}, models.Page{}, nil)
+	search("room of another team", models.SearchFilter{Query: "search", RoomID: secret}, models.Page{}, nil)
+	search("no match", models.SearchFilter{Query: "absent"}, models.Page{}, nil)
+
+	if _, err := s.UpdateMessage(ctx, works, 7, "renamed entirely", "2025-07-05 10:00:00"); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+	search("index follows edits", models.SearchFilter{Query: "search"}, models.Page{}, []int64{deploy})
+	search("new content is found", models.SearchFilter{Query: "renamed"}, models.Page{}, []int64{works})
+}
+
+func testAttachments(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	attachment := models.Attachment{
+		UserID:    7,
+		RoomID:    generalRoom,
+		FileName:  "cat.png",
+		MimeType:  "image/png",
+		Size:      1234,
+		SHA256:    strings.Repeat("ab", 32),
+		BlobKey:   "blobs/cat",
+		CreatedAt: "2025-07-01 10:00:00",
+	}
+	id, err := s.SaveAttachment(ctx, attachment)
+	if err != nil {
+		t.Fatalf("SaveAttachment: %v", err)
+	}
+	attachment.ID = id
+
+	got, err := s.GetAttachment(ctx, id)
+	if err != nil {
+		t.Fatalf("GetAttachment: %v", err)
+	}
+	if got != attachment {
+		t.Errorf("GetAttachment = %+v, want %+v", got, attachment)
+	}
+
+	thumb, err := s.SaveAttachment(ctx, models.Attachment{UserID: 7, RoomID: generalRoom, FileName: "thumb.jpg", MimeType: "image/jpeg", Size: 10, SHA256: "00", BlobKey: "blobs/thumb", CreatedAt: "2025-07-01 10:00:01"})
+	if err != nil {
+		t.Fatalf("SaveAttachment thumbnail: %v", err)
+	}
+	if err := s.SetAttachmentImage(ctx, id, 640, 480, thumb); err != nil {
+		t.Fatalf("SetAttachmentImage: %v", err)
+	}
+	if err := s.SetAttachmentImage(ctx, id+1000, 1, 1, 0); !errors.Is(err, storage.ErrAttachmentNotExist) {
+		t.Errorf("SetAttachmentImage of unknown id: err = %v, want %v", err, storage.ErrAttachmentNotExist)
+	}
+
+	attachments, err := s.Attachments(ctx, []int64{id, thumb, id + 1000})
+	if err != nil {
+		t.Fatalf("Attachments: %v", err)
+	}
+	if len(attachments) != 2 {
+		t.Errorf("Attachments returned %d entries, want 2 without the unknown id", len(attachments))
+	}
+	image := attachments[id]
+	if image.Width != 640 || image.Height != 480 || image.ThumbnailID != thumb {
+		t.Errorf("image after SetAttachmentImage: %+v", image)
+	}
+
+	mid := mustCreateWith(t, s, 7, generalRoom, "look", models.TypeImage, id)
+	message, err := s.GetMessage(ctx, mid)
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if message.AttachmentID != id || message.Type != "image" {
+		t.Errorf("image message: AttachmentID = %d, Type = %q", message.AttachmentID, message.Type)
+	}
+
+	if _, err := s.GetAttachment(ctx, id+1000); !errors.Is(err, storage.ErrAttachmentNotExist) {
+		t.Errorf("GetAttachment of unknown id: err = %v, want %v", err, storage.ErrAttachmentNotExist)
+	}
+	if attachments, err := s.Attachments(ctx, nil); err != nil || len(attachments) != 0 {
+		t.Errorf("Attachments of no ids = %v, %v", attachments, err)
+	}
+}
+
+func testRooms(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	room := mustCreateRoom(t, s, 7, "team", true)
+	if _, err := s.CreateRoom(ctx, 8, "team", true, "2025-07-01 10:00:00"); !errors.Is(err, storage.ErrRoomExist) {
+		t.Errorf("CreateRoom with a taken name: err = %v, want %v", err, storage.ErrRoomExist)
+	}
+
+	member, err := s.IsRoomMember(ctx, room, 7)
+	if err != nil || !member {
+		t.Errorf("owner is a member = %t, %v", member, err)
+	}
+	if ok, err := s.AddRoomMember(ctx, room, 8, "2025-07-01 10:00:00"); err != nil || !ok {
+		t.Errorf("AddRoomMember = %t, %v", ok, err)
+	}
+	if ok, err := s.AddRoomMember(ctx, room, 8, "2025-07-01 10:00:00"); err != nil || !ok {
+		t.Errorf("AddRoomMember twice = %t, %v", ok, err)
+	}
+
+	rooms, err := s.ListRooms(ctx, 8)
+	if err != nil {
+		t.Fatalf("ListRooms: %v", err)
+	}
+	i := slices.IndexFunc(rooms, func(r models.Room) bool { return r.ID == room })
+	if i < 0 {
+		t.Fatalf("ListRooms does not return the room: %+v", rooms)
+	}
+	if rooms[i].Name != "team" || rooms[i].OwnerID != 7 || !rooms[i].Public || !rooms[i].IsMember {
+		t.Errorf("listed room = %+v", rooms[i])
+	}
+
+	if ok, err := s.RemoveRoomMember(ctx, room, 8); err != nil || !ok {
+		t.Errorf("RemoveRoomMember = %t, %v", ok, err)
+	}
+	if _, err := s.RemoveRoomMember(ctx, room, 8); !errors.Is(err, storage.ErrNotRoomMember) {
+		t.Errorf("RemoveRoomMember twice: err = %v, want %v", err, storage.ErrNotRoomMember)
+	}
+	if member, err := s.IsRoomMember(ctx, room, 8); err != nil || member {
+		t.Errorf("member after leaving = %t, %v", member, err)
+	}
+
+	const unknown = 1000
+	if _, err := s.AddRoomMember(ctx, unknown, 8, "2025-07-01 10:00:00"); !errors.Is(err, storage.ErrRoomNotExist) {
+		t.Errorf("AddRoomMember of unknown room: err = %v, want %v", err, storage.ErrRoomNotExist)
+	}
+	if _, err := s.IsRoomMember(ctx, unknown, 8); !errors.Is(err, storage.ErrRoomNotExist) {
+		t.Errorf("IsRoomMember of unknown room: err = %v, want %v", err, storage.ErrRoomNotExist)
+	}
+}
+
+func testInvites(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	room := mustCreateRoom(t, s, 7, "private", false)
+	if _, err := s.AddRoomMember(ctx, room, 8, "2025-07-01 10:00:00"); !errors.Is(err, storage.ErrNotInvited) {
+		t.Errorf("AddRoomMember without invite: err = %v, want %v", err, storage.ErrNotInvited)
+	}
+	if rooms, err := s.ListRooms(ctx, 8); err != nil || slices.ContainsFunc(rooms, func(r models.Room) bool { return r.ID == room }) {
+		t.Errorf("ListRooms shows a private room to an outsider: %+v, %v", rooms, err)
+	}
+
+	if ok, err := s.InviteRoomMember(ctx, room, 7, 8, "2025-07-01 10:00:00"); err != nil || !ok {
+		t.Errorf("InviteRoomMember = %t, %v", ok, err)
+	}
+	if ok, err := s.InviteRoomMember(ctx, room, 7, 8, "2025-07-01 10:00:00"); err != nil || ok {
+		t.Errorf("InviteRoomMember twice = %t, %v, want false", ok, err)
+	}
+	if ok, err := s.InviteRoomMember(ctx, room, 7, 7, "2025-07-01 10:00:00"); err != nil || ok {
+		t.Errorf("InviteRoomMember of a member = %t, %v, want false", ok, err)
+	}
+	rooms, err := s.ListRooms(ctx, 8)
+	if err != nil {
+		t.Fatalf("ListRooms: %v", err)
+	}
+	i := slices.IndexFunc(rooms, func(r models.Room) bool { return r.ID == room })
+	if i < 0 || !rooms[i].IsInvited || rooms[i].IsMember || rooms[i].Public {
+		t.Errorf("ListRooms of an invited user: %+v", rooms)
+	}
+
+	if ok, err := s.AddRoomMember(ctx, room, 8, "2025-07-01 11:00:00"); err != nil || !ok {
+		t.Fatalf("AddRoomMember with invite = %t, %v", ok, err)
+	}
+	if ok, err := s.AddRoomMember(ctx, room, 8, "2025-07-01 11:00:00"); err != nil || !ok {
+		t.Errorf("AddRoomMember of a member = %t, %v", ok, err)
+	}
+	if _, err := s.RemoveRoomMember(ctx, room, 8); err != nil {
+		t.Fatalf("RemoveRoomMember: %v", err)
+	}
+	if _, err := s.AddRoomMember(ctx, room, 8, "2025-07-01 12:00:00"); !errors.Is(err, storage.ErrNotInvited) {
+		t.Errorf("AddRoomMember after the invite was used: err = %v, want %v", err, storage.ErrNotInvited)
+	}
+	if _, err := s.InviteRoomMember(ctx, 1000, 7, 8, "2025-07-01 10:00:00"); !errors.Is(err, storage.ErrRoomNotExist) {
+		t.Errorf("InviteRoomMember of unknown room: err = %v, want %v", err, storage.ErrRoomNotExist)
+	}
+}
+
+func mustCreate(t *testing.T, s Storage, uid, roomID int64, content string, typeOf int32, datetime string) int64 {
+	t.Helper()
+	mid, err := s.CreateMessage(context.Background(), uid, roomID, models.Reply{}, content, typeOf, 0, datetime)
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	return mid
+}
+
+func mustCreateWith(t *testing.T, s Storage, uid, roomID int64, content string, typeOf int32, attachmentID int64) int64 {
+	t.Helper()
+	mid, err := s.CreateMessage(context.Background(), uid, roomID, models.Reply{}, content, typeOf, attachmentID, "2025-07-01 10:00:00")
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	return mid
+}
+
+func mustCreateRoom(t *testing.T, s Storage, ownerID int64, name string, public bool) int64 {
+	t.Helper()
+	id, err := s.CreateRoom(context.Background(), ownerID, name, public, "2025-07-01 09:00:00")
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	return id
+}
+
+func assertIDs(t *testing.T, name string, messages []models.Message, want []int64) {
+	t.Helper()
+	got := make([]int64, 0, len(messages))
+	for _, m := range messages {
+		got = append(got, m.ID)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("%s: ids = %v, want %v", name, got, want)
+	}
+}
@@ -22,32 +22,41 @@ func main() {
 	log := logger.SetupLogger(cfg.Env)
 	log.Info("Starting sso")
 
-	clientFabric := client.ClientMustLoad(cfg, log)
+	application := app.New(log, cfg.GRPC.Port, cfg.StoragePath, cfg.TokenTTL, cfg.RefreshTokenTTL, cfg.Signing, cfg.OIDC, cfg.Mail, cfg.TOTP,
+		cfg.Lockout, cfg.Services)
+
+	clientFabric := client.ClientMustLoad(cfg, log, application.KEYS, application.OIDC)
 
 	go func() {
 		log.Info("Starting HTTP server on :8080")
 		if err := clientFabric.HttpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Error("HTTP server error", err)
+			log.Error("HTTP server error", "error", err.Error())
 		}
 	}()
 
-	application := app.New(log, cfg.GRPC.Port, cfg.StoragePath, cfg.TokenTTL)
-
 	go func() {
 		application.GRPCServer.MustRun()
 	}()
 
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	go application.RunRevocationPurge(purgeCtx)
+	go application.RunKeyRotation(purgeCtx)
+	go application.RunCodePurge(purgeCtx)
+	go application.RunLockoutPurge(purgeCtx)
+	go application.RunSanctionPurge(purgeCtx)
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
 	// Ожидаем сигнала для завершения работы
 	<-stop
 
+	stopPurge()
 	application.GRPCServer.Stop()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := clientFabric.HttpServer.Shutdown(ctx); err != nil {
-		log.Error("HTTP shutdown error", err)
+		log.Error("HTTP shutdown error", "error", err.Error())
 	}
 
 	application.GRPCServer.Stop()
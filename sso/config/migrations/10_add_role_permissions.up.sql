@@ -0,0 +1,23 @@
+-- Permissions of the roles in the permission table beyond its get and update flags
+CREATE TABLE IF NOT EXISTS role_permissions
+(
+    role_id    INTEGER NOT NULL REFERENCES permission (id) ON DELETE CASCADE,
+    permission TEXT    NOT NULL,
+    PRIMARY KEY (role_id, permission)
+);
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, p.permission
+FROM permission,
+     (SELECT 'message.edit.any' AS permission
+      UNION ALL SELECT 'message.delete.any'
+      UNION ALL SELECT 'message.restore'
+      UNION ALL SELECT 'user.ban') AS p
+WHERE name IN ('mod', 'admin');
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, p.permission
+FROM permission,
+     (SELECT 'user.role.change' AS permission
+      UNION ALL SELECT 'user.unlock') AS p
+WHERE name = 'admin';
@@ -0,0 +1,2 @@
+DELETE FROM role_permissions WHERE permission = 'user.mute';
+DROP TABLE IF EXISTS sanctions;
@@ -0,0 +1,21 @@
+-- Bans and mutes handed out by moderators. A ban (room_id 0) keeps the user out of every room,
+-- a mute keeps them from writing to one room. A user has at most one of each per room,
+-- a new one replaces the old. Rows stay until the purge after expires_at.
+CREATE TABLE IF NOT EXISTS sanctions
+(
+    user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    kind       TEXT    NOT NULL,
+    room_id    INTEGER NOT NULL DEFAULT 0,
+    reason     TEXT    NOT NULL,
+    issued_by  INTEGER NOT NULL,
+    created_at TEXT    NOT NULL,
+    expires_at TEXT    NOT NULL,
+    PRIMARY KEY (user_id, kind, room_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sanctions_expires_at ON sanctions (expires_at);
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, 'user.mute'
+FROM permission
+WHERE name IN ('mod', 'admin');
@@ -0,0 +1,3 @@
+-- OpenID Connect clients authenticate at /token with their own secret, stored as a bcrypt hash.
+-- apps.secret only verified legacy HS256 tokens. Apps with an empty hash can not exchange codes.
+ALTER TABLE apps ADD COLUMN client_secret_hash BLOB NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- Access tokens are not stored when issued, so ending all sessions of a user revokes every
+-- token of theirs issued before revoked_before. One row per user, a later reset moves it on.
+CREATE TABLE IF NOT EXISTS revoked_sessions
+(
+    user_id        INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    revoked_before TEXT NOT NULL
+);
@@ -0,0 +1,19 @@
+-- Refresh tokens are opaque, only their sha256 is stored.
+-- Every rotation adds a row to the family of the login it came from,
+-- rotated_at marks the tokens that were already exchanged.
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    id         INTEGER PRIMARY KEY,
+    token_hash TEXT     NOT NULL UNIQUE,
+    family_id  TEXT     NOT NULL,
+    user_id    INTEGER  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    app_id     INTEGER  NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+    device     TEXT     NOT NULL DEFAULT '',
+    created_at TEXT     NOT NULL,
+    expires_at TEXT     NOT NULL,
+    rotated_at TEXT,
+    revoked_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON refresh_tokens (user_id);
@@ -0,0 +1,10 @@
+-- Access tokens ended by Logout before their exp. A row is only needed
+-- until the token would have expired anyway, expired rows are purged.
+CREATE TABLE IF NOT EXISTS revoked_tokens
+(
+    jti        TEXT PRIMARY KEY,
+    user_id    INTEGER NOT NULL,
+    expires_at TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens (expires_at);
@@ -0,0 +1,13 @@
+-- Keys access tokens are signed with. The private key is stored as PKCS #8 DER.
+-- A retired key is kept until expires_at, tokens it signed are still verified until then.
+CREATE TABLE IF NOT EXISTS signing_keys
+(
+    kid         TEXT PRIMARY KEY,
+    algorithm   TEXT NOT NULL,
+    private_key BLOB NOT NULL,
+    created_at  TEXT NOT NULL,
+    retired_at  TEXT,
+    expires_at  TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_signing_keys_expires_at ON signing_keys (expires_at);
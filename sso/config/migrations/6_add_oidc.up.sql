@@ -0,0 +1,25 @@
+-- Apps are the OpenID Connect clients, an authorization code is only sent to a registered redirect URI.
+CREATE TABLE IF NOT EXISTS app_redirect_uris
+(
+    app_id       INTEGER NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+    redirect_uri TEXT    NOT NULL,
+    PRIMARY KEY (app_id, redirect_uri)
+);
+
+-- Authorization codes are single use, used_at is set by the exchange. Expired rows are purged.
+CREATE TABLE IF NOT EXISTS authorization_codes
+(
+    code_hash      TEXT PRIMARY KEY,
+    app_id         INTEGER NOT NULL,
+    user_id        INTEGER NOT NULL,
+    redirect_uri   TEXT    NOT NULL,
+    scope          TEXT    NOT NULL,
+    nonce          TEXT    NOT NULL DEFAULT '',
+    code_challenge TEXT    NOT NULL,
+    auth_time      TEXT    NOT NULL,
+    created_at     TEXT    NOT NULL,
+    expires_at     TEXT    NOT NULL,
+    used_at        TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_authorization_codes_expires_at ON authorization_codes (expires_at);
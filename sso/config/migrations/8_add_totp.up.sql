@@ -0,0 +1,34 @@
+-- TOTP secrets are encrypted with the key from the config. enabled is set once the user
+-- confirmed the enrolment with a code, last_step keeps a code from being used twice.
+CREATE TABLE IF NOT EXISTS user_totp
+(
+    user_id    INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret     BLOB    NOT NULL,
+    enabled    BOOLEAN NOT NULL DEFAULT false,
+    last_step  INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT    NOT NULL
+);
+
+-- One-time recovery codes for a lost authenticator, only their sha256 is stored
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    code_hash TEXT PRIMARY KEY,
+    user_id   INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    used_at   TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+-- A login that passed the password and waits for the second factor
+CREATE TABLE IF NOT EXISTS login_challenges
+(
+    token_hash TEXT PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    app_id     INTEGER NOT NULL,
+    device     TEXT    NOT NULL DEFAULT '',
+    attempts   INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT    NOT NULL,
+    expires_at TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_challenges_expires_at ON login_challenges (expires_at);
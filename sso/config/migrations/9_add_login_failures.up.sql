@@ -0,0 +1,11 @@
+-- Failed logins per account (account:<email>) and per client address (ip:<addr>).
+-- failures starts again from one when the last failure is older than the reset window.
+CREATE TABLE IF NOT EXISTS login_failures
+(
+    key             TEXT PRIMARY KEY,
+    failures        INTEGER NOT NULL,
+    last_failure_at TEXT    NOT NULL,
+    locked_until    TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_failures_last_failure_at ON login_failures (last_failure_at);
@@ -4,33 +4,167 @@ import (
 	authapp "ChatService/sso/internal/app/auth"
 	grpcapp "ChatService/sso/internal/app/grpc"
 	profileapp "ChatService/sso/internal/app/profile"
+	"ChatService/sso/internal/config"
+	authlib "ChatService/sso/internal/lib/auth"
+	"ChatService/sso/internal/lib/mail"
+	"ChatService/sso/internal/lib/secretbox"
 	"ChatService/sso/internal/services/auth"
+	"ChatService/sso/internal/services/keys"
+	"ChatService/sso/internal/services/lockout"
+	"ChatService/sso/internal/services/oidc"
 	"ChatService/sso/internal/services/profile"
+	"ChatService/sso/internal/services/rbac"
+	"ChatService/sso/internal/services/sanction"
+	"ChatService/sso/internal/services/twofactor"
 	"ChatService/sso/internal/storage/sqlite"
+	"context"
+	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 )
 
+// revocationPurgeInterval is how often revoked tokens that expired anyway are deleted
+const revocationPurgeInterval = time.Hour
+
+// keyRotationCheckInterval is how often the signing key is checked against its rotation interval
+const keyRotationCheckInterval = time.Hour
+
+// codePurgeInterval is how often expired authorization codes are deleted
+const codePurgeInterval = time.Hour
+
+// lockoutPurgeInterval is how often login failures that are no longer counted are deleted
+const lockoutPurgeInterval = time.Hour
+
+// sanctionPurgeInterval is how often expired bans and mutes are deleted
+const sanctionPurgeInterval = time.Hour
+
 type App struct {
 	GRPCServer *grpcapp.App
 	AUTH       *auth.Auth
 	PROFILE    *profile.Profile
+	KEYS       *keys.Keys
+	OIDC       *oidc.OIDC
+	LOCKOUT    *lockout.Lockout
+	SANCTIONS  *sanction.Sanctions
 }
 
-func New(log *slog.Logger, port int, storagePath string, tokenTTL time.Duration) *App {
+func New(log *slog.Logger, port int, storagePath string, tokenTTL time.Duration, refreshTokenTTL time.Duration,
+	signing config.Signing, oidcCfg config.OIDC, mailCfg config.Mail, totpCfg config.TOTP,
+	lockoutCfg config.Lockout, servicesCfg config.Services) *App {
 	storage, err := sqlite.New(storagePath)
 	if err != nil {
 		panic(err)
 	}
-	authService := authapp.New(log, storage, storage, storage, tokenTTL)
 
-	profileService := profileapp.New(log, storage, storage, tokenTTL)
+	// A retired key has to outlive every token it signed
+	overlap := max(signing.Overlap, tokenTTL)
+	keyService := &keys.Keys{
+		Log:              log,
+		Storage:          storage,
+		Algorithm:        signing.Algorithm,
+		RotationInterval: signing.RotationInterval,
+		Overlap:          overlap,
+	}
+	// Fails early on a bad algorithm and creates the first key of a fresh database
+	if _, err := keyService.SigningKey(context.Background()); err != nil {
+		panic(err)
+	}
+
+	sender, err := newMailSender(mailCfg)
+	if err != nil {
+		panic(err)
+	}
+	mailer := auth.Mailer{Sender: sender, LinkBaseURL: strings.TrimSuffix(mailCfg.LinkBaseURL, "/")}
+
+	box, err := secretbox.New(totpCfg.EncryptionKey)
+	if err != nil {
+		panic(err)
+	}
+	twoFactor := &twofactor.TwoFactor{Log: log, Storage: storage, Box: box, Issuer: totpCfg.Issuer}
+
+	lockoutService := &lockout.Lockout{
+		Log:        log,
+		Storage:    storage,
+		Attempts:   lockoutCfg.Attempts,
+		IPAttempts: lockoutCfg.IPAttempts,
+		BaseDelay:  lockoutCfg.BaseDelay,
+		MaxDelay:   lockoutCfg.MaxDelay,
+		ResetAfter: lockoutCfg.ResetAfter,
+	}
+
+	permissions := &rbac.RBAC{Log: log, Storage: storage}
+	sanctions := &sanction.Sanctions{Log: log, Storage: storage, Roles: storage}
+
+	authService := authapp.New(log, storage, storage, storage, tokenTTL, storage, refreshTokenTTL, storage, keyService,
+		storage, mailer, twoFactor, storage, lockoutService, permissions, sanctions)
 
-	grpcApp := grpcapp.New(log, authService, profileService, port)
+	profileService := profileapp.New(log, storage, storage, tokenTTL, twoFactor, lockoutService, permissions, sanctions)
+
+	oidcService := &oidc.OIDC{
+		Log:          log,
+		Issuer:       oidcCfg.Issuer,
+		AppProvider:  storage,
+		UserProvider: storage,
+		Codes:        storage,
+		Keys:         keyService,
+		Revocations:  storage,
+		TokenTTL:     tokenTTL,
+	}
+
+	authenticator := &authlib.Authenticator{Keys: keyService, Revocations: storage}
+
+	services := authlib.NewServiceTokens(servicesCfg.Tokens)
+	if services.Empty() {
+		log.Warn("no service tokens configured, calls from other services are refused")
+	}
+
+	grpcApp := grpcapp.New(log, authService, profileService, authenticator, services, port, lockoutCfg.TrustedProxies)
 
 	return &App{
 		GRPCServer: grpcApp,
 		AUTH:       authService,
 		PROFILE:    profileService,
+		KEYS:       keyService,
+		OIDC:       oidcService,
+		LOCKOUT:    lockoutService,
+		SANCTIONS:  sanctions,
+	}
+}
+
+// RunRevocationPurge deletes expired token revocations and user tokens in the background until ctx is cancelled.
+func (a *App) RunRevocationPurge(ctx context.Context) {
+	a.AUTH.RunRevocationPurge(ctx, revocationPurgeInterval)
+}
+
+// RunKeyRotation rotates the signing key when it is due, until ctx is cancelled.
+func (a *App) RunKeyRotation(ctx context.Context) {
+	a.KEYS.RunRotation(ctx, keyRotationCheckInterval)
+}
+
+// RunCodePurge deletes expired authorization codes until ctx is cancelled.
+func (a *App) RunCodePurge(ctx context.Context) {
+	a.OIDC.RunCodePurge(ctx, codePurgeInterval)
+}
+
+// RunLockoutPurge deletes forgotten login failures until ctx is cancelled.
+func (a *App) RunLockoutPurge(ctx context.Context) {
+	a.LOCKOUT.RunPurge(ctx, lockoutPurgeInterval)
+}
+
+// RunSanctionPurge deletes expired bans and mutes until ctx is cancelled.
+func (a *App) RunSanctionPurge(ctx context.Context) {
+	a.SANCTIONS.RunPurge(ctx, sanctionPurgeInterval)
+}
+
+func newMailSender(cfg config.Mail) (mail.Sender, error) {
+	switch cfg.Sender {
+	case "smtp":
+		return &mail.SMTP{Addr: cfg.SMTP.Addr, From: cfg.From, Username: cfg.SMTP.Username, Password: cfg.SMTP.Password}, nil
+	case "file":
+		return mail.NewFile(cfg.Path, cfg.From)
+	case "memory":
+		return &mail.Memory{}, nil
 	}
+	return nil, fmt.Errorf("unknown mail sender %q", cfg.Sender)
 }
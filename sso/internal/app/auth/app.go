@@ -7,12 +7,31 @@ import (
 )
 
 func New(log *slog.Logger,
-	userSaver auth.UserSaver, userProvider auth.UserProvider, appProvider auth.AppProvider, tokenTTL time.Duration) *auth.Auth {
+	userSaver auth.UserSaver, userProvider auth.UserProvider, appProvider auth.AppProvider, tokenTTL time.Duration,
+	refreshTokens auth.RefreshTokenStorage, refreshTokenTTL time.Duration, revocations auth.RevocationStorage, keys auth.SigningKeys,
+	userTokens auth.UserTokenStorage, mailer auth.Mailer, secondFactor auth.SecondFactor, challenges auth.LoginChallengeStorage, lockout auth.Lockout,
+	permissions auth.Permissions, sanctions auth.Sanctions) *auth.Auth {
 	return &auth.Auth{
 		Log:          log,
 		UserSaver:    userSaver,
 		UserProvider: userProvider,
 		AppProvider:  appProvider,
 		TokenTTL:     tokenTTL,
+
+		RefreshTokens:   refreshTokens,
+		RefreshTokenTTL: refreshTokenTTL,
+		Revocations:     revocations,
+		Keys:            keys,
+
+		UserTokens: userTokens,
+		Mail:       mailer,
+
+		SecondFactor: secondFactor,
+		Challenges:   challenges,
+
+		Lockout: lockout,
+
+		Permissions: permissions,
+		Sanctions:   sanctions,
 	}
 }
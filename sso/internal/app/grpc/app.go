@@ -3,6 +3,7 @@ package grpc
 import (
 	"ChatService/sso/internal/grpc/auth"
 	"ChatService/sso/internal/grpc/profile"
+	authlib "ChatService/sso/internal/lib/auth"
 	"fmt"
 	"google.golang.org/grpc"
 	"log/slog"
@@ -15,9 +16,12 @@ type App struct {
 	port       int
 }
 
-func New(log *slog.Logger, authService auth.Auth, profileService profile.Profile, port int) *App {
-	grpcServer := grpc.NewServer()
-	auth.RegisterService(grpcServer, authService)
+func New(log *slog.Logger, authService auth.Auth, profileService profile.Profile, authenticator *authlib.Authenticator,
+	services *authlib.ServiceTokens, port int, trustedProxies []string) *App {
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(authUnaryInterceptor(authenticator, services)),
+	)
+	auth.RegisterService(grpcServer, authService, trustedProxies)
 	profile.RegisterService(grpcServer, profileService)
 
 	return &App{
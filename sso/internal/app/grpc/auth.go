@@ -0,0 +1,98 @@
+package grpc
+
+import (
+	ssov1 "ChatService/protos/gen/go/sso"
+	"ChatService/sso/internal/lib/auth"
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const bearerPrefix = "bearer "
+
+// serviceTokenKey is the metadata key other services send their token in
+const serviceTokenKey = "x-service-token"
+
+// profileMethodPrefix selects the calls that act on behalf of a signed in user,
+// AuthService is how a user signs in and stays open.
+var profileMethodPrefix = "/" + ssov1.Profile_ServiceDesc.ServiceName + "/"
+
+// serviceMethods are the calls only other services make, they tell about any user.
+var serviceMethods = map[string]bool{
+	ssov1.AuthService_CheckPermission_FullMethodName: true,
+	ssov1.AuthService_IsAdmin_FullMethodName:         true,
+	ssov1.AuthService_IsModerator_FullMethodName:     true,
+}
+
+// selfMethods are made by other services about any user or by a signed in user about themselves,
+// the handler checks the user asked about when the call carries an identity.
+var selfMethods = map[string]bool{
+	ssov1.AuthService_GetRestrictions_FullMethodName: true,
+}
+
+// authenticate validates the authorization metadata of a call.
+func authenticate(ctx context.Context, authenticator *auth.Authenticator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "authorization required")
+	}
+
+	header := values[0]
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return nil, status.Error(codes.Unauthenticated, "authorization must use the Bearer scheme")
+	}
+
+	identity, err := authenticator.Authenticate(ctx, strings.TrimSpace(header[len(bearerPrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	return auth.WithIdentity(ctx, identity), nil
+}
+
+// authenticateService validates the service token metadata of a call.
+func authenticateService(ctx context.Context, services *auth.ServiceTokens) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(serviceTokenKey)
+	if len(values) == 0 {
+		return status.Error(codes.Unauthenticated, "service token required")
+	}
+	if !services.Valid(values[0]) {
+		return status.Error(codes.Unauthenticated, "invalid service token")
+	}
+	return nil
+}
+
+func authUnaryInterceptor(authenticator *auth.Authenticator, services *auth.ServiceTokens) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		switch {
+		case strings.HasPrefix(info.FullMethod, profileMethodPrefix):
+			ctx, err := authenticate(ctx, authenticator)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		case serviceMethods[info.FullMethod]:
+			if err := authenticateService(ctx, services); err != nil {
+				return nil, err
+			}
+		case selfMethods[info.FullMethod]:
+			if md, _ := metadata.FromIncomingContext(ctx); len(md.Get(serviceTokenKey)) > 0 {
+				if err := authenticateService(ctx, services); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}
+			ctx, err := authenticate(ctx, authenticator)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}
+		return handler(ctx, req)
+	}
+}
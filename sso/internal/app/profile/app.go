@@ -7,11 +7,16 @@ import (
 )
 
 func New(log *slog.Logger,
-	userRefactor profile.UserRefactor, userAdmin profile.UserAdmin, tokenTTL time.Duration) *profile.Profile {
+	userRefactor profile.UserRefactor, userAdmin profile.UserAdmin, tokenTTL time.Duration, twoFactor profile.TwoFactor,
+	lockout profile.Lockout, permissions profile.Permissions, sanctions profile.Sanctions) *profile.Profile {
 	return &profile.Profile{
 		Log:          log,
 		UserRefactor: userRefactor,
 		UserAdmin:    userAdmin,
 		TokenTTL:     tokenTTL,
+		TwoFactor:    twoFactor,
+		Lockout:      lockout,
+		Permissions:  permissions,
+		Sanctions:    sanctions,
 	}
 }
@@ -0,0 +1,281 @@
+package clients
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/jwt"
+	"ChatService/sso/internal/services/oidc"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OIDCProvider is the OpenID Connect side of SSO, the handlers below only speak HTTP.
+type OIDCProvider interface {
+	Client(ctx context.Context, clientID int64, redirectURI string) (models.App, error)
+	Session(ctx context.Context, accessToken string) (jwt.TokenInfo, error)
+	Authorize(ctx context.Context, req oidc.AuthorizeRequest, userID int64, authTime time.Time) (string, error)
+	Exchange(ctx context.Context, clientID int64, clientSecret, code, redirectURI, codeVerifier string) (oidc.Tokens, error)
+	UserInfo(ctx context.Context, accessToken string) (oidc.UserInfo, error)
+}
+
+// discovery is the OpenID Provider Metadata document
+type discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func setupOIDCRoutes(mux *http.ServeMux, provider OIDCProvider, issuer, algorithm string) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	metadata := discovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		JwksURI:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   oidc.Scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{algorithm},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name"},
+	}
+
+	// Описание провайдера для клиентов OpenID Connect
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	// Запрос авторизации: пользователь входит в SSO и возвращается в приложение с кодом
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Пока redirect_uri не проверен, ошибки показываются здесь, а не отправляются по нему
+		clientID, err := strconv.ParseInt(r.Form.Get("client_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid client_id", http.StatusBadRequest)
+			return
+		}
+		redirectURI := r.Form.Get("redirect_uri")
+		if _, err := provider.Client(r.Context(), clientID, redirectURI); err != nil {
+			if errors.Is(err, oidc.ErrInvalidClient) || errors.Is(err, oidc.ErrInvalidRedirectURI) {
+				http.Error(w, "Unknown client or redirect_uri", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Authorization failed", http.StatusInternalServerError)
+			return
+		}
+		state := r.Form.Get("state")
+
+		if r.Form.Get("response_type") != "code" {
+			redirectWithError(w, r, redirectURI, state, "unsupported_response_type", "only the code flow is supported")
+			return
+		}
+
+		var session jwt.TokenInfo
+		if tokenCookie, err := r.Cookie("token"); err == nil {
+			session, err = provider.Session(r.Context(), tokenCookie.Value)
+			if err != nil && !errors.Is(err, oidc.ErrInvalidToken) {
+				redirectWithError(w, r, redirectURI, state, "server_error", "")
+				return
+			}
+		}
+		if session.UserID == 0 {
+			if r.Form.Get("prompt") == "none" {
+				redirectWithError(w, r, redirectURI, state, "login_required", "")
+				return
+			}
+			// После входа пользователь вернется на этот же запрос
+			http.Redirect(w, r, "/login?"+url.Values{"next": {"/authorize?" + r.Form.Encode()}}.Encode(), http.StatusSeeOther)
+			return
+		}
+
+		code, err := provider.Authorize(r.Context(), oidc.AuthorizeRequest{
+			ClientID:            clientID,
+			RedirectURI:         redirectURI,
+			Scope:               r.Form.Get("scope"),
+			Nonce:               r.Form.Get("nonce"),
+			CodeChallenge:       r.Form.Get("code_challenge"),
+			CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+		}, session.UserID, session.IssuedAt)
+		if err != nil {
+			switch {
+			case errors.Is(err, oidc.ErrInvalidScope):
+				redirectWithError(w, r, redirectURI, state, "invalid_scope", "openid scope required")
+			case errors.Is(err, oidc.ErrInvalidRequest):
+				redirectWithError(w, r, redirectURI, state, "invalid_request", "code_challenge with method S256 required")
+			default:
+				redirectWithError(w, r, redirectURI, state, "server_error", "")
+			}
+			return
+		}
+		redirectWithParams(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+	})
+
+	// Обмен кода авторизации на токены, вызывается сервером приложения
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+			return
+		}
+		if r.PostForm.Get("grant_type") != "authorization_code" {
+			writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+			return
+		}
+
+		clientIDValue, clientSecret, basic := r.BasicAuth()
+		if basic {
+			// client_secret_basic кодирует id и секрет как application/x-www-form-urlencoded
+			clientIDValue, _ = url.QueryUnescape(clientIDValue)
+			clientSecret, _ = url.QueryUnescape(clientSecret)
+		} else {
+			clientIDValue = r.PostForm.Get("client_id")
+			clientSecret = r.PostForm.Get("client_secret")
+		}
+		clientID, err := strconv.ParseInt(clientIDValue, 10, 64)
+		if err != nil {
+			writeClientError(w, basic)
+			return
+		}
+
+		tokens, err := provider.Exchange(r.Context(), clientID, clientSecret, r.PostForm.Get("code"),
+			r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		if err != nil {
+			switch {
+			case errors.Is(err, oidc.ErrInvalidClient):
+				writeClientError(w, basic)
+			case errors.Is(err, oidc.ErrInvalidGrant):
+				writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+			default:
+				writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: tokens.AccessToken,
+			TokenType:   "Bearer",
+			ExpiresIn:   int64(tokens.ExpiresIn.Seconds()),
+			IDToken:     tokens.IDToken,
+			Scope:       tokens.Scope,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	// Данные пользователя по access токену
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		header := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sso"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		info, err := provider.UserInfo(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, oidc.ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="sso", error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// redirectWithParams adds params to the query of a registered redirect URI
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	for name, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func redirectWithError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	redirectWithParams(w, r, redirectURI, url.Values{"error": {code}, "error_description": {description}, "state": {state}})
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(oauthError{Error: code, ErrorDescription: description})
+}
+
+func writeClientError(w http.ResponseWriter, basic bool) {
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="sso"`)
+	}
+	writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+}
@@ -6,14 +6,28 @@ import (
 	"ChatService/sso/internal/lib/jwt"
 	"context"
 	"embed"
+	"encoding/json"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io/fs"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
+// Keys verifies access tokens and publishes the keys they are signed with
+type Keys interface {
+	jwt.KeyResolver
+	JWKS(ctx context.Context) (jwt.JWKS, error)
+}
+
 type ClientFabric struct {
 	SSO        *client.ClientSSO
 	HttpServer *http.Server
@@ -22,7 +36,7 @@ type ClientFabric struct {
 //go:embed all:front/*
 var frontFS embed.FS
 
-func ClientMustLoad(cnf *config.Config, logger *slog.Logger) *ClientFabric {
+func ClientMustLoad(cnf *config.Config, logger *slog.Logger, keys Keys, provider OIDCProvider) *ClientFabric {
 	ssoClient, err := client.New(
 		context.Background(),
 		logger,
@@ -31,14 +45,17 @@ func ClientMustLoad(cnf *config.Config, logger *slog.Logger) *ClientFabric {
 		cnf.Clients.SSO.RetriesCount,
 	)
 	if err != nil {
-		logger.Error("failed to initialize SSO client", err)
+		logger.Error("failed to initialize SSO client", "error", err.Error())
 		os.Exit(1)
 	}
 	logger.Info("ClientSSO initialized")
 
+	mux := setupRoutes(ssoClient, keys)
+	setupOIDCRoutes(mux, provider, cnf.OIDC.Issuer, cnf.Signing.Algorithm)
+
 	httpServer := &http.Server{
 		Addr:    ":8080",
-		Handler: setupRoutes(ssoClient),
+		Handler: mux,
 	}
 
 	return &ClientFabric{
@@ -47,7 +64,67 @@ func ClientMustLoad(cnf *config.Config, logger *slog.Logger) *ClientFabric {
 	}
 }
 
-func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
+const refreshCookieName = "refresh_token"
+
+// secondFactorPage carries a login that waits for its code through the second form
+type secondFactorPage struct {
+	Challenge string
+	Next      string
+}
+
+// setTokenCookies stores a token pair. The refresh token is never visible to scripts.
+func setTokenCookies(w http.ResponseWriter, token, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  "token",
+		Value: token,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refreshToken,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// loginLocked reports whether SSO refused a login after too many failures and for how long
+func loginLocked(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return 0, false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, true
+}
+
+// remoteIP is the address of the browser, SSO counts failed logins per address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginRedirect returns where to go after login. Only paths of this server are followed,
+// so the login form can not be used to send users to another site.
+func loginRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/profile"
+	}
+	return next
+}
+
+func clearTokenCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "token", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookieName, Path: "/", MaxAge: -1})
+}
+
+func setupRoutes(cli *client.ClientSSO, keys Keys) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	// Загрузка HTML шаблонов
@@ -55,6 +132,10 @@ func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
 		"front/templates/register.html",
 		"front/templates/login.html",
 		"front/templates/profile.html",
+		"front/templates/forgot_password.html",
+		"front/templates/reset_password.html",
+		"front/templates/message.html",
+		"front/templates/second_factor.html",
 	))
 
 	// Обработчик статических файлов (CSS, JS)
@@ -74,6 +155,25 @@ func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
 		fileServer.ServeHTTP(w, r)
 	})))
 
+	// Публичные ключи для проверки токенов другими сервисами
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		jwks, err := keys.JWKS(r.Context())
+		if err != nil {
+			http.Error(w, "Failed to get keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// Ключи меняются редко, а неизвестный kid клиенты все равно запрашивают заново
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(jwks); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
 	// Страница регистрации
 	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" {
@@ -102,17 +202,31 @@ func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
 			password := r.FormValue("password")
 			appID := int64(1)
 
-			token, err := cli.Login(r.Context(), email, password, appID)
+			token, refreshToken, challenge, err := cli.Login(r.Context(), email, password, appID, r.UserAgent(), remoteIP(r))
 			if err != nil {
+				if retryAfter, locked := loginLocked(err); locked {
+					// Слишком много неудачных попыток, вход временно заблокирован
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+					return
+				}
 				http.Error(w, "Login failed", http.StatusUnauthorized)
 				return
 			}
+			if challenge != "" {
+				// Включена двухфакторная аутентификация: нужен код из приложения
+				w.Header().Set("Content-Type", "text/html")
+				if err := templates.ExecuteTemplate(w, "second_factor.html", secondFactorPage{
+					Challenge: challenge,
+					Next:      r.FormValue("next"),
+				}); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
 
-			http.SetCookie(w, &http.Cookie{
-				Name:  "token",
-				Value: token,
-			})
-			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			setTokenCookies(w, token, refreshToken)
+			http.Redirect(w, r, loginRedirect(r.FormValue("next")), http.StatusSeeOther)
 		} else {
 			w.Header().Set("Content-Type", "text/html")
 			if err := templates.ExecuteTemplate(w, "login.html", nil); err != nil {
@@ -121,6 +235,136 @@ func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
 		}
 	})
 
+	// Второй шаг входа: код TOTP или код восстановления
+	mux.HandleFunc("/login/second-factor", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, refreshToken, err := cli.VerifySecondFactor(r.Context(), r.PostFormValue("challenge"), r.PostFormValue("code"), remoteIP(r))
+		if err != nil {
+			if retryAfter, locked := loginLocked(err); locked {
+				// Неверные коды считаются неудачными попытками входа
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+				return
+			}
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+
+		setTokenCookies(w, token, refreshToken)
+		http.Redirect(w, r, loginRedirect(r.PostFormValue("next")), http.StatusSeeOther)
+	})
+
+	// Обмен refresh токена на новую пару, старый refresh токен больше не действует
+	mux.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		refreshCookie, err := r.Cookie(refreshCookieName)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		token, refreshToken, err := cli.RefreshToken(r.Context(), refreshCookie.Value)
+		if err != nil {
+			// Недействительный refresh токен не стоит отправлять повторно
+			http.SetCookie(w, &http.Cookie{Name: refreshCookieName, Path: "/", MaxAge: -1})
+			http.Error(w, "Refresh failed", http.StatusUnauthorized)
+			return
+		}
+
+		setTokenCookies(w, token, refreshToken)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Выход: токен отзывается в SSO, а не только удаляется из браузера
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tokenCookie, err := r.Cookie("token")
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		TokenInfo := jwt.ValidateToken(r.Context(), tokenCookie.Value, keys, jwt.AudienceSSO)
+		if TokenInfo.Error != nil {
+			clearTokenCookies(w)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		var refreshToken string
+		if refreshCookie, err := r.Cookie(refreshCookieName); err == nil {
+			refreshToken = refreshCookie.Value
+		}
+		if _, err := cli.Logout(r.Context(), tokenCookie.Value, refreshToken, TokenInfo.UserID); err != nil {
+			http.Error(w, "Logout failed", http.StatusInternalServerError)
+			return
+		}
+
+		clearTokenCookies(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+
+	// Подтверждение email по ссылке из письма
+	mux.HandleFunc("/verify-email", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		message := "Email confirmed."
+		if err := cli.VerifyEmail(r.Context(), r.URL.Query().Get("token")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			message = "The link is invalid or expired."
+		}
+		if err := templates.ExecuteTemplate(w, "message.html", message); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	// Запрос ссылки для сброса пароля
+	mux.HandleFunc("/forgot-password", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.Method == "POST" {
+			if err := cli.RequestPasswordReset(r.Context(), r.FormValue("email")); err != nil {
+				http.Error(w, "Request failed", http.StatusInternalServerError)
+				return
+			}
+			// Ответ одинаковый, есть такой аккаунт или нет
+			if err := templates.ExecuteTemplate(w, "message.html", "If an account with this email exists, a reset link was sent to it."); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if err := templates.ExecuteTemplate(w, "forgot_password.html", nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	// Новый пароль по ссылке из письма
+	mux.HandleFunc("/reset-password", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.Method == "POST" {
+			if err := cli.ResetPassword(r.Context(), r.URL.Query().Get("token"), r.PostFormValue("new_password")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				if err := templates.ExecuteTemplate(w, "message.html", "The link is invalid or expired."); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			// Все сессии завершены, старые cookie больше не нужны
+			clearTokenCookies(w)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err := templates.ExecuteTemplate(w, "reset_password.html", nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
 	// Страница профиля
 	mux.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) {
 		tokenCookie, err := r.Cookie("token")
@@ -129,7 +373,7 @@ func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
 			return
 		}
 
-		TokenInfo := jwt.ValidateToken(tokenCookie.Value, os.Getenv("SECRET"))
+		TokenInfo := jwt.ValidateToken(r.Context(), tokenCookie.Value, keys, jwt.AudienceSSO)
 		if TokenInfo.Error != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
@@ -137,7 +381,7 @@ func setupRoutes(cli *client.ClientSSO) *http.ServeMux {
 
 		if r.Method == "POST" {
 			newName := r.FormValue("new_name")
-			_, err := cli.ChangeName(r.Context(), TokenInfo.UserID, newName)
+			_, err := cli.ChangeName(r.Context(), tokenCookie.Value, newName)
 			if err != nil {
 				http.Error(w, "Failed to change name", http.StatusInternalServerError)
 				return
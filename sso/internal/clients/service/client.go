@@ -9,6 +9,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"log/slog"
 	"time"
 )
@@ -85,27 +86,68 @@ func (c *ClientSSO) IsModerator(ctx context.Context, userID int64) (bool, error)
 	return resp.IsMod, nil
 }
 
-func (c *ClientSSO) Login(ctx context.Context, email, password string, appID int64) (string, error) {
+// Login returns the access token and the refresh token of a new session. For users with
+// two-factor authentication only a challenge token is returned, see VerifySecondFactor.
+// clientIP is forwarded to SSO, failed logins are counted per client address.
+func (c *ClientSSO) Login(ctx context.Context, email, password string, appID int64, device, clientIP string) (string, string, string, error) {
 	const op = "auth.Login"
 
+	if clientIP != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", clientIP)
+	}
+
 	resp, err := c.apiAuth.Login(ctx, &ssov1.LoginRequest{
 		Email:    email,
 		Password: password,
 		AppId:    appID,
+		Device:   device,
+	})
+	if err != nil {
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Token, resp.RefreshToken, resp.ChallengeToken, nil
+}
+
+// VerifySecondFactor exchanges the challenge token of a login and a code for the session tokens.
+// clientIP is forwarded to SSO, wrong codes are counted as failed logins.
+func (c *ClientSSO) VerifySecondFactor(ctx context.Context, challengeToken, code, clientIP string) (string, string, error) {
+	const op = "auth.VerifySecondFactor"
+
+	if clientIP != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", clientIP)
+	}
+
+	resp, err := c.apiAuth.VerifySecondFactor(ctx, &ssov1.VerifySecondFactorRequest{
+		ChallengeToken: challengeToken,
+		Code:           code,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	return resp.Token, resp.RefreshToken, nil
+}
+
+// RefreshToken exchanges a refresh token for a new pair, the old refresh token stops working.
+func (c *ClientSSO) RefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	const op = "auth.RefreshToken"
+
+	resp, err := c.apiAuth.RefreshToken(ctx, &ssov1.RefreshTokenRequest{
+		RefreshToken: refreshToken,
 	})
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", op, err)
+		return "", "", fmt.Errorf("%s: %w", op, err)
 	}
-	return resp.Token, nil
+	return resp.Token, resp.RefreshToken, nil
 }
 
-func (c *ClientSSO) Logout(ctx context.Context, token string, userID int64) (bool, error) {
+func (c *ClientSSO) Logout(ctx context.Context, token, refreshToken string, userID int64) (bool, error) {
 	const op = "auth.Logout"
 	c.log.Debug("logout request", slog.Int64("user_id", userID))
 
 	resp, err := c.apiAuth.Logout(ctx, &ssov1.LogoutRequest{
-		Token:  token,
-		UserId: userID,
+		Token:        token,
+		RefreshToken: refreshToken,
+		UserId:       userID,
 	})
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
@@ -127,11 +169,15 @@ func (c *ClientSSO) Register(ctx context.Context, username, email, password stri
 	return resp.UserId, nil
 }
 
-func (c *ClientSSO) ChangePassword(ctx context.Context, oldPassword, newPassword string, userID int64) (bool, error) {
+// withToken authenticates a Profile call as the owner of the access token.
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func (c *ClientSSO) ChangePassword(ctx context.Context, token, oldPassword, newPassword string) (bool, error) {
 	const op = "profile.ChangePassword"
 
-	resp, err := c.apiProfile.ChangePassword(ctx, &ssov1.ChangePasswordRequest{
-		UserId:      userID,
+	resp, err := c.apiProfile.ChangePassword(withToken(ctx, token), &ssov1.ChangePasswordRequest{
 		OldPassword: oldPassword,
 		NewPassword: newPassword,
 	})
@@ -141,11 +187,10 @@ func (c *ClientSSO) ChangePassword(ctx context.Context, oldPassword, newPassword
 	return resp.Success, nil
 }
 
-func (c *ClientSSO) ChangeName(ctx context.Context, userID int64, newName string) (bool, error) {
+func (c *ClientSSO) ChangeName(ctx context.Context, token, newName string) (bool, error) {
 	const op = "profile.ChangeName"
 
-	resp, err := c.apiProfile.ChangeName(ctx, &ssov1.ChangeNameRequest{
-		UserId:  userID,
+	resp, err := c.apiProfile.ChangeName(withToken(ctx, token), &ssov1.ChangeNameRequest{
 		NewName: newName,
 	})
 	if err != nil {
@@ -154,11 +199,11 @@ func (c *ClientSSO) ChangeName(ctx context.Context, userID int64, newName string
 	return resp.Success, nil
 }
 
-func (c *ClientSSO) ChangeRole(ctx context.Context, adminID int64, targetUserID int64, newRole int32, adminPassword string) (bool, error) {
+// ChangeRole is done by the owner of token, an admin, who confirms it with their password.
+func (c *ClientSSO) ChangeRole(ctx context.Context, token string, targetUserID int64, newRole int32, adminPassword string) (bool, error) {
 	const op = "profile.ChangeRole"
 
-	resp, err := c.apiProfile.ChangeRole(ctx, &ssov1.ChangeRoleRequest{
-		AdminId:  adminID,
+	resp, err := c.apiProfile.ChangeRole(withToken(ctx, token), &ssov1.ChangeRoleRequest{
 		UserId:   targetUserID,
 		NewRole:  newRole,
 		Password: adminPassword,
@@ -168,3 +213,30 @@ func (c *ClientSSO) ChangeRole(ctx context.Context, adminID int64, targetUserID
 	}
 	return resp.Success, nil
 }
+
+func (c *ClientSSO) VerifyEmail(ctx context.Context, token string) error {
+	const op = "auth.VerifyEmail"
+
+	if _, err := c.apiAuth.VerifyEmail(ctx, &ssov1.VerifyEmailRequest{Token: token}); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (c *ClientSSO) RequestPasswordReset(ctx context.Context, email string) error {
+	const op = "auth.RequestPasswordReset"
+
+	if _, err := c.apiAuth.RequestPasswordReset(ctx, &ssov1.RequestPasswordResetRequest{Email: email}); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (c *ClientSSO) ResetPassword(ctx context.Context, token, newPassword string) error {
+	const op = "auth.ResetPassword"
+
+	if _, err := c.apiAuth.ResetPassword(ctx, &ssov1.ResetPasswordRequest{Token: token, NewPassword: newPassword}); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
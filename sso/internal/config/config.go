@@ -10,6 +10,15 @@ type Config struct {
 	Env         string        `yaml:"env" env-default:"local"`
 	StoragePath string        `yaml:"storage_path" env-required:"true"`
 	TokenTTL    time.Duration `yaml:"token_ttl" env-required:"true"`
+	// RefreshTokenTTL is how long a refresh token stays valid, every rotation starts it again
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" env-default:"720h"`
+
+	Signing  Signing  `yaml:"signing"`
+	OIDC     OIDC     `yaml:"oidc"`
+	Mail     Mail     `yaml:"mail"`
+	TOTP     TOTP     `yaml:"totp"`
+	Lockout  Lockout  `yaml:"lockout"`
+	Services Services `yaml:"services"`
 
 	GRPC struct {
 		Port    int           `yaml:"port"`
@@ -25,6 +34,61 @@ type Config struct {
 	}
 }
 
+// Signing selects how access tokens are signed. Algorithm is "EdDSA" or "RS256". The active key is replaced
+// every RotationInterval, the replaced one stays published for Overlap, never less than the token TTL.
+type Signing struct {
+	Algorithm        string        `yaml:"algorithm" env:"SIGNING_ALGORITHM" env-default:"EdDSA"`
+	RotationInterval time.Duration `yaml:"rotation_interval" env:"SIGNING_ROTATION_INTERVAL" env-default:"720h"`
+	Overlap          time.Duration `yaml:"overlap" env:"SIGNING_OVERLAP" env-default:"2h"`
+}
+
+// OIDC configures the OpenID Connect provider. Issuer is the public URL of the SSO HTTP server,
+// it is the iss claim of ID tokens and the base of the endpoints in the discovery document.
+type OIDC struct {
+	Issuer string `yaml:"issuer" env:"OIDC_ISSUER" env-default:"http://localhost:8080"`
+}
+
+// Mail selects how verification and password reset mails are sent: "smtp" delivers them,
+// "file" writes them into Path and "memory" keeps them in the process. Links in the mails
+// start with LinkBaseURL, the public URL of the SSO HTTP server.
+type Mail struct {
+	Sender      string `yaml:"sender" env:"MAIL_SENDER" env-default:"file"`
+	From        string `yaml:"from" env:"MAIL_FROM" env-default:"sso@localhost"`
+	Path        string `yaml:"path" env:"MAIL_PATH" env-default:"./sso/storage/mail"`
+	LinkBaseURL string `yaml:"link_base_url" env:"MAIL_LINK_BASE_URL" env-default:"http://localhost:8080"`
+	SMTP        struct {
+		Addr     string `yaml:"addr" env:"SMTP_ADDR"`
+		Username string `yaml:"username" env:"SMTP_USERNAME"`
+		Password string `yaml:"password" env:"SMTP_PASSWORD"`
+	} `yaml:"smtp"`
+}
+
+// TOTP configures two-factor authentication. Issuer is the name authenticator apps show,
+// EncryptionKey is the base64 encoded 32 byte AES key the secrets are stored encrypted with.
+type TOTP struct {
+	Issuer        string `yaml:"issuer" env:"TOTP_ISSUER" env-default:"ChatService"`
+	EncryptionKey string `yaml:"encryption_key" env:"TOTP_ENCRYPTION_KEY" env-required:"true"`
+}
+
+// Lockout limits failed logins per account (Attempts) and per client address (IPAttempts).
+// Past them each failure locks logins for BaseDelay, doubled every time up to MaxDelay.
+// Failures are forgotten ResetAfter the last one. The client address is taken from the
+// x-forwarded-for metadata only for calls from TrustedProxies, e.g. the HTTP server of SSO.
+type Lockout struct {
+	Attempts       int           `yaml:"attempts" env:"LOCKOUT_ATTEMPTS" env-default:"5"`
+	IPAttempts     int           `yaml:"ip_attempts" env:"LOCKOUT_IP_ATTEMPTS" env-default:"50"`
+	BaseDelay      time.Duration `yaml:"base_delay" env:"LOCKOUT_BASE_DELAY" env-default:"30s"`
+	MaxDelay       time.Duration `yaml:"max_delay" env:"LOCKOUT_MAX_DELAY" env-default:"1h"`
+	ResetAfter     time.Duration `yaml:"reset_after" env:"LOCKOUT_RESET_AFTER" env-default:"24h"`
+	TrustedProxies []string      `yaml:"trusted_proxies" env:"LOCKOUT_TRUSTED_PROXIES" env-default:"127.0.0.1,::1"`
+}
+
+// Services lists the tokens other services send in the x-service-token metadata,
+// they are required for the calls that tell about any user, e.g. CheckPermission.
+type Services struct {
+	Tokens []string `yaml:"tokens" env:"SERVICE_TOKENS"`
+}
+
 func MustLoad() *Config {
 	configPath := os.Getenv("CONFIG_PATH")
 	// if config path is empty
@@ -1,7 +1,12 @@
 package models
 
+// App is a client of SSO. Apps that log users in through OpenID Connect register the
+// redirect URIs the authorization code may be sent to and authenticate at /token with the
+// client secret ClientSecretHash is the bcrypt hash of. Secret only verified legacy HS256 tokens.
 type App struct {
-	ID      int64
-	AppName string
-	Secret  string
+	ID               int64
+	AppName          string
+	Secret           string
+	ClientSecretHash []byte
+	RedirectURIs     []string
 }
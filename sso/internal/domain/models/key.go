@@ -0,0 +1,24 @@
+package models
+
+import (
+	"crypto"
+	"time"
+)
+
+// SigningKey is a private key access tokens are signed with, tokens name it in their kid header.
+// Only the newest key signs. Older keys are retired but stay published until ExpiresAt,
+// so tokens they signed keep validating.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+	// RetiredAt and ExpiresAt are zero while the key is the active one
+	RetiredAt time.Time
+	ExpiresAt time.Time
+}
+
+// Active reports whether new tokens are signed with the key.
+func (k SigningKey) Active() bool {
+	return k.RetiredAt.IsZero()
+}
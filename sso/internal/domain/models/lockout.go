@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// LoginFailures counts failed logins for one account or client address. Logins are
+// refused until LockedUntil, which is zero when there is no lock.
+type LoginFailures struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
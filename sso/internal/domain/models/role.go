@@ -0,0 +1,52 @@
+package models
+
+// Roles are the rows of the permission table, users.role holds the id.
+const (
+	RoleUser      int32 = 1
+	RoleModerator int32 = 2
+	RoleAdmin     int32 = 3
+	RoleBanned    int32 = 4
+)
+
+// Permissions a role can be granted. The get and update flags of the permission table grant
+// PermissionMessageRead and PermissionMessageWrite, the others come from role_permissions.
+const (
+	PermissionMessageRead      = "message.read"
+	PermissionMessageWrite     = "message.write"
+	PermissionMessageEditAny   = "message.edit.any"
+	PermissionMessageDeleteAny = "message.delete.any"
+	PermissionMessageRestore   = "message.restore"
+	PermissionUserBan          = "user.ban"
+	PermissionUserMute         = "user.mute"
+	PermissionUserChangeRole   = "user.role.change"
+	PermissionUserUnlock       = "user.unlock"
+)
+
+// Permissions lists every known permission, checks for other names are refused.
+var Permissions = []string{
+	PermissionMessageRead,
+	PermissionMessageWrite,
+	PermissionMessageEditAny,
+	PermissionMessageDeleteAny,
+	PermissionMessageRestore,
+	PermissionUserBan,
+	PermissionUserMute,
+	PermissionUserChangeRole,
+	PermissionUserUnlock,
+}
+
+// Role is a named set of permissions
+type Role struct {
+	ID          int32
+	Name        string
+	Permissions []string
+}
+
+func (r Role) Has(permission string) bool {
+	for _, granted := range r.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Kinds of sanctions: a ban keeps a user out of every room, a mute keeps them from writing to one.
+const (
+	SanctionBan  = "ban"
+	SanctionMute = "mute"
+)
+
+// Sanction is a ban or a mute until ExpiresAt. RoomID is only set for mutes.
+type Sanction struct {
+	UserID    int64
+	Kind      string
+	RoomID    int64
+	Reason    string
+	IssuedBy  int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Restrictions are the sanctions of a user in force right now.
+type Restrictions struct {
+	// Ban is nil unless the user is banned. Users with the banned role are banned
+	// for good, their Ban has a zero ExpiresAt.
+	Ban   *Sanction
+	Mutes []Sanction
+}
@@ -0,0 +1,60 @@
+package models
+
+import "time"
+
+// RefreshToken is the stored side of an opaque refresh token. The token itself is only
+// known to the client, TokenHash is its sha256. All tokens rotated from one login share FamilyID.
+type RefreshToken struct {
+	ID        int64
+	TokenHash string
+	FamilyID  string
+	UserID    int64
+	AppID     int64
+	Device    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Rotated   bool
+	Revoked   bool
+}
+
+// AuthorizationCode is the stored side of an OpenID Connect authorization code, CodeHash is
+// its sha256. It is exchanged once at /token by the app it was issued to.
+type AuthorizationCode struct {
+	CodeHash      string
+	AppID         int64
+	UserID        int64
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// Purposes of user tokens, a token is only accepted for the purpose it was issued for.
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// UserToken is the stored side of a single-use token mailed to a user, TokenHash is its sha256.
+type UserToken struct {
+	TokenHash string
+	UserID    int64
+	Purpose   string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// LoginChallenge is a login that passed the password check and waits for the second factor.
+// The challenge token is only known to the client, TokenHash is its sha256.
+type LoginChallenge struct {
+	TokenHash string
+	UserID    int64
+	AppID     int64
+	Device    string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// TOTP is the authenticator of a user. Secret is encrypted, the service holds the key.
+// It only protects logins once Enabled, after the user confirmed a first code.
+type TOTP struct {
+	UserID    int64
+	Secret    []byte
+	Enabled   bool
+	LastStep  int64
+	CreatedAt time.Time
+}
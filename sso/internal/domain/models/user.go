@@ -1,9 +1,10 @@
 package models
 
 type User struct {
-	ID       int64
-	UserName string
-	Email    string
-	PassHash []byte
-	Role     string
+	ID            int64
+	UserName      string
+	Email         string
+	PassHash      []byte
+	Role          string
+	EmailVerified bool
 }
@@ -2,30 +2,54 @@ package auth
 
 import (
 	ssov1 "ChatService/protos/gen/go/sso"
+	"ChatService/sso/internal/domain/models"
+	authlib "ChatService/sso/internal/lib/auth"
+	"ChatService/sso/internal/lib/jwt"
 	"ChatService/sso/internal/lib/validator"
 	"ChatService/sso/internal/services/auth"
+	"ChatService/sso/internal/services/rbac"
+	"ChatService/sso/internal/storage"
 	"context"
 	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"net"
+	"slices"
+	"strings"
+	"time"
 )
 
 type Auth interface {
-	Login(ctx context.Context, email, password string, appID int) (string, error)
+	Login(ctx context.Context, email, password string, appID int, device, clientIP string) (string, string, string, error)
+	VerifySecondFactor(ctx context.Context, challengeToken, code, clientIP string) (string, string, error)
+	RefreshToken(ctx context.Context, refreshToken string) (string, string, error)
 	Register(ctx context.Context, username, email, password string) (int64, error)
-	Logout(ctx context.Context, token string) (bool, error)
+	Logout(ctx context.Context, userID int64, token string, refreshToken string) (bool, error)
+	IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error)
 	IsAdmin(ctx context.Context, userID int64) (bool, error)
 	IsModerator(ctx context.Context, userID int64) (bool, error)
+	CheckPermission(ctx context.Context, userID int64, permission string) (bool, error)
+	Restrictions(ctx context.Context, userID int64) (models.Restrictions, error)
+	JWKS(ctx context.Context) (jwt.JWKS, error)
+	VerifyEmail(ctx context.Context, token string) error
+	RequestPasswordReset(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, token, newPassword string) error
 }
 
 type serverAuth struct {
 	ssov1.UnimplementedAuthServiceServer
 	auth Auth
+	// trustedProxies may pass the address of their client in x-forwarded-for
+	trustedProxies []string
 }
 
-func RegisterService(gRPCServer *grpc.Server, auth Auth) {
-	ssov1.RegisterAuthServiceServer(gRPCServer, &serverAuth{auth: auth})
+func RegisterService(gRPCServer *grpc.Server, auth Auth, trustedProxies []string) {
+	ssov1.RegisterAuthServiceServer(gRPCServer, &serverAuth{auth: auth, trustedProxies: trustedProxies})
 }
 
 func (s *serverAuth) Login(ctx context.Context, req *ssov1.LoginRequest) (*ssov1.LoginResponse, error) {
@@ -34,30 +58,158 @@ func (s *serverAuth) Login(ctx context.Context, req *ssov1.LoginRequest) (*ssov1
 		return nil, err
 	}
 
-	token, err := s.auth.Login(ctx, req.Email, req.Password, int(req.AppId))
+	token, refreshToken, challenge, err := s.auth.Login(ctx, req.Email, req.Password, int(req.AppId), req.Device, s.clientIP(ctx))
 	if err != nil {
+		var locked *auth.LockedError
+		if errors.As(err, &locked) {
+			return nil, lockedError(locked)
+		}
 		if errors.Is(err, auth.ErrInvalidCredentials) {
 			return nil, status.Error(codes.PermissionDenied, "invalid credentials")
 		}
 		return nil, status.Error(codes.Unauthenticated, "failed with login")
 	}
-	return &ssov1.LoginResponse{Token: token}, nil
+	return &ssov1.LoginResponse{Token: token, RefreshToken: refreshToken, ChallengeToken: challenge}, nil
 
 }
 
+func (s *serverAuth) VerifySecondFactor(ctx context.Context, req *ssov1.VerifySecondFactorRequest) (*ssov1.VerifySecondFactorResponse, error) {
+	err := validator.VerifySecondFactorValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	token, refreshToken, err := s.auth.VerifySecondFactor(ctx, req.ChallengeToken, req.Code, s.clientIP(ctx))
+	if err != nil {
+		var locked *auth.LockedError
+		if errors.As(err, &locked) {
+			return nil, lockedError(locked)
+		}
+		if errors.Is(err, auth.ErrInvalidChallenge) {
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired login challenge")
+		}
+		if errors.Is(err, auth.ErrInvalidCode) {
+			return nil, status.Error(codes.PermissionDenied, "invalid code")
+		}
+		return nil, status.Error(codes.Internal, "failed to verify second factor")
+	}
+	return &ssov1.VerifySecondFactorResponse{Token: token, RefreshToken: refreshToken}, nil
+}
+
 func (s *serverAuth) Logout(ctx context.Context, req *ssov1.LogoutRequest) (*ssov1.LogoutResponse, error) {
 	err := validator.LogoutValid(req)
 	if err != nil {
 		return nil, err
 	}
 
-	answer, err := s.auth.Logout(ctx, req.Token)
+	answer, err := s.auth.Logout(ctx, req.UserId, req.Token, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			return nil, status.Error(codes.PermissionDenied, "token belongs to another user")
+		}
+		return nil, status.Error(codes.Internal, "failed with logout")
+	}
 	return &ssov1.LogoutResponse{Answer: answer}, nil
 }
 
-/*func (s *serverAuth) RefreshToken(ctx context.Context, req *ssov1.RefreshTokenRequest) (*ssov1.RefreshTokenResponse, error) {
+func (s *serverAuth) IsTokenRevoked(ctx context.Context, req *ssov1.IsTokenRevokedRequest) (*ssov1.IsTokenRevokedResponse, error) {
+	err := validator.IsTokenRevokedValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.auth.IsTokenRevoked(ctx, req.GetJti(), req.GetUserId(), time.Unix(req.GetIssuedAt(), 0))
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to check token")
+	}
+	return &ssov1.IsTokenRevokedResponse{Revoked: revoked}, nil
+}
+
+func (s *serverAuth) GetJWKS(ctx context.Context, req *ssov1.GetJWKSRequest) (*ssov1.GetJWKSResponse, error) {
+	jwks, err := s.auth.JWKS(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "failed to get signing keys")
+	}
 
-}*/
+	keys := make([]*ssov1.JWK, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		keys = append(keys, &ssov1.JWK{
+			Kid: key.KeyID,
+			Kty: key.KeyType,
+			Alg: key.Algorithm,
+			Use: key.Use,
+			Crv: key.Curve,
+			X:   key.X,
+			N:   key.N,
+			E:   key.E,
+		})
+	}
+	return &ssov1.GetJWKSResponse{Keys: keys}, nil
+}
+
+func (s *serverAuth) VerifyEmail(ctx context.Context, req *ssov1.VerifyEmailRequest) (*ssov1.VerifyEmailResponse, error) {
+	err := validator.VerifyEmailValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.VerifyEmail(ctx, req.Token); err != nil {
+		if errors.Is(err, auth.ErrInvalidUserToken) {
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired token")
+		}
+		return nil, status.Error(codes.Internal, "failed to verify email")
+	}
+	return &ssov1.VerifyEmailResponse{Success: true}, nil
+}
+
+func (s *serverAuth) RequestPasswordReset(ctx context.Context, req *ssov1.RequestPasswordResetRequest) (*ssov1.RequestPasswordResetResponse, error) {
+	err := validator.RequestPasswordResetValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.RequestPasswordReset(ctx, req.Email); err != nil {
+		return nil, status.Error(codes.Internal, "failed to request password reset")
+	}
+	return &ssov1.RequestPasswordResetResponse{}, nil
+}
+
+func (s *serverAuth) ResetPassword(ctx context.Context, req *ssov1.ResetPasswordRequest) (*ssov1.ResetPasswordResponse, error) {
+	err := validator.ResetPasswordValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.ResetPassword(ctx, req.Token, req.NewPassword); err != nil {
+		if errors.Is(err, auth.ErrInvalidUserToken) {
+			return nil, status.Error(codes.InvalidArgument, "invalid or expired token")
+		}
+		return nil, status.Error(codes.Internal, "failed to reset password")
+	}
+	return &ssov1.ResetPasswordResponse{Success: true}, nil
+}
+
+func (s *serverAuth) RefreshToken(ctx context.Context, req *ssov1.RefreshTokenRequest) (*ssov1.RefreshTokenResponse, error) {
+	err := validator.RefreshTokenValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	token, refreshToken, err := s.auth.RefreshToken(ctx, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrRefreshTokenReused) {
+			return nil, status.Error(codes.Unauthenticated, "refresh token was already used, all sessions of this login are revoked")
+		}
+		if errors.Is(err, auth.ErrInvalidRefreshToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+	return &ssov1.RefreshTokenResponse{Token: token, RefreshToken: refreshToken}, nil
+}
 
 func (s *serverAuth) Register(ctx context.Context, req *ssov1.RegisterRequest) (*ssov1.RegisterResponse, error) {
 	err := validator.RegisterValid(req)
@@ -107,3 +259,92 @@ func (s *serverAuth) IsModerator(ctx context.Context, req *ssov1.IsModeratorRequ
 	}
 	return &ssov1.IsModeratorResponse{IsMod: answer}, nil
 }
+
+func (s *serverAuth) CheckPermission(ctx context.Context, req *ssov1.CheckPermissionRequest) (*ssov1.CheckPermissionResponse, error) {
+	err := validator.CheckPermissionValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := s.auth.CheckPermission(ctx, req.UserId, req.Permission)
+	if err != nil {
+		if errors.Is(err, rbac.ErrUnknownPermission) {
+			return nil, status.Error(codes.InvalidArgument, "unknown permission")
+		}
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to check permission")
+	}
+	return &ssov1.CheckPermissionResponse{Allowed: allowed}, nil
+}
+
+func (s *serverAuth) GetRestrictions(ctx context.Context, req *ssov1.GetRestrictionsRequest) (*ssov1.GetRestrictionsResponse, error) {
+	err := validator.GetRestrictionsValid(req)
+	if err != nil {
+		return nil, err
+	}
+	// Services ask without an identity, a signed in user only about themselves
+	if identity, ok := authlib.FromContext(ctx); ok && identity.UserID != req.UserId {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	restrictions, err := s.auth.Restrictions(ctx, req.UserId)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "failed to get restrictions")
+	}
+
+	resp := &ssov1.GetRestrictionsResponse{}
+	if restrictions.Ban != nil {
+		resp.Ban = restrictionToPB(*restrictions.Ban)
+	}
+	for _, mute := range restrictions.Mutes {
+		resp.Mutes = append(resp.Mutes, restrictionToPB(mute))
+	}
+	return resp, nil
+}
+
+func restrictionToPB(sanction models.Sanction) *ssov1.Restriction {
+	restriction := &ssov1.Restriction{RoomId: sanction.RoomID, Reason: sanction.Reason}
+	if !sanction.ExpiresAt.IsZero() {
+		restriction.ExpiresAt = sanction.ExpiresAt.Unix()
+	}
+	return restriction
+}
+
+// lockedError tells the client when to try again in a RetryInfo detail
+func lockedError(locked *auth.LockedError) error {
+	st := status.New(codes.ResourceExhausted, "too many failed login attempts")
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(locked.RetryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// clientIP is the address of the caller. Trusted proxies forward the address of their own
+// client in x-forwarded-for, anyone else could make it up.
+func (s *serverAuth) clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	ip := p.Addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !slices.Contains(s.trustedProxies, ip) {
+		return ip
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if forwarded := md.Get("x-forwarded-for"); len(forwarded) > 0 {
+		// The first address is the original client
+		if client := strings.TrimSpace(strings.Split(forwarded[0], ",")[0]); client != "" {
+			return client
+		}
+	}
+	return ip
+}
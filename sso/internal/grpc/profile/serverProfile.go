@@ -2,19 +2,32 @@ package profile
 
 import (
 	ssov1 "ChatService/protos/gen/go/sso"
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/auth"
 	"ChatService/sso/internal/lib/validator"
-	"ChatService/sso/internal/services/auth"
+	"ChatService/sso/internal/services/profile"
+	"ChatService/sso/internal/services/twofactor"
+	"ChatService/sso/internal/storage"
 	"context"
 	"errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"time"
 )
 
 type Profile interface {
 	ChangePassword(ctx context.Context, oldPassword string, password string, id int64) (bool, error)
 	ChangeName(ctx context.Context, id int64, newName string) (bool, error)
 	ChangeRole(ctx context.Context, password string, idAdmin int64, id int64, newRole int32) (bool, error)
+	EnrollTOTP(ctx context.Context, id int64, password string) (string, string, error)
+	ConfirmTOTP(ctx context.Context, id int64, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, id int64, password, code string) error
+	UnlockUser(ctx context.Context, password string, idAdmin int64, id int64) error
+	BanUser(ctx context.Context, idModerator int64, id int64, duration time.Duration, reason string) (models.Sanction, error)
+	UnbanUser(ctx context.Context, idModerator int64, id int64) error
+	MuteUser(ctx context.Context, idModerator int64, id int64, roomID int64, duration time.Duration, reason string) (models.Sanction, error)
+	UnmuteUser(ctx context.Context, idModerator int64, id int64, roomID int64) error
 }
 
 type serviceProfile struct {
@@ -32,9 +45,14 @@ func (s *serviceProfile) ChangePassword(ctx context.Context, req *ssov1.ChangePa
 		return nil, err
 	}
 
-	answer, err := s.profile.ChangePassword(ctx, req.OldPassword, req.NewPassword, req.UserId)
+	userID, err := caller(ctx)
 	if err != nil {
-		if errors.Is(err, auth.ErrInvalidCredentials) {
+		return nil, err
+	}
+
+	answer, err := s.profile.ChangePassword(ctx, req.OldPassword, req.NewPassword, userID)
+	if err != nil {
+		if errors.Is(err, profile.ErrInvalidCredentials) {
 			return nil, status.Error(codes.PermissionDenied, "invalid credentials")
 		}
 		return nil, status.Error(codes.Unauthenticated, "failed with ChangePassword")
@@ -48,9 +66,14 @@ func (s *serviceProfile) ChangeName(ctx context.Context, req *ssov1.ChangeNameRe
 		return nil, err
 	}
 
-	answer, err := s.profile.ChangeName(ctx, req.UserId, req.NewName)
+	userID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := s.profile.ChangeName(ctx, userID, req.NewName)
 	if err != nil {
-		if errors.Is(err, auth.ErrInvalidCredentials) {
+		if errors.Is(err, profile.ErrInvalidCredentials) {
 			return nil, status.Error(codes.PermissionDenied, "invalid credentials")
 		}
 		return nil, status.Error(codes.Unauthenticated, "failed with ChangeName")
@@ -63,12 +86,203 @@ func (s *serviceProfile) ChangeRole(ctx context.Context, req *ssov1.ChangeRoleRe
 	if err != nil {
 		return nil, err
 	}
-	answer, err := s.profile.ChangeRole(ctx, req.Password, req.AdminId, req.UserId, req.NewRole)
+	adminID, err := caller(ctx)
 	if err != nil {
-		if errors.Is(err, auth.ErrInvalidCredentials) {
+		return nil, err
+	}
+
+	answer, err := s.profile.ChangeRole(ctx, req.Password, adminID, req.UserId, req.NewRole)
+	if err != nil {
+		if errors.Is(err, profile.ErrInvalidCredentials) {
 			return nil, status.Error(codes.PermissionDenied, "invalid credentials")
 		}
+		if errors.Is(err, profile.ErrPermissionDenied) {
+			return nil, status.Error(codes.PermissionDenied, "permission denied")
+		}
+		if errors.Is(err, profile.ErrUnknownRole) {
+			return nil, status.Error(codes.InvalidArgument, "unknown role")
+		}
 		return nil, status.Error(codes.Unauthenticated, "failed with ChangeRole")
 	}
 	return &ssov1.ChangeRoleResponse{Success: answer}, nil
 }
+
+func (s *serviceProfile) EnrollTOTP(ctx context.Context, req *ssov1.EnrollTOTPRequest) (*ssov1.EnrollTOTPResponse, error) {
+	err := validator.EnrollTOTPValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, url, err := s.profile.EnrollTOTP(ctx, userID, req.Password)
+	if err != nil {
+		return nil, twoFactorError(err, "failed with EnrollTOTP")
+	}
+	return &ssov1.EnrollTOTPResponse{Secret: secret, Url: url}, nil
+}
+
+func (s *serviceProfile) ConfirmTOTP(ctx context.Context, req *ssov1.ConfirmTOTPRequest) (*ssov1.ConfirmTOTPResponse, error) {
+	err := validator.ConfirmTOTPValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := s.profile.ConfirmTOTP(ctx, userID, req.Code)
+	if err != nil {
+		return nil, twoFactorError(err, "failed with ConfirmTOTP")
+	}
+	return &ssov1.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (s *serviceProfile) DisableTOTP(ctx context.Context, req *ssov1.DisableTOTPRequest) (*ssov1.DisableTOTPResponse, error) {
+	err := validator.DisableTOTPValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.profile.DisableTOTP(ctx, userID, req.Password, req.Code); err != nil {
+		return nil, twoFactorError(err, "failed with DisableTOTP")
+	}
+	return &ssov1.DisableTOTPResponse{Success: true}, nil
+}
+
+func (s *serviceProfile) UnlockUser(ctx context.Context, req *ssov1.UnlockUserRequest) (*ssov1.UnlockUserResponse, error) {
+	err := validator.UnlockUserValid(req)
+	if err != nil {
+		return nil, err
+	}
+
+	adminID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.profile.UnlockUser(ctx, req.Password, adminID, req.UserId); err != nil {
+		if errors.Is(err, profile.ErrInvalidCredentials) {
+			return nil, status.Error(codes.PermissionDenied, "invalid credentials")
+		}
+		if errors.Is(err, profile.ErrPermissionDenied) {
+			return nil, status.Error(codes.PermissionDenied, "permission denied")
+		}
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+		return nil, status.Error(codes.Internal, "failed with UnlockUser")
+	}
+	return &ssov1.UnlockUserResponse{Success: true}, nil
+}
+
+func (s *serviceProfile) BanUser(ctx context.Context, req *ssov1.BanUserRequest) (*ssov1.BanUserResponse, error) {
+	err := validator.BanUserValid(req)
+	if err != nil {
+		return nil, err
+	}
+	moderatorID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sanction, err := s.profile.BanUser(ctx, moderatorID, req.UserId, time.Duration(req.DurationSeconds)*time.Second, req.Reason)
+	if err != nil {
+		return nil, sanctionError(err, "failed with BanUser")
+	}
+	return &ssov1.BanUserResponse{ExpiresAt: sanction.ExpiresAt.Unix()}, nil
+}
+
+func (s *serviceProfile) UnbanUser(ctx context.Context, req *ssov1.UnbanUserRequest) (*ssov1.UnbanUserResponse, error) {
+	err := validator.UnbanUserValid(req)
+	if err != nil {
+		return nil, err
+	}
+	moderatorID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.profile.UnbanUser(ctx, moderatorID, req.UserId); err != nil {
+		return nil, sanctionError(err, "failed with UnbanUser")
+	}
+	return &ssov1.UnbanUserResponse{Success: true}, nil
+}
+
+func (s *serviceProfile) MuteUser(ctx context.Context, req *ssov1.MuteUserRequest) (*ssov1.MuteUserResponse, error) {
+	err := validator.MuteUserValid(req)
+	if err != nil {
+		return nil, err
+	}
+	moderatorID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sanction, err := s.profile.MuteUser(ctx, moderatorID, req.UserId, req.RoomId, time.Duration(req.DurationSeconds)*time.Second, req.Reason)
+	if err != nil {
+		return nil, sanctionError(err, "failed with MuteUser")
+	}
+	return &ssov1.MuteUserResponse{ExpiresAt: sanction.ExpiresAt.Unix()}, nil
+}
+
+func (s *serviceProfile) UnmuteUser(ctx context.Context, req *ssov1.UnmuteUserRequest) (*ssov1.UnmuteUserResponse, error) {
+	err := validator.UnmuteUserValid(req)
+	if err != nil {
+		return nil, err
+	}
+	moderatorID, err := caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.profile.UnmuteUser(ctx, moderatorID, req.UserId, req.RoomId); err != nil {
+		return nil, sanctionError(err, "failed with UnmuteUser")
+	}
+	return &ssov1.UnmuteUserResponse{Success: true}, nil
+}
+
+// caller returns the user the bearer token of the call belongs to, ids in the requests are not trusted
+func caller(ctx context.Context) (int64, error) {
+	identity, ok := auth.FromContext(ctx)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, "authorization required")
+	}
+	return identity.UserID, nil
+}
+
+func twoFactorError(err error, message string) error {
+	switch {
+	case errors.Is(err, profile.ErrInvalidCredentials):
+		return status.Error(codes.PermissionDenied, "invalid credentials")
+	case errors.Is(err, twofactor.ErrInvalidCode):
+		return status.Error(codes.PermissionDenied, "invalid code")
+	case errors.Is(err, twofactor.ErrAlreadyEnabled):
+		return status.Error(codes.FailedPrecondition, "two-factor authentication already enabled")
+	case errors.Is(err, twofactor.ErrNotEnrolled):
+		return status.Error(codes.FailedPrecondition, "two-factor authentication not enrolled")
+	}
+	return status.Error(codes.Internal, message)
+}
+
+func sanctionError(err error, message string) error {
+	switch {
+	case errors.Is(err, profile.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, "permission denied")
+	case errors.Is(err, storage.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, storage.ErrSanctionNotFound):
+		return status.Error(codes.NotFound, "no such ban or mute")
+	}
+	return status.Error(codes.Internal, message)
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"ChatService/sso/internal/lib/jwt"
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RevocationChecker answers whether a token was ended by Logout or a password reset.
+type RevocationChecker interface {
+	IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error)
+}
+
+// Authenticator turns an access token into the identity of the caller.
+type Authenticator struct {
+	Keys        jwt.KeyResolver
+	Revocations RevocationChecker
+}
+
+// Authenticate validates the token and makes sure it was not revoked. Errors are gRPC statuses.
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	tokenInfo := jwt.ValidateToken(ctx, token, a.Keys, jwt.AudienceSSO)
+	if tokenInfo.Error != nil {
+		return Identity{}, status.Error(codes.Unauthenticated, "invalid authentication token")
+	}
+
+	// Tokens without jti predate revocation and simply live until exp
+	if tokenInfo.ID != "" {
+		revoked, err := a.Revocations.IsTokenRevoked(ctx, tokenInfo.ID, tokenInfo.UserID, tokenInfo.IssuedAt)
+		if err != nil {
+			return Identity{}, status.Error(codes.Internal, "failed to check authentication token")
+		}
+		if revoked {
+			return Identity{}, status.Error(codes.Unauthenticated, "authentication token was revoked")
+		}
+	}
+	return Identity{UserID: tokenInfo.UserID}, nil
+}
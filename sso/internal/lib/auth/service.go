@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+)
+
+// ServiceTokens are the credentials other services present for calls they make on their own behalf.
+type ServiceTokens struct {
+	hashes [][sha256.Size]byte
+}
+
+// NewServiceTokens accepts the given tokens, blank ones are skipped.
+func NewServiceTokens(tokens []string) *ServiceTokens {
+	s := &ServiceTokens{}
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			s.hashes = append(s.hashes, sha256.Sum256([]byte(token)))
+		}
+	}
+	return s
+}
+
+// Empty reports whether no token is accepted, every service call is refused then.
+func (s *ServiceTokens) Empty() bool {
+	return len(s.hashes) == 0
+}
+
+// Valid compares token with every accepted one in constant time.
+func (s *ServiceTokens) Valid(token string) bool {
+	hash := sha256.Sum256([]byte(token))
+	valid := 0
+	for _, accepted := range s.hashes {
+		valid |= subtle.ConstantTimeCompare(hash[:], accepted[:])
+	}
+	return valid == 1
+}
@@ -2,31 +2,146 @@ package jwt
 
 import (
 	"ChatService/sso/internal/domain/models"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"slices"
+	"strconv"
 	"time"
 )
 
-func NewToken(user models.User, app models.App, duration time.Duration) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
+// KeyResolver finds the public key named by the kid header of a token.
+type KeyResolver interface {
+	PublicKey(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// Audiences of the chat access tokens NewToken issues, SSO and the CRUD service accept only
+// tokens that name them. Tokens of OpenID Connect clients name the client instead.
+const (
+	AudienceSSO  = "sso"
+	AudienceCRUD = "crud"
+)
+
+// NewToken signs a chat access token, it acts for the user at SSO and the CRUD service.
+func NewToken(user models.User, app models.App, duration time.Duration, key models.SigningKey) (string, error) {
+	method, err := SigningMethod(key.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	// jti lets a single token be revoked before exp
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	token := jwt.New(method)
+	token.Header["kid"] = key.ID
 
 	claims := token.Claims.(jwt.MapClaims)
+	claims["jti"] = hex.EncodeToString(jti)
 	claims["userID"] = user.ID
 	claims["email"] = user.Email
 	claims["appID"] = app.ID
+	claims["aud"] = []string{AudienceSSO, AudienceCRUD}
+	claims["iat"] = time.Now().Unix()
 	claims["exp"] = time.Now().Add(duration).Unix()
 
-	tokenString, err := token.SignedString([]byte(app.Secret))
+	tokenString, err := token.SignedString(key.PrivateKey)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
+// NewClientToken signs the access token of an OpenID Connect client. Its audience is the client
+// and scope lists what it was granted, it is only good for the userinfo endpoint.
+func NewClientToken(user models.User, clientID int64, scope string, issuer string, duration time.Duration,
+	key models.SigningKey) (string, error) {
+	method, err := SigningMethod(key.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"jti":    hex.EncodeToString(jti),
+		"iss":    issuer,
+		"sub":    strconv.FormatInt(user.ID, 10),
+		"userID": user.ID,
+		"aud":    strconv.FormatInt(clientID, 10),
+		"scope":  scope,
+		"iat":    now.Unix(),
+		"exp":    now.Add(duration).Unix(),
+	})
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+// IDToken holds the claims of an OpenID Connect ID token, exp and iat are set when it is signed.
+type IDToken struct {
+	Issuer   string
+	Subject  string
+	Audience string
+	Nonce    string
+	AuthTime time.Time
+	// Optional profile claims, only set for the scopes the app asked for
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// NewIDToken signs an ID token with the same keys as access tokens, so apps verify it through the JWKS.
+func NewIDToken(idToken IDToken, duration time.Duration, key models.SigningKey) (string, error) {
+	method, err := SigningMethod(key.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       idToken.Issuer,
+		"sub":       idToken.Subject,
+		"aud":       idToken.Audience,
+		"iat":       now.Unix(),
+		"exp":       now.Add(duration).Unix(),
+		"auth_time": idToken.AuthTime.Unix(),
+	}
+	if idToken.Nonce != "" {
+		claims["nonce"] = idToken.Nonce
+	}
+	if idToken.Email != "" {
+		claims["email"] = idToken.Email
+		claims["email_verified"] = idToken.EmailVerified
+	}
+	if idToken.Name != "" {
+		claims["name"] = idToken.Name
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
 type TokenInfo struct {
-	Error  error
-	UserID int64
+	Error     error
+	UserID    int64
+	AppID     int64
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Audience  []string
+	// Scope is only set in tokens of OpenID Connect clients
+	Scope string
 }
 
 var (
@@ -34,14 +149,17 @@ var (
 	ErrInvalidToken = errors.New("invalid token")
 )
 
-func ValidateToken(tokenString string, secret string) TokenInfo {
+// ValidateToken checks the signature and expiry of a token and that its aud claim names audience.
+// An empty audience skips the check, the caller has to tell the kind of token apart itself.
+func ValidateToken(ctx context.Context, tokenString string, keys KeyResolver, audience string) TokenInfo {
 	// Decoding jwt
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return false, fmt.Errorf("unexpected signing method")
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, ErrInvalidToken
 		}
-		return []byte(secret), nil
-	})
+		return keys.PublicKey(ctx, kid)
+	}, jwt.WithValidMethods(Algorithms))
 	if err != nil || !token.Valid {
 		return TokenInfo{Error: err}
 	}
@@ -61,11 +179,39 @@ func ValidateToken(tokenString string, secret string) TokenInfo {
 			return TokenInfo{Error: ErrTokenExpired}
 		}
 
-		userId, ok := claims["userID"]
+		userId, ok := claims["userID"].(float64)
 		if !ok {
 			return TokenInfo{Error: ErrInvalidToken}
 		}
-		return TokenInfo{Error: nil, UserID: int64(userId.(float64))}
+		aud, err := claims.GetAudience()
+		if err != nil || (audience != "" && !slices.Contains(aud, audience)) {
+			return TokenInfo{Error: ErrInvalidToken}
+		}
+		appID, _ := claims["appID"].(float64)
+		jti, _ := claims["jti"].(string)
+		scope, _ := claims["scope"].(string)
+		// Tokens issued before iat was added count as issued now
+		issuedAt := time.Now()
+		if iat, ok := claims["iat"].(float64); ok {
+			issuedAt = time.Unix(int64(iat), 0)
+		}
+		return TokenInfo{Error: nil, UserID: int64(userId), AppID: int64(appID), ID: jti, IssuedAt: issuedAt, ExpiresAt: expTime,
+			Audience: aud, Scope: scope}
 	}
 	return TokenInfo{Error: ErrInvalidToken}
 }
+
+// Algorithms are the signing algorithms SSO issues tokens with.
+var Algorithms = []string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()}
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+
+func SigningMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case jwt.SigningMethodEdDSA.Alg():
+		return jwt.SigningMethodEdDSA, nil
+	case jwt.SigningMethodRS256.Alg():
+		return jwt.SigningMethodRS256, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, alg)
+}
@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File writes every message as an .eml file into Dir instead of sending it.
+type File struct {
+	Dir  string
+	From string
+}
+
+func NewFile(dir, from string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &File{Dir: dir, From: from}, nil
+}
+
+func (f *File) Send(ctx context.Context, msg Message) error {
+	const op = "mail.File.Send"
+
+	if err := validHeader(msg.To); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := validHeader(msg.Subject); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+	// Messages carry tokens, so they are only readable by the service
+	if err := os.WriteFile(filepath.Join(f.Dir, name), format(f.From, msg), 0o600); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// SMTP sends messages through an SMTP server. The connection is upgraded with STARTTLS when the
+// server offers it, credentials are only sent over TLS or to localhost as net/smtp enforces.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	const op = "mail.SMTP.Send"
+
+	if err := validHeader(msg.To); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := validHeader(msg.Subject); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	// net/smtp has no context support, the send runs until the server answers
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, format(s.From, msg))
+	}()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", op, ctx.Err())
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+// Package secretbox encrypts small secrets kept in the database with AES-256-GCM.
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the size of an AES-256 key
+const KeySize = 32
+
+var ErrInvalidKey = errors.New("secretbox key must be 32 bytes, base64 encoded")
+
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New creates a Box from a base64 encoded 32 byte key.
+func New(encodedKey string) (*Box, error) {
+	const op = "secretbox.New"
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("%s: %w", op, ErrInvalidKey)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts plaintext, the random nonce is put in front of the ciphertext.
+// additionalData binds the ciphertext to its owner, e.g. the user id, and must be given to Open again.
+func (b *Box) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("secretbox.Seal: %w", err)
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (b *Box) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	const op = "secretbox.Open"
+
+	if len(ciphertext) < b.aead.NonceSize() {
+		return nil, fmt.Errorf("%s: ciphertext too short", op)
+	}
+	nonce, sealed := ciphertext[:b.aead.NonceSize()], ciphertext[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,83 @@
+package secretbox_test
+
+import (
+	"ChatService/sso/internal/lib/secretbox"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func newBox(t *testing.T, fill byte) *secretbox.Box {
+	t.Helper()
+	box, err := secretbox.New(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, secretbox.KeySize)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return box
+}
+
+func TestSealOpen(t *testing.T) {
+	box := newBox(t, 1)
+	plaintext := []byte("12345678901234567890")
+	ad := []byte("totp:7")
+
+	sealed, err := box.Seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Errorf("sealed value contains the plaintext")
+	}
+	again, err := box.Seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Errorf("sealing twice gave the same ciphertext, the nonce is not random")
+	}
+
+	opened, err := box.Open(sealed, ad)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open = %q, want %q", opened, plaintext)
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	box := newBox(t, 1)
+	ad := []byte("totp:7")
+	sealed, err := box.Seal([]byte("secret"), ad)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	cases := []struct {
+		name       string
+		box        *secretbox.Box
+		ciphertext []byte
+		ad         []byte
+	}{
+		{"other user", box, sealed, []byte("totp:8")},
+		{"other key", newBox(t, 2), sealed, ad},
+		{"tampered", box, tampered, ad},
+		{"too short", box, sealed[:4], ad},
+	}
+	for _, c := range cases {
+		if _, err := c.box.Open(c.ciphertext, c.ad); err == nil {
+			t.Errorf("Open with %s succeeded", c.name)
+		}
+	}
+}
+
+func TestNewRejectsBadKeys(t *testing.T) {
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := secretbox.New(key); !errors.Is(err, secretbox.ErrInvalidKey) {
+			t.Errorf("New(%q): err = %v, want %v", key, err, secretbox.ErrInvalidKey)
+		}
+	}
+}
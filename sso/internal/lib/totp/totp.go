@@ -0,0 +1,97 @@
+// Package totp implements RFC 6238 time-based one-time passwords with the parameters
+// authenticator apps expect: HMAC-SHA1, 6 digits and a 30 second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// skew is how many steps a code may be early or late, clocks of phones drift
+	skew = 1
+	// secretSize is the 160 bits RFC 4226 recommends
+	secretSize = 20
+)
+
+var ErrInvalidCode = errors.New("invalid code")
+
+// Secret is the shared key of an authenticator
+type Secret []byte
+
+func NewSecret() (Secret, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// String is the base32 form users type into authenticator apps
+func (s Secret) String() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(s)
+}
+
+// URL is the otpauth:// URL authenticator apps read from a QR code
+func (s Secret) URL(issuer, account string) string {
+	params := url.Values{
+		"secret":    {s.String()},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period.Seconds()))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Step is the counter of the time step t falls into
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code is the code of the given step
+func (s Secret) Code(step int64) string {
+	return s.code(step, Digits)
+}
+
+func (s Secret) code(step int64, digits int) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, s)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for range digits {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+// Validate checks code against the steps around t and returns the step it matched, so the
+// caller can refuse the same or an older step next time.
+func (s Secret) Validate(code string, t time.Time) (int64, error) {
+	if len(code) != Digits {
+		return 0, ErrInvalidCode
+	}
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(s.Code(step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidCode
+}
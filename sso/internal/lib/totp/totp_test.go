@@ -0,0 +1,69 @@
+package totp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of the test vectors in RFC 6238 Appendix B
+var rfcSecret = Secret("12345678901234567890")
+
+func TestCodeRFC6238(t *testing.T) {
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, c := range cases {
+		step := Step(time.Unix(c.unix, 0))
+		if got := rfcSecret.code(step, 8); got != c.want {
+			t.Errorf("code at %d = %s, want %s", c.unix, got, c.want)
+		}
+		// Authenticator apps show the last six digits of the same value
+		if got := rfcSecret.Code(step); got != c.want[2:] {
+			t.Errorf("Code at %d = %s, want %s", c.unix, got, c.want[2:])
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	for _, step := range []int64{current - 1, current, current + 1} {
+		got, err := rfcSecret.Validate(rfcSecret.Code(step), now)
+		if err != nil {
+			t.Errorf("Validate code of step %+d: %v", step-current, err)
+			continue
+		}
+		if got != step {
+			t.Errorf("Validate code of step %+d matched step %+d", step-current, got-current)
+		}
+	}
+	for _, step := range []int64{current - 2, current + 2} {
+		if _, err := rfcSecret.Validate(rfcSecret.Code(step), now); !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("Validate code of step %+d: err = %v, want %v", step-current, err, ErrInvalidCode)
+		}
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := rfcSecret.Code(Step(now))
+
+	for _, bad := range []string{"", code[1:], code + "0", rfcSecret.code(Step(now), 8)} {
+		if _, err := rfcSecret.Validate(bad, now); !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("Validate(%q): err = %v, want %v", bad, err, ErrInvalidCode)
+		}
+	}
+	if _, err := Secret("another secret").Validate(code, now); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("Validate with another secret: err = %v, want %v", err, ErrInvalidCode)
+	}
+}
@@ -4,12 +4,17 @@ import (
 	ssov1 "ChatService/protos/gen/go/sso"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"strings"
+	"time"
 )
 
 const (
 	emptyValue = 0
 )
 
+// maxSanctionDuration bounds bans and mutes, longer ones are better done with the banned role
+const maxSanctionDuration = 10 * 365 * 24 * time.Hour
+
 func LoginValid(req *ssov1.LoginRequest) error {
 	if req.GetEmail() == "" {
 		return status.Error(codes.InvalidArgument, "email required")
@@ -23,10 +28,61 @@ func LoginValid(req *ssov1.LoginRequest) error {
 	return nil
 }
 
+func VerifySecondFactorValid(req *ssov1.VerifySecondFactorRequest) error {
+	if req.GetChallengeToken() == "" {
+		return status.Error(codes.InvalidArgument, "challenge token required")
+	}
+	if req.GetCode() == "" {
+		return status.Error(codes.InvalidArgument, "code required")
+	}
+	return nil
+}
+
+func RefreshTokenValid(req *ssov1.RefreshTokenRequest) error {
+	if req.GetRefreshToken() == "" {
+		return status.Error(codes.InvalidArgument, "refresh token required")
+	}
+	return nil
+}
+
 func LogoutValid(req *ssov1.LogoutRequest) error {
 	if req.GetUserId() == emptyValue {
 		return status.Error(codes.InvalidArgument, "user id required")
 	}
+	if req.GetToken() == "" {
+		return status.Error(codes.InvalidArgument, "token required")
+	}
+	return nil
+}
+
+func IsTokenRevokedValid(req *ssov1.IsTokenRevokedRequest) error {
+	if req.GetJti() == "" {
+		return status.Error(codes.InvalidArgument, "jti required")
+	}
+	return nil
+}
+
+func VerifyEmailValid(req *ssov1.VerifyEmailRequest) error {
+	if req.GetToken() == "" {
+		return status.Error(codes.InvalidArgument, "token required")
+	}
+	return nil
+}
+
+func RequestPasswordResetValid(req *ssov1.RequestPasswordResetRequest) error {
+	if req.GetEmail() == "" {
+		return status.Error(codes.InvalidArgument, "email required")
+	}
+	return nil
+}
+
+func ResetPasswordValid(req *ssov1.ResetPasswordRequest) error {
+	if req.GetToken() == "" {
+		return status.Error(codes.InvalidArgument, "token required")
+	}
+	if req.GetNewPassword() == "" {
+		return status.Error(codes.InvalidArgument, "new password can not be empty")
+	}
 	return nil
 }
 
@@ -55,9 +111,6 @@ func IsModValid(req *ssov1.IsModeratorRequest) error {
 }
 
 func ChangePasswordValid(req *ssov1.ChangePasswordRequest) error {
-	if req.GetUserId() == emptyValue {
-		return status.Error(codes.InvalidArgument, "user id required")
-	}
 	if req.GetNewPassword() == "" {
 		return status.Error(codes.InvalidArgument, "new password can not be empty")
 	}
@@ -68,9 +121,6 @@ func ChangePasswordValid(req *ssov1.ChangePasswordRequest) error {
 }
 
 func ChangeNameValid(req *ssov1.ChangeNameRequest) error {
-	if req.GetUserId() == emptyValue {
-		return status.Error(codes.InvalidArgument, "user id required")
-	}
 	if req.GetNewName() == "" {
 		return status.Error(codes.InvalidArgument, "new name can not be empty")
 	}
@@ -81,18 +131,113 @@ func ChangeRoleValid(req *ssov1.ChangeRoleRequest) error {
 	if req.GetUserId() == emptyValue {
 		return status.Error(codes.InvalidArgument, "user id required")
 	}
-	if req.GetAdminId() == emptyValue {
-		return status.Error(codes.InvalidArgument, "admin id required")
+	// Whether the role exists is up to the roles table
+	if req.GetNewRole() <= 0 {
+		return status.Error(codes.InvalidArgument, "new role required")
+	}
+	if req.GetPassword() == "" {
+		return status.Error(codes.InvalidArgument, "password required")
+	}
+	return nil
+}
+
+func EnrollTOTPValid(req *ssov1.EnrollTOTPRequest) error {
+	if req.GetPassword() == "" {
+		return status.Error(codes.InvalidArgument, "password required")
+	}
+	return nil
+}
+
+func ConfirmTOTPValid(req *ssov1.ConfirmTOTPRequest) error {
+	if req.GetCode() == "" {
+		return status.Error(codes.InvalidArgument, "code required")
+	}
+	return nil
+}
+
+func DisableTOTPValid(req *ssov1.DisableTOTPRequest) error {
+	if req.GetPassword() == "" {
+		return status.Error(codes.InvalidArgument, "password required")
+	}
+	if req.GetCode() == "" {
+		return status.Error(codes.InvalidArgument, "code required")
+	}
+	return nil
+}
+
+func UnlockUserValid(req *ssov1.UnlockUserRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
+	}
+	if req.GetPassword() == "" {
+		return status.Error(codes.InvalidArgument, "password required")
+	}
+	return nil
+}
+
+func CheckPermissionValid(req *ssov1.CheckPermissionRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
+	}
+	if req.GetPermission() == "" {
+		return status.Error(codes.InvalidArgument, "permission required")
+	}
+	return nil
+}
+
+func GetRestrictionsValid(req *ssov1.GetRestrictionsRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
+	}
+	return nil
+}
+
+func BanUserValid(req *ssov1.BanUserRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
+	}
+	if !sanctionDurationValid(req.GetDurationSeconds()) {
+		return status.Error(codes.InvalidArgument, "duration must be positive and at most ten years")
+	}
+	if strings.TrimSpace(req.GetReason()) == "" {
+		return status.Error(codes.InvalidArgument, "reason required")
 	}
-	if !RoleValid(req.NewRole) {
-		return status.Error(codes.InvalidArgument, "new role must have a valid role")
+	return nil
+}
+
+func UnbanUserValid(req *ssov1.UnbanUserRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
 	}
 	return nil
 }
 
-func RoleValid(role int32) bool {
-	if role > 4 || role < 1 {
-		return false
+func MuteUserValid(req *ssov1.MuteUserRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
 	}
-	return true
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	if !sanctionDurationValid(req.GetDurationSeconds()) {
+		return status.Error(codes.InvalidArgument, "duration must be positive and at most ten years")
+	}
+	if strings.TrimSpace(req.GetReason()) == "" {
+		return status.Error(codes.InvalidArgument, "reason required")
+	}
+	return nil
+}
+
+func UnmuteUserValid(req *ssov1.UnmuteUserRequest) error {
+	if req.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "user id required")
+	}
+	if req.GetRoomId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "room id required")
+	}
+	return nil
+}
+
+func sanctionDurationValid(seconds int64) bool {
+	return seconds > 0 && seconds <= int64(maxSanctionDuration/time.Second)
 }
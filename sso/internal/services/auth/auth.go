@@ -5,6 +5,7 @@ import (
 	"ChatService/sso/internal/lib/jwt"
 	"ChatService/sso/internal/storage"
 	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
@@ -18,6 +19,48 @@ type Auth struct {
 	UserProvider UserProvider
 	AppProvider  AppProvider
 	TokenTTL     time.Duration
+
+	RefreshTokens   RefreshTokenStorage
+	RefreshTokenTTL time.Duration
+	Revocations     RevocationStorage
+	Keys            SigningKeys
+
+	UserTokens UserTokenStorage
+	Mail       Mailer
+
+	SecondFactor SecondFactor
+	Challenges   LoginChallengeStorage
+
+	Lockout Lockout
+
+	Permissions Permissions
+	Sanctions   Sanctions
+}
+
+// Permissions checks what a user may do, see services/rbac
+type Permissions interface {
+	Can(ctx context.Context, userID int64, permission string) (bool, error)
+}
+
+// Sanctions are the bans and mutes of users, see services/sanction
+type Sanctions interface {
+	Restrictions(ctx context.Context, userID int64) (models.Restrictions, error)
+}
+
+// Lockout counts failed logins, see services/lockout
+type Lockout interface {
+	Locked(ctx context.Context, email, clientIP string) (time.Duration, error)
+	Failed(ctx context.Context, email, clientIP string) error
+	Succeeded(ctx context.Context, email string) error
+}
+
+// LockedError is returned by Login while the account or the client is locked out
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter.Round(time.Second))
 }
 
 type UserSaver interface {
@@ -26,62 +69,223 @@ type UserSaver interface {
 
 type UserProvider interface {
 	GetUser(ctx context.Context, email string) (models.User, error)
-	IsAdmin(ctx context.Context, id int64) (bool, error)
-	IsModerator(ctx context.Context, id int64) (bool, error)
+	GetUserById(ctx context.Context, id int64) (models.User, error)
 }
 
 type AppProvider interface {
 	GetApp(ctx context.Context, id int) (models.App, error)
 }
 
+type RevocationStorage interface {
+	RevokeToken(ctx context.Context, jti string, userID int64, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error)
+	DeleteExpiredRevocations(ctx context.Context, before time.Time) (int64, error)
+}
+
+// SigningKeys provides the key new tokens are signed with and the keys they are verified with.
+type SigningKeys interface {
+	SigningKey(ctx context.Context) (models.SigningKey, error)
+	PublicKey(ctx context.Context, kid string) (crypto.PublicKey, error)
+	JWKS(ctx context.Context) (jwt.JWKS, error)
+}
+
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidToken       = errors.New("invalid token")
 )
 
-func (a *Auth) Login(ctx context.Context, email, password string, appID int) (string, error) {
+// Login returns an access token and a refresh token for a new session on device. When the user has
+// two-factor authentication enabled no tokens are issued yet, the returned challenge is exchanged
+// for them in VerifySecondFactor. Failed attempts are counted for the account and clientIP, once
+// either is locked Login returns a *LockedError without checking the password. The failures of
+// the account are reset only when the tokens are issued.
+func (a *Auth) Login(ctx context.Context, email, password string, appID int, device, clientIP string) (string, string, string, error) {
 	const op = "auth.Login"
 	a.Log.With(slog.String("op", op))
+
+	retryAfter, err := a.Lockout.Locked(ctx, email, clientIP)
+	if err != nil {
+		a.Log.Error("failed to check lockout")
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if retryAfter > 0 {
+		a.Log.Warn("login locked", slog.Duration("retry_after", retryAfter))
+		return "", "", "", fmt.Errorf("%s: %w", op, &LockedError{RetryAfter: retryAfter})
+	}
+
 	// Get User
 	user, err := a.UserProvider.GetUser(ctx, email)
 	if err != nil {
 		if errors.Is(err, storage.ErrUserNotFound) {
 			a.Log.Warn("user not found")
-			return "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+			a.loginFailed(ctx, email, clientIP)
+			return "", "", "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
 		}
 		a.Log.Warn("failed to get user")
-		return "", fmt.Errorf("%s: %w", op, err)
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Valid Password
 	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
 		a.Log.Warn("invalid password")
-		return "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+		a.loginFailed(ctx, email, clientIP)
+		return "", "", "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
 	}
 
 	// Get App
 	app, err := a.AppProvider.GetApp(ctx, appID)
 	if err != nil {
 		a.Log.Warn(err.Error())
-		return "", fmt.Errorf("%s: %w", op, err)
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	enabled, err := a.SecondFactor.Enabled(ctx, user.ID)
+	if err != nil {
+		a.Log.Error("failed to check second factor")
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if enabled {
+		challenge, err := a.issueLoginChallenge(ctx, user.ID, app.ID, device)
+		if err != nil {
+			a.Log.Error("failed to create login challenge")
+			return "", "", "", fmt.Errorf("%s: %w", op, err)
+		}
+		a.Log.Debug("second factor required")
+		return "", "", challenge, nil
 	}
 	a.Log.Debug("user logged in successfully")
 
 	// Create Token
-	token, err := jwt.NewToken(user, app, a.TokenTTL)
+	token, err := a.newToken(ctx, user, app)
 	if err != nil {
 		a.Log.Error("failed to create token")
-		return "", fmt.Errorf("%s: %w", op, err)
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	refreshToken, err := a.issueRefreshToken(ctx, user.ID, app.ID, device)
+	if err != nil {
+		a.Log.Error("failed to create refresh token")
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	a.loginSucceeded(ctx, email)
+	return token, refreshToken, "", nil
+}
+
+// loginFailed counts a failed login. The caller answers with invalid credentials either way,
+// a broken counter must not turn into a different answer.
+func (a *Auth) loginFailed(ctx context.Context, email, clientIP string) {
+	if err := a.Lockout.Failed(ctx, email, clientIP); err != nil {
+		a.Log.Error("failed to count failed login", slog.String("err", err.Error()))
 	}
-	return token, nil
 }
 
-func (a *Auth) Logout(ctx context.Context, token string) (bool, error) {
+// loginSucceeded resets the failures of the account once the whole login is done, a known password
+// alone must not reset them while the second factor is still being guessed.
+func (a *Auth) loginSucceeded(ctx context.Context, email string) {
+	if err := a.Lockout.Succeeded(ctx, email); err != nil {
+		a.Log.Error("failed to reset lockout", slog.String("err", err.Error()))
+	}
+}
+
+// Logout revokes the access token of userID until it expires. When the refresh token of the session
+// is given, its whole family is revoked as well so the session can not be continued.
+func (a *Auth) Logout(ctx context.Context, userID int64, token string, refreshToken string) (bool, error) {
 	const op = "auth.Logout"
-	a.Log.With(slog.String("op", op))
-	a.Log.Info("user logged out successfully")
+	log := a.Log.With(slog.String("op", op))
+
+	tokenInfo := jwt.ValidateToken(ctx, token, a.Keys, jwt.AudienceSSO)
+	if tokenInfo.Error != nil {
+		log.Warn("invalid token", slog.String("err", tokenInfo.Error.Error()))
+		return false, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+	}
+	if tokenInfo.UserID != userID {
+		log.Warn("token belongs to another user", slog.Int64("user_id", userID))
+		return false, fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+	}
+	// Tokens issued before jti was added can not be revoked one by one
+	if tokenInfo.ID == "" {
+		return false, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+	}
+
+	if err := a.Revocations.RevokeToken(ctx, tokenInfo.ID, userID, tokenInfo.ExpiresAt); err != nil {
+		log.Error("failed to revoke token", slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if refreshToken != "" {
+		stored, err := a.RefreshTokens.GetRefreshToken(ctx, hashRefreshToken(refreshToken))
+		switch {
+		case err != nil && !errors.Is(err, storage.ErrRefreshTokenNotFound):
+			log.Error("failed to get refresh token", slog.String("err", err.Error()))
+			return false, fmt.Errorf("%s: %w", op, err)
+		case err == nil && stored.UserID == userID:
+			if _, err := a.RefreshTokens.RevokeRefreshFamily(ctx, stored.FamilyID, time.Now()); err != nil {
+				log.Error("failed to revoke refresh token family", slog.String("err", err.Error()))
+				return false, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	log.Info("user logged out successfully", slog.Int64("user_id", userID))
 	return true, nil
 }
 
+// IsTokenRevoked reports whether the access token with the given jti was ended by Logout, or was
+// issued to the user before ResetPassword ended all of their sessions.
+func (a *Auth) IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	const op = "auth.IsTokenRevoked"
+
+	revoked, err := a.Revocations.IsTokenRevoked(ctx, jti, userID, issuedAt)
+	if err != nil {
+		a.Log.Error("failed to check token revocation", slog.String("op", op), slog.String("err", err.Error()))
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return revoked, nil
+}
+
+// RunRevocationPurge forgets revoked tokens, mailed user tokens and login challenges once they expired,
+// every interval until ctx is cancelled.
+func (a *Auth) RunRevocationPurge(ctx context.Context, interval time.Duration) {
+	const op = "auth.RunRevocationPurge"
+	log := a.Log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := a.Revocations.DeleteExpiredRevocations(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to purge revoked tokens", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("expired revocations purged", slog.Int64("count", deleted))
+			}
+
+			deleted, err = a.UserTokens.DeleteExpiredUserTokens(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to purge user tokens", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("expired user tokens purged", slog.Int64("count", deleted))
+			}
+
+			deleted, err = a.Challenges.DeleteExpiredLoginChallenges(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to purge login challenges", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("expired login challenges purged", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
+
 func (a *Auth) Register(ctx context.Context, username, email, password string) (int64, error) {
 	const op = "auth.Register"
 	a.Log.With(slog.String("op", op))
@@ -97,29 +301,84 @@ func (a *Auth) Register(ctx context.Context, username, email, password string) (
 		a.Log.Error("failed to save user")
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
+	// The account works without a verified email, a lost mail must not fail the registration
+	if err := a.sendVerification(ctx, id, username, email); err != nil {
+		a.Log.Error("failed to send verification mail", slog.String("err", err.Error()))
+	}
 	a.Log.Debug("user register in successfully")
 	return id, nil
 }
 
+// IsAdmin reports whether the role of the user grants user.role.change.
+//
+// Deprecated: use CheckPermission with the permission the action needs.
 func (a *Auth) IsAdmin(ctx context.Context, userID int64) (bool, error) {
 	const op = "auth.IsAdmin"
-	a.Log.With(slog.String("op", op))
 
-	success, err := a.UserProvider.IsAdmin(ctx, userID)
+	success, err := a.CheckPermission(ctx, userID, models.PermissionUserChangeRole)
 	if err != nil {
-		a.Log.Warn("failed to get user")
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
 	return success, nil
 }
 
+// IsModerator reports whether the role of the user grants user.ban, admins included.
+//
+// Deprecated: use CheckPermission with the permission the action needs.
 func (a *Auth) IsModerator(ctx context.Context, userID int64) (bool, error) {
 	const op = "auth.IsModerator"
-	a.Log.With(slog.String("op", op))
-	success, err := a.UserProvider.IsModerator(ctx, userID)
+
+	success, err := a.CheckPermission(ctx, userID, models.PermissionUserBan)
 	if err != nil {
-		a.Log.Warn("failed to get user")
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
 	return success, nil
 }
+
+// CheckPermission reports whether the role of the user grants permission.
+func (a *Auth) CheckPermission(ctx context.Context, userID int64, permission string) (bool, error) {
+	const op = "auth.CheckPermission"
+
+	allowed, err := a.Permissions.Can(ctx, userID, permission)
+	if err != nil {
+		if !errors.Is(err, storage.ErrUserNotFound) {
+			a.Log.Warn("failed to check permission", slog.String("op", op), slog.String("err", err.Error()))
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return allowed, nil
+}
+
+// Restrictions returns the bans and mutes of the user in force now.
+func (a *Auth) Restrictions(ctx context.Context, userID int64) (models.Restrictions, error) {
+	const op = "auth.Restrictions"
+
+	restrictions, err := a.Sanctions.Restrictions(ctx, userID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrUserNotFound) {
+			a.Log.Warn("failed to get restrictions", slog.String("op", op), slog.String("err", err.Error()))
+		}
+		return models.Restrictions{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return restrictions, nil
+}
+
+// JWKS returns the public keys access tokens are verified with.
+func (a *Auth) JWKS(ctx context.Context) (jwt.JWKS, error) {
+	const op = "auth.JWKS"
+
+	jwks, err := a.Keys.JWKS(ctx)
+	if err != nil {
+		return jwt.JWKS{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return jwks, nil
+}
+
+// newToken signs an access token with the active key.
+func (a *Auth) newToken(ctx context.Context, user models.User, app models.App) (string, error) {
+	key, err := a.Keys.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return jwt.NewToken(user, app, a.TokenTTL, key)
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/storage"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// loginChallengeTTL is how long the user has to type the code after the password
+	loginChallengeTTL = 5 * time.Minute
+	// maxChallengeAttempts wrong codes end the challenge, the password has to be given again
+	maxChallengeAttempts = 5
+)
+
+// SecondFactor checks the codes of users with two-factor authentication, see services/twofactor
+type SecondFactor interface {
+	Enabled(ctx context.Context, userID int64) (bool, error)
+	Verify(ctx context.Context, userID int64, code string) error
+}
+
+type LoginChallengeStorage interface {
+	SaveLoginChallenge(ctx context.Context, challenge models.LoginChallenge) error
+	GetLoginChallenge(ctx context.Context, tokenHash string, now time.Time) (models.LoginChallenge, error)
+	FailLoginChallenge(ctx context.Context, tokenHash string) (int, error)
+	DeleteLoginChallenge(ctx context.Context, tokenHash string) error
+	DeleteExpiredLoginChallenges(ctx context.Context, before time.Time) (int64, error)
+}
+
+var (
+	ErrInvalidChallenge = errors.New("invalid or expired login challenge")
+	ErrInvalidCode      = errors.New("invalid code")
+)
+
+// VerifySecondFactor finishes a login that Login answered with a challenge. code is a code of
+// the authenticator or a recovery code. The challenge works once and only for a few wrong codes.
+// Wrong codes count as failed logins of the account and clientIP, so new challenges do not give
+// new guesses once either is locked, a *LockedError is returned then.
+func (a *Auth) VerifySecondFactor(ctx context.Context, challengeToken, code, clientIP string) (string, string, error) {
+	const op = "auth.VerifySecondFactor"
+	log := a.Log.With(slog.String("op", op))
+
+	challengeHash := hashUserToken(challengeToken)
+	challenge, err := a.Challenges.GetLoginChallenge(ctx, challengeHash, time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrLoginChallengeNotFound) {
+			return "", "", fmt.Errorf("%s: %w", op, ErrInvalidChallenge)
+		}
+		log.Error("failed to get login challenge", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	log = log.With(slog.Int64("user_id", challenge.UserID))
+
+	user, err := a.UserProvider.GetUserById(ctx, challenge.UserID)
+	if err != nil {
+		log.Error("failed to get user", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	retryAfter, err := a.Lockout.Locked(ctx, user.Email, clientIP)
+	if err != nil {
+		log.Error("failed to check lockout", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if retryAfter > 0 {
+		log.Warn("login locked", slog.Duration("retry_after", retryAfter))
+		return "", "", fmt.Errorf("%s: %w", op, &LockedError{RetryAfter: retryAfter})
+	}
+
+	if err := a.SecondFactor.Verify(ctx, challenge.UserID, code); err != nil {
+		log.Warn("invalid second factor", slog.String("err", err.Error()))
+		a.loginFailed(ctx, user.Email, clientIP)
+		attempts, failErr := a.Challenges.FailLoginChallenge(ctx, challengeHash)
+		if failErr == nil && attempts >= maxChallengeAttempts {
+			_ = a.Challenges.DeleteLoginChallenge(ctx, challengeHash)
+		}
+		return "", "", fmt.Errorf("%s: %w", op, ErrInvalidCode)
+	}
+
+	// Only one of concurrent requests with a right code gets the tokens
+	if err := a.Challenges.DeleteLoginChallenge(ctx, challengeHash); err != nil {
+		if errors.Is(err, storage.ErrLoginChallengeNotFound) {
+			return "", "", fmt.Errorf("%s: %w", op, ErrInvalidChallenge)
+		}
+		log.Error("failed to delete login challenge", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	app, err := a.AppProvider.GetApp(ctx, int(challenge.AppID))
+	if err != nil {
+		log.Error("failed to get app", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := a.newToken(ctx, user, app)
+	if err != nil {
+		log.Error("failed to create token", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	refreshToken, err := a.issueRefreshToken(ctx, user.ID, app.ID, challenge.Device)
+	if err != nil {
+		log.Error("failed to create refresh token", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	a.loginSucceeded(ctx, user.Email)
+	log.Debug("user logged in with second factor")
+	return token, refreshToken, nil
+}
+
+// issueLoginChallenge remembers a login that passed the password check, the challenge
+// token is the only proof of it and is stored as its sha256.
+func (a *Auth) issueLoginChallenge(ctx context.Context, userID, appID int64, device string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	if err := a.Challenges.SaveLoginChallenge(ctx, models.LoginChallenge{
+		TokenHash: hashUserToken(token),
+		UserID:    userID,
+		AppID:     appID,
+		Device:    device,
+		CreatedAt: now,
+		ExpiresAt: now.Add(loginChallengeTTL),
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/mail"
+	"ChatService/sso/internal/storage"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+const (
+	// verifyEmailTTL is how long the link of a verification mail works
+	verifyEmailTTL = 24 * time.Hour
+	// resetPasswordTTL is short, a reset link is as good as the password
+	resetPasswordTTL = time.Hour
+)
+
+// UserTokenStorage keeps the single-use tokens mailed to users.
+type UserTokenStorage interface {
+	SaveUserToken(ctx context.Context, token models.UserToken) error
+	UseUserToken(ctx context.Context, tokenHash, purpose string, usedAt time.Time) (models.UserToken, error)
+	DeleteExpiredUserTokens(ctx context.Context, before time.Time) (int64, error)
+	SetEmailVerified(ctx context.Context, userID int64) error
+	// ResetPassword uses a reset token, sets the password and ends every session of the user at once
+	ResetPassword(ctx context.Context, tokenHash string, passHash []byte, resetAt time.Time) (models.UserToken, int64, error)
+}
+
+// Mailer sends the mails of the email flows. LinkBaseURL is the public URL of the SSO
+// HTTP server, the links in the mails point to its pages.
+type Mailer struct {
+	Sender      mail.Sender
+	LinkBaseURL string
+}
+
+var ErrInvalidUserToken = errors.New("invalid or expired token")
+
+// VerifyEmail confirms the email of the user the token was mailed to.
+func (a *Auth) VerifyEmail(ctx context.Context, token string) error {
+	const op = "auth.VerifyEmail"
+	log := a.Log.With(slog.String("op", op))
+
+	stored, err := a.UserTokens.UseUserToken(ctx, hashUserToken(token), models.TokenPurposeVerifyEmail, time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrUserTokenNotFound) {
+			return fmt.Errorf("%s: %w", op, ErrInvalidUserToken)
+		}
+		log.Error("failed to use token", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := a.UserTokens.SetEmailVerified(ctx, stored.UserID); err != nil {
+		log.Error("failed to verify email", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("email verified", slog.Int64("user_id", stored.UserID))
+	return nil
+}
+
+// RequestPasswordReset mails a reset link if an account with the email exists. Callers get
+// the same answer either way, so it can not be used to find out who has an account.
+func (a *Auth) RequestPasswordReset(ctx context.Context, email string) error {
+	const op = "auth.RequestPasswordReset"
+	log := a.Log.With(slog.String("op", op))
+
+	user, err := a.UserProvider.GetUser(ctx, email)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			log.Debug("password reset for unknown email")
+			return nil
+		}
+		log.Error("failed to get user", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := a.issueUserToken(ctx, user.ID, models.TokenPurposeResetPassword, resetPasswordTTL)
+	if err != nil {
+		log.Error("failed to create reset token", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := a.Mail.Sender.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset the password of your account. Open the link below "+
+			"within %s to choose a new one:\n\n%s\n\nIf it was not you, ignore this mail, your password stays the same.\n",
+			user.UserName, resetPasswordTTL, a.link("/reset-password", token)),
+	}); err != nil {
+		log.Error("failed to send reset mail", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset. All sessions of the
+// user are ended, refresh and access tokens alike, whoever knew the old password has to log in again.
+func (a *Auth) ResetPassword(ctx context.Context, token, newPassword string) error {
+	const op = "auth.ResetPassword"
+	log := a.Log.With(slog.String("op", op))
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Error("failed to generate password hash")
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// The token is only used up together with the new password, and the mail proves the address as well
+	stored, revoked, err := a.UserTokens.ResetPassword(ctx, hashUserToken(token), passHash, time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrUserTokenNotFound) {
+			return fmt.Errorf("%s: %w", op, ErrInvalidUserToken)
+		}
+		log.Error("failed to reset password", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("password reset", slog.Int64("user_id", stored.UserID), slog.Int64("revoked", revoked))
+	return nil
+}
+
+// sendVerification mails the email verification link to a new user.
+func (a *Auth) sendVerification(ctx context.Context, userID int64, username, email string) error {
+	token, err := a.issueUserToken(ctx, userID, models.TokenPurposeVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	return a.Mail.Sender.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Hello %s,\n\nplease confirm your email by opening the link below within %s:\n\n%s\n",
+			username, verifyEmailTTL, a.link("/verify-email", token)),
+	})
+}
+
+func (a *Auth) issueUserToken(ctx context.Context, userID int64, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	if err := a.UserTokens.SaveUserToken(ctx, models.UserToken{
+		TokenHash: hashUserToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (a *Auth) link(path, token string) string {
+	return a.Mail.LinkBaseURL + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+func hashUserToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/storage"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type RefreshTokenStorage interface {
+	SaveRefreshToken(ctx context.Context, token models.RefreshToken) (int64, error)
+	GetRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, id int64, next models.RefreshToken) (int64, error)
+	RevokeRefreshFamily(ctx context.Context, familyID string, revokedAt time.Time) (int64, error)
+}
+
+// refreshTokenBytes is the entropy of a refresh token, enough for a plain sha256 to be a safe lookup key
+const refreshTokenBytes = 32
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// RefreshToken exchanges a refresh token for a new access token and a new refresh token.
+// Every refresh token works once: presenting a rotated token again means it leaked,
+// so the whole family of the login is revoked and both parties have to log in again.
+func (a *Auth) RefreshToken(ctx context.Context, refreshToken string) (string, string, error) {
+	const op = "auth.RefreshToken"
+	log := a.Log.With(slog.String("op", op))
+
+	stored, err := a.RefreshTokens.GetRefreshToken(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, storage.ErrRefreshTokenNotFound) {
+			log.Warn("unknown refresh token")
+			return "", "", fmt.Errorf("%s: %w", op, ErrInvalidRefreshToken)
+		}
+		log.Error("failed to get refresh token", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if stored.Revoked {
+		log.Warn("revoked refresh token", slog.Int64("user_id", stored.UserID))
+		return "", "", fmt.Errorf("%s: %w", op, ErrInvalidRefreshToken)
+	}
+	if stored.Rotated {
+		a.revokeFamily(ctx, log, stored)
+		return "", "", fmt.Errorf("%s: %w", op, ErrRefreshTokenReused)
+	}
+	now := time.Now()
+	if now.After(stored.ExpiresAt) {
+		log.Info("expired refresh token", slog.Int64("user_id", stored.UserID))
+		return "", "", fmt.Errorf("%s: %w", op, ErrInvalidRefreshToken)
+	}
+
+	user, err := a.UserProvider.GetUserById(ctx, stored.UserID)
+	if err != nil {
+		log.Warn("failed to get user", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	app, err := a.AppProvider.GetApp(ctx, int(stored.AppID))
+	if err != nil {
+		log.Warn("failed to get app", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	nextToken, next, err := a.newRefreshToken(stored.FamilyID, stored.UserID, stored.AppID, stored.Device, now)
+	if err != nil {
+		log.Error("failed to create refresh token", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := a.RefreshTokens.RotateRefreshToken(ctx, stored.ID, next); err != nil {
+		// A concurrent request won the race with the same token, that is a reuse as well
+		if errors.Is(err, storage.ErrRefreshTokenUsed) {
+			a.revokeFamily(ctx, log, stored)
+			return "", "", fmt.Errorf("%s: %w", op, ErrRefreshTokenReused)
+		}
+		log.Error("failed to rotate refresh token", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := a.newToken(ctx, user, app)
+	if err != nil {
+		log.Error("failed to create token")
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	log.Debug("refresh token rotated", slog.Int64("user_id", user.ID))
+	return token, nextToken, nil
+}
+
+// issueRefreshToken starts a new token family for a fresh login.
+func (a *Auth) issueRefreshToken(ctx context.Context, userID int64, appID int64, device string) (string, error) {
+	familyID := make([]byte, 16)
+	if _, err := rand.Read(familyID); err != nil {
+		return "", err
+	}
+
+	refreshToken, stored, err := a.newRefreshToken(hex.EncodeToString(familyID), userID, appID, device, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if _, err := a.RefreshTokens.SaveRefreshToken(ctx, stored); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// newRefreshToken returns the token for the client and the row to store for it
+func (a *Auth) newRefreshToken(familyID string, userID int64, appID int64, device string, now time.Time) (string, models.RefreshToken, error) {
+	raw := make([]byte, refreshTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", models.RefreshToken{}, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	return refreshToken, models.RefreshToken{
+		TokenHash: hashRefreshToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    userID,
+		AppID:     appID,
+		Device:    device,
+		CreatedAt: now,
+		ExpiresAt: now.Add(a.RefreshTokenTTL),
+	}, nil
+}
+
+func (a *Auth) revokeFamily(ctx context.Context, log *slog.Logger, token models.RefreshToken) {
+	revoked, err := a.RefreshTokens.RevokeRefreshFamily(ctx, token.FamilyID, time.Now())
+	if err != nil {
+		log.Error("failed to revoke refresh token family", slog.String("family_id", token.FamilyID), slog.String("err", err.Error()))
+		return
+	}
+	log.Warn("refresh token reused, family revoked",
+		slog.Int64("user_id", token.UserID),
+		slog.String("family_id", token.FamilyID),
+		slog.String("device", token.Device),
+		slog.Int64("revoked", revoked),
+	)
+}
+
+func hashRefreshToken(refreshToken string) string {
+	hash := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,124 @@
+package auth_test
+
+import (
+	"ChatService/sso/internal/services/auth"
+	"ChatService/sso/internal/services/keys"
+	"ChatService/sso/internal/services/lockout"
+	"ChatService/sso/internal/services/twofactor"
+	"ChatService/sso/internal/storage/sqlite"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const migrationsPath = "../../../config/migrations"
+
+// exampleApp is created by the migrations
+const exampleApp = 1
+
+// newAuth returns the service on a freshly migrated storage with one user, m@x with password pw
+func newAuth(t *testing.T) *auth.Auth {
+	t.Helper()
+
+	migrations, err := filepath.Abs(migrationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sqlite.New checks for the file at "sqlite3://"+path, a relative path makes that the
+	// directory "sqlite3:" inside the working directory
+	t.Chdir(t.TempDir())
+	const path = "sso.db"
+	if err := os.Mkdir("sqlite3:", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{path, filepath.Join("sqlite3:", path)} {
+		if err := os.WriteFile(name, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := migrate.New("file://"+migrations, "sqlite3://"+path)
+	if err != nil {
+		t.Fatalf("migrate.New: %v", err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+		t.Fatalf("migrate close: %v, %v", srcErr, dbErr)
+	}
+	s, err := sqlite.New(path)
+	if err != nil {
+		t.Fatalf("sqlite.New: %v", err)
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveUser(context.Background(), "m", "m@x", passHash); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return &auth.Auth{
+		Log:             log,
+		UserSaver:       s,
+		UserProvider:    s,
+		AppProvider:     s,
+		TokenTTL:        time.Hour,
+		RefreshTokens:   s,
+		RefreshTokenTTL: 24 * time.Hour,
+		Revocations:     s,
+		Keys:            &keys.Keys{Log: log, Storage: s, Algorithm: "EdDSA", RotationInterval: 24 * time.Hour, Overlap: time.Hour},
+		SecondFactor:    &twofactor.TwoFactor{Log: log, Storage: s},
+		Challenges:      s,
+		Lockout:         &lockout.Lockout{Log: log, Storage: s, Attempts: 5, IPAttempts: 50, BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Hour},
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	ctx := context.Background()
+	a := newAuth(t)
+
+	_, first, _, err := a.Login(ctx, "m@x", "pw", exampleApp, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	_, other, _, err := a.Login(ctx, "m@x", "pw", exampleApp, "other device", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	token, second, err := a.RefreshToken(ctx, first)
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if token == "" || second == "" || second == first {
+		t.Fatalf("RefreshToken returned token %q and refresh token %q, want a new pair", token, second)
+	}
+
+	// The old token was already rotated, presenting it again means it leaked
+	if _, _, err := a.RefreshToken(ctx, first); !errors.Is(err, auth.ErrRefreshTokenReused) {
+		t.Errorf("RefreshToken with the rotated token: err = %v, want %v", err, auth.ErrRefreshTokenReused)
+	}
+	// and the whole family ends, including the token the legitimate client holds
+	if _, _, err := a.RefreshToken(ctx, second); !errors.Is(err, auth.ErrInvalidRefreshToken) {
+		t.Errorf("RefreshToken with the newest token of the family: err = %v, want %v", err, auth.ErrInvalidRefreshToken)
+	}
+
+	// Sessions of other logins go on
+	if _, _, err := a.RefreshToken(ctx, other); err != nil {
+		t.Errorf("RefreshToken of another login: %v", err)
+	}
+	if _, _, err := a.RefreshToken(ctx, "unknown"); !errors.Is(err, auth.ErrInvalidRefreshToken) {
+		t.Errorf("RefreshToken with an unknown token: err = %v, want %v", err, auth.ErrInvalidRefreshToken)
+	}
+}
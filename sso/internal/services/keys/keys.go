@@ -0,0 +1,216 @@
+package keys
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/jwt"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// rsaKeyBits is the size of generated RS256 keys
+const rsaKeyBits = 2048
+
+var ErrKeyNotFound = errors.New("signing key not found")
+
+type KeyStorage interface {
+	RotateSigningKey(ctx context.Context, next models.SigningKey, expiresAt time.Time) error
+	SigningKeys(ctx context.Context, now time.Time) ([]models.SigningKey, error)
+	DeleteExpiredSigningKeys(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Keys holds the keys SSO signs access tokens with. A new key is generated every RotationInterval,
+// the previous one is still published for Overlap so tokens it signed can be verified until they expire.
+type Keys struct {
+	Log              *slog.Logger
+	Storage          KeyStorage
+	Algorithm        string
+	RotationInterval time.Duration
+	Overlap          time.Duration
+
+	mu sync.Mutex
+	// published keys, the active one first
+	keys []models.SigningKey
+}
+
+// SigningKey returns the active key, the first one is generated on demand.
+func (k *Keys) SigningKey(ctx context.Context) (models.SigningKey, error) {
+	const op = "keys.SigningKey"
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.keys) == 0 {
+		if err := k.load(ctx); err != nil {
+			return models.SigningKey{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if len(k.keys) == 0 || !k.keys[0].Active() {
+		if err := k.rotate(ctx); err != nil {
+			return models.SigningKey{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return k.keys[0], nil
+}
+
+// PublicKey returns the public key with the given kid while it is published.
+func (k *Keys) PublicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	const op = "keys.PublicKey"
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.find(kid)
+	if !ok {
+		// Another instance sharing the storage may have rotated
+		if err := k.load(ctx); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if key, ok = k.find(kid); !ok {
+			return nil, fmt.Errorf("%s: %w", op, ErrKeyNotFound)
+		}
+	}
+	return key.PrivateKey.Public(), nil
+}
+
+// JWKS returns the published public keys.
+func (k *Keys) JWKS(ctx context.Context) (jwt.JWKS, error) {
+	const op = "keys.JWKS"
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.load(ctx); err != nil {
+		return jwt.JWKS{}, fmt.Errorf("%s: %w", op, err)
+	}
+	jwks := jwt.JWKS{Keys: make([]jwt.JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		jwk, err := jwt.NewJWK(key.ID, key.Algorithm, key.PrivateKey.Public())
+		if err != nil {
+			return jwt.JWKS{}, fmt.Errorf("%s: %w", op, err)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// Rotate makes a new key the active one, the previous key stays published for Overlap.
+func (k *Keys) Rotate(ctx context.Context) (models.SigningKey, error) {
+	const op = "keys.Rotate"
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.rotate(ctx); err != nil {
+		return models.SigningKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return k.keys[0], nil
+}
+
+// RunRotation checks every interval whether the active key is due for rotation and
+// forgets keys that are no longer published, until ctx is cancelled.
+func (k *Keys) RunRotation(ctx context.Context, interval time.Duration) {
+	const op = "keys.RunRotation"
+	log := k.Log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			active, err := k.SigningKey(ctx)
+			if err != nil {
+				log.Error("failed to get signing key", slog.String("err", err.Error()))
+				continue
+			}
+			if time.Since(active.CreatedAt) >= k.RotationInterval {
+				next, err := k.Rotate(ctx)
+				if err != nil {
+					log.Error("failed to rotate signing key", slog.String("err", err.Error()))
+					continue
+				}
+				log.Info("signing key rotated", slog.String("kid", next.ID), slog.String("retired", active.ID))
+			}
+
+			deleted, err := k.Storage.DeleteExpiredSigningKeys(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to purge signing keys", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("expired signing keys purged", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
+
+func (k *Keys) load(ctx context.Context) error {
+	keys, err := k.Storage.SigningKeys(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	return nil
+}
+
+func (k *Keys) rotate(ctx context.Context) error {
+	next, err := k.generate()
+	if err != nil {
+		return err
+	}
+	if err := k.Storage.RotateSigningKey(ctx, next, next.CreatedAt.Add(k.Overlap)); err != nil {
+		return err
+	}
+	return k.load(ctx)
+}
+
+func (k *Keys) find(kid string) (models.SigningKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == kid && (key.Active() || time.Now().Before(key.ExpiresAt)) {
+			return key, true
+		}
+	}
+	return models.SigningKey{}, false
+}
+
+func (k *Keys) generate() (models.SigningKey, error) {
+	var signer crypto.Signer
+	switch k.Algorithm {
+	case "EdDSA":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return models.SigningKey{}, err
+		}
+		signer = privateKey
+	case "RS256":
+		privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return models.SigningKey{}, err
+		}
+		signer = privateKey
+	default:
+		return models.SigningKey{}, fmt.Errorf("%w: %q", jwt.ErrUnsupportedAlgorithm, k.Algorithm)
+	}
+
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return models.SigningKey{}, err
+	}
+	return models.SigningKey{
+		ID:         hex.EncodeToString(kid),
+		Algorithm:  k.Algorithm,
+		PrivateKey: signer,
+		// Stored with second precision, truncated so the cached copy matches the stored one
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
@@ -0,0 +1,145 @@
+package lockout
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Lockout slows down password guessing. Failed logins are counted per account and per client
+// address, after Attempts (IPAttempts for an address) free failures every further one locks
+// logins for BaseDelay, doubled each time up to MaxDelay. Counters are forgotten ResetAfter
+// the last failure, a successful login resets the one of the account.
+type Lockout struct {
+	Log        *slog.Logger
+	Storage    Storage
+	Attempts   int
+	IPAttempts int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	ResetAfter time.Duration
+}
+
+type Storage interface {
+	LoginFailures(ctx context.Context, key string) (models.LoginFailures, error)
+	RecordLoginFailure(ctx context.Context, key string, at, resetBefore time.Time) (int, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	DeleteLoginFailures(ctx context.Context, key string) error
+	DeleteStaleLoginFailures(ctx context.Context, lastFailureBefore, now time.Time) (int64, error)
+}
+
+// Locked returns how long logins to the account from the client address are still refused,
+// zero when they are allowed. clientIP may be empty when the address is unknown.
+func (l *Lockout) Locked(ctx context.Context, email, clientIP string) (time.Duration, error) {
+	const op = "lockout.Locked"
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, key := range keys(email, clientIP) {
+		failures, err := l.Storage.LoginFailures(ctx, key)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		retryAfter = max(retryAfter, failures.LockedUntil.Sub(now))
+	}
+	// Sub of a zero LockedUntil is negative
+	return max(retryAfter, 0), nil
+}
+
+// Failed counts a failed login and locks the account or the address once its free attempts are used up.
+func (l *Lockout) Failed(ctx context.Context, email, clientIP string) error {
+	const op = "lockout.Failed"
+
+	now := time.Now()
+	for _, key := range keys(email, clientIP) {
+		failures, err := l.Storage.RecordLoginFailure(ctx, key, now, now.Add(-l.ResetAfter))
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		free := l.Attempts
+		if strings.HasPrefix(key, "ip:") {
+			free = l.IPAttempts
+		}
+		if failures <= free {
+			continue
+		}
+		delay := l.delay(failures - free)
+		if err := l.Storage.LockLogin(ctx, key, now.Add(delay)); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		l.Log.Warn("login locked", slog.String("op", op), slog.String("key", key),
+			slog.Int("failures", failures), slog.Duration("delay", delay))
+	}
+	return nil
+}
+
+// Succeeded resets the counter of the account. The one of the address is kept, a single
+// known password must not clear the failures of every account tried from there.
+func (l *Lockout) Succeeded(ctx context.Context, email string) error {
+	const op = "lockout.Succeeded"
+
+	if err := l.Storage.DeleteLoginFailures(ctx, accountKey(email)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// Unlock lifts the lock of an account and forgets its failures.
+func (l *Lockout) Unlock(ctx context.Context, email string) error {
+	const op = "lockout.Unlock"
+
+	if err := l.Storage.DeleteLoginFailures(ctx, accountKey(email)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	l.Log.Info("account unlocked", slog.String("op", op), slog.String("key", accountKey(email)))
+	return nil
+}
+
+// RunPurge deletes counters that are no longer counted every interval until ctx is cancelled.
+func (l *Lockout) RunPurge(ctx context.Context, interval time.Duration) {
+	const op = "lockout.RunPurge"
+	log := l.Log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			deleted, err := l.Storage.DeleteStaleLoginFailures(ctx, now.Add(-l.ResetAfter), now)
+			if err != nil {
+				log.Error("failed to purge login failures", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("stale login failures purged", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
+
+// delay is BaseDelay for the first locking failure, doubled for every further one
+func (l *Lockout) delay(over int) time.Duration {
+	delay := l.BaseDelay
+	for i := 1; i < over && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, l.MaxDelay)
+}
+
+func keys(email, clientIP string) []string {
+	if clientIP == "" {
+		return []string{accountKey(email)}
+	}
+	return []string{accountKey(email), "ip:" + clientIP}
+}
+
+// accountKey uses the email and not the user id, so guessing unknown emails is limited as well
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,361 @@
+package oidc
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/jwt"
+	"ChatService/sso/internal/storage"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// codeTTL is how long an authorization code can be exchanged, the app redeems it right after the redirect
+const codeTTL = time.Minute
+
+// Scopes are the scopes SSO understands, openid is required for every request.
+var Scopes = []string{"openid", "email", "profile"}
+
+var (
+	ErrInvalidClient      = errors.New("invalid client")
+	ErrInvalidRedirectURI = errors.New("redirect uri is not registered")
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrInvalidScope       = errors.New("invalid scope")
+	ErrInvalidGrant       = errors.New("invalid grant")
+	ErrInvalidToken       = errors.New("invalid token")
+)
+
+type AppProvider interface {
+	GetApp(ctx context.Context, id int) (models.App, error)
+}
+
+type UserProvider interface {
+	GetUserById(ctx context.Context, id int64) (models.User, error)
+}
+
+type CodeStorage interface {
+	SaveAuthorizationCode(ctx context.Context, code models.AuthorizationCode) error
+	UseAuthorizationCode(ctx context.Context, codeHash string, usedAt time.Time) (models.AuthorizationCode, error)
+	DeleteExpiredAuthorizationCodes(ctx context.Context, before time.Time) (int64, error)
+}
+
+type SigningKeys interface {
+	SigningKey(ctx context.Context) (models.SigningKey, error)
+	PublicKey(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+type RevocationChecker interface {
+	IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error)
+}
+
+// OIDC implements the authorization code flow of OpenID Connect with PKCE. Apps are the clients,
+// users authenticate with their SSO session and are sent back to the app with a code.
+type OIDC struct {
+	Log          *slog.Logger
+	Issuer       string
+	AppProvider  AppProvider
+	UserProvider UserProvider
+	Codes        CodeStorage
+	Keys         SigningKeys
+	Revocations  RevocationChecker
+	TokenTTL     time.Duration
+}
+
+// AuthorizeRequest is an authentication request of an app, see OpenID Connect Core 3.1.2.1.
+type AuthorizeRequest struct {
+	ClientID            int64
+	RedirectURI         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// Tokens is the response of the token endpoint.
+type Tokens struct {
+	AccessToken string
+	IDToken     string
+	ExpiresIn   time.Duration
+	Scope       string
+}
+
+// UserInfo holds the claims returned by the userinfo endpoint.
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name,omitempty"`
+}
+
+// Client returns the app with the given id if redirectURI is one of its registered URIs.
+// Errors of Client must not be sent to the redirect URI, it is not trusted yet.
+func (o *OIDC) Client(ctx context.Context, clientID int64, redirectURI string) (models.App, error) {
+	const op = "oidc.Client"
+
+	app, err := o.AppProvider.GetApp(ctx, int(clientID))
+	if err != nil {
+		if errors.Is(err, storage.ErrAppNotFound) {
+			return models.App{}, fmt.Errorf("%s: %w", op, ErrInvalidClient)
+		}
+		return models.App{}, fmt.Errorf("%s: %w", op, err)
+	}
+	// Redirect URIs are compared exactly, as OpenID Connect requires
+	if !slices.Contains(app.RedirectURIs, redirectURI) {
+		return models.App{}, fmt.Errorf("%s: %w", op, ErrInvalidRedirectURI)
+	}
+	return app, nil
+}
+
+// Authorize issues an authorization code for userID, who authenticated at authTime.
+func (o *OIDC) Authorize(ctx context.Context, req AuthorizeRequest, userID int64, authTime time.Time) (string, error) {
+	const op = "oidc.Authorize"
+	log := o.Log.With(slog.String("op", op))
+
+	if _, err := o.Client(ctx, req.ClientID, req.RedirectURI); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	scope, err := parseScope(req.Scope)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	// PKCE is required for every app, only S256 is accepted
+	if req.CodeChallengeMethod != "S256" || len(req.CodeChallenge) < 43 {
+		return "", fmt.Errorf("%s: %w: code_challenge with method S256 required", op, ErrInvalidRequest)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	if err := o.Codes.SaveAuthorizationCode(ctx, models.AuthorizationCode{
+		CodeHash:      hashCode(code),
+		AppID:         req.ClientID,
+		UserID:        userID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(scope, " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      authTime,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(codeTTL),
+	}); err != nil {
+		log.Error("failed to save authorization code", slog.String("err", err.Error()))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	log.Debug("authorization code issued", slog.Int64("user_id", userID), slog.Int64("client_id", req.ClientID))
+	return code, nil
+}
+
+// Exchange redeems an authorization code for an access token and an ID token. The app
+// authenticates with its client secret and proves with codeVerifier that it started the flow.
+// The access token is meant for the userinfo endpoint only, SSO and the CRUD service refuse it.
+func (o *OIDC) Exchange(ctx context.Context, clientID int64, clientSecret, code, redirectURI, codeVerifier string) (Tokens, error) {
+	const op = "oidc.Exchange"
+	log := o.Log.With(slog.String("op", op))
+
+	app, err := o.AppProvider.GetApp(ctx, int(clientID))
+	if err != nil {
+		if errors.Is(err, storage.ErrAppNotFound) {
+			return Tokens{}, fmt.Errorf("%s: %w", op, ErrInvalidClient)
+		}
+		return Tokens{}, fmt.Errorf("%s: %w", op, err)
+	}
+	// Apps without a client secret are not OpenID Connect clients
+	if len(app.ClientSecretHash) == 0 || bcrypt.CompareHashAndPassword(app.ClientSecretHash, []byte(clientSecret)) != nil {
+		log.Warn("invalid client secret", slog.Int64("client_id", clientID))
+		return Tokens{}, fmt.Errorf("%s: %w", op, ErrInvalidClient)
+	}
+
+	stored, err := o.Codes.UseAuthorizationCode(ctx, hashCode(code), time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrAuthorizationCodeNotFound) || errors.Is(err, storage.ErrAuthorizationCodeUsed) {
+			log.Warn("unknown or used authorization code", slog.Int64("client_id", clientID))
+			return Tokens{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+		}
+		return Tokens{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if stored.AppID != app.ID || stored.RedirectURI != redirectURI || time.Now().After(stored.ExpiresAt) {
+		return Tokens{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+	}
+	if !verifyChallenge(stored.CodeChallenge, codeVerifier) {
+		log.Warn("code verifier does not match", slog.Int64("client_id", clientID))
+		return Tokens{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+	}
+
+	user, err := o.UserProvider.GetUserById(ctx, stored.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return Tokens{}, fmt.Errorf("%s: %w", op, ErrInvalidGrant)
+		}
+		return Tokens{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, err := o.Keys.SigningKey(ctx)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("%s: %w", op, err)
+	}
+	accessToken, err := jwt.NewClientToken(user, app.ID, stored.Scope, o.Issuer, o.TokenTTL, key)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	scope := strings.Fields(stored.Scope)
+	idToken := jwt.IDToken{
+		Issuer:   o.Issuer,
+		Subject:  strconv.FormatInt(user.ID, 10),
+		Audience: strconv.FormatInt(app.ID, 10),
+		Nonce:    stored.Nonce,
+		AuthTime: stored.AuthTime,
+	}
+	if slices.Contains(scope, "email") {
+		idToken.Email = user.Email
+		idToken.EmailVerified = user.EmailVerified
+	}
+	if slices.Contains(scope, "profile") {
+		idToken.Name = user.UserName
+	}
+	idTokenString, err := jwt.NewIDToken(idToken, o.TokenTTL, key)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Debug("authorization code exchanged", slog.Int64("user_id", user.ID), slog.Int64("client_id", app.ID))
+	return Tokens{
+		AccessToken: accessToken,
+		IDToken:     idTokenString,
+		ExpiresIn:   o.TokenTTL,
+		Scope:       stored.Scope,
+	}, nil
+}
+
+// Session checks an access token of SSO itself, the user behind a valid one needs no new login
+// to authorize another app.
+func (o *OIDC) Session(ctx context.Context, accessToken string) (jwt.TokenInfo, error) {
+	const op = "oidc.Session"
+
+	tokenInfo, err := o.validate(ctx, accessToken, jwt.AudienceSSO)
+	if err != nil {
+		return jwt.TokenInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return tokenInfo, nil
+}
+
+// UserInfo returns the claims about the owner of an access token issued by Exchange,
+// limited to the scopes granted to the client.
+func (o *OIDC) UserInfo(ctx context.Context, accessToken string) (UserInfo, error) {
+	const op = "oidc.UserInfo"
+
+	// The audience is the client, chat tokens have no scope and are refused
+	tokenInfo, err := o.validate(ctx, accessToken, "")
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	scope := strings.Fields(tokenInfo.Scope)
+	if !slices.Contains(scope, "openid") {
+		return UserInfo{}, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+	}
+
+	user, err := o.UserProvider.GetUserById(ctx, tokenInfo.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return UserInfo{}, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+		}
+		return UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	info := UserInfo{Subject: strconv.FormatInt(user.ID, 10)}
+	if slices.Contains(scope, "email") {
+		info.Email = user.Email
+		info.EmailVerified = user.EmailVerified
+	}
+	if slices.Contains(scope, "profile") {
+		info.Name = user.UserName
+	}
+	return info, nil
+}
+
+// validate checks an access token for audience and makes sure it was not revoked
+func (o *OIDC) validate(ctx context.Context, accessToken string, audience string) (jwt.TokenInfo, error) {
+	tokenInfo := jwt.ValidateToken(ctx, accessToken, o.Keys, audience)
+	if tokenInfo.Error != nil {
+		return jwt.TokenInfo{}, ErrInvalidToken
+	}
+	if tokenInfo.ID != "" {
+		revoked, err := o.Revocations.IsTokenRevoked(ctx, tokenInfo.ID, tokenInfo.UserID, tokenInfo.IssuedAt)
+		if err != nil {
+			return jwt.TokenInfo{}, err
+		}
+		if revoked {
+			return jwt.TokenInfo{}, ErrInvalidToken
+		}
+	}
+	return tokenInfo, nil
+}
+
+// RunCodePurge forgets expired authorization codes every interval until ctx is cancelled.
+func (o *OIDC) RunCodePurge(ctx context.Context, interval time.Duration) {
+	const op = "oidc.RunCodePurge"
+	log := o.Log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := o.Codes.DeleteExpiredAuthorizationCodes(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to purge authorization codes", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("expired authorization codes purged", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
+
+// parseScope keeps the known scopes, unknown ones are ignored as OAuth 2.0 allows
+func parseScope(scope string) ([]string, error) {
+	requested := strings.Fields(scope)
+	if !slices.Contains(requested, "openid") {
+		return nil, fmt.Errorf("%w: openid scope required", ErrInvalidScope)
+	}
+	var granted []string
+	for _, s := range Scopes {
+		if slices.Contains(requested, s) {
+			granted = append(granted, s)
+		}
+	}
+	return granted, nil
+}
+
+// verifyChallenge checks a PKCE code verifier against its S256 challenge (RFC 7636 4.6)
+func verifyChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -16,6 +16,16 @@ type Profile struct {
 	UserRefactor UserRefactor
 	UserAdmin    UserAdmin
 	TokenTTL     time.Duration
+	TwoFactor    TwoFactor
+	Lockout      Lockout
+	Permissions  Permissions
+	Sanctions    Sanctions
+}
+
+// Permissions checks what a user may do, see services/rbac
+type Permissions interface {
+	Can(ctx context.Context, userID int64, permission string) (bool, error)
+	Role(ctx context.Context, id int32) (models.Role, error)
 }
 
 type UserRefactor interface {
@@ -24,13 +34,34 @@ type UserRefactor interface {
 	UpdateName(ctx context.Context, id int64, newName string) (bool, error)
 }
 
+// TwoFactor manages the authenticator of a user, see services/twofactor
+type TwoFactor interface {
+	Enroll(ctx context.Context, userID int64, account string) (string, string, error)
+	Confirm(ctx context.Context, userID int64, code string) ([]string, error)
+	Disable(ctx context.Context, userID int64, code string) error
+}
+
+// Lockout lifts login locks, see services/lockout
+type Lockout interface {
+	Unlock(ctx context.Context, email string) error
+}
+
+// Sanctions bans and mutes users, see services/sanction
+type Sanctions interface {
+	Ban(ctx context.Context, issuedBy, userID int64, duration time.Duration, reason string) (models.Sanction, error)
+	Mute(ctx context.Context, issuedBy, userID, roomID int64, duration time.Duration, reason string) (models.Sanction, error)
+	Lift(ctx context.Context, userID int64, kind string, roomID int64) error
+}
+
 type UserAdmin interface {
 	UpdateRole(ctx context.Context, id int64, newRole int32) (bool, error)
 }
 
 var (
 	ErrUserNotAdmin       = errors.New("user is not admin")
+	ErrPermissionDenied   = errors.New("permission denied")
 	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUnknownRole        = errors.New("unknown role")
 )
 
 func (p *Profile) ChangePassword(ctx context.Context, oldPassword string, password string, id int64) (bool, error) {
@@ -86,23 +117,23 @@ func (p *Profile) ChangeName(ctx context.Context, id int64, newName string) (boo
 	return success, nil
 }
 
+// ChangeRole sets the role of user id to a row of the roles table. idAdmin is the caller,
+// their role has to grant user.role.change and their password is asked again.
 func (p *Profile) ChangeRole(ctx context.Context, password string, idAdmin int64, id int64, newRole int32) (bool, error) {
 	const op = "services.profile.ChangeRole"
 	p.Log.With(slog.String("op", op))
 
-	user, err := p.UserRefactor.GetUserById(ctx, idAdmin)
-	if err != nil {
-		if errors.Is(err, storage.ErrUserNotFound) {
-			p.Log.Warn("user not found")
-			return false, fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
-		}
-		p.Log.Warn("failed to get user")
+	if _, err := p.checkPassword(ctx, idAdmin, password); err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
-
-	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
-		p.Log.Warn("invalid password")
-		return false, fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
+	if err := p.require(ctx, idAdmin, models.PermissionUserChangeRole); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := p.Permissions.Role(ctx, newRole); err != nil {
+		if errors.Is(err, storage.ErrRoleNotFound) {
+			return false, fmt.Errorf("%s: %w", op, ErrUnknownRole)
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
 	}
 
 	success, err := p.UserAdmin.UpdateRole(ctx, id, newRole)
@@ -112,3 +143,171 @@ func (p *Profile) ChangeRole(ctx context.Context, password string, idAdmin int64
 	}
 	return success, nil
 }
+
+// EnrollTOTP starts two-factor enrolment and returns the secret and its otpauth URL.
+// The password is asked again, a stolen session alone must not be enough to add an authenticator.
+func (p *Profile) EnrollTOTP(ctx context.Context, id int64, password string) (string, string, error) {
+	const op = "services.profile.EnrollTOTP"
+
+	user, err := p.checkPassword(ctx, id, password)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	secret, url, err := p.TwoFactor.Enroll(ctx, id, user.Email)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	return secret, url, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with a first code and returns the recovery codes.
+func (p *Profile) ConfirmTOTP(ctx context.Context, id int64, code string) ([]string, error) {
+	const op = "services.profile.ConfirmTOTP"
+
+	codes, err := p.TwoFactor.Confirm(ctx, id, code)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off, it needs both the password and a code.
+func (p *Profile) DisableTOTP(ctx context.Context, id int64, password, code string) error {
+	const op = "services.profile.DisableTOTP"
+
+	if _, err := p.checkPassword(ctx, id, password); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := p.TwoFactor.Disable(ctx, id, code); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// UnlockUser lets an admin lift the login lock of a user before it runs out.
+func (p *Profile) UnlockUser(ctx context.Context, password string, idAdmin int64, id int64) error {
+	const op = "services.profile.UnlockUser"
+
+	if _, err := p.checkPassword(ctx, idAdmin, password); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := p.require(ctx, idAdmin, models.PermissionUserUnlock); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := p.UserRefactor.GetUserById(ctx, id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := p.Lockout.Unlock(ctx, user.Email); err != nil {
+		p.Log.Error("failed to unlock user")
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	p.Log.Info("user unlocked", slog.Int64("user_id", id), slog.Int64("admin_id", idAdmin))
+	return nil
+}
+
+// BanUser keeps a user out of every room for duration. Users who may ban others can not be banned.
+func (p *Profile) BanUser(ctx context.Context, idModerator int64, id int64, duration time.Duration, reason string) (models.Sanction, error) {
+	const op = "services.profile.BanUser"
+
+	if err := p.requireOver(ctx, idModerator, id, models.PermissionUserBan); err != nil {
+		return models.Sanction{}, fmt.Errorf("%s: %w", op, err)
+	}
+	sanction, err := p.Sanctions.Ban(ctx, idModerator, id, duration, reason)
+	if err != nil {
+		p.Log.Error("failed to ban user")
+		return models.Sanction{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return sanction, nil
+}
+
+// UnbanUser lifts the ban of a user before it runs out.
+func (p *Profile) UnbanUser(ctx context.Context, idModerator int64, id int64) error {
+	const op = "services.profile.UnbanUser"
+
+	if err := p.require(ctx, idModerator, models.PermissionUserBan); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := p.Sanctions.Lift(ctx, id, models.SanctionBan, 0); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// MuteUser keeps a user from writing to a room for duration. Users who may mute others can not be muted.
+func (p *Profile) MuteUser(ctx context.Context, idModerator int64, id int64, roomID int64, duration time.Duration, reason string) (models.Sanction, error) {
+	const op = "services.profile.MuteUser"
+
+	if err := p.requireOver(ctx, idModerator, id, models.PermissionUserMute); err != nil {
+		return models.Sanction{}, fmt.Errorf("%s: %w", op, err)
+	}
+	sanction, err := p.Sanctions.Mute(ctx, idModerator, id, roomID, duration, reason)
+	if err != nil {
+		p.Log.Error("failed to mute user")
+		return models.Sanction{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return sanction, nil
+}
+
+// UnmuteUser lifts the mute of a user in a room before it runs out.
+func (p *Profile) UnmuteUser(ctx context.Context, idModerator int64, id int64, roomID int64) error {
+	const op = "services.profile.UnmuteUser"
+
+	if err := p.require(ctx, idModerator, models.PermissionUserMute); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := p.Sanctions.Lift(ctx, id, models.SanctionMute, roomID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// require returns ErrPermissionDenied unless the role of the user grants permission
+func (p *Profile) require(ctx context.Context, userID int64, permission string) error {
+	allowed, err := p.Permissions.Can(ctx, userID, permission)
+	if err != nil {
+		p.Log.Error("failed to check permission", slog.String("err", err.Error()))
+		return err
+	}
+	if !allowed {
+		p.Log.Warn("permission denied", slog.Int64("user_id", userID), slog.String("permission", permission))
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// requireOver is require for actions on another user, who must not hold permission themselves:
+// moderators can not sanction each other or admins.
+func (p *Profile) requireOver(ctx context.Context, userID int64, targetID int64, permission string) error {
+	if err := p.require(ctx, userID, permission); err != nil {
+		return err
+	}
+	protected, err := p.Permissions.Can(ctx, targetID, permission)
+	if err != nil {
+		return err
+	}
+	if protected {
+		p.Log.Warn("permission denied", slog.Int64("user_id", userID), slog.Int64("target_id", targetID),
+			slog.String("permission", permission))
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func (p *Profile) checkPassword(ctx context.Context, id int64, password string) (models.User, error) {
+	user, err := p.UserRefactor.GetUserById(ctx, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			p.Log.Warn("user not found")
+			return models.User{}, ErrInvalidCredentials
+		}
+		p.Log.Warn("failed to get user")
+		return models.User{}, err
+	}
+	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
+		p.Log.Warn("invalid password")
+		return models.User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -0,0 +1,66 @@
+package rbac
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// RBAC answers whether a user may do something. Users have one role, roles are granted
+// named permissions, see models.Permissions.
+type RBAC struct {
+	Log     *slog.Logger
+	Storage Storage
+}
+
+type Storage interface {
+	UserRole(ctx context.Context, id int64) (int32, error)
+	Role(ctx context.Context, id int32) (models.Role, error)
+}
+
+var ErrUnknownPermission = errors.New("unknown permission")
+
+// Can reports whether the role of the user grants permission.
+func (r *RBAC) Can(ctx context.Context, userID int64, permission string) (bool, error) {
+	const op = "rbac.Can"
+
+	if !slices.Contains(models.Permissions, permission) {
+		return false, fmt.Errorf("%s: %w", op, ErrUnknownPermission)
+	}
+	role, err := r.UserRole(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return role.Has(permission), nil
+}
+
+// Role returns the role with id and its permissions, storage.ErrRoleNotFound when the roles table has none.
+func (r *RBAC) Role(ctx context.Context, id int32) (models.Role, error) {
+	const op = "rbac.Role"
+
+	role, err := r.Storage.Role(ctx, id)
+	if err != nil {
+		return models.Role{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return role, nil
+}
+
+// UserRole returns the role of the user with its permissions.
+func (r *RBAC) UserRole(ctx context.Context, userID int64) (models.Role, error) {
+	const op = "rbac.UserRole"
+
+	roleID, err := r.Storage.UserRole(ctx, userID)
+	if err != nil {
+		return models.Role{}, fmt.Errorf("%s: %w", op, err)
+	}
+	role, err := r.Storage.Role(ctx, roleID)
+	if err != nil {
+		r.Log.Error("failed to load role", slog.String("op", op), slog.Int("role", int(roleID)),
+			slog.String("err", err.Error()))
+		return models.Role{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return role, nil
+}
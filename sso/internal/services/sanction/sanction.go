@@ -0,0 +1,131 @@
+package sanction
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Sanctions bans users from every room or mutes them in one, for a duration and with a reason.
+// SSO only keeps them, the CRUD service enforces them through Restrictions.
+type Sanctions struct {
+	Log     *slog.Logger
+	Storage Storage
+	Roles   RoleProvider
+}
+
+type Storage interface {
+	SaveSanction(ctx context.Context, sanction models.Sanction) error
+	ActiveSanctions(ctx context.Context, userID int64, now time.Time) ([]models.Sanction, error)
+	DeleteSanction(ctx context.Context, userID int64, kind string, roomID int64, now time.Time) error
+	DeleteExpiredSanctions(ctx context.Context, before time.Time) (int64, error)
+}
+
+type RoleProvider interface {
+	UserRole(ctx context.Context, id int64) (int32, error)
+}
+
+// Ban keeps the user out of every room for duration, a new ban replaces the old one.
+func (s *Sanctions) Ban(ctx context.Context, issuedBy, userID int64, duration time.Duration, reason string) (models.Sanction, error) {
+	const op = "sanction.Ban"
+
+	sanction, err := s.save(ctx, models.Sanction{UserID: userID, Kind: models.SanctionBan, Reason: reason, IssuedBy: issuedBy}, duration)
+	if err != nil {
+		return models.Sanction{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return sanction, nil
+}
+
+// Mute keeps the user from writing to the room for duration, a new mute replaces the old one.
+func (s *Sanctions) Mute(ctx context.Context, issuedBy, userID, roomID int64, duration time.Duration, reason string) (models.Sanction, error) {
+	const op = "sanction.Mute"
+
+	sanction, err := s.save(ctx, models.Sanction{UserID: userID, Kind: models.SanctionMute, RoomID: roomID, Reason: reason, IssuedBy: issuedBy}, duration)
+	if err != nil {
+		return models.Sanction{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return sanction, nil
+}
+
+// Lift ends a ban (roomID 0) or a mute before it runs out, storage.ErrSanctionNotFound
+// is returned when there is none.
+func (s *Sanctions) Lift(ctx context.Context, userID int64, kind string, roomID int64) error {
+	const op = "sanction.Lift"
+
+	if err := s.Storage.DeleteSanction(ctx, userID, kind, roomID, time.Now()); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.Log.Info("sanction lifted", slog.String("op", op), slog.Int64("user_id", userID),
+		slog.String("kind", kind), slog.Int64("room_id", roomID))
+	return nil
+}
+
+// Restrictions returns the sanctions of the user in force now.
+func (s *Sanctions) Restrictions(ctx context.Context, userID int64) (models.Restrictions, error) {
+	const op = "sanction.Restrictions"
+
+	role, err := s.Roles.UserRole(ctx, userID)
+	if err != nil {
+		return models.Restrictions{}, fmt.Errorf("%s: %w", op, err)
+	}
+	var restrictions models.Restrictions
+	if role == models.RoleBanned {
+		restrictions.Ban = &models.Sanction{UserID: userID, Kind: models.SanctionBan}
+	}
+
+	sanctions, err := s.Storage.ActiveSanctions(ctx, userID, time.Now())
+	if err != nil {
+		return models.Restrictions{}, fmt.Errorf("%s: %w", op, err)
+	}
+	for _, sanction := range sanctions {
+		switch sanction.Kind {
+		case models.SanctionBan:
+			if restrictions.Ban == nil {
+				restrictions.Ban = &sanction
+			}
+		case models.SanctionMute:
+			restrictions.Mutes = append(restrictions.Mutes, sanction)
+		}
+	}
+	return restrictions, nil
+}
+
+// RunPurge deletes expired sanctions every interval until ctx is cancelled.
+func (s *Sanctions) RunPurge(ctx context.Context, interval time.Duration) {
+	const op = "sanction.RunPurge"
+	log := s.Log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.Storage.DeleteExpiredSanctions(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to purge sanctions", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				log.Info("expired sanctions purged", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
+
+func (s *Sanctions) save(ctx context.Context, sanction models.Sanction, duration time.Duration) (models.Sanction, error) {
+	// Stored times have second resolution, the sanction is returned the way it is read back
+	now := time.Now().UTC().Truncate(time.Second)
+	sanction.CreatedAt = now
+	sanction.ExpiresAt = now.Add(duration)
+	if err := s.Storage.SaveSanction(ctx, sanction); err != nil {
+		return models.Sanction{}, err
+	}
+	s.Log.Info("sanction imposed", slog.Int64("user_id", sanction.UserID), slog.String("kind", sanction.Kind),
+		slog.Int64("room_id", sanction.RoomID), slog.Int64("issued_by", sanction.IssuedBy),
+		slog.Time("expires_at", sanction.ExpiresAt))
+	return sanction, nil
+}
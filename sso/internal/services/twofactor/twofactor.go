@@ -0,0 +1,213 @@
+package twofactor
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/secretbox"
+	"ChatService/sso/internal/lib/totp"
+	"ChatService/sso/internal/storage"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets with every enrolment
+const recoveryCodeCount = 10
+
+// TwoFactor keeps the TOTP authenticators of users. Secrets are encrypted with Box before
+// they are stored, Issuer is the name authenticator apps show next to the codes.
+type TwoFactor struct {
+	Log     *slog.Logger
+	Storage Storage
+	Box     *secretbox.Box
+	Issuer  string
+}
+
+type Storage interface {
+	SaveTOTP(ctx context.Context, userID int64, secret []byte, createdAt time.Time) error
+	GetTOTP(ctx context.Context, userID int64) (models.TOTP, error)
+	EnableTOTP(ctx context.Context, userID int64, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, userID int64, step int64) error
+	UseRecoveryCode(ctx context.Context, userID int64, codeHash string, usedAt time.Time) error
+	DeleteTOTP(ctx context.Context, userID int64) error
+}
+
+var (
+	ErrAlreadyEnabled = errors.New("two-factor authentication already enabled")
+	ErrNotEnrolled    = errors.New("two-factor authentication not enrolled")
+	ErrInvalidCode    = errors.New("invalid code")
+)
+
+// Enroll creates a new secret for the user. It only protects logins after Confirm, until then
+// Enroll can be called again, e.g. when the QR code was not scanned.
+func (t *TwoFactor) Enroll(ctx context.Context, userID int64, account string) (string, string, error) {
+	const op = "twofactor.Enroll"
+	log := t.Log.With(slog.String("op", op), slog.Int64("user_id", userID))
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	sealed, err := t.Box.Seal(secret, associatedData(userID))
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if err := t.Storage.SaveTOTP(ctx, userID, sealed, time.Now()); err != nil {
+		if errors.Is(err, storage.ErrTOTPEnabled) {
+			return "", "", fmt.Errorf("%s: %w", op, ErrAlreadyEnabled)
+		}
+		log.Error("failed to save secret", slog.String("err", err.Error()))
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("totp enrolment started")
+	return secret.String(), secret.URL(t.Issuer, account), nil
+}
+
+// Confirm enables the enrolled secret once the user shows a code of it, which proves the
+// authenticator app got it. The recovery codes are returned in clear text only here.
+func (t *TwoFactor) Confirm(ctx context.Context, userID int64, code string) ([]string, error) {
+	const op = "twofactor.Confirm"
+	log := t.Log.With(slog.String("op", op), slog.Int64("user_id", userID))
+
+	stored, secret, err := t.secret(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if stored.Enabled {
+		return nil, fmt.Errorf("%s: %w", op, ErrAlreadyEnabled)
+	}
+	step, err := secret.Validate(code, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, ErrInvalidCode)
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := t.Storage.EnableTOTP(ctx, userID, step, hashes); err != nil {
+		if errors.Is(err, storage.ErrTOTPNotFound) {
+			// Enabled or replaced by a concurrent call
+			return nil, fmt.Errorf("%s: %w", op, ErrNotEnrolled)
+		}
+		log.Error("failed to enable totp", slog.String("err", err.Error()))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("totp enabled")
+	return codes, nil
+}
+
+// Disable removes the authenticator of the user, a current code or a recovery code is required.
+func (t *TwoFactor) Disable(ctx context.Context, userID int64, code string) error {
+	const op = "twofactor.Disable"
+	log := t.Log.With(slog.String("op", op), slog.Int64("user_id", userID))
+
+	if err := t.Verify(ctx, userID, code); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := t.Storage.DeleteTOTP(ctx, userID); err != nil {
+		log.Error("failed to delete totp", slog.String("err", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("totp disabled")
+	return nil
+}
+
+// Enabled reports whether logins of the user need a second factor.
+func (t *TwoFactor) Enabled(ctx context.Context, userID int64) (bool, error) {
+	const op = "twofactor.Enabled"
+
+	stored, err := t.Storage.GetTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrTOTPNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return stored.Enabled, nil
+}
+
+// Verify accepts a code of the authenticator or an unused recovery code. Every code works once.
+func (t *TwoFactor) Verify(ctx context.Context, userID int64, code string) error {
+	const op = "twofactor.Verify"
+
+	stored, secret, err := t.secret(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if !stored.Enabled {
+		return fmt.Errorf("%s: %w", op, ErrNotEnrolled)
+	}
+
+	code = strings.TrimSpace(code)
+	if _, err := strconv.Atoi(code); err == nil && len(code) == totp.Digits {
+		step, err := secret.Validate(code, time.Now())
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, ErrInvalidCode)
+		}
+		if err := t.Storage.UseTOTPStep(ctx, userID, step); err != nil {
+			if errors.Is(err, storage.ErrTOTPStepUsed) {
+				return fmt.Errorf("%s: %w", op, ErrInvalidCode)
+			}
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		return nil
+	}
+
+	if err := t.Storage.UseRecoveryCode(ctx, userID, hashRecoveryCode(code), time.Now()); err != nil {
+		if errors.Is(err, storage.ErrRecoveryCodeNotFound) {
+			return fmt.Errorf("%s: %w", op, ErrInvalidCode)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	t.Log.Info("recovery code used", slog.String("op", op), slog.Int64("user_id", userID))
+	return nil
+}
+
+func (t *TwoFactor) secret(ctx context.Context, userID int64) (models.TOTP, totp.Secret, error) {
+	stored, err := t.Storage.GetTOTP(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrTOTPNotFound) {
+			return models.TOTP{}, nil, ErrNotEnrolled
+		}
+		return models.TOTP{}, nil, err
+	}
+	secret, err := t.Box.Open(stored.Secret, associatedData(userID))
+	if err != nil {
+		return models.TOTP{}, nil, err
+	}
+	return stored, secret, nil
+}
+
+// associatedData ties a sealed secret to its user, a secret copied to another row does not open
+func associatedData(userID int64) []byte {
+	return []byte("totp:" + strconv.FormatInt(userID, 10))
+}
+
+// newRecoveryCode returns 80 random bits as XXXX-XXXX-XXXX-XXXX
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.EncodeToString(raw)
+	return encoded[0:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:16], nil
+}
+
+// hashRecoveryCode ignores case and dashes, users type the codes from paper
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+package twofactor_test
+
+import (
+	"ChatService/sso/internal/domain/models"
+	"ChatService/sso/internal/lib/secretbox"
+	"ChatService/sso/internal/lib/totp"
+	"ChatService/sso/internal/services/twofactor"
+	"ChatService/sso/internal/storage"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+const userID int64 = 7
+
+// memStorage keeps one authenticator with the semantics of the SQL storage
+type memStorage struct {
+	totp     *models.TOTP
+	recovery map[string]bool
+}
+
+func (m *memStorage) SaveTOTP(ctx context.Context, userID int64, secret []byte, createdAt time.Time) error {
+	if m.totp != nil && m.totp.Enabled {
+		return storage.ErrTOTPEnabled
+	}
+	m.totp = &models.TOTP{UserID: userID, Secret: secret, CreatedAt: createdAt}
+	return nil
+}
+
+func (m *memStorage) GetTOTP(ctx context.Context, userID int64) (models.TOTP, error) {
+	if m.totp == nil {
+		return models.TOTP{}, storage.ErrTOTPNotFound
+	}
+	return *m.totp, nil
+}
+
+func (m *memStorage) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryCodeHashes []string) error {
+	if m.totp == nil || m.totp.Enabled {
+		return storage.ErrTOTPNotFound
+	}
+	m.totp.Enabled, m.totp.LastStep = true, step
+	m.recovery = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		m.recovery[hash] = false
+	}
+	return nil
+}
+
+func (m *memStorage) UseTOTPStep(ctx context.Context, userID int64, step int64) error {
+	if m.totp == nil || !m.totp.Enabled || m.totp.LastStep >= step {
+		return storage.ErrTOTPStepUsed
+	}
+	m.totp.LastStep = step
+	return nil
+}
+
+func (m *memStorage) UseRecoveryCode(ctx context.Context, userID int64, codeHash string, usedAt time.Time) error {
+	used, ok := m.recovery[codeHash]
+	if !ok || used {
+		return storage.ErrRecoveryCodeNotFound
+	}
+	m.recovery[codeHash] = true
+	return nil
+}
+
+func (m *memStorage) DeleteTOTP(ctx context.Context, userID int64) error {
+	m.totp, m.recovery = nil, nil
+	return nil
+}
+
+// enrolled returns a service with a confirmed authenticator, its secret and the recovery codes
+func enrolled(t *testing.T) (*twofactor.TwoFactor, *memStorage, totp.Secret, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	box, err := secretbox.New(base64.StdEncoding.EncodeToString(make([]byte, secretbox.KeySize)))
+	if err != nil {
+		t.Fatalf("secretbox.New: %v", err)
+	}
+	store := &memStorage{}
+	tf := &twofactor.TwoFactor{Log: slog.New(slog.NewTextHandler(io.Discard, nil)), Storage: store, Box: box, Issuer: "test"}
+
+	encoded, _, err := tf.Enroll(ctx, userID, "user@test")
+	if err != nil {
+		t.Fatalf("Enroll: %v", err)
+	}
+	if strings.Contains(string(store.totp.Secret), encoded) {
+		t.Fatalf("secret is stored in clear text")
+	}
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	secret := totp.Secret(raw)
+
+	recoveryCodes, err := tf.Confirm(ctx, userID, secret.Code(totp.Step(time.Now())))
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	return tf, store, secret, recoveryCodes
+}
+
+func TestVerifyRejectsReusedCode(t *testing.T) {
+	ctx := context.Background()
+	tf, store, secret, _ := enrolled(t)
+
+	// The step of Confirm is used up, the next one is still inside the skew window
+	now := store.totp.LastStep
+	if err := tf.Verify(ctx, userID, secret.Code(now)); !errors.Is(err, twofactor.ErrInvalidCode) {
+		t.Errorf("Verify with the code of Confirm: err = %v, want %v", err, twofactor.ErrInvalidCode)
+	}
+	next := secret.Code(now + 1)
+	if err := tf.Verify(ctx, userID, next); err != nil {
+		t.Fatalf("Verify with the next code: %v", err)
+	}
+	if err := tf.Verify(ctx, userID, next); !errors.Is(err, twofactor.ErrInvalidCode) {
+		t.Errorf("Verify with the same code again: err = %v, want %v", err, twofactor.ErrInvalidCode)
+	}
+	if err := tf.Verify(ctx, userID, secret.Code(now-1)); !errors.Is(err, twofactor.ErrInvalidCode) {
+		t.Errorf("Verify with an older code: err = %v, want %v", err, twofactor.ErrInvalidCode)
+	}
+}
+
+func TestVerifyRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	tf, store, _, recoveryCodes := enrolled(t)
+
+	if len(recoveryCodes) != 10 {
+		t.Fatalf("got %d recovery codes, want 10", len(recoveryCodes))
+	}
+	seen := make(map[string]bool)
+	for _, code := range recoveryCodes {
+		if seen[code] {
+			t.Errorf("recovery code %s handed out twice", code)
+		}
+		seen[code] = true
+		if _, stored := store.recovery[code]; stored {
+			t.Errorf("recovery code %s is stored in clear text", code)
+		}
+	}
+
+	// Codes are typed from paper, case and dashes do not matter
+	typed := strings.ToLower(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	if err := tf.Verify(ctx, userID, typed); err != nil {
+		t.Fatalf("Verify with a recovery code: %v", err)
+	}
+	if err := tf.Verify(ctx, userID, recoveryCodes[0]); !errors.Is(err, twofactor.ErrInvalidCode) {
+		t.Errorf("Verify with a used recovery code: err = %v, want %v", err, twofactor.ErrInvalidCode)
+	}
+	if err := tf.Verify(ctx, userID, "AAAA-BBBB-CCCC-DDDD"); !errors.Is(err, twofactor.ErrInvalidCode) {
+		t.Errorf("Verify with an unknown recovery code: err = %v, want %v", err, twofactor.ErrInvalidCode)
+	}
+	if err := tf.Verify(ctx, userID, recoveryCodes[1]); err != nil {
+		t.Errorf("Verify with another recovery code: %v", err)
+	}
+}
+
+func TestVerifyNotEnrolled(t *testing.T) {
+	ctx := context.Background()
+	tf, store, secret, _ := enrolled(t)
+
+	if err := tf.Disable(ctx, userID, secret.Code(store.totp.LastStep+1)); err != nil {
+		t.Fatalf("Disable: %v", err)
+	}
+	if err := tf.Verify(ctx, userID, secret.Code(totp.Step(time.Now()))); !errors.Is(err, twofactor.ErrNotEnrolled) {
+		t.Errorf("Verify after Disable: err = %v, want %v", err, twofactor.ErrNotEnrolled)
+	}
+}
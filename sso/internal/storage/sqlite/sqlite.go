@@ -4,10 +4,13 @@ import (
 	"ChatService/sso/internal/domain/models"
 	"ChatService/sso/internal/storage"
 	"context"
+	"crypto"
+	"crypto/x509"
 	"database/sql"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	_ "github.com/golang-migrate/migrate/v4/database/sqlite3"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
@@ -67,7 +70,7 @@ func (s *Storage) SaveUser(ctx context.Context, username, email string, password
 func (s *Storage) GetUser(ctx context.Context, email string) (models.User, error) {
 	const op = "sqlite.GetUser"
 
-	stmt, err := s.db.Prepare("SELECT * FROM users WHERE email = ?")
+	stmt, err := s.db.Prepare("SELECT id, username, email, pass_hash, role, email_verified FROM users WHERE email = ?")
 	if err != nil {
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
@@ -78,7 +81,7 @@ func (s *Storage) GetUser(ctx context.Context, email string) (models.User, error
 	}()
 	var user models.User
 	if err := stmt.QueryRowContext(ctx, email).
-		Scan(&user.ID, &user.UserName, &user.Email, &user.PassHash, &user.Role); err != nil {
+		Scan(&user.ID, &user.UserName, &user.Email, &user.PassHash, &user.Role, &user.EmailVerified); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return models.User{}, fmt.Errorf("%s, %w", op, storage.ErrUserNotFound)
 		}
@@ -90,7 +93,7 @@ func (s *Storage) GetUser(ctx context.Context, email string) (models.User, error
 func (s *Storage) GetUserById(ctx context.Context, id int64) (models.User, error) {
 	const op = "sqlite.GetUser"
 
-	stmt, err := s.db.Prepare("SELECT * FROM users WHERE id = ?")
+	stmt, err := s.db.Prepare("SELECT id, username, email, pass_hash, role, email_verified FROM users WHERE id = ?")
 	if err != nil {
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
@@ -101,7 +104,7 @@ func (s *Storage) GetUserById(ctx context.Context, id int64) (models.User, error
 	}()
 	var user models.User
 	if err := stmt.QueryRowContext(ctx, id).
-		Scan(&user.ID, &user.UserName, &user.Email, &user.PassHash, &user.Role); err != nil {
+		Scan(&user.ID, &user.UserName, &user.Email, &user.PassHash, &user.Role, &user.EmailVerified); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return models.User{}, fmt.Errorf("%s, %w", op, storage.ErrUserNotFound)
 		}
@@ -137,7 +140,7 @@ func (s *Storage) GetUserById(ctx context.Context, id int64) (models.User, error
 func (s *Storage) GetApp(ctx context.Context, id int) (models.App, error) {
 	const op = "sqlite.GetApp"
 
-	stmt, err := s.db.Prepare("SELECT * FROM apps WHERE id = ?")
+	stmt, err := s.db.Prepare("SELECT id, name, secret, client_secret_hash FROM apps WHERE id = ?")
 	if err != nil {
 		return models.App{}, fmt.Errorf("%s: %w", op, err)
 	}
@@ -148,42 +151,49 @@ func (s *Storage) GetApp(ctx context.Context, id int) (models.App, error) {
 	}()
 	var app models.App
 	if err := stmt.QueryRowContext(ctx, id).
-		Scan(&app.ID, &app.AppName, &app.Secret); err != nil {
-		if errors.Is(err, storage.ErrAppNotFound) {
+		Scan(&app.ID, &app.AppName, &app.Secret, &app.ClientSecretHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
 			return models.App{}, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
 		}
 		return models.App{}, fmt.Errorf("%s: %w", op, err)
 	}
+
+	app.RedirectURIs, err = s.redirectURIs(ctx, app.ID)
+	if err != nil {
+		return models.App{}, fmt.Errorf("%s: %w", op, err)
+	}
 	return app, nil
 }
 
-func (s *Storage) IsAdmin(ctx context.Context, id int64) (bool, error) {
-	const op = "sqlite.IsAdmin"
-	stmt, err := s.db.Prepare("SELECT role FROM users WHERE id = ?")
+func (s *Storage) redirectURIs(ctx context.Context, appID int64) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT redirect_uri FROM app_redirect_uris WHERE app_id = ?", appID)
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", op, err)
+		return nil, err
 	}
 	defer func() {
-		err := stmt.Close()
+		err := rows.Close()
 		if err != nil {
 		}
 	}()
 
-	var role int32
-	if err := stmt.QueryRowContext(ctx, id).Scan(&role); err != nil {
-		if errors.Is(err, storage.ErrUserNotFound) {
-			return false, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return nil, err
 		}
-		return false, fmt.Errorf("%s: %w", op, err)
+		uris = append(uris, uri)
 	}
-	return role == 3, nil
+	return uris, rows.Err()
 }
 
-func (s *Storage) IsModerator(ctx context.Context, id int64) (bool, error) {
-	const op = "sqlite.IsAdmin"
+// UserRole returns the id of the role of the user, a row of the permission table.
+func (s *Storage) UserRole(ctx context.Context, id int64) (int32, error) {
+	const op = "sqlite.UserRole"
+
 	stmt, err := s.db.Prepare("SELECT role FROM users WHERE id = ?")
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", op, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 	defer func() {
 		err := stmt.Close()
@@ -191,14 +201,58 @@ func (s *Storage) IsModerator(ctx context.Context, id int64) (bool, error) {
 		}
 	}()
 
-	var role int32
+	var role sql.NullInt32
 	if err := stmt.QueryRowContext(ctx, id).Scan(&role); err != nil {
-		if errors.Is(err, storage.ErrUserNotFound) {
-			return false, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
 		}
-		return false, fmt.Errorf("%s: %w", op, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if !role.Valid {
+		return models.RoleUser, nil
+	}
+	return role.Int32, nil
+}
+
+// Role returns a role with its permissions. The get and update flags of the permission
+// table grant reading and writing messages, the rest is listed in role_permissions.
+func (s *Storage) Role(ctx context.Context, id int32) (models.Role, error) {
+	const op = "sqlite.Role"
+
+	var role models.Role
+	var get, update sql.NullBool
+	if err := s.db.QueryRowContext(ctx, `SELECT id, name, "get", "update" FROM permission WHERE id = ?`, id).
+		Scan(&role.ID, &role.Name, &get, &update); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Role{}, fmt.Errorf("%s: %w", op, storage.ErrRoleNotFound)
+		}
+		return models.Role{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if get.Bool {
+		role.Permissions = append(role.Permissions, models.PermissionMessageRead)
+	}
+	if update.Bool {
+		role.Permissions = append(role.Permissions, models.PermissionMessageWrite)
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT permission FROM role_permissions WHERE role_id = ?", id)
+	if err != nil {
+		return models.Role{}, fmt.Errorf("%s: %w", op, err)
 	}
-	return role == 2, nil
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return models.Role{}, fmt.Errorf("%s: %w", op, err)
+		}
+		role.Permissions = append(role.Permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return models.Role{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return role, nil
 }
 
 func (s *Storage) UpdatePassword(ctx context.Context, passHash []byte, id int64) (bool, error) {
@@ -258,3 +312,1091 @@ func (s *Storage) UpdateRole(ctx context.Context, id int64, newRole int32) (bool
 	}
 	return true, nil
 }
+
+func (s *Storage) SaveRefreshToken(ctx context.Context, token models.RefreshToken) (int64, error) {
+	const op = "sqlite.SaveRefreshToken"
+
+	stmt, err := s.db.Prepare(`INSERT INTO refresh_tokens (token_hash, family_id, user_id, app_id, device, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, token.TokenHash, token.FamilyID, token.UserID, token.AppID, token.Device,
+		formatTime(token.CreatedAt), formatTime(token.ExpiresAt))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+func (s *Storage) GetRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error) {
+	const op = "sqlite.GetRefreshToken"
+
+	stmt, err := s.db.Prepare(`SELECT id, token_hash, family_id, user_id, app_id, device, created_at, expires_at,
+		rotated_at IS NOT NULL, revoked_at IS NOT NULL FROM refresh_tokens WHERE token_hash = ?`)
+	if err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	var token models.RefreshToken
+	var createdAt, expiresAt string
+	if err := stmt.QueryRowContext(ctx, tokenHash).Scan(&token.ID, &token.TokenHash, &token.FamilyID, &token.UserID,
+		&token.AppID, &token.Device, &createdAt, &expiresAt, &token.Rotated, &token.Revoked); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.RefreshToken{}, fmt.Errorf("%s: %w", op, storage.ErrRefreshTokenNotFound)
+		}
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if token.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if token.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return models.RefreshToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return token, nil
+}
+
+// RotateRefreshToken marks the token as used and stores its successor in one transaction.
+// ErrRefreshTokenUsed means another request rotated or revoked the token first.
+func (s *Storage) RotateRefreshToken(ctx context.Context, id int64, next models.RefreshToken) (int64, error) {
+	const op = "sqlite.RotateRefreshToken"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET rotated_at = ?
+		WHERE id = ? AND rotated_at IS NULL AND revoked_at IS NULL`, formatTime(next.CreatedAt), id)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if affected == 0 {
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrRefreshTokenUsed)
+	}
+
+	res, err = tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, family_id, user_id, app_id, device, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, next.TokenHash, next.FamilyID, next.UserID, next.AppID, next.Device,
+		formatTime(next.CreatedAt), formatTime(next.ExpiresAt))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return newID, nil
+}
+
+// RevokeRefreshFamily revokes every token rotated from the same login.
+func (s *Storage) RevokeRefreshFamily(ctx context.Context, familyID string, revokedAt time.Time) (int64, error) {
+	const op = "sqlite.RevokeRefreshFamily"
+
+	stmt, err := s.db.Prepare("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(revokedAt), familyID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return revoked, nil
+}
+
+// RevokeToken stores the jti of an access token until the token expires, revoking twice is not an error.
+func (s *Storage) RevokeToken(ctx context.Context, jti string, userID int64, expiresAt time.Time) error {
+	const op = "sqlite.RevokeToken"
+
+	stmt, err := s.db.Prepare("INSERT OR IGNORE INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, jti, userID, formatTime(expiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether the token with the given jti was revoked, or was issued before
+// all sessions of its user were ended by ResetPassword.
+func (s *Storage) IsTokenRevoked(ctx context.Context, jti string, userID int64, issuedAt time.Time) (bool, error) {
+	const op = "sqlite.IsTokenRevoked"
+
+	stmt, err := s.db.Prepare(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR EXISTS (SELECT 1 FROM revoked_sessions WHERE user_id = ? AND revoked_before > ?)`)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	var revoked bool
+	if err := stmt.QueryRowContext(ctx, jti, userID, formatTime(issuedAt)).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return revoked, nil
+}
+
+// DeleteExpiredRevocations forgets revoked tokens that expired before the given time.
+func (s *Storage) DeleteExpiredRevocations(ctx context.Context, before time.Time) (int64, error) {
+	const op = "sqlite.DeleteExpiredRevocations"
+
+	stmt, err := s.db.Prepare("DELETE FROM revoked_tokens WHERE expires_at < ?")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+// RotateSigningKey retires the active signing key, published until expiresAt, and stores next as
+// the new active key in one transaction.
+func (s *Storage) RotateSigningKey(ctx context.Context, next models.SigningKey, expiresAt time.Time) error {
+	const op = "sqlite.RotateSigningKey"
+
+	der, err := x509.MarshalPKCS8PrivateKey(next.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE signing_keys SET retired_at = ?, expires_at = ? WHERE retired_at IS NULL`,
+		formatTime(next.CreatedAt), formatTime(expiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO signing_keys (kid, algorithm, private_key, created_at) VALUES (?, ?, ?, ?)`,
+		next.ID, next.Algorithm, der, formatTime(next.CreatedAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// SigningKeys returns the keys that are still published at now, the newest first.
+func (s *Storage) SigningKeys(ctx context.Context, now time.Time) ([]models.SigningKey, error) {
+	const op = "sqlite.SigningKeys"
+
+	stmt, err := s.db.Prepare(`SELECT kid, algorithm, private_key, created_at, COALESCE(retired_at, ''), COALESCE(expires_at, '')
+		FROM signing_keys WHERE expires_at IS NULL OR expires_at > ? ORDER BY created_at DESC, retired_at IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	rows, err := stmt.QueryContext(ctx, formatTime(now))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+		}
+	}()
+
+	var keys []models.SigningKey
+	for rows.Next() {
+		var key models.SigningKey
+		var der []byte
+		var createdAt, retiredAt, expiresAt string
+		if err := rows.Scan(&key.ID, &key.Algorithm, &der, &createdAt, &retiredAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		privateKey, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key type %T", op, privateKey)
+		}
+		key.PrivateKey = signer
+		if key.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if retiredAt != "" {
+			if key.RetiredAt, err = parseTime(retiredAt); err != nil {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+			if key.ExpiresAt, err = parseTime(expiresAt); err != nil {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return keys, nil
+}
+
+// DeleteExpiredSigningKeys removes retired keys that stopped being published before the given time.
+func (s *Storage) DeleteExpiredSigningKeys(ctx context.Context, before time.Time) (int64, error) {
+	const op = "sqlite.DeleteExpiredSigningKeys"
+
+	stmt, err := s.db.Prepare("DELETE FROM signing_keys WHERE expires_at IS NOT NULL AND expires_at < ?")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+func (s *Storage) SaveAuthorizationCode(ctx context.Context, code models.AuthorizationCode) error {
+	const op = "sqlite.SaveAuthorizationCode"
+
+	stmt, err := s.db.Prepare(`INSERT INTO authorization_codes (code_hash, app_id, user_id, redirect_uri, scope, nonce,
+		code_challenge, auth_time, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, code.CodeHash, code.AppID, code.UserID, code.RedirectURI, code.Scope, code.Nonce,
+		code.CodeChallenge, formatTime(code.AuthTime), formatTime(code.CreatedAt), formatTime(code.ExpiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// UseAuthorizationCode marks the code as used and returns it. ErrAuthorizationCodeUsed means it
+// was exchanged before, expired codes are returned as well and have to be checked by the caller.
+func (s *Storage) UseAuthorizationCode(ctx context.Context, codeHash string, usedAt time.Time) (models.AuthorizationCode, error) {
+	const op = "sqlite.UseAuthorizationCode"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var code models.AuthorizationCode
+	var authTime, createdAt, expiresAt string
+	var used bool
+	if err := tx.QueryRowContext(ctx, `SELECT code_hash, app_id, user_id, redirect_uri, scope, nonce, code_challenge,
+		auth_time, created_at, expires_at, used_at IS NOT NULL FROM authorization_codes WHERE code_hash = ?`, codeHash).
+		Scan(&code.CodeHash, &code.AppID, &code.UserID, &code.RedirectURI, &code.Scope, &code.Nonce, &code.CodeChallenge,
+			&authTime, &createdAt, &expiresAt, &used); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, storage.ErrAuthorizationCodeNotFound)
+		}
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if used {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, storage.ErrAuthorizationCodeUsed)
+	}
+	if code.AuthTime, err = parseTime(authTime); err != nil {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if code.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if code.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE authorization_codes SET used_at = ? WHERE code_hash = ?",
+		formatTime(usedAt), codeHash); err != nil {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.AuthorizationCode{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return code, nil
+}
+
+// DeleteExpiredAuthorizationCodes removes codes that expired before the given time, used or not.
+func (s *Storage) DeleteExpiredAuthorizationCodes(ctx context.Context, before time.Time) (int64, error) {
+	const op = "sqlite.DeleteExpiredAuthorizationCodes"
+
+	stmt, err := s.db.Prepare("DELETE FROM authorization_codes WHERE expires_at < ?")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+func (s *Storage) SaveUserToken(ctx context.Context, token models.UserToken) error {
+	const op = "sqlite.SaveUserToken"
+
+	stmt, err := s.db.Prepare("INSERT INTO user_tokens (token_hash, user_id, purpose, created_at, expires_at) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, token.TokenHash, token.UserID, token.Purpose,
+		formatTime(token.CreatedAt), formatTime(token.ExpiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// UseUserToken marks an unexpired token of the given purpose as used and returns it. The other
+// unused tokens of the user for that purpose are used up as well, only the latest mail matters.
+func (s *Storage) UseUserToken(ctx context.Context, tokenHash, purpose string, usedAt time.Time) (models.UserToken, error) {
+	const op = "sqlite.UseUserToken"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.UserToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	token, err := useUserToken(ctx, tx, tokenHash, purpose, usedAt)
+	if err != nil {
+		return models.UserToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.UserToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return token, nil
+}
+
+func useUserToken(ctx context.Context, tx *sql.Tx, tokenHash, purpose string, usedAt time.Time) (models.UserToken, error) {
+	var token models.UserToken
+	var createdAt, expiresAt string
+	if err := tx.QueryRowContext(ctx, `SELECT token_hash, user_id, purpose, created_at, expires_at FROM user_tokens
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`, tokenHash, purpose, formatTime(usedAt)).
+		Scan(&token.TokenHash, &token.UserID, &token.Purpose, &createdAt, &expiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.UserToken{}, storage.ErrUserTokenNotFound
+		}
+		return models.UserToken{}, err
+	}
+	var err error
+	if token.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.UserToken{}, err
+	}
+	if token.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return models.UserToken{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_tokens SET used_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL",
+		formatTime(usedAt), token.UserID, purpose); err != nil {
+		return models.UserToken{}, err
+	}
+	return token, nil
+}
+
+// DeleteExpiredUserTokens removes user tokens that expired before the given time, used or not.
+func (s *Storage) DeleteExpiredUserTokens(ctx context.Context, before time.Time) (int64, error) {
+	const op = "sqlite.DeleteExpiredUserTokens"
+
+	stmt, err := s.db.Prepare("DELETE FROM user_tokens WHERE expires_at < ?")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+func (s *Storage) SetEmailVerified(ctx context.Context, userID int64) error {
+	const op = "sqlite.SetEmailVerified"
+
+	stmt, err := s.db.Prepare("UPDATE users SET email_verified = true WHERE id = ?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ResetPassword uses the password reset token and sets the new password in one transaction. The address
+// counts as verified, and every session of the user ends: refresh tokens are revoked and access tokens
+// issued up to resetAt count as revoked, see IsTokenRevoked. It returns the used token and the number
+// of revoked refresh tokens.
+func (s *Storage) ResetPassword(ctx context.Context, tokenHash string, passHash []byte, resetAt time.Time) (models.UserToken, int64, error) {
+	const op = "sqlite.ResetPassword"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	token, err := useUserToken(ctx, tx, tokenHash, models.TokenPurposeResetPassword, resetAt)
+	if err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET pass_hash = ?, email_verified = true WHERE id = ?",
+		passHash, token.UserID); err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+		formatTime(resetAt), token.UserID)
+	if err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	// iat has whole seconds, tokens issued later in the same second are revoked as well
+	if _, err := tx.ExecContext(ctx, `INSERT INTO revoked_sessions (user_id, revoked_before) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = excluded.revoked_before`,
+		token.UserID, formatTime(resetAt.Truncate(time.Second).Add(time.Second))); err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.UserToken{}, 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return token, revoked, nil
+}
+
+// SaveTOTP stores a new, not yet enabled secret for the user, replacing an unconfirmed one.
+// An enabled secret is left alone, it has to be disabled first.
+func (s *Storage) SaveTOTP(ctx context.Context, userID int64, secret []byte, createdAt time.Time) error {
+	const op = "sqlite.SaveTOTP"
+
+	stmt, err := s.db.Prepare(`INSERT INTO user_totp (user_id, secret, enabled, last_step, created_at) VALUES (?, ?, false, 0, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at
+		WHERE user_totp.enabled = false`)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, userID, secret, formatTime(createdAt))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	saved, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if saved == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrTOTPEnabled)
+	}
+	return nil
+}
+
+func (s *Storage) GetTOTP(ctx context.Context, userID int64) (models.TOTP, error) {
+	const op = "sqlite.GetTOTP"
+
+	stmt, err := s.db.Prepare("SELECT user_id, secret, enabled, last_step, created_at FROM user_totp WHERE user_id = ?")
+	if err != nil {
+		return models.TOTP{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	var totp models.TOTP
+	var createdAt string
+	if err := stmt.QueryRowContext(ctx, userID).Scan(&totp.UserID, &totp.Secret, &totp.Enabled, &totp.LastStep, &createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.TOTP{}, fmt.Errorf("%s: %w", op, storage.ErrTOTPNotFound)
+		}
+		return models.TOTP{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if totp.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.TOTP{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return totp, nil
+}
+
+// EnableTOTP turns on the pending secret of the user, step is the step of the confirming code.
+// The recovery codes replace any left from an earlier enrolment.
+func (s *Storage) EnableTOTP(ctx context.Context, userID int64, step int64, recoveryCodeHashes []string) error {
+	const op = "sqlite.EnableTOTP"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.ExecContext(ctx, "UPDATE user_totp SET enabled = true, last_step = ? WHERE user_id = ? AND enabled = false",
+		step, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	enabled, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if enabled == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrTOTPNotFound)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (code_hash, user_id) VALUES (?, ?)", hash, userID); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code of the given step was accepted. A code of the same or an
+// earlier step is refused afterwards, so an intercepted code can not be replayed.
+func (s *Storage) UseTOTPStep(ctx context.Context, userID int64, step int64) error {
+	const op = "sqlite.UseTOTPStep"
+
+	stmt, err := s.db.Prepare("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND enabled = true AND last_step < ?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, step, userID, step)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if used == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrTOTPStepUsed)
+	}
+	return nil
+}
+
+func (s *Storage) UseRecoveryCode(ctx context.Context, userID int64, codeHash string, usedAt time.Time) error {
+	const op = "sqlite.UseRecoveryCode"
+
+	stmt, err := s.db.Prepare("UPDATE recovery_codes SET used_at = ? WHERE code_hash = ? AND user_id = ? AND used_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(usedAt), codeHash, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if used == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrRecoveryCodeNotFound)
+	}
+	return nil
+}
+
+// DeleteTOTP removes the secret and the recovery codes of the user.
+func (s *Storage) DeleteTOTP(ctx context.Context, userID int64) error {
+	const op = "sqlite.DeleteTOTP"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) SaveLoginChallenge(ctx context.Context, challenge models.LoginChallenge) error {
+	const op = "sqlite.SaveLoginChallenge"
+
+	stmt, err := s.db.Prepare(`INSERT INTO login_challenges (token_hash, user_id, app_id, device, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, challenge.TokenHash, challenge.UserID, challenge.AppID, challenge.Device,
+		formatTime(challenge.CreatedAt), formatTime(challenge.ExpiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// GetLoginChallenge returns the challenge if it did not expire at now.
+func (s *Storage) GetLoginChallenge(ctx context.Context, tokenHash string, now time.Time) (models.LoginChallenge, error) {
+	const op = "sqlite.GetLoginChallenge"
+
+	stmt, err := s.db.Prepare(`SELECT token_hash, user_id, app_id, device, attempts, created_at, expires_at
+		FROM login_challenges WHERE token_hash = ? AND expires_at > ?`)
+	if err != nil {
+		return models.LoginChallenge{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	var challenge models.LoginChallenge
+	var createdAt, expiresAt string
+	if err := stmt.QueryRowContext(ctx, tokenHash, formatTime(now)).Scan(&challenge.TokenHash, &challenge.UserID,
+		&challenge.AppID, &challenge.Device, &challenge.Attempts, &createdAt, &expiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.LoginChallenge{}, fmt.Errorf("%s: %w", op, storage.ErrLoginChallengeNotFound)
+		}
+		return models.LoginChallenge{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if challenge.CreatedAt, err = parseTime(createdAt); err != nil {
+		return models.LoginChallenge{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if challenge.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return models.LoginChallenge{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return challenge, nil
+}
+
+// FailLoginChallenge counts a wrong code against the challenge and returns the attempts so far.
+func (s *Storage) FailLoginChallenge(ctx context.Context, tokenHash string) (int, error) {
+	const op = "sqlite.FailLoginChallenge"
+
+	var attempts int
+	if err := s.db.QueryRowContext(ctx, "UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ? RETURNING attempts",
+		tokenHash).Scan(&attempts); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrLoginChallengeNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return attempts, nil
+}
+
+// DeleteLoginChallenge ends the challenge. Only one caller gets to delete it, the others
+// get ErrLoginChallengeNotFound, so a challenge is exchanged for tokens at most once.
+func (s *Storage) DeleteLoginChallenge(ctx context.Context, tokenHash string) error {
+	const op = "sqlite.DeleteLoginChallenge"
+
+	stmt, err := s.db.Prepare("DELETE FROM login_challenges WHERE token_hash = ?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, tokenHash)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrLoginChallengeNotFound)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteExpiredLoginChallenges(ctx context.Context, before time.Time) (int64, error) {
+	const op = "sqlite.DeleteExpiredLoginChallenges"
+
+	stmt, err := s.db.Prepare("DELETE FROM login_challenges WHERE expires_at < ?")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+// LoginFailures returns the failed logins counted for key, a key without failures has a zero count.
+func (s *Storage) LoginFailures(ctx context.Context, key string) (models.LoginFailures, error) {
+	const op = "sqlite.LoginFailures"
+
+	stmt, err := s.db.Prepare("SELECT key, failures, last_failure_at, locked_until FROM login_failures WHERE key = ?")
+	if err != nil {
+		return models.LoginFailures{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	failures := models.LoginFailures{Key: key}
+	var lastFailureAt string
+	var lockedUntil sql.NullString
+	if err := stmt.QueryRowContext(ctx, key).Scan(&failures.Key, &failures.Failures, &lastFailureAt, &lockedUntil); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return failures, nil
+		}
+		return models.LoginFailures{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if failures.LastFailureAt, err = parseTime(lastFailureAt); err != nil {
+		return models.LoginFailures{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if lockedUntil.Valid {
+		if failures.LockedUntil, err = parseTime(lockedUntil.String); err != nil {
+			return models.LoginFailures{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return failures, nil
+}
+
+// RecordLoginFailure counts a failed login for key and returns the failures so far. Failures
+// before resetBefore are forgotten, the count starts again from one.
+func (s *Storage) RecordLoginFailure(ctx context.Context, key string, at, resetBefore time.Time) (int, error) {
+	const op = "sqlite.RecordLoginFailure"
+
+	var failures int
+	if err := s.db.QueryRowContext(ctx, `INSERT INTO login_failures (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < ? THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING failures`, key, formatTime(at), formatTime(resetBefore)).Scan(&failures); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return failures, nil
+}
+
+func (s *Storage) LockLogin(ctx context.Context, key string, until time.Time) error {
+	const op = "sqlite.LockLogin"
+
+	stmt, err := s.db.Prepare("UPDATE login_failures SET locked_until = ? WHERE key = ?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, formatTime(until), key); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// DeleteLoginFailures forgets the failures of key and lifts its lock.
+func (s *Storage) DeleteLoginFailures(ctx context.Context, key string) error {
+	const op = "sqlite.DeleteLoginFailures"
+
+	stmt, err := s.db.Prepare("DELETE FROM login_failures WHERE key = ?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, key); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// DeleteStaleLoginFailures removes counters whose last failure is before lastFailureBefore
+// and which are not locked at now.
+func (s *Storage) DeleteStaleLoginFailures(ctx context.Context, lastFailureBefore, now time.Time) (int64, error) {
+	const op = "sqlite.DeleteStaleLoginFailures"
+
+	stmt, err := s.db.Prepare(`DELETE FROM login_failures WHERE last_failure_at < ?
+		AND (locked_until IS NULL OR locked_until < ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(lastFailureBefore), formatTime(now))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+// SaveSanction bans or mutes a user, it replaces the sanction of the same kind and room.
+func (s *Storage) SaveSanction(ctx context.Context, sanction models.Sanction) error {
+	const op = "sqlite.SaveSanction"
+
+	stmt, err := s.db.Prepare(`INSERT INTO sanctions (user_id, kind, room_id, reason, issued_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, kind, room_id) DO UPDATE SET
+			reason = excluded.reason,
+			issued_by = excluded.issued_by,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at`)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	if _, err := stmt.ExecContext(ctx, sanction.UserID, sanction.Kind, sanction.RoomID, sanction.Reason,
+		sanction.IssuedBy, formatTime(sanction.CreatedAt), formatTime(sanction.ExpiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ActiveSanctions returns the bans and mutes of the user that have not expired at now.
+func (s *Storage) ActiveSanctions(ctx context.Context, userID int64, now time.Time) ([]models.Sanction, error) {
+	const op = "sqlite.ActiveSanctions"
+
+	stmt, err := s.db.Prepare(`SELECT user_id, kind, room_id, reason, issued_by, created_at, expires_at
+		FROM sanctions WHERE user_id = ? AND expires_at > ? ORDER BY kind, room_id`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+
+	rows, err := stmt.QueryContext(ctx, userID, formatTime(now))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var sanctions []models.Sanction
+	for rows.Next() {
+		var sanction models.Sanction
+		var createdAt, expiresAt string
+		if err := rows.Scan(&sanction.UserID, &sanction.Kind, &sanction.RoomID, &sanction.Reason,
+			&sanction.IssuedBy, &createdAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if sanction.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if sanction.ExpiresAt, err = parseTime(expiresAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		sanctions = append(sanctions, sanction)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return sanctions, nil
+}
+
+// DeleteSanction lifts a ban or a mute before it runs out.
+func (s *Storage) DeleteSanction(ctx context.Context, userID int64, kind string, roomID int64, now time.Time) error {
+	const op = "sqlite.DeleteSanction"
+
+	stmt, err := s.db.Prepare("DELETE FROM sanctions WHERE user_id = ? AND kind = ? AND room_id = ? AND expires_at > ?")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, userID, kind, roomID, formatTime(now))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrSanctionNotFound)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteExpiredSanctions(ctx context.Context, before time.Time) (int64, error) {
+	const op = "sqlite.DeleteExpiredSanctions"
+
+	stmt, err := s.db.Prepare("DELETE FROM sanctions WHERE expires_at <= ?")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() {
+		err := stmt.Close()
+		if err != nil {
+		}
+	}()
+	res, err := stmt.ExecContext(ctx, formatTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return deleted, nil
+}
+
+// Times are stored as UTC text, so they compare correctly as strings inside queries
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.DateTime)
+}
+
+func parseTime(value string) (time.Time, error) {
+	return time.ParseInLocation(time.DateTime, value, time.UTC)
+}
@@ -6,4 +6,21 @@ var (
 	ErrUserExist    = errors.New("user already exists")
 	ErrUserNotFound = errors.New("user not found")
 	ErrAppNotFound  = errors.New("app not found")
+	ErrRoleNotFound = errors.New("role not found")
+
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenUsed     = errors.New("refresh token already used")
+
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found")
+	ErrAuthorizationCodeUsed     = errors.New("authorization code already used")
+
+	ErrUserTokenNotFound = errors.New("user token not found")
+
+	ErrTOTPNotFound           = errors.New("totp not found")
+	ErrTOTPEnabled            = errors.New("totp already enabled")
+	ErrTOTPStepUsed           = errors.New("totp code already used")
+	ErrRecoveryCodeNotFound   = errors.New("recovery code not found")
+	ErrLoginChallengeNotFound = errors.New("login challenge not found")
+
+	ErrSanctionNotFound = errors.New("sanction not found")
 )